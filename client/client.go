@@ -2,9 +2,12 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/turtlemonvh/blanket/lib/database"
 	"github.com/turtlemonvh/blanket/tasks"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -14,21 +17,41 @@ import (
 
 /*
 The client package provides utilities for working with a running blanket server over HTTP
+Requests are abandoned once ctx is done
 */
 
+// http.Get, abandoned once ctx is done
+func get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// http.Post, abandoned once ctx is done
+func post(ctx context.Context, url string, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return http.DefaultClient.Do(req)
+}
+
 type GetTasksConf struct {
 	All          bool
 	States       string
 	Types        string
 	RequiredTags string
 	MaxTags      string
+	Query        string // a query expression; see database.ParseTaskQuery
 	Limit        int
 	ParsedTags   []string
 }
 
-func GetTasks(c *GetTasksConf, port int) ([]map[string]interface{}, error) {
-	var tasks []map[string]interface{}
-
+// Query string for the filters that were set
+func (c *GetTasksConf) filterValues() url.Values {
 	v := url.Values{}
 	if c.States != "" {
 		v.Set("states", strings.ToUpper(c.States))
@@ -42,28 +65,68 @@ func GetTasks(c *GetTasksConf, port int) ([]map[string]interface{}, error) {
 	if c.MaxTags != "" {
 		v.Set("maxTags", c.MaxTags)
 	}
-	v.Set("limit", strconv.Itoa(c.Limit))
-
-	paramsString := v.Encode()
-	reqURL := fmt.Sprintf("http://localhost:%d/task/", port)
-	if paramsString != "" {
-		reqURL += "?" + paramsString
-	}
-	res, err := http.Get(reqURL)
-	if err != nil {
-		return tasks, err
+	if c.Query != "" {
+		v.Set("q", c.Query)
 	}
+	return v
+}
 
-	defer res.Body.Close()
+// Tasks are fetched this many at a time
+const getTasksPageSize = 100
+
+// Fetch up to c.Limit tasks, following cursors from page to page
+func GetTasks(ctx context.Context, c *GetTasksConf, port int) ([]map[string]interface{}, error) {
+	tasks := []map[string]interface{}{}
+
+	cursor := ""
+	for len(tasks) < c.Limit {
+		v := c.filterValues()
+		pageSize := c.Limit - len(tasks)
+		if pageSize > getTasksPageSize {
+			pageSize = getTasksPageSize
+		}
+		v.Set("limit", strconv.Itoa(pageSize))
+		if cursor != "" {
+			v.Set("cursor", cursor)
+		}
+
+		res, err := get(ctx, fmt.Sprintf("http://localhost:%d/task/?%s", port, v.Encode()))
+		if err != nil {
+			return tasks, err
+		}
 
-	// FIXME: Encode as task objects instead
-	dec := json.NewDecoder(res.Body)
-	dec.Decode(&tasks)
+		rbts, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return tasks, err
+		}
+
+		if res.StatusCode != http.StatusOK {
+			var errBody map[string]string
+			json.Unmarshal(rbts, &errBody)
+			return tasks, fmt.Errorf("Listing tasks failed with status %d: %s", res.StatusCode, errBody["error"])
+		}
+
+		// FIXME: Encode as task objects instead
+		var page struct {
+			Items      []map[string]interface{} `json:"items"`
+			NextCursor string                   `json:"nextCursor"`
+		}
+		if err = json.Unmarshal(rbts, &page); err != nil {
+			return tasks, err
+		}
+
+		tasks = append(tasks, page.Items...)
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
 
 	return tasks, nil
 }
 
-func SubmitTask(taskType string, env map[string]interface{}, port int) (tasks.Task, error) {
+func SubmitTask(ctx context.Context, taskType string, env map[string]interface{}, port int) (tasks.Task, error) {
 	var t tasks.Task
 
 	body := make(map[string]interface{})
@@ -76,7 +139,7 @@ func SubmitTask(taskType string, env map[string]interface{}, port int) (tasks.Ta
 	}
 
 	reqURL := fmt.Sprintf("http://localhost:%d/task/", port)
-	res, err := http.Post(reqURL, "encoding/json", bytes.NewBuffer(bts))
+	res, err := post(ctx, reqURL, "encoding/json", bytes.NewBuffer(bts))
 	if err != nil {
 		return t, err
 	}
@@ -91,3 +154,131 @@ func SubmitTask(taskType string, env map[string]interface{}, port int) (tasks.Ta
 	err = json.Unmarshal(rbts, &t)
 	return t, err
 }
+
+// Submit a copy of a finished task; env overrides part of the original environment and may be empty
+func RerunTask(ctx context.Context, taskId string, env map[string]interface{}, port int) (tasks.Task, error) {
+	var t tasks.Task
+
+	body := make(map[string]interface{})
+	if len(env) > 0 {
+		body["environment"] = env
+	}
+
+	bts, err := json.Marshal(body)
+	if err != nil {
+		return t, err
+	}
+
+	reqURL := fmt.Sprintf("http://localhost:%d/task/%s/rerun", port, taskId)
+	res, err := post(ctx, reqURL, "application/json", bytes.NewBuffer(bts))
+	if err != nil {
+		return t, err
+	}
+	defer res.Body.Close()
+
+	rbts, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return t, err
+	}
+
+	if res.StatusCode != http.StatusCreated {
+		var errBody map[string]string
+		json.Unmarshal(rbts, &errBody)
+		return t, fmt.Errorf("Rerun failed with status %d: %s", res.StatusCode, errBody["error"])
+	}
+
+	err = json.Unmarshal(rbts, &t)
+	return t, err
+}
+
+// Run a bulk operation on the tasks in req.Ids, or else on the tasks matching filter
+// A filter limit of 0 means every matching task
+func BulkTasks(ctx context.Context, op string, filter *GetTasksConf, req *tasks.BulkTaskRequest, dryRun bool, port int) (tasks.BulkTaskResponse, error) {
+	var resp tasks.BulkTaskResponse
+
+	v := filter.filterValues()
+	if filter.Limit > 0 {
+		v.Set("limit", strconv.Itoa(filter.Limit))
+	}
+	if dryRun {
+		v.Set("dryRun", "true")
+	}
+
+	bts, err := json.Marshal(req)
+	if err != nil {
+		return resp, err
+	}
+
+	reqURL := fmt.Sprintf("http://localhost:%d/task/bulk/%s?%s", port, op, v.Encode())
+	res, err := post(ctx, reqURL, "application/json", bytes.NewBuffer(bts))
+	if err != nil {
+		return resp, err
+	}
+	defer res.Body.Close()
+
+	rbts, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		var errBody map[string]string
+		json.Unmarshal(rbts, &errBody)
+		return resp, fmt.Errorf("Bulk %s failed with status %d: %s", op, res.StatusCode, errBody["error"])
+	}
+
+	err = json.Unmarshal(rbts, &resp)
+	return resp, err
+}
+
+// Stream an export of the server's database to w
+func ExportDatabase(ctx context.Context, w io.Writer, port int) error {
+	reqURL := fmt.Sprintf("http://localhost:%d/ops/export", port)
+	res, err := get(ctx, reqURL)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		var errBody map[string]string
+		rbts, _ := ioutil.ReadAll(res.Body)
+		json.Unmarshal(rbts, &errBody)
+		return fmt.Errorf("Export failed with status %d: %s", res.StatusCode, errBody["error"])
+	}
+
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+// Load an export read from r into the server's database
+func ImportDatabase(ctx context.Context, r io.Reader, opts database.ImportOptions, port int) (database.ImportReport, error) {
+	var report database.ImportReport
+
+	v := url.Values{}
+	v.Set("mode", opts.Mode)
+	if opts.RemapIds {
+		v.Set("remapIds", "true")
+	}
+
+	reqURL := fmt.Sprintf("http://localhost:%d/ops/import?%s", port, v.Encode())
+	res, err := post(ctx, reqURL, "application/x-ndjson", r)
+	if err != nil {
+		return report, err
+	}
+	defer res.Body.Close()
+
+	rbts, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return report, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		var errBody map[string]string
+		json.Unmarshal(rbts, &errBody)
+		return report, fmt.Errorf("Import failed with status %d: %s", res.StatusCode, errBody["error"])
+	}
+
+	err = json.Unmarshal(rbts, &report)
+	return report, err
+}
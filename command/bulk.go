@@ -0,0 +1,166 @@
+package command
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/turtlemonvh/blanket/client"
+	"github.com/turtlemonvh/blanket/tasks"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+var bulkFilter client.GetTasksConf
+var bulkConf BulkConf
+var bulkCmd = &cobra.Command{
+	Use:   "bulk",
+	Short: "Cancel, delete, rerun or retag many tasks at once",
+	Long: `Cancel, delete, rerun or retag many tasks at once.
+
+Tasks are picked by id, or by the same filters as 'blanket ps'. Pass '-' instead of ids to read them from stdin.
+
+    blanket bulk delete --state ERROR --dryRun
+    blanket bulk cancel <id> <id> --reason "superseded"
+    blanket ps -q --state ERROR | blanket bulk rerun -
+    blanket bulk retag --types echo_task --addTags gpu`,
+	Run: func(cmd *cobra.Command, args []string) {
+		InitializeConfig()
+		viper.Set("logLevel", "error")
+		InitializeLogging()
+		if len(args) < 1 {
+			fmt.Println("ERROR: Missing required positional argument 'operation'")
+			cmd.Usage()
+			os.Exit(1)
+		}
+		bulkConf.BulkTasks(args[0], args[1:])
+	},
+}
+
+type BulkConf struct {
+	DryRun     bool
+	Force      bool
+	Reason     string
+	Env        string
+	Tags       string
+	AddTags    string
+	RemoveTags string
+	Quiet      bool
+}
+
+func init() {
+	bulkCmd.Flags().StringVarP(&bulkFilter.States, "state", "s", "", "Only act on tasks in these states (comma separated).")
+	bulkCmd.Flags().StringVarP(&bulkFilter.Types, "types", "t", "", "Only act on tasks of these types (comma separated)")
+	bulkCmd.Flags().StringVar(&bulkFilter.RequiredTags, "requiredTags", "", "Only act on tasks whose tags are a superset of these tags (comma separated)")
+	bulkCmd.Flags().StringVar(&bulkFilter.MaxTags, "maxTags", "", "Only act on tasks whose tags are a subset of these tags (comma separated)")
+	bulkCmd.Flags().StringVar(&bulkFilter.Query, "query", "", "Only act on tasks matching this query, e.g. 'env.DATASET=foo state=ERROR'")
+	bulkCmd.Flags().IntVarP(&bulkFilter.Limit, "limit", "l", 0, "Maximum number of tasks to act on; 0 for all that match")
+	bulkCmd.Flags().BoolVar(&bulkConf.DryRun, "dryRun", false, "Only report how many tasks match")
+	bulkCmd.Flags().BoolVarP(&bulkConf.Force, "force", "f", false, "cancel: kill running commands instead of asking them to exit")
+	bulkCmd.Flags().StringVar(&bulkConf.Reason, "reason", "", "cancel: reason recorded in each task's history")
+	bulkCmd.Flags().StringVarP(&bulkConf.Env, "env", "e", "{}", "rerun: JSON string of environment variables to override in each copy")
+	bulkCmd.Flags().StringVar(&bulkConf.Tags, "tags", "", "retag: replace the tags on each task (comma separated)")
+	bulkCmd.Flags().StringVar(&bulkConf.AddTags, "addTags", "", "retag: tags to add (comma separated)")
+	bulkCmd.Flags().StringVar(&bulkConf.RemoveTags, "removeTags", "", "retag: tags to remove (comma separated)")
+	bulkCmd.Flags().BoolVarP(&bulkConf.Quiet, "quiet", "q", false, "Print only the ids of tasks that failed; for rerun, the ids of the new tasks")
+	RootCmd.AddCommand(bulkCmd)
+}
+
+func (c *BulkConf) BulkTasks(op string, ids []string) {
+	if len(ids) == 1 && ids[0] == "-" {
+		ids = readIds(os.Stdin)
+	}
+
+	req := &tasks.BulkTaskRequest{
+		Ids:        ids,
+		Force:      c.Force,
+		Reason:     c.Reason,
+		AddTags:    splitFlagCSV(c.AddTags),
+		RemoveTags: splitFlagCSV(c.RemoveTags),
+	}
+	if c.Tags != "" {
+		req.Tags = splitFlagCSV(c.Tags)
+	}
+	if err := json.Unmarshal([]byte(c.Env), &req.Environment); err != nil {
+		log.Fatal("Error interpreting environment as valid json")
+	}
+
+	resp, err := client.BulkTasks(context.Background(), op, &bulkFilter, req, c.DryRun, viper.GetInt("port"))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+			"op":  op,
+		}).Fatal("Error running bulk operation")
+	}
+	printBulkResponse(resp, c.Quiet)
+	if resp.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func printBulkResponse(resp tasks.BulkTaskResponse, quiet bool) {
+	if quiet {
+		for _, r := range resp.Results {
+			if r.Error != "" {
+				fmt.Println(r.Id)
+			} else if r.NewTaskId != "" {
+				fmt.Println(r.NewTaskId)
+			}
+		}
+		return
+	}
+
+	if resp.DryRun {
+		var states []string
+		for state := range resp.ByState {
+			states = append(states, state)
+		}
+		sort.Strings(states)
+		fmt.Printf("%s would apply to %d task(s)\n", resp.Op, resp.Matched)
+		for _, state := range states {
+			fmt.Printf("  %s\t%d\n", state, resp.ByState[state])
+		}
+		if len(resp.Missing) > 0 {
+			fmt.Printf("  not found\t%d\n", len(resp.Missing))
+		}
+		return
+	}
+
+	for _, r := range resp.Results {
+		switch {
+		case r.Error != "":
+			fmt.Printf("%s\tfailed (%d): %s\n", r.Id, r.Status, r.Error)
+		case r.NewTaskId != "":
+			fmt.Printf("%s\t-> %s\n", r.Id, r.NewTaskId)
+		default:
+			fmt.Printf("%s\tok\n", r.Id)
+		}
+	}
+	fmt.Printf("%s: %d succeeded, %d failed\n", resp.Op, resp.Succeeded, resp.Failed)
+}
+
+// Ids separated by whitespace, e.g. the output of `blanket ps -q`
+func readIds(r io.Reader) []string {
+	var ids []string
+	scanner := bufio.NewScanner(r)
+	scanner.Split(bufio.ScanWords)
+	for scanner.Scan() {
+		ids = append(ids, scanner.Text())
+	}
+	return ids
+}
+
+func splitFlagCSV(raw string) []string {
+	var out []string
+	for _, v := range strings.Split(raw, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,93 @@
+package command
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	bolt "github.com/turtlemonvh/blanket/lib/bolt"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/lib/memory"
+	"github.com/turtlemonvh/blanket/lib/queue"
+	"time"
+)
+
+const (
+	DRIVER_BOLT   = "bolt"
+	DRIVER_MEMORY = "memory"
+)
+
+// The configured `database.driver`
+// Configs that set `database` to the path of the bolt file hide every `database.*` key, so that means bolt too
+func databaseDriver() string {
+	if driver := viper.GetString("database.driver"); driver != "" {
+		return driver
+	}
+	return DRIVER_BOLT
+}
+
+// Fatal unless the bolt driver is configured; for commands that open the database file themselves
+// Memory snapshots are already exports, so they can be read without a server
+func mustUseBoltDriver() {
+	if driver := databaseDriver(); driver != DRIVER_BOLT {
+		log.WithFields(log.Fields{
+			"driver": driver,
+		}).Fatal("Only the bolt database can be opened without a server; a memory snapshot is already an export")
+	}
+}
+
+// The database and queue for the server, sharing storage; fatal if they can't be opened
+// The returned function closes them once the server has stopped
+func mustOpenBackend() (database.BlanketDB, queue.BlanketQueue, func()) {
+	switch driver := databaseDriver(); driver {
+	case DRIVER_BOLT:
+		db := bolt.MustOpenBoltDatabase()
+		bolt.MustMigrateBoltDatabase(db)
+		return bolt.NewBlanketBoltDB(db), bolt.NewBlanketBoltQueue(db), func() {
+			db.Close()
+		}
+	case DRIVER_MEMORY:
+		return mustOpenMemoryBackend()
+	default:
+		log.WithFields(log.Fields{
+			"driver": driver,
+		}).Fatalf("Unknown database driver; must be one of: %v", []string{DRIVER_BOLT, DRIVER_MEMORY})
+	}
+	return nil, nil, nil
+}
+
+// An in-memory backend, loaded from and saved to `database.snapshotPath` if it is set
+func mustOpenMemoryBackend() (database.BlanketDB, queue.BlanketQueue, func()) {
+	s := memory.NewStore()
+	DB, Q := memory.NewBlanketMemoryDB(s), memory.NewBlanketMemoryQueue(s)
+
+	path := viper.GetString("database.snapshotPath")
+	if path == "" {
+		log.Warn("Using the memory database without a snapshot path; nothing will be kept after the server stops")
+		return DB, Q, func() {}
+	}
+
+	report, err := s.LoadSnapshot(path)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path": path,
+			"err":  err.Error(),
+		}).Fatal("Could not load snapshot")
+	}
+	log.WithFields(log.Fields{
+		"path":     path,
+		"imported": report.Imported,
+	}).Info("Loaded snapshot")
+
+	stop := make(chan struct{})
+	if interval := viper.GetFloat64("database.snapshotIntervalSeconds"); interval > 0 {
+		go s.RunSnapshots(path, time.Duration(interval*1000)*time.Millisecond, stop)
+	}
+	return DB, Q, func() {
+		close(stop)
+		if err := s.SaveSnapshot(path); err != nil {
+			log.WithFields(log.Fields{
+				"path": path,
+				"err":  err.Error(),
+			}).Error("Could not save snapshot")
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package command
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	bolt "github.com/turtlemonvh/blanket/lib/bolt"
+)
+
+var dbCmd = &cobra.Command{
+	Use:   "db",
+	Short: "Manage the database file",
+}
+
+var migrateConf MigrateConf
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Bring the database up to this build's schema version",
+	Long: `Run any schema migrations the database file hasn't had yet.
+
+The server runs these itself when it starts; this command lets you see what they will do first.
+It opens the database file directly, so the server must be stopped.
+
+    blanket db migrate --dry-run`,
+	Run: func(cmd *cobra.Command, args []string) {
+		InitializeConfig()
+		viper.Set("logLevel", "error")
+		InitializeLogging()
+		migrateConf.Migrate()
+	},
+}
+
+type MigrateConf struct {
+	DryRun bool
+}
+
+func init() {
+	migrateCmd.Flags().BoolVar(&migrateConf.DryRun, "dry-run", false, "Report what would change without changing it")
+	dbCmd.AddCommand(migrateCmd)
+	RootCmd.AddCommand(dbCmd)
+}
+
+func (c *MigrateConf) Migrate() {
+	mustUseBoltDriver()
+	db := bolt.MustOpenBoltDatabase()
+	defer db.Close()
+
+	report, err := bolt.MigrateBoltDatabase(db, c.DryRun)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Fatal("Error migrating database")
+	}
+
+	fmt.Printf("Schema version %d, this build uses %d\n", report.FromVersion, report.ToVersion)
+	if len(report.Steps) == 0 {
+		fmt.Println("Nothing to migrate")
+		return
+	}
+	verb := "Changed"
+	if c.DryRun {
+		verb = "Would change"
+	}
+	for _, step := range report.Steps {
+		fmt.Printf("%3d  %s\n     %s %d records\n", step.Version, step.Description, verb, step.Changed)
+	}
+}
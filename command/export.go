@@ -0,0 +1,94 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/turtlemonvh/blanket/client"
+	bolt "github.com/turtlemonvh/blanket/lib/bolt"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"io"
+	"os"
+)
+
+var exportConf ExportConf
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Write workers, tasks, queue entries and webhooks as JSON Lines",
+	Long: `Write a consistent snapshot of the database as JSON Lines, to stdout or a file.
+Load it again with 'blanket import'.
+
+    blanket export -o backup.jsonl
+
+Goes through the running server unless --direct is set, which opens the database file itself
+and needs the server to be stopped.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		InitializeConfig()
+		viper.Set("logLevel", "error")
+		InitializeLogging()
+		exportConf.Export()
+	},
+}
+
+type ExportConf struct {
+	Output string
+	Direct bool
+}
+
+func init() {
+	exportCmd.Flags().StringVarP(&exportConf.Output, "output", "o", "", "File to write to; stdout if not set")
+	exportCmd.Flags().BoolVar(&exportConf.Direct, "direct", false, "Read the database file instead of going through the server")
+	RootCmd.AddCommand(exportCmd)
+}
+
+func (c *ExportConf) Export() {
+	var w io.Writer = os.Stdout
+	if c.Output != "" {
+		f, err := os.Create(c.Output)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":  err,
+				"file": c.Output,
+			}).Fatal("Error opening output file")
+		}
+		defer f.Close()
+		w = f
+	}
+
+	var err error
+	if c.Direct {
+		err = directExporter().Export(context.Background(), w)
+	} else {
+		err = client.ExportDatabase(context.Background(), w, viper.GetInt("port"))
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Fatal("Error exporting database")
+	}
+	if c.Output != "" {
+		fmt.Printf("Wrote export to %s\n", c.Output)
+	}
+}
+
+// The database file opened read-only without a server, so exporting never changes it
+// Fatal if it is locked, or not at this build's schema version, since that would need a migration
+func directExporter() database.Exporter {
+	mustUseBoltDriver()
+	db := bolt.MustOpenBoltDatabaseReadOnly()
+	if err := bolt.CheckSchemaVersion(db); err != nil {
+		log.Fatalf("could not export bolt database %q: %v", db.Path(), err)
+	}
+	return bolt.NewBlanketBoltDB(db).(database.Exporter)
+}
+
+// The database file opened without a server and migrated, so imports are written in the current schema
+// Fatal if it is locked or from a newer build
+func directImporter() database.Exporter {
+	mustUseBoltDriver()
+	db := bolt.MustOpenBoltDatabase()
+	bolt.MustMigrateBoltDatabase(db)
+	return bolt.NewBlanketBoltDB(db).(database.Exporter)
+}
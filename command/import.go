@@ -0,0 +1,93 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/turtlemonvh/blanket/client"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"io"
+	"os"
+)
+
+var importConf ImportConf
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Load an export written by 'blanket export'",
+	Long: `Load an export from a file, or from stdin if the file is '-' or missing.
+
+    blanket import backup.jsonl
+    blanket import --mode replace backup.jsonl
+
+In merge mode (the default) existing items are kept, and imported items whose id is already taken
+are skipped, or given a new id with --remapIds. Replace mode removes existing workers, tasks,
+queue entries and webhooks first. Nothing is changed if any record is invalid.
+
+Goes through the running server unless --direct is set, which opens the database file itself
+and needs the server to be stopped.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		InitializeConfig()
+		viper.Set("logLevel", "error")
+		InitializeLogging()
+		file := "-"
+		if len(args) > 0 {
+			file = args[0]
+		}
+		importConf.Import(file)
+	},
+}
+
+type ImportConf struct {
+	Mode     string
+	RemapIds bool
+	Direct   bool
+}
+
+func init() {
+	importCmd.Flags().StringVar(&importConf.Mode, "mode", database.IMPORT_MERGE, "How to treat existing items: merge or replace")
+	importCmd.Flags().BoolVar(&importConf.RemapIds, "remapIds", false, "In merge mode, give items whose id is taken a new id instead of skipping them")
+	importCmd.Flags().BoolVar(&importConf.Direct, "direct", false, "Write the database file instead of going through the server")
+	RootCmd.AddCommand(importCmd)
+}
+
+func (c *ImportConf) Import(file string) {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":  err,
+				"file": file,
+			}).Fatal("Error opening export file")
+		}
+		defer f.Close()
+		r = f
+	}
+
+	opts := database.ImportOptions{Mode: c.Mode, RemapIds: c.RemapIds}
+	var report database.ImportReport
+	var err error
+	if c.Direct {
+		report, err = directImporter().Import(context.Background(), r, opts)
+	} else {
+		report, err = client.ImportDatabase(context.Background(), r, opts, viper.GetInt("port"))
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Fatal("Error importing database")
+	}
+
+	kinds := make([]string, 0, len(report.Imported))
+	for _, kind := range database.ValidExportKinds {
+		if report.Imported[kind]+report.Skipped[kind] > 0 {
+			kinds = append(kinds, kind)
+		}
+	}
+	fmt.Printf("%-10s %10s %10s %10s\n", "KIND", "IMPORTED", "REMAPPED", "SKIPPED")
+	for _, kind := range kinds {
+		fmt.Printf("%-10s %10d %10d %10d\n", kind, report.Imported[kind], report.Remapped[kind], report.Skipped[kind])
+	}
+}
@@ -1,6 +1,7 @@
 package command
 
 import (
+	"context"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -36,6 +37,7 @@ func init() {
 	psCmd.Flags().StringVarP(&getConf.Types, "types", "t", "", "Only list tasks of these types (comma separated)")
 	psCmd.Flags().StringVar(&getConf.RequiredTags, "requiredTags", "", "Only list tasks whose tags are a superset of these tags (comma separated)")
 	psCmd.Flags().StringVar(&getConf.MaxTags, "maxTags", "", "Only list tasks whose tags are a subset of these tags (comma separated)")
+	psCmd.Flags().StringVar(&getConf.Query, "query", "", "Only list tasks matching this query, e.g. 'env.DATASET=foo state=ERROR'")
 	psCmd.Flags().StringVar(&psConf.Template, "template", "", "The template to use for listing tasks")
 	psCmd.Flags().IntVarP(&getConf.Limit, "limit", "l", 500, "Maximum number of items to return")
 	psCmd.Flags().BoolVarP(&psConf.Quiet, "quiet", "q", false, "Print ids only")
@@ -43,7 +45,10 @@ func init() {
 }
 
 func ListTasks() {
-	tasks, err := client.GetTasks(&getConf, viper.GetInt("port"))
+	tasks, err := client.GetTasks(context.Background(), &getConf, viper.GetInt("port"))
+	if err != nil {
+		log.Fatalf(err.Error())
+	}
 
 	if psConf.Template == "" {
 		psConf.Template = "{{.id}} {{.type}} {{.state}} {{.tags}}"
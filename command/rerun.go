@@ -0,0 +1,61 @@
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/turtlemonvh/blanket/client"
+	"os"
+)
+
+var rerunConf RerunConf
+var rerunCmd = &cobra.Command{
+	Use:   "rerun",
+	Short: "Submit a copy of a finished task, with the same environment and uploaded files.",
+	Run: func(cmd *cobra.Command, args []string) {
+		InitializeConfig()
+		viper.Set("logLevel", "error")
+		InitializeLogging()
+		if len(args) < 1 {
+			fmt.Println("ERROR: Missing required positional argument 'taskId'")
+			cmd.Usage()
+			os.Exit(1)
+		}
+		RerunTask(args[0])
+	},
+}
+
+type RerunConf struct {
+	Env   string
+	Quiet bool
+}
+
+func init() {
+	rerunCmd.Flags().StringVarP(&rerunConf.Env, "env", "e", "{}", "JSON string of environment variables to override in the copy.")
+	rerunCmd.Flags().BoolVarP(&rerunConf.Quiet, "quiet", "q", false, "Print the new task id only")
+	RootCmd.AddCommand(rerunCmd)
+}
+
+func RerunTask(taskId string) {
+	overrides := make(map[string]interface{})
+	err := json.Unmarshal([]byte(rerunConf.Env), &overrides)
+	if err != nil {
+		log.Fatal("Error interpreting environment as valid json")
+	}
+
+	t, err := client.RerunTask(context.Background(), taskId, overrides, viper.GetInt("port"))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":    err,
+			"taskId": taskId,
+		}).Fatal("Error rerunning task")
+	}
+	if rerunConf.Quiet {
+		fmt.Println(t.Id.Hex())
+	} else {
+		fmt.Println(t.String())
+	}
+}
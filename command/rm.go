@@ -1,11 +1,13 @@
 package command
 
 import (
+	"context"
 	"fmt"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/turtlemonvh/blanket/client"
+	"github.com/turtlemonvh/blanket/tasks"
 	"log"
-	"net/http"
 	"os"
 )
 
@@ -13,6 +15,9 @@ var rmConf RmConf
 var rmCmd = &cobra.Command{
 	Use:   "rm",
 	Short: "Remove tasks",
+	Long: `Remove tasks by id. Pass '-' instead of ids to read them from stdin.
+
+    blanket ps -q --state ERROR | blanket rm -`,
 	Run: func(cmd *cobra.Command, args []string) {
 		InitializeConfig()
 		viper.Set("logLevel", "error")
@@ -22,31 +27,43 @@ var rmCmd = &cobra.Command{
 			cmd.Usage()
 			os.Exit(1)
 		}
-		rmConf.RemoveTask(args[0])
+		rmConf.RemoveTasks(args)
 	},
 }
 
 type RmConf struct {
-	Force  bool
-	TaskId string
+	Force bool
 }
 
-// FIXME: Accept stdin
 func init() {
 	// Add options for tags, state, and view template
 	rmCmd.Flags().BoolVarP(&rmConf.Force, "force", "f", false, "Force deletion of tasks (ignore errors and warnings)")
 	RootCmd.AddCommand(rmCmd)
 }
 
-func (c *RmConf) RemoveTask(taskId string) {
-	// Use RootConfig to decide what port to hit
-	req, err := http.NewRequest("DELETE", fmt.Sprintf("http://localhost:%d/task/%s", viper.GetInt("port"), taskId), nil)
-	if err != nil {
-		log.Fatalf(err.Error())
+// Removes all the tasks in one request
+func (c *RmConf) RemoveTasks(taskIds []string) {
+	if len(taskIds) == 1 && taskIds[0] == "-" {
+		taskIds = readIds(os.Stdin)
 	}
-	resp, err := http.DefaultClient.Do(req)
+	if len(taskIds) == 0 {
+		return
+	}
+
+	req := &tasks.BulkTaskRequest{Ids: taskIds}
+	resp, err := client.BulkTasks(context.Background(), tasks.BULK_DELETE, &client.GetTasksConf{}, req, false, viper.GetInt("port"))
 	if err != nil {
 		log.Fatalf(err.Error())
 	}
-	defer resp.Body.Close()
+	if c.Force {
+		return
+	}
+	for _, r := range resp.Results {
+		if r.Error != "" {
+			fmt.Printf("%s\tfailed (%d): %s\n", r.Id, r.Status, r.Error)
+		}
+	}
+	if resp.Failed > 0 {
+		os.Exit(1)
+	}
 }
@@ -52,12 +52,39 @@ func InitializeConfig() {
 	// Add reloads for select config values
 	// https://github.com/spf13/viper#watching-and-re-reading-config-files
 	viper.SetDefault("port", 8773)
-	viper.SetDefault("database", "blanket.db")
+
+	// Where tasks and workers are kept; `memory` keeps nothing across restarts unless snapshotPath is set
+	viper.SetDefault("database.driver", "bolt")
+	viper.SetDefault("database.path", "blanket.db")
+	viper.SetDefault("database.snapshotPath", "")
+	viper.SetDefault("database.snapshotIntervalSeconds", 60)
+
 	viper.SetDefault("tasks.typesPaths", []string{"types"})
+	// Where types created through the API are written; empty means the first of `tasks.typesPaths`
+	viper.SetDefault("tasks.writableTypesPath", "")
 	// FIXME: Why is this a slice? It makes sending a target result dir to a client pretty tough.
 	viper.SetDefault("tasks.resultsPath", []string{"results"})
 	viper.SetDefault("workers.logfileNameTemplate", "worker.{{.Id.Hex}}.log")
 
+	// Webhook deliveries; failed attempts are retried after retryDelaySeconds, doubling each time
+	viper.SetDefault("webhooks.maxAttempts", 8)
+	viper.SetDefault("webhooks.retryDelaySeconds", 10)
+	viper.SetDefault("webhooks.timeoutSeconds", 10)
+	viper.SetDefault("webhooks.pollIntervalSeconds", 5)
+
+	// Cancelling claimed and running tasks; see tasks/task_cancel.go
+	viper.SetDefault("tasks.cancelGracePeriodSeconds", 10)
+	viper.SetDefault("tasks.cancelAckTimeoutSeconds", 60)
+
+	// Finished tasks are kept forever unless retention rules are set; see tasks/task_retention.go
+	viper.SetDefault("tasks.retention.intervalSeconds", 3600)
+	viper.SetDefault("tasks.retention.archivePath", "")
+	// The event log behind GET /events is trimmed to this age by the same collector; 0 keeps it forever
+	viper.SetDefault("events.maxAgeDays", 7)
+
+	// API requests give up after this long, plus any `?wait=` they ask for; 0 turns the limit off
+	viper.SetDefault("server.requestTimeoutSeconds", 30)
+
 	// Time multiplier can be used in tests to speed up tests
 	viper.SetDefault("timeMultiplier", "1.0")
 
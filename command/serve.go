@@ -3,7 +3,6 @@ package command
 import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	bolt "github.com/turtlemonvh/blanket/lib/bolt"
 	"github.com/turtlemonvh/blanket/server"
 )
 
@@ -17,15 +16,15 @@ var RootCmd = &cobra.Command{
 		InitializeLogging()
 
 		// Connect to database
-		db := bolt.MustOpenBoltDatabase()
-		defer db.Close()
-
 		// DB and Q initializers are fatal if they don't succeed
+		DB, Q, closefn := mustOpenBackend()
+		defer closefn()
+
 		// Serve gracefully
 
 		c := server.ServerConfig{
-			DB:             bolt.NewBlanketBoltDB(db),
-			Q:              bolt.NewBlanketBoltQueue(db),
+			DB:             DB,
+			Q:              Q,
 			Port:           viper.GetInt("port"),
 			ResultsPath:    viper.GetString("tasks.resultsPath"),
 			TimeMultiplier: viper.GetFloat64("timeMultiplier"),
@@ -1,6 +1,7 @@
 package command
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	log "github.com/sirupsen/logrus"
@@ -42,7 +43,7 @@ func SubmitTask() {
 		log.Fatal("Error interpreting environment as valid json")
 	}
 
-	t, err := client.SubmitTask(submitConf.Type, executionEnvironment, viper.GetInt("port"))
+	t, err := client.SubmitTask(context.Background(), submitConf.Type, executionEnvironment, viper.GetInt("port"))
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"sort"
+	"strings"
 	"text/tabwriter"
 
 	"github.com/spf13/cobra"
@@ -13,7 +15,9 @@ import (
 var taskValidateCmd = &cobra.Command{
 	Use:   "task-validate [type-name]",
 	Short: "Validate that task types are runnable",
-	Long:  `Checks that each task type's executor is on $PATH and that the command field is non-empty.`,
+	Long: `Checks that each task type's executor is on $PATH and that the command field is non-empty.
+
+When a type name is given, also prints the fully resolved definition and the file each field came from.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		InitializeConfig()
 
@@ -49,14 +53,41 @@ var taskValidateCmd = &cobra.Command{
 				executor = "bash"
 			}
 			command := tt.Config.GetString("command")
+			executors := []string{executor}
+			if steps := tt.Steps(); len(steps) > 0 {
+				command = fmt.Sprintf("(%d steps)", len(steps))
+				executors = nil
+				for _, step := range steps {
+					if step.Executor == "" {
+						step.Executor = "bash"
+					}
+					executors = append(executors, step.Executor)
+				}
+			}
+			for _, hook := range tt.Hooks() {
+				if hook.Command == "" {
+					continue
+				}
+				if hook.Executor == "" {
+					hook.Executor = "bash"
+				}
+				executors = append(executors, hook.Executor)
+			}
 
 			status := "ok"
-			if command == "" {
+			if tt.IsAbstract() {
+				status = "abstract"
+			} else if command == "" {
 				status = "missing command"
 				anyFailed = true
-			} else if _, err := exec.LookPath(executor); err != nil {
-				status = fmt.Sprintf("executor not found: %s", executor)
-				anyFailed = true
+			} else {
+				for _, e := range executors {
+					if _, err := exec.LookPath(e); err != nil {
+						status = fmt.Sprintf("executor not found: %s", e)
+						anyFailed = true
+						break
+					}
+				}
 			}
 
 			cmdDisplay := command
@@ -65,10 +96,48 @@ var taskValidateCmd = &cobra.Command{
 			}
 			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", tt.GetName(), executor, cmdDisplay, status)
 		}
+		for _, loadErr := range tasks.DefaultRegistry().LoadErrors() {
+			if len(args) > 0 && loadErr.Name != args[0] {
+				continue
+			}
+			fmt.Fprintf(w, "%s\t\t%s\tload error: %s\n", loadErr.Name, loadErr.ConfigFile, loadErr.Error)
+			anyFailed = true
+		}
 		w.Flush()
 
+		if len(args) > 0 && len(tts) == 1 {
+			printResolvedTaskType(&tts[0])
+		}
+
 		if anyFailed {
 			os.Exit(1)
 		}
 	},
 }
+
+// Print each resolved field alongside the file it was taken from
+func printResolvedTaskType(tt *tasks.TaskType) {
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FIELD\tVALUE\tFROM")
+
+	fields := make([]string, 0, len(tt.Provenance))
+	for field := range tt.Provenance {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	defaultEnv := tt.DefaultEnv()
+	for _, field := range fields {
+		value := ""
+		if name, ok := strings.CutPrefix(field, "environment.default."); ok {
+			value = defaultEnv[name]
+		} else if tt.Config.IsSet(field) {
+			value = strings.ReplaceAll(fmt.Sprintf("%v", tt.Config.Get(field)), "\n", " ")
+		}
+		if len(value) > 40 {
+			value = value[:37] + "..."
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", field, value, tt.Provenance[field])
+	}
+	w.Flush()
+}
@@ -50,7 +50,7 @@ func init() {
 	workerCmd.Flags().StringVarP(&workerRawTags, "tags", "t", "", "Tags defining capabilities of this worker")
 	workerCmd.Flags().StringVar(&workerId, "id", "", "Id of this worker")
 	workerCmd.Flags().StringVar(&workerConf.Logfile, "logfile", "", "Logfile to use")
-	workerCmd.Flags().Float64Var(&workerConf.CheckInterval, "checkinterval", 0, "Check interval in seconds")
+	workerCmd.Flags().Float64Var(&workerConf.CheckInterval, "checkinterval", 0, "Seconds to wait before retrying after an error talking to the server")
 	workerCmd.Flags().BoolVarP(&workerConf.Daemon, "daemon", "d", false, "Run as a daemon")
 	RootCmd.AddCommand(workerCmd)
 }
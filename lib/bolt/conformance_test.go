@@ -0,0 +1,13 @@
+package bolt
+
+import (
+	"github.com/turtlemonvh/blanket/lib/conformance"
+	"testing"
+)
+
+func TestConformance(t *testing.T) {
+	conformance.RunDatabaseTests(t, NewTestDB)
+	conformance.RunQueueTests(t, NewTestQueue)
+	conformance.RunExportTests(t, NewTestBackend)
+	conformance.RunBackendTests(t, NewTestBackend)
+}
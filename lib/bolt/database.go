@@ -1,6 +1,7 @@
 package bolt
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	log "github.com/sirupsen/logrus"
@@ -29,6 +30,11 @@ type BlanketBoltDB struct {
 }
 
 func NewBlanketBoltDB(db *bolt.DB) database.BlanketDB {
+	// Read-only files are used as they are; reads treat missing buckets as empty or fail with BucketDNEError
+	if db.IsReadOnly() {
+		return &BlanketBoltDB{db}
+	}
+
 	// Ensure required buckets exist
 	db.Update(func(tx *bolt.Tx) error {
 		var err error
@@ -36,6 +42,13 @@ func NewBlanketBoltDB(db *bolt.DB) database.BlanketDB {
 		requiredBuckets := []string{
 			BOLTDB_WORKER_BUCKET,
 			BOLTDB_TASK_BUCKET,
+			BOLTDB_WEBHOOK_BUCKET,
+			BOLTDB_DELIVERY_BUCKET,
+			BOLTDB_OUTBOX_BUCKET,
+			BOLTDB_EVENT_BUCKET,
+			BOLTDB_TASK_STATS_BUCKET,
+			BOLTDB_TASK_STATE_COUNTS_BUCKET,
+			BOLTDB_SETTINGS_BUCKET,
 		}
 
 		for _, bucketName := range requiredBuckets {
@@ -57,11 +70,11 @@ func NewBlanketBoltDB(db *bolt.DB) database.BlanketDB {
 // WORKERS
 
 // Get all workers
-func (DB *BlanketBoltDB) GetWorkers() ([]worker.WorkerConf, error) {
+func (DB *BlanketBoltDB) GetWorkers(ctx context.Context) ([]worker.WorkerConf, error) {
 	var err error
 	ws := []worker.WorkerConf{}
 
-	err = DB.db.View(func(tx *bolt.Tx) error {
+	err = viewContext(ctx, DB.db, func(tx *bolt.Tx) error {
 		var err error
 
 		b := tx.Bucket([]byte(BOLTDB_WORKER_BUCKET))
@@ -84,9 +97,9 @@ func (DB *BlanketBoltDB) GetWorkers() ([]worker.WorkerConf, error) {
 	return ws, err
 }
 
-func (DB *BlanketBoltDB) GetWorker(workerId objectid.ObjectId) (worker.WorkerConf, error) {
+func (DB *BlanketBoltDB) GetWorker(ctx context.Context, workerId objectid.ObjectId) (worker.WorkerConf, error) {
 	w := worker.WorkerConf{}
-	err := DB.db.View(func(tx *bolt.Tx) error {
+	err := viewContext(ctx, DB.db, func(tx *bolt.Tx) error {
 		result, err := fetchWorkerBytes(workerId, tx)
 		if err != nil {
 			return err
@@ -96,30 +109,80 @@ func (DB *BlanketBoltDB) GetWorker(workerId objectid.ObjectId) (worker.WorkerCon
 	return w, err
 }
 
-// FIXME: More granularity, because may be killed by setting field in database
-// Should only every be called by one process, so just overwrites all values
-// Should handle creation if the worker doesn't already exist
-func (DB *BlanketBoltDB) UpdateWorker(w *worker.WorkerConf) error {
-	return DB.db.Update(func(tx *bolt.Tx) error {
+// Write the whole worker record, creating it if it doesn't exist
+// A non-zero w.Revision must match the stored revision; w.Revision is set to the new revision
+func (DB *BlanketBoltDB) UpdateWorker(ctx context.Context, w *worker.WorkerConf) error {
+	return updateContext(ctx, DB.db, func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(BOLTDB_WORKER_BUCKET))
 		if b == nil {
 			return MakeBucketDNEError(BOLTDB_WORKER_BUCKET)
 		}
-		bts, err := json.Marshal(w)
-		if err != nil {
+		eventType, oldState := database.EVENT_WORKER_CREATED, ""
+		old := worker.WorkerConf{}
+		if existing := b.Get(IdBytes(w.Id)); existing != nil {
+			if err := json.Unmarshal(existing, &old); err != nil {
+				return err
+			}
+			eventType, oldState = database.EVENT_WORKER_UPDATED, database.WorkerState(&old)
+		}
+		if w.Revision != 0 && w.Revision != old.Revision {
+			return database.RevisionConflictError{Id: w.Id.Hex(), Expected: w.Revision, Actual: old.Revision}
+		}
+
+		next := *w
+		next.Revision = old.Revision + 1
+		if err := saveWorkerToBucket(&next, b); err != nil {
 			return err
 		}
-		return b.Put(IdBytes(w.Id), bts)
+		w.Revision = next.Revision
+		return appendEventInTransaction(tx, eventType, w.Id, oldState, database.WorkerState(w))
+	})
+}
+
+// Mark the worker stopped without touching its other fields
+// The worker exits after its current task when it next checks in
+func (DB *BlanketBoltDB) StopWorker(ctx context.Context, workerId objectid.ObjectId) (worker.WorkerConf, error) {
+	return modifyWorkerInBoltTransaction(ctx, DB.db, workerId, func(w *worker.WorkerConf) error {
+		w.Stopped = true
+		return nil
 	})
 }
 
-func (DB *BlanketBoltDB) DeleteWorker(workerId objectid.ObjectId) error {
-	return DB.db.Update(func(tx *bolt.Tx) error {
+// Stop or let the worker take new tasks without touching its other fields
+// A draining worker finishes its current task and stays registered
+func (DB *BlanketBoltDB) DrainWorker(ctx context.Context, workerId objectid.ObjectId, draining bool) (worker.WorkerConf, error) {
+	return modifyWorkerInBoltTransaction(ctx, DB.db, workerId, func(w *worker.WorkerConf) error {
+		w.Draining = draining
+		return nil
+	})
+}
+
+// Record that the worker checked in, returning its record so it can see if it has been stopped
+func (DB *BlanketBoltDB) HeartbeatWorker(ctx context.Context, workerId objectid.ObjectId, ts int64) (worker.WorkerConf, error) {
+	return modifyWorkerInBoltTransaction(ctx, DB.db, workerId, func(w *worker.WorkerConf) error {
+		w.LastHeardTs = ts
+		return nil
+	})
+}
+
+func (DB *BlanketBoltDB) DeleteWorker(ctx context.Context, workerId objectid.ObjectId) error {
+	return updateContext(ctx, DB.db, func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(BOLTDB_WORKER_BUCKET))
 		if b == nil {
 			return MakeBucketDNEError(BOLTDB_WORKER_BUCKET)
 		}
-		return b.Delete(IdBytes(workerId))
+		existing := b.Get(IdBytes(workerId))
+		if existing == nil {
+			return nil
+		}
+		old := worker.WorkerConf{}
+		if err := json.Unmarshal(existing, &old); err != nil {
+			return err
+		}
+		if err := b.Delete(IdBytes(workerId)); err != nil {
+			return err
+		}
+		return appendEventInTransaction(tx, database.EVENT_WORKER_DELETED, workerId, database.WorkerState(&old), "")
 	})
 }
 
@@ -128,16 +191,16 @@ func (DB *BlanketBoltDB) DeleteWorker(workerId objectid.ObjectId) error {
 // - query OS for process information
 // - remove from DB if not running (pid is not found or is to a non-worker process)
 // - kill if running and not responsive
-func (DB *BlanketBoltDB) CleanupStalledWorkers() error {
+func (DB *BlanketBoltDB) CleanupStalledWorkers(ctx context.Context) error {
 	return nil
 }
 
 // Tasks
 
-func (DB *BlanketBoltDB) GetTask(taskId objectid.ObjectId) (tasks.Task, error) {
+func (DB *BlanketBoltDB) GetTask(ctx context.Context, taskId objectid.ObjectId) (tasks.Task, error) {
 	var err error
 	task := tasks.Task{}
-	err = DB.db.View(func(tx *bolt.Tx) error {
+	err = viewContext(ctx, DB.db, func(tx *bolt.Tx) error {
 		b, err := fetchTaskBucket(tx)
 		if err != nil {
 			return err
@@ -148,59 +211,132 @@ func (DB *BlanketBoltDB) GetTask(taskId objectid.ObjectId) (tasks.Task, error) {
 	return task, err
 }
 
-func (DB *BlanketBoltDB) GetTasks(tc *database.TaskSearchConf) ([]tasks.Task, int, error) {
-	return FindTasksInBoltDB(DB.db, BOLTDB_TASK_BUCKET, tc)
+func (DB *BlanketBoltDB) GetTasks(ctx context.Context, tc *database.TaskSearchConf) ([]tasks.Task, int, error) {
+	return FindTasksInBoltDB(ctx, DB.db, BOLTDB_TASK_BUCKET, tc)
 }
 
-func (DB *BlanketBoltDB) DeleteTask(taskId objectid.ObjectId) error {
-	return DB.db.Update(func(tx *bolt.Tx) error {
+func (DB *BlanketBoltDB) DeleteTask(ctx context.Context, taskId objectid.ObjectId) error {
+	return updateContext(ctx, DB.db, func(tx *bolt.Tx) error {
 		b, err := fetchTaskBucket(tx)
 		if err != nil {
 			return err
 		}
-		return b.Delete(IdBytes(taskId))
+		old, err := fetchTaskFromBucket(&taskId, b)
+		if _, ok := err.(database.ItemNotFoundError); ok {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := b.Delete(IdBytes(taskId)); err != nil {
+			return err
+		}
+		if err := countTaskStateInTransaction(tx, old.State, ""); err != nil {
+			return err
+		}
+		return appendEventInTransaction(tx, database.EVENT_TASK_DELETED, taskId, old.State, "")
 	})
 }
 
 // progress is a number [0:100]
 // Should also update task.LastUpdatedTs
-func (DB *BlanketBoltDB) UpdateTaskProgress(taskId objectid.ObjectId, progress int) error {
-	return ModifyTaskInBoltTransaction(DB.db, &taskId, func(t *tasks.Task) error {
+func (DB *BlanketBoltDB) UpdateTaskProgress(ctx context.Context, taskId objectid.ObjectId, progress int) error {
+	return ModifyTaskInBoltTransaction(ctx, DB.db, &taskId, func(t *tasks.Task) error {
 		t.Progress = progress
 		return nil
 	})
 }
 
+// Replace the tags on a task
+// For WAITING tasks the queue entry has to be updated too, since that is what workers claim from
+func (DB *BlanketBoltDB) UpdateTaskTags(ctx context.Context, taskId objectid.ObjectId, tags []string) error {
+	return ModifyTaskInBoltTransaction(ctx, DB.db, &taskId, func(t *tasks.Task) error {
+		t.Tags = tags
+		return nil
+	})
+}
+
+// Record the state of one step of a multi-step task
+// Progress is set from the number of finished steps
+func (DB *BlanketBoltDB) UpdateTaskStep(ctx context.Context, taskId objectid.ObjectId, step int, state string, exitCode int) error {
+	return ModifyTaskInBoltTransaction(ctx, DB.db, &taskId, func(t *tasks.Task) error {
+		if t.State != "RUNNING" {
+			return fmt.Errorf("Task found in unexpected state; found '%s', expected 'RUNNING'", t.State)
+		}
+		t.LastUpdatedTs = time.Now().Unix()
+		return t.UpdateStep(step, state, exitCode, t.LastUpdatedTs)
+	})
+}
+
+// Record the state of one hook of a task
+// Hooks also run after the task has finished, so any state but WAITING is accepted
+func (DB *BlanketBoltDB) UpdateTaskHook(ctx context.Context, taskId objectid.ObjectId, hook string, state string, exitCode int, followUpTaskId string) error {
+	return ModifyTaskInBoltTransaction(ctx, DB.db, &taskId, func(t *tasks.Task) error {
+		if t.State == "WAITING" {
+			return fmt.Errorf("Task found in unexpected state; found 'WAITING', expected the task to be claimed")
+		}
+		t.LastUpdatedTs = time.Now().Unix()
+		return t.UpdateHook(hook, state, exitCode, followUpTaskId, t.LastUpdatedTs)
+	})
+}
+
 // Things to clean up
 // - tasks still in state `CLAIMED` X min after StartedTs because:
 //   - worker failed to parse worker object
 //   - worker crashed trying to run the task
-func (DB *BlanketBoltDB) CleanupStalledTasks() error {
+func (DB *BlanketBoltDB) CleanupStalledTasks(ctx context.Context) error {
 	// FIXME: Implement me
 	return nil
 }
 
 // This will be called on a task pulled out of the queue
-// Any task that, for any reason, happens to exist with the same id should be overwritten
-func (DB *BlanketBoltDB) SaveTask(t *tasks.Task) error {
+// Any task that, for any reason, happens to exist with the same id is overwritten, unless t.Revision is set
+// and doesn't match; t.Revision is set to the new revision
+func (DB *BlanketBoltDB) SaveTask(ctx context.Context, t *tasks.Task) error {
 	// Just save in database
-	return DB.db.Update(func(tx *bolt.Tx) error {
+	return updateContext(ctx, DB.db, func(tx *bolt.Tx) error {
 		bucket, err := fetchTaskBucket(tx)
 		if err != nil {
 			return err
 		}
-		return saveTaskToBucket(t, bucket)
+		eventType, oldState := database.EVENT_TASK_CREATED, ""
+		var oldTask *tasks.Task
+		old, err := fetchTaskFromBucket(&t.Id, bucket)
+		if err == nil {
+			eventType, oldState, oldTask = database.EVENT_TASK_UPDATED, old.State, &old
+		} else if _, ok := err.(database.ItemNotFoundError); !ok {
+			return err
+		}
+		if t.Revision != 0 && t.Revision != old.Revision {
+			return database.RevisionConflictError{Id: t.Id.Hex(), Expected: t.Revision, Actual: old.Revision}
+		}
+
+		next := *t
+		next.Revision = old.Revision + 1
+		if err := saveTaskToBucket(&next, bucket); err != nil {
+			return err
+		}
+		t.Revision = next.Revision
+		if err := recordTaskStatsInTransaction(tx, oldTask, t, time.Now().Unix()); err != nil {
+			return err
+		}
+		if err := countTaskStateInTransaction(tx, oldState, t.State); err != nil {
+			return err
+		}
+		if err := queueTaskDeliveriesInTransaction(tx, oldTask, t); err != nil {
+			return err
+		}
+		return appendEventInTransaction(tx, eventType, t.Id, oldState, t.State)
 	})
 }
 
 // This should be done as an upsert or within a transaction
-func (DB *BlanketBoltDB) RunTask(taskId objectid.ObjectId, fields *database.TaskRunConfig) error {
+func (DB *BlanketBoltDB) RunTask(ctx context.Context, taskId objectid.ObjectId, fields *database.TaskRunConfig) error {
 	// Set lots of fields
-	return ModifyTaskInBoltTransaction(DB.db, &taskId, func(t *tasks.Task) error {
+	return ModifyTaskInBoltTransaction(ctx, DB.db, &taskId, func(t *tasks.Task) error {
 		if t.State != "CLAIMED" {
 			return fmt.Errorf("Task found in unexpected state; found '%s', expected 'CLAIMED'", t.State)
 		}
-		t.State = "RUNNING"
+		t.Transition("RUNNING", tasks.WorkerActor(t.WorkerId), "", fields.LastUpdatedTs)
 		t.Progress = 0
 		t.Timeout = int64(fields.Timeout)
 		t.LastUpdatedTs = int64(fields.LastUpdatedTs)
@@ -210,20 +346,80 @@ func (DB *BlanketBoltDB) RunTask(taskId objectid.ObjectId, fields *database.Task
 	})
 }
 
+// Ask the worker that has a task to stop it
+// A second request can add force or change the reason
+func (DB *BlanketBoltDB) RequestTaskCancel(ctx context.Context, taskId objectid.ObjectId, force bool, reason string) error {
+	return ModifyTaskInBoltTransaction(ctx, DB.db, &taskId, func(t *tasks.Task) error {
+		if t.State != "RUNNING" && t.State != "CLAIMED" {
+			return fmt.Errorf("Task found in unexpected state; found '%s', expected 'CLAIMED' or 'RUNNING'", t.State)
+		}
+		if t.Cancellation == nil {
+			t.Cancellation = &tasks.TaskCancellation{RequestedTs: time.Now().Unix()}
+		}
+		t.Cancellation.Force = t.Cancellation.Force || force
+		if reason != "" {
+			t.Cancellation.Reason = reason
+		}
+		return nil
+	})
+}
+
+// Record progress on a cancel request
+// An empty outcome only acknowledges the request; otherwise the task moves to STOPPED
+// An empty actor means the worker that claimed the task
+func (DB *BlanketBoltDB) UpdateTaskCancel(ctx context.Context, taskId objectid.ObjectId, actor string, outcome string) error {
+	return ModifyTaskInBoltTransaction(ctx, DB.db, &taskId, func(t *tasks.Task) error {
+		if t.Cancellation == nil {
+			return fmt.Errorf("Task has no cancel request")
+		}
+		if t.State != "RUNNING" && t.State != "CLAIMED" {
+			return fmt.Errorf("Task found in unexpected state; found '%s', expected 'CLAIMED' or 'RUNNING'", t.State)
+		}
+		isValid := outcome == ""
+		for _, o := range tasks.ValidCancelOutcomes {
+			if outcome == o {
+				isValid = true
+				break
+			}
+		}
+		if !isValid {
+			return fmt.Errorf("Invalid cancel outcome '%s'; must be one of: %v", outcome, tasks.ValidCancelOutcomes)
+		}
+		if actor == "" {
+			actor = tasks.WorkerActor(t.WorkerId)
+		}
+
+		t.LastUpdatedTs = time.Now().Unix()
+		if t.Cancellation.AcknowledgedTs == 0 && outcome != tasks.CANCEL_UNACKNOWLEDGED {
+			t.Cancellation.AcknowledgedTs = t.LastUpdatedTs
+		}
+		if outcome != "" {
+			t.Cancellation.Outcome = outcome
+			t.Transition("STOPPED", actor, t.Cancellation.Reason, t.LastUpdatedTs)
+		}
+		return nil
+	})
+}
+
 // Set task to a terminal state
-// Checks that task is currently in the RUNNING state
+// Checks that task is currently in the RUNNING state, or CLAIMED if it failed before it could start
 // Sets progress to 100 if the state is SUCCESS
-func (DB *BlanketBoltDB) FinishTask(taskId objectid.ObjectId, newState string) error {
+// An empty actor means the worker that claimed the task; exitCode is nil if the worker didn't report one
+func (DB *BlanketBoltDB) FinishTask(ctx context.Context, taskId objectid.ObjectId, newState string, actor string, reason string, exitCode *int) error {
 	// Set lots of fields
-	return ModifyTaskInBoltTransaction(DB.db, &taskId, func(t *tasks.Task) error {
-		if t.State != "RUNNING" && t.State != "WAITING" {
+	return ModifyTaskInBoltTransaction(ctx, DB.db, &taskId, func(t *tasks.Task) error {
+		if t.State != "RUNNING" && t.State != "WAITING" && t.State != "CLAIMED" {
 			return fmt.Errorf("Task found in unexpected state; found '%s', expected 'RUNNING'", t.State)
 		}
-		t.State = newState
+		if actor == "" {
+			actor = tasks.WorkerActor(t.WorkerId)
+		}
+		t.LastUpdatedTs = time.Now().Unix()
+		t.Transition(newState, actor, reason, t.LastUpdatedTs)
+		t.ExitCode = exitCode
 		if t.State == "SUCCESS" {
 			t.Progress = 100
 		}
-		t.LastUpdatedTs = time.Now().Unix()
 		return nil
 	})
 }
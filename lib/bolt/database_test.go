@@ -1,21 +1,26 @@
 package bolt
 
 import (
+	"context"
 	"github.com/stretchr/testify/assert"
+	"github.com/turtlemonvh/blanket/lib/database"
 	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/lib/webhooks"
+	"github.com/turtlemonvh/blanket/tasks"
 	"github.com/turtlemonvh/blanket/worker"
 	"testing"
 	"time"
 )
 
 func TestWorkers(t *testing.T) {
+	ctx := context.Background()
 	DB, closefn := NewTestDB()
 	defer closefn()
 
 	var workers []worker.WorkerConf
 	var err error
 
-	workers, err = DB.GetWorkers()
+	workers, err = DB.GetWorkers(ctx)
 	assert.Equal(t, len(workers), 0)
 	assert.Equal(t, err, nil)
 
@@ -31,7 +36,7 @@ func TestWorkers(t *testing.T) {
 		Daemon:        false,
 	}
 	w1.SetLogfileName()
-	err = DB.UpdateWorker(w1)
+	err = DB.UpdateWorker(ctx, w1)
 	assert.Equal(t, err, nil)
 
 	w2 := &worker.WorkerConf{
@@ -44,49 +49,356 @@ func TestWorkers(t *testing.T) {
 		Daemon:        false,
 	}
 	w2.SetLogfileName()
-	err = DB.UpdateWorker(w2)
+	err = DB.UpdateWorker(ctx, w2)
 	assert.Equal(t, err, nil)
 
 	// Check that we can fetch each worker individually
-	w1_fetched, err := DB.GetWorker(w1.Id)
+	w1_fetched, err := DB.GetWorker(ctx, w1.Id)
 	assert.Equal(t, err, nil)
 	assert.Equal(t, w1.StartedTs, w1_fetched.StartedTs)
 	assert.Equal(t, w1.Tags, w1_fetched.Tags)
 
-	w2_fetched, err := DB.GetWorker(w2.Id)
+	w2_fetched, err := DB.GetWorker(ctx, w2.Id)
 	assert.Equal(t, err, nil)
 	assert.Equal(t, w2.StartedTs, w2_fetched.StartedTs)
 	assert.Equal(t, w2.Tags, w2_fetched.Tags)
 
 	// Check that we see both workers in the database
-	workers, err = DB.GetWorkers()
+	workers, err = DB.GetWorkers(ctx)
 	assert.Equal(t, err, nil)
 	assert.Equal(t, len(workers), 2)
 
 	// Check that DeleteWorker with an invalid id does not error, but does not change count
-	err = DB.DeleteWorker(objectid.NewObjectId())
+	err = DB.DeleteWorker(ctx, objectid.NewObjectId())
 	assert.Equal(t, err, nil)
-	workers, err = DB.GetWorkers()
+	workers, err = DB.GetWorkers(ctx)
 	assert.Equal(t, err, nil)
 	assert.Equal(t, len(workers), 2)
 
 	// Check that DeleteWorker with a valid id is fine
-	err = DB.DeleteWorker(w1.Id)
+	err = DB.DeleteWorker(ctx, w1.Id)
 	assert.Equal(t, err, nil)
-	workers, err = DB.GetWorkers()
+	workers, err = DB.GetWorkers(ctx)
 	assert.Equal(t, err, nil)
 	assert.Equal(t, len(workers), 1)
 
 	// Trying to fetch by id of deleted item should return error now
-	w1_fetched, err = DB.GetWorker(w1.Id)
+	w1_fetched, err = DB.GetWorker(ctx, w1.Id)
 	assert.NotEqual(t, err, nil)
 
 	// Should return just 1 item
-	workers, err = DB.GetWorkers()
+	workers, err = DB.GetWorkers(ctx)
 	assert.Equal(t, err, nil)
 	assert.Equal(t, len(workers), 1)
 }
 
+func TestWebhookOutbox(t *testing.T) {
+	ctx := context.Background()
+	DB, closefn := NewTestDB()
+	defer closefn()
+
+	w := &webhooks.Webhook{Id: objectid.NewObjectId(), URL: "http://localhost:9999/hook", Secret: "s"}
+	assert.NoError(t, DB.SaveWebhook(ctx, w))
+	hooks, err := DB.GetWebhooks(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, hooks, 1)
+
+	now := time.Now().Unix()
+	due, _ := webhooks.NewDelivery(w, webhooks.Event{Name: "task.claimed"})
+	later, _ := webhooks.NewDelivery(w, webhooks.Event{Name: "task.running"})
+	later.NextAttemptTs = now + 60
+	assert.NoError(t, DB.SaveWebhookDelivery(ctx, &due))
+	assert.NoError(t, DB.SaveWebhookDelivery(ctx, &later))
+
+	pending, err := DB.GetDueWebhookDeliveries(ctx, now, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, pending, 1) {
+		assert.Equal(t, due.Id, pending[0].Id)
+	}
+
+	// Delivered entries leave the outbox but stay in the history
+	due.RecordAttempt(webhooks.Attempt{Ts: now, StatusCode: 200}, 3, 10)
+	assert.NoError(t, DB.SaveWebhookDelivery(ctx, &due))
+	pending, err = DB.GetDueWebhookDeliveries(ctx, now+60, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, pending, 1) {
+		assert.Equal(t, later.Id, pending[0].Id)
+	}
+
+	history, err := DB.GetWebhookDeliveries(ctx, w.Id, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, history, 2) {
+		assert.Equal(t, later.Id, history[0].Id)
+		assert.Equal(t, webhooks.DELIVERY_DELIVERED, history[1].State)
+	}
+
+	assert.NoError(t, DB.DeleteWebhook(ctx, w.Id))
+	_, err = DB.GetWebhook(ctx, w.Id)
+	assert.IsType(t, database.ItemNotFoundError(""), err)
+}
+
+func TestRevisions(t *testing.T) {
+	ctx := context.Background()
+	DB, closefn := NewTestDB()
+	defer closefn()
+
+	task := tasks.Task{Id: objectid.NewObjectId(), State: "WAITING"}
+	assert.NoError(t, DB.SaveTask(ctx, &task))
+	assert.Equal(t, int64(1), task.Revision)
+	stale := task
+
+	assert.NoError(t, DB.UpdateTaskProgress(ctx, task.Id, 50))
+	stale.Progress = 10
+	err := DB.SaveTask(ctx, &stale)
+	assert.Equal(t, database.RevisionConflictError{Id: task.Id.Hex(), Expected: 1, Actual: 2}, err)
+	fetched, err := DB.GetTask(ctx, task.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, 50, fetched.Progress)
+	assert.Equal(t, int64(2), fetched.Revision)
+
+	// Revision 0 overwrites
+	stale.Revision = 0
+	assert.NoError(t, DB.SaveTask(ctx, &stale))
+	assert.Equal(t, int64(3), stale.Revision)
+
+	// A worker writing back its whole record can't undo a stop
+	w := worker.WorkerConf{Id: objectid.NewObjectId()}
+	assert.NoError(t, DB.UpdateWorker(ctx, &w))
+	assert.Equal(t, int64(1), w.Revision)
+	stopped, err := DB.StopWorker(ctx, w.Id)
+	assert.NoError(t, err)
+	assert.True(t, stopped.Stopped)
+	w.Pid = 100
+	_, isConflict := DB.UpdateWorker(ctx, &w).(database.RevisionConflictError)
+	assert.True(t, isConflict)
+
+	eventsBefore, err := DB.GetEvents(ctx, 0, 100)
+	assert.NoError(t, err)
+	heard, err := DB.HeartbeatWorker(ctx, w.Id, 12345)
+	assert.NoError(t, err)
+	assert.True(t, heard.Stopped)
+	assert.Equal(t, int64(12345), heard.LastHeardTs)
+	assert.Equal(t, int64(3), heard.Revision)
+	eventsAfter, err := DB.GetEvents(ctx, 0, 100)
+	assert.NoError(t, err)
+	assert.Len(t, eventsAfter, len(eventsBefore))
+
+	_, err = DB.HeartbeatWorker(ctx, objectid.NewObjectId(), 1)
+	assert.IsType(t, database.ItemNotFoundError(""), err)
+}
+
+func TestEventLog(t *testing.T) {
+	ctx := context.Background()
+	DB, closefn := NewTestDB()
+	defer closefn()
+
+	task := tasks.Task{Id: objectid.NewObjectId(), State: "WAITING"}
+	assert.NoError(t, DB.SaveTask(ctx, &task))
+	task.State = "CLAIMED"
+	assert.NoError(t, DB.SaveTask(ctx, &task))
+	assert.NoError(t, DB.RunTask(ctx, task.Id, &database.TaskRunConfig{}))
+	assert.NoError(t, DB.UpdateTaskProgress(ctx, task.Id, 50))
+	assert.NoError(t, DB.FinishTask(ctx, task.Id, "SUCCESS", "", "", nil))
+	assert.NoError(t, DB.DeleteTask(ctx, task.Id))
+
+	// Failed updates don't log anything
+	assert.Error(t, DB.RunTask(ctx, task.Id, &database.TaskRunConfig{}))
+
+	w := worker.WorkerConf{Id: objectid.NewObjectId()}
+	assert.NoError(t, DB.UpdateWorker(ctx, &w))
+	w.Stopped = true
+	assert.NoError(t, DB.UpdateWorker(ctx, &w))
+	assert.NoError(t, DB.DeleteWorker(ctx, w.Id))
+
+	events, err := DB.GetEvents(ctx, 0, 100)
+	assert.NoError(t, err)
+	expected := [][3]string{
+		{database.EVENT_TASK_CREATED, "", "WAITING"},
+		{database.EVENT_TASK_UPDATED, "WAITING", "CLAIMED"},
+		{database.EVENT_TASK_UPDATED, "CLAIMED", "RUNNING"},
+		{database.EVENT_TASK_UPDATED, "RUNNING", "RUNNING"},
+		{database.EVENT_TASK_UPDATED, "RUNNING", "SUCCESS"},
+		{database.EVENT_TASK_DELETED, "SUCCESS", ""},
+		{database.EVENT_WORKER_CREATED, "", "RUNNING"},
+		{database.EVENT_WORKER_UPDATED, "RUNNING", "STOPPED"},
+		{database.EVENT_WORKER_DELETED, "STOPPED", ""},
+	}
+	if assert.Len(t, events, len(expected)) {
+		for i, e := range events {
+			assert.Equal(t, uint64(i+1), e.Seq)
+			assert.Equal(t, expected[i], [3]string{e.Type, e.OldState, e.NewState})
+		}
+		assert.Equal(t, task.Id, events[0].EntityId)
+		assert.Equal(t, w.Id, events[len(events)-1].EntityId)
+	}
+
+	// Resuming
+	events, err = DB.GetEvents(ctx, 7, 1)
+	assert.NoError(t, err)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, uint64(8), events[0].Seq)
+	}
+	events, err = DB.GetEvents(ctx, 9, 100)
+	assert.NoError(t, err)
+	assert.Len(t, events, 0)
+}
+
+func TestTaskStats(t *testing.T) {
+	ctx := context.Background()
+	DB, closefn := NewTestDB()
+	defer closefn()
+
+	now := time.Now().Unix()
+	for i, finalState := range []string{"SUCCESS", "SUCCESS", "ERROR", ""} {
+		task := &tasks.Task{
+			Id:        objectid.NewObjectId(),
+			TypeId:    "render_job",
+			CreatedTs: now - 100,
+			State:     "WAITING",
+			Tags:      []string{"gpu"},
+		}
+		if i == 3 {
+			task.TypeId, task.Tags = "echo_task", nil
+		}
+		assert.NoError(t, DB.SaveTask(ctx, task))
+		if finalState == "" {
+			continue
+		}
+
+		// Claiming saves the whole task
+		task.State, task.StartedTs = "CLAIMED", now-60
+		assert.NoError(t, DB.SaveTask(ctx, task))
+		assert.NoError(t, DB.RunTask(ctx, task.Id, &database.TaskRunConfig{LastUpdatedTs: now}))
+		// Changes that keep the state aren't counted
+		assert.NoError(t, DB.UpdateTaskProgress(ctx, task.Id, 50))
+		assert.NoError(t, DB.FinishTask(ctx, task.Id, finalState, "", "", nil))
+	}
+
+	sq := &database.TaskStatsQuery{From: now - 3600, To: now + 1, Bucket: database.STATS_BUCKET_HOUR}
+	report, err := database.GetTaskStatsReport(ctx, DB, sq)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, report.Totals.Submitted)
+	assert.Equal(t, 3, report.Totals.Claimed)
+	assert.Equal(t, map[string]int{"SUCCESS": 2, "ERROR": 1}, report.Totals.Finished)
+	assert.InDelta(t, 2.0/3, report.Totals.SuccessRatio, 0.001)
+	assert.Equal(t, int64(3), report.Totals.Duration.Count)
+	assert.InDelta(t, 60, report.Totals.Duration.Mean, 2)
+	assert.InDelta(t, 100, report.Totals.Wait.Mean, 2)
+	assert.Len(t, report.Buckets, 2)
+
+	assert.Equal(t, 3, report.ByType["render_job"].Submitted)
+	assert.Equal(t, 1, report.ByType["echo_task"].Submitted)
+	assert.Equal(t, 3, report.ByTag["gpu"].Submitted)
+
+	sq.Tag = "gpu"
+	sq.Bucket = database.STATS_BUCKET_DAY
+	report, err = database.GetTaskStatsReport(ctx, DB, sq)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, report.Totals.Submitted)
+	assert.NotContains(t, report.ByType, "echo_task")
+
+	// Nothing outside the range
+	report, err = database.GetTaskStatsReport(ctx, DB, &database.TaskStatsQuery{From: now - 7200, To: now - 3600, Bucket: database.STATS_BUCKET_HOUR})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, report.Totals.Submitted)
+}
+
+func TestTaskPages(t *testing.T) {
+	ctx := context.Background()
+	DB, closefn := NewTestDB()
+	defer closefn()
+
+	// 7 tasks, one second apart, started in the opposite order to their creation
+	now := time.Now()
+	var created []objectid.ObjectId
+	for i := 0; i < 7; i++ {
+		ts := now.Add(time.Duration(i-7) * time.Second)
+		task := &tasks.Task{
+			Id:            objectid.NewObjectIdWithTime(ts),
+			CreatedTs:     ts.Unix(),
+			StartedTs:     now.Unix() - int64(i),
+			LastUpdatedTs: now.Unix(),
+			State:         "RUNNING",
+		}
+		assert.NoError(t, DB.SaveTask(ctx, task))
+		created = append(created, task.Id)
+	}
+
+	// Read every page of a listing
+	readAll := func(sortBy string, reverse bool, countAll bool) ([]objectid.ObjectId, []int) {
+		var ids []objectid.ObjectId
+		var totals []int
+		var cursor *database.TaskCursor
+		for page := 0; page < 10; page++ {
+			tc := database.TaskSearchConf{
+				Limit:       3,
+				Sort:        sortBy,
+				ReverseSort: reverse,
+				Cursor:      cursor,
+				CountAll:    countAll,
+				SmallestId:  objectid.NewObjectIdWithTime(time.Unix(0, 0)),
+				LargestId:   objectid.NewObjectIdWithTime(time.Unix(database.FAR_FUTURE_SECONDS, 0)),
+			}
+			p, err := database.GetTaskPage(ctx, DB, &tc)
+			assert.NoError(t, err)
+			for _, task := range p.Items {
+				ids = append(ids, task.Id)
+			}
+			totals = append(totals, p.Total)
+			if p.NextCursor == "" {
+				break
+			}
+			cursor, err = database.DecodeTaskCursor(p.NextCursor)
+			assert.NoError(t, err)
+		}
+		return ids, totals
+	}
+
+	reversed := make([]objectid.ObjectId, len(created))
+	for i, id := range created {
+		reversed[len(created)-1-i] = id
+	}
+
+	// Created order, both ways, with and without totals
+	ids, totals := readAll(database.SORT_CREATED, false, true)
+	assert.Equal(t, created, ids)
+	assert.Equal(t, []int{7, 7, 7}, totals)
+	ids, totals = readAll(database.SORT_CREATED, true, false)
+	assert.Equal(t, reversed, ids)
+	assert.Equal(t, []int{-1, -1, -1}, totals)
+
+	// Started order is the reverse of creation, so later tasks have run longer
+	ids, _ = readAll(database.SORT_STARTED, false, false)
+	assert.Equal(t, reversed, ids)
+	ids, _ = readAll(database.SORT_DURATION, true, false)
+	assert.Equal(t, reversed, ids)
+
+	// Updated times are all equal, so the id breaks ties
+	ids, _ = readAll(database.SORT_UPDATED, false, true)
+	assert.Equal(t, created, ids)
+
+	// Tasks added after the first page don't shift later pages
+	tc := database.TaskSearchConf{
+		Limit:      3,
+		SmallestId: objectid.NewObjectIdWithTime(time.Unix(0, 0)),
+		LargestId:  objectid.NewObjectIdWithTime(time.Unix(database.FAR_FUTURE_SECONDS, 0)),
+	}
+	first, err := database.GetTaskPage(ctx, DB, &tc)
+	assert.NoError(t, err)
+	early := &tasks.Task{Id: objectid.NewObjectIdWithTime(now.Add(-time.Hour)), State: "WAITING"}
+	assert.NoError(t, DB.SaveTask(ctx, early))
+	tc.Cursor, err = database.DecodeTaskCursor(first.NextCursor)
+	assert.NoError(t, err)
+	second, err := database.GetTaskPage(ctx, DB, &tc)
+	assert.NoError(t, err)
+	if assert.Len(t, second.Items, 3) {
+		assert.Equal(t, created[3], second.Items[0].Id)
+	}
+
+	_, err = database.DecodeTaskCursor("not-a-cursor")
+	assert.Error(t, err)
+}
+
 /*
 func TestTasks(t *testing.T) {
 	DB, closefn := NewTestDB()
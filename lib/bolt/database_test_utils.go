@@ -3,6 +3,7 @@ package bolt
 import (
 	"fmt"
 	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/lib/queue"
 	bolt "go.etcd.io/bbolt"
 	"io/ioutil"
 	"os"
@@ -10,6 +11,22 @@ import (
 )
 
 func NewTestDB() (database.BlanketDB, func()) {
+	db := openTestBoltDB()
+	DB := NewBlanketBoltDB(db)
+	return DB, func() {
+		db.Close()
+	}
+}
+
+// A database and a queue sharing one file, as under `blanket serve`
+func NewTestBackend() (database.BlanketDB, queue.BlanketQueue, func()) {
+	db := openTestBoltDB()
+	return NewBlanketBoltDB(db), NewBlanketBoltQueue(db), func() {
+		db.Close()
+	}
+}
+
+func openTestBoltDB() *bolt.DB {
 	// Retrieve a temporary path.
 	f, err := ioutil.TempFile("", "")
 	if err != nil {
@@ -24,9 +41,5 @@ func NewTestDB() (database.BlanketDB, func()) {
 	if err != nil {
 		panic(fmt.Sprintf("open: %s", err))
 	}
-
-	DB := NewBlanketBoltDB(db)
-	return DB, func() {
-		db.Close()
-	}
+	return db
 }
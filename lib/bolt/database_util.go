@@ -2,6 +2,7 @@ package bolt
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	log "github.com/sirupsen/logrus"
@@ -9,6 +10,7 @@ import (
 	"github.com/turtlemonvh/blanket/lib/database"
 	"github.com/turtlemonvh/blanket/lib/objectid"
 	"github.com/turtlemonvh/blanket/tasks"
+	"github.com/turtlemonvh/blanket/worker"
 	bolt "go.etcd.io/bbolt"
 	"time"
 )
@@ -19,10 +21,27 @@ func MakeBucketDNEError(bucketName string) BucketDNEError {
 	return fmt.Errorf("Database format error: Bucket '%s' does not exist.", bucketName)
 }
 
+// Path of the bolt file; `database` used to be the path itself, and still can be
+func DatabasePath() string {
+	if path, ok := viper.Get("database").(string); ok {
+		return path
+	}
+	return viper.GetString("database.path")
+}
+
 // https://blog.golang.org/error-handling-and-go
 func MustOpenBoltDatabase() *bolt.DB {
-	path := viper.GetString("database")
-	db, err := bolt.Open(path, 0666, &bolt.Options{Timeout: 1 * time.Second})
+	return mustOpenBoltDatabase(false)
+}
+
+// For reading the file without changing it, as `blanket export --direct` does
+func MustOpenBoltDatabaseReadOnly() *bolt.DB {
+	return mustOpenBoltDatabase(true)
+}
+
+func mustOpenBoltDatabase(readOnly bool) *bolt.DB {
+	path := DatabasePath()
+	db, err := bolt.Open(path, 0666, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: readOnly})
 	if err != nil {
 		// bbolt returns a bare "timeout" error when another process holds
 		// the file lock. Surface an actionable hint instead.
@@ -34,6 +53,23 @@ func MustOpenBoltDatabase() *bolt.DB {
 	return db
 }
 
+// Run f in a read transaction, unless ctx is already done
+func viewContext(ctx context.Context, db *bolt.DB, f func(tx *bolt.Tx) error) error {
+	if err := database.CheckContext(ctx); err != nil {
+		return err
+	}
+	return db.View(f)
+}
+
+// Run f in a write transaction, unless ctx is already done
+// Bolt can't abandon a write once it has started; scans inside f can still give up, which rolls it back
+func updateContext(ctx context.Context, db *bolt.DB, f func(tx *bolt.Tx) error) error {
+	if err := database.CheckContext(ctx); err != nil {
+		return err
+	}
+	return db.Update(f)
+}
+
 // WORKERS
 
 // Get a single worler in a transaction
@@ -71,126 +107,106 @@ func fetchTaskFromBucket(taskId *objectid.ObjectId, b *bolt.Bucket) (t tasks.Tas
 }
 
 // Returns a list of tasks, the number found, and any error
+// The count stops at the limit unless tc.CountAll is set
+// Sorting by creation walks the bucket in key order from the cursor; other sorts read every match and sort in memory
 // FIXME: Move FindTasksInBoltDB and ModifyTaskInBoltTransaction to their own helper library
-// FIXME: Return task objects in a slice instead of a string; may actually want to send on a channel for streaming
-func FindTasksInBoltDB(db *bolt.DB, bucketName string, tc *database.TaskSearchConf) ([]tasks.Task, int, error) {
-	var err error
-
-	result := []tasks.Task{}
-	nfound := 0
-	err = db.View(func(tx *bolt.Tx) error {
+// Gives up with a database.CanceledError if ctx is done during the scan
+func FindTasksInBoltDB(ctx context.Context, db *bolt.DB, bucketName string, tc *database.TaskSearchConf) ([]tasks.Task, int, error) {
+	var result []tasks.Task
+	var nfound int
+	err := viewContext(ctx, db, func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(bucketName))
 		if b == nil {
 			return MakeBucketDNEError(bucketName)
 		}
+		var err error
+		result, nfound, err = findTasksInBucket(ctx, b, tc)
+		return err
+	})
+	return result, nfound, err
+}
 
-		c := b.Cursor()
-
-		// Sort order
-		var (
-			checkFunction func(bts []byte) bool
-			k             []byte
-			v             []byte
-			iterFunction  func() ([]byte, []byte)
-			endBytes      []byte
-		)
-		if tc.ReverseSort {
-			// Have to just jump to the end, since seeking to a far future key goes to the end
-			// Seek only goes in 1 order
-			// Seek manually to the highest value
-			for k, v = c.Last(); k != nil && bytes.Compare(k, IdBytes(tc.LargestId)) >= 0; k, v = c.Prev() {
-				continue
-			}
-			iterFunction = c.Prev
-			endBytes = IdBytes(tc.SmallestId)
-			checkFunction = func(bts []byte) bool {
-				return k != nil && bytes.Compare(k, endBytes) >= 0
-			}
-		} else {
-			// Normal case
-			k, v = c.Seek(IdBytes(tc.SmallestId))
-			iterFunction = c.Next
-			endBytes = IdBytes(tc.LargestId)
-			checkFunction = func(bts []byte) bool {
-				return k != nil && bytes.Compare(k, endBytes) <= 0
-			}
-		}
-
-		for ; checkFunction(k); k, v = iterFunction() {
-			// e.g. 50-40 == 10
-			if nfound-tc.Offset == tc.Limit {
-				break
-			}
-
-			// Create an object from bytes
-			t := tasks.Task{}
-			json.Unmarshal(v, &t)
-
-			// Filter results
-			if tc.JustUnclaimed && !t.WorkerId.IsZero() {
-				continue
-			}
-
-			if len(tc.AllowedTaskTypes) != 0 && !tc.AllowedTaskTypes[t.TypeId] {
-				continue
-			}
-			if len(tc.AllowedTaskStates) != 0 && !tc.AllowedTaskStates[t.State] {
-				continue
-			}
-
-			// All tags in tc.requiredTags must be present on every task
-			if len(tc.RequiredTags) > 0 {
-				hasTags := true
-				for _, requestedTag := range tc.RequiredTags {
-					found := false
-					for _, existingTag := range t.Tags {
-						if requestedTag == existingTag {
-							found = true
-						}
-					}
-					if !found {
-						hasTags = false
-						break
-					}
-				}
-				if !hasTags {
-					continue
-				}
-			}
-
-			// All tags on each task must be present in tc.maxTags
-			if len(tc.MaxTags) > 0 {
-				taskHasExtraTags := false
-				for _, existingTag := range t.Tags {
-					found := false
-					for _, allowedTag := range tc.MaxTags {
-						if allowedTag == existingTag {
-							found = true
-						}
-					}
-					if !found {
-						taskHasExtraTags = true
-						break
-					}
-				}
-				if taskHasExtraTags {
-					continue
-				}
-			}
-
-			// Keep track of found items, and build string that will be returned
-			nfound += 1
-			if nfound > tc.Offset {
-				if !tc.JustCounts {
-					result = append(result, t)
-				}
-			}
+// Like FindTasksInBoltDB, within a transaction the caller already has open
+func findTasksInBucket(ctx context.Context, b *bolt.Bucket, tc *database.TaskSearchConf) ([]tasks.Task, int, error) {
+	result := []tasks.Task{}
+	nfound := 0
+	byId := tc.Sort == "" || tc.Sort == database.SORT_CREATED
+
+	c := b.Cursor()
+
+	// Where to start; when counting everything the walk covers the whole id range,
+	// and tasks up to the cursor are counted but not returned
+	smallest, largest := IdBytes(tc.SmallestId), IdBytes(tc.LargestId)
+	seekToCursor := byId && tc.Cursor != nil && !tc.CountAll
+	if seekToCursor {
+		if tc.ReverseSort && bytes.Compare(IdBytes(tc.Cursor.Id), largest) < 0 {
+			largest = IdBytes(tc.Cursor.Id)
+		} else if !tc.ReverseSort && bytes.Compare(IdBytes(tc.Cursor.Id), smallest) > 0 {
+			smallest = IdBytes(tc.Cursor.Id)
 		}
+	}
 
-		return nil
-	})
+	// Sort order
+	var (
+		k, v         []byte
+		iterFunction func() ([]byte, []byte)
+		inRange      func() bool
+	)
+	if tc.ReverseSort {
+		k, v = c.Seek(largest)
+		if k == nil {
+			k, v = c.Last()
+		}
+		for k != nil && bytes.Compare(k, largest) > 0 {
+			k, v = c.Prev()
+		}
+		iterFunction = c.Prev
+		inRange = func() bool {
+			return k != nil && bytes.Compare(k, smallest) >= 0
+		}
+	} else {
+		k, v = c.Seek(smallest)
+		iterFunction = c.Next
+		inRange = func() bool {
+			return k != nil && bytes.Compare(k, largest) <= 0
+		}
+	}
 
-	return result, nfound, err
+	matched := []tasks.Task{}
+	skipped := 0
+	for ; inRange(); k, v = iterFunction() {
+		if byId && nfound-skipped-tc.Offset == tc.Limit && !tc.CountAll {
+			break
+		}
+		if err := database.CheckContext(ctx); err != nil {
+			return nil, 0, err
+		}
+
+		// Create an object from bytes
+		t := tasks.Task{}
+		json.Unmarshal(v, &t)
+		if !tc.Matches(&t) {
+			continue
+		}
+		nfound += 1
+
+		if !byId {
+			matched = append(matched, t)
+			continue
+		}
+		if tc.Cursor != nil && !tc.Cursor.Precedes(&t) {
+			skipped += 1
+			continue
+		}
+		if n := nfound - skipped; n > tc.Offset && n-tc.Offset <= tc.Limit && !tc.JustCounts {
+			result = append(result, t)
+		}
+	}
+
+	if !byId && !tc.JustCounts {
+		result = database.SortAndPageTasks(matched, tc)
+	}
+	return result, nfound, nil
 }
 
 func saveTaskToBucket(t *tasks.Task, b *bolt.Bucket) (err error) {
@@ -201,8 +217,8 @@ func saveTaskToBucket(t *tasks.Task, b *bolt.Bucket) (err error) {
 	return b.Put(IdBytes(t.Id), bts)
 }
 
-func ModifyTaskInBoltTransaction(db *bolt.DB, taskId *objectid.ObjectId, f func(t *tasks.Task) error) error {
-	err := db.Update(func(tx *bolt.Tx) error {
+func ModifyTaskInBoltTransaction(ctx context.Context, db *bolt.DB, taskId *objectid.ObjectId, f func(t *tasks.Task) error) error {
+	err := updateContext(ctx, db, func(tx *bolt.Tx) error {
 		bucket, err := fetchTaskBucket(tx)
 		if err != nil {
 			return err
@@ -213,14 +229,69 @@ func ModifyTaskInBoltTransaction(db *bolt.DB, taskId *objectid.ObjectId, f func(
 		}
 
 		// Main function; accepts a task object and can perform checks and modify it
+		old := t
 		err = f(&t)
 		if err != nil {
 			return err
 		} else {
 			t.LastUpdatedTs = time.Now().Unix()
+			t.Revision++
 		}
 
-		return saveTaskToBucket(&t, bucket)
+		if err = saveTaskToBucket(&t, bucket); err != nil {
+			return err
+		}
+		if err = recordTaskStatsInTransaction(tx, &old, &t, t.LastUpdatedTs); err != nil {
+			return err
+		}
+		if err = countTaskStateInTransaction(tx, old.State, t.State); err != nil {
+			return err
+		}
+		if err = queueTaskDeliveriesInTransaction(tx, &old, &t); err != nil {
+			return err
+		}
+		return appendEventInTransaction(tx, database.EVENT_TASK_UPDATED, t.Id, old.State, t.State)
 	})
 	return err
 }
+
+func saveWorkerToBucket(w *worker.WorkerConf, b *bolt.Bucket) error {
+	bts, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	return b.Put(IdBytes(w.Id), bts)
+}
+
+// Like ModifyTaskInBoltTransaction, for workers; returns the worker as saved
+// Only changes of state are logged, so heartbeats don't flood the event log
+func modifyWorkerInBoltTransaction(ctx context.Context, db *bolt.DB, workerId objectid.ObjectId, f func(w *worker.WorkerConf) error) (worker.WorkerConf, error) {
+	var w worker.WorkerConf
+	err := updateContext(ctx, db, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BOLTDB_WORKER_BUCKET))
+		if b == nil {
+			return MakeBucketDNEError(BOLTDB_WORKER_BUCKET)
+		}
+		bts := b.Get(IdBytes(workerId))
+		if bts == nil {
+			return database.ItemNotFoundError(workerId.Hex())
+		}
+		if err := json.Unmarshal(bts, &w); err != nil {
+			return err
+		}
+
+		oldState := database.WorkerState(&w)
+		if err := f(&w); err != nil {
+			return err
+		}
+		w.Revision++
+		if err := saveWorkerToBucket(&w, b); err != nil {
+			return err
+		}
+		if newState := database.WorkerState(&w); newState != oldState {
+			return appendEventInTransaction(tx, database.EVENT_WORKER_UPDATED, w.Id, oldState, newState)
+		}
+		return nil
+	})
+	return w, err
+}
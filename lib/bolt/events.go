@@ -0,0 +1,118 @@
+package bolt
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+const (
+	// Keyed by the big-endian sequence number so a cursor reads events in order
+	BOLTDB_EVENT_BUCKET = "events"
+)
+
+func seqBytes(seq uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+	return b
+}
+
+// Add an event to the log as part of the transaction making the change
+// The log is trimmed by age in TrimEvents
+func appendEventInTransaction(tx *bolt.Tx, eventType string, entityId objectid.ObjectId, oldState string, newState string) error {
+	b := tx.Bucket([]byte(BOLTDB_EVENT_BUCKET))
+	if b == nil {
+		return MakeBucketDNEError(BOLTDB_EVENT_BUCKET)
+	}
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	js, err := json.Marshal(database.Event{
+		Seq:      seq,
+		Ts:       time.Now().Unix(),
+		Type:     eventType,
+		EntityId: entityId,
+		OldState: oldState,
+		NewState: newState,
+	})
+	if err != nil {
+		return err
+	}
+	return b.Put(seqBytes(seq), js)
+}
+
+// Events with a sequence number greater than since, oldest first
+func (DB *BlanketBoltDB) GetEvents(ctx context.Context, since uint64, limit int) ([]database.Event, error) {
+	result := []database.Event{}
+	err := viewContext(ctx, DB.db, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BOLTDB_EVENT_BUCKET))
+		if b == nil {
+			return MakeBucketDNEError(BOLTDB_EVENT_BUCKET)
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(seqBytes(since + 1)); k != nil && len(result) < limit; k, v = c.Next() {
+			e := database.Event{}
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			result = append(result, e)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// The sequence number of the oldest event kept, or of the next event if the log is empty
+func (DB *BlanketBoltDB) FirstEventSeq(ctx context.Context) (uint64, error) {
+	var first uint64
+	err := viewContext(ctx, DB.db, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BOLTDB_EVENT_BUCKET))
+		if b == nil {
+			return MakeBucketDNEError(BOLTDB_EVENT_BUCKET)
+		}
+		first = b.Sequence() + 1
+		if k, _ := b.Cursor().First(); k != nil {
+			first = binary.BigEndian.Uint64(k)
+		}
+		return nil
+	})
+	return first, err
+}
+
+// Remove events from before the unix time before; returns how many were removed
+// Events are appended in time order, so this stops at the first one it keeps
+// Deleting doesn't reset the bucket's sequence, so numbering carries on from the last event
+func (DB *BlanketBoltDB) TrimEvents(ctx context.Context, before int64) (int, error) {
+	n := 0
+	err := updateContext(ctx, DB.db, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BOLTDB_EVENT_BUCKET))
+		if b == nil {
+			return MakeBucketDNEError(BOLTDB_EVENT_BUCKET)
+		}
+		var expired [][]byte
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			e := database.Event{}
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if e.Ts >= before {
+				break
+			}
+			expired = append(expired, append([]byte{}, k...))
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(expired)
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,144 @@
+package bolt
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/tasks"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"time"
+)
+
+// Buckets written by an export, in order, with the kind of their records
+var exportBuckets = []struct {
+	kind   string
+	bucket string
+}{
+	{database.EXPORT_WORKER, BOLTDB_WORKER_BUCKET},
+	{database.EXPORT_TASK, BOLTDB_TASK_BUCKET},
+	{database.EXPORT_QUEUE, BOLTDB_TASK_QUEUE_BUCKET},
+	{database.EXPORT_WEBHOOK, BOLTDB_WEBHOOK_BUCKET},
+}
+
+// Buckets emptied by an import in replace mode
+var replacedBuckets = []string{
+	BOLTDB_WORKER_BUCKET,
+	BOLTDB_TASK_BUCKET,
+	BOLTDB_TASK_QUEUE_BUCKET,
+	BOLTDB_WEBHOOK_BUCKET,
+	BOLTDB_TASK_STATS_BUCKET,
+	BOLTDB_TASK_STATE_COUNTS_BUCKET,
+}
+
+// Write every worker, task, queue entry and webhook from a single read transaction
+// Queue entries are only found if the queue shares the database file, as it does under `blanket serve`
+func (DB *BlanketBoltDB) Export(ctx context.Context, w io.Writer) error {
+	return viewContext(ctx, DB.db, func(tx *bolt.Tx) error {
+		enc := json.NewEncoder(w)
+
+		header, err := json.Marshal(database.ExportHeader{
+			Version:    database.EXPORT_FORMAT_VERSION,
+			ExportedTs: time.Now().Unix(),
+		})
+		if err != nil {
+			return err
+		}
+		if err = enc.Encode(database.ExportRecord{Kind: database.EXPORT_HEADER, Data: header}); err != nil {
+			return err
+		}
+
+		for _, eb := range exportBuckets {
+			b := tx.Bucket([]byte(eb.bucket))
+			if b == nil {
+				continue
+			}
+			err = b.ForEach(func(k, v []byte) error {
+				if err := database.CheckContext(ctx); err != nil {
+					return err
+				}
+				return enc.Encode(database.ExportRecord{Kind: eb.kind, Data: v})
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Load an export in a single write transaction
+// Every record is decoded and checked before anything is written
+func (DB *BlanketBoltDB) Import(ctx context.Context, r io.Reader, opts database.ImportOptions) (database.ImportReport, error) {
+	items, err := database.DecodeExport(r, opts)
+	if err != nil {
+		return database.NewImportReport(opts), err
+	}
+
+	var report database.ImportReport
+	err = updateContext(ctx, DB.db, func(tx *bolt.Tx) error {
+		if opts.Mode == database.IMPORT_REPLACE {
+			for _, bucketName := range replacedBuckets {
+				if tx.Bucket([]byte(bucketName)) != nil {
+					if err := tx.DeleteBucket([]byte(bucketName)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		target := &boltImportTarget{tx: tx, buckets: make(map[string]*bolt.Bucket)}
+		if target.stats, err = tx.CreateBucketIfNotExists([]byte(BOLTDB_TASK_STATS_BUCKET)); err != nil {
+			return err
+		}
+		if _, err = tx.CreateBucketIfNotExists([]byte(BOLTDB_TASK_STATE_COUNTS_BUCKET)); err != nil {
+			return err
+		}
+		for _, eb := range exportBuckets {
+			b, err := tx.CreateBucketIfNotExists([]byte(eb.bucket))
+			if err != nil {
+				return err
+			}
+			target.buckets[eb.kind] = b
+		}
+
+		report, err = database.ImportItems(items, opts, target)
+		return err
+	})
+	return report, err
+}
+
+// The buckets of an import transaction, by export kind
+type boltImportTarget struct {
+	tx      *bolt.Tx
+	buckets map[string]*bolt.Bucket
+	stats   *bolt.Bucket
+}
+
+func (target *boltImportTarget) Has(kind string, id objectid.ObjectId) bool {
+	return target.buckets[kind].Get(IdBytes(id)) != nil
+}
+
+func (target *boltImportTarget) Put(kind string, id objectid.ObjectId, value interface{}) error {
+	bts, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if err = target.buckets[kind].Put(IdBytes(id), bts); err != nil {
+		return err
+	}
+
+	// Statistics aren't exported, so count imported tasks from their history
+	// Imports only add tasks, so each one is new to the state counts
+	if t, ok := value.(*tasks.Task); ok && kind == database.EXPORT_TASK {
+		if err = countTaskStateInTransaction(target.tx, "", t.State); err != nil {
+			return err
+		}
+		for _, ch := range database.TaskStatsChangesFromHistory(t) {
+			if err = applyTaskStatsChange(target.stats, t, ch); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package bolt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/tasks"
+	bolt "go.etcd.io/bbolt"
+	"strconv"
+)
+
+/*
+
+Records are stored as the JSON of Go structs, so a change to those structs can leave older files behind.
+The schema version in the meta bucket says which of the migrations below a file has had.
+
+Migrations run in order, in one transaction, when the server starts. Each must be safe to run again, and
+works on the stored JSON rather than the current structs so it keeps working as they change.
+Add new steps to the end of `Migrations`; never edit or reorder ones that have shipped.
+
+*/
+
+const (
+	BOLTDB_META_BUCKET = "meta"
+	SCHEMA_VERSION_KEY = "schemaVersion"
+)
+
+// A step from version Version-1 to Version
+type Migration struct {
+	Version     int
+	Description string
+	// Returns the number of records changed, or read to build new ones
+	Migrate func(tx *bolt.Tx) (int, error)
+}
+
+var Migrations = []Migration{
+	{1, "Fill in createdTs from the id on tasks and queue entries stored without it", migrateCreatedTs},
+	{2, "Build task statistics from the history of stored tasks", migrateTaskStats},
+	{3, "Count stored tasks by state", migrateTaskStateCounts},
+}
+
+// The schema version written by this build
+var SchemaVersion = Migrations[len(Migrations)-1].Version
+
+type MigrationStep struct {
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+	Changed     int    `json:"changed"` // records rewritten, or read to build new ones
+}
+
+// What a migration did, or would do in a dry run
+type MigrationReport struct {
+	FromVersion int             `json:"fromVersion"`
+	ToVersion   int             `json:"toVersion"`
+	DryRun      bool            `json:"dryRun"`
+	Steps       []MigrationStep `json:"steps"`
+}
+
+var errMigrationDryRun = errors.New("dry run")
+
+// Bring the file up to SchemaVersion
+// New files are stamped with the current version; files from a newer build are refused
+// A dry run makes every change and then rolls them back
+func MigrateBoltDatabase(db *bolt.DB, dryRun bool) (MigrationReport, error) {
+	report := MigrationReport{ToVersion: SchemaVersion, DryRun: dryRun, Steps: []MigrationStep{}}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists([]byte(BOLTDB_META_BUCKET))
+		if err != nil {
+			return err
+		}
+
+		if report.FromVersion, err = schemaVersionInTransaction(tx); err != nil {
+			return err
+		}
+		if report.FromVersion > SchemaVersion {
+			return newerSchemaError(report.FromVersion)
+		}
+
+		for _, m := range Migrations {
+			if m.Version <= report.FromVersion {
+				continue
+			}
+			changed, err := m.Migrate(tx)
+			if err != nil {
+				return fmt.Errorf("Migration %d (%s) failed :: %s", m.Version, m.Description, err.Error())
+			}
+			report.Steps = append(report.Steps, MigrationStep{m.Version, m.Description, changed})
+		}
+
+		if err = meta.Put([]byte(SCHEMA_VERSION_KEY), []byte(strconv.Itoa(SchemaVersion))); err != nil {
+			return err
+		}
+		if dryRun {
+			return errMigrationDryRun
+		}
+		return nil
+	})
+	if err == errMigrationDryRun {
+		err = nil
+	}
+	if err == nil && !dryRun && len(report.Steps) > 0 {
+		log.WithFields(log.Fields{
+			"fromVersion": report.FromVersion,
+			"toVersion":   report.ToVersion,
+			"steps":       len(report.Steps),
+		}).Info("Migrated database schema")
+	}
+	return report, err
+}
+
+// The schema version of the file; 0 for files from before versions were recorded
+func schemaVersionInTransaction(tx *bolt.Tx) (int, error) {
+	if meta := tx.Bucket([]byte(BOLTDB_META_BUCKET)); meta != nil {
+		if v := meta.Get([]byte(SCHEMA_VERSION_KEY)); v != nil {
+			version, err := strconv.Atoi(string(v))
+			if err != nil {
+				return 0, fmt.Errorf("Invalid schema version '%s' :: %s", v, err.Error())
+			}
+			return version, nil
+		}
+	}
+	if tx.Bucket([]byte(BOLTDB_TASK_BUCKET)) == nil {
+		// Nothing stored yet
+		return SchemaVersion, nil
+	}
+	return 0, nil
+}
+
+func newerSchemaError(version int) error {
+	return fmt.Errorf("Database schema version %d is newer than the %d this build supports; upgrade blanket to use it", version, SchemaVersion)
+}
+
+// Fail unless the file is at SchemaVersion; for reading a file without migrating it
+func CheckSchemaVersion(db *bolt.DB) error {
+	return db.View(func(tx *bolt.Tx) error {
+		version, err := schemaVersionInTransaction(tx)
+		if err != nil {
+			return err
+		}
+		if version > SchemaVersion {
+			return newerSchemaError(version)
+		}
+		if version < SchemaVersion {
+			return fmt.Errorf("Database schema version %d is older than the %d this build reads; run 'blanket db migrate' first", version, SchemaVersion)
+		}
+		return nil
+	})
+}
+
+// Run migrations, exiting if they fail
+func MustMigrateBoltDatabase(db *bolt.DB) {
+	if _, err := MigrateBoltDatabase(db, false); err != nil {
+		log.Fatalf("could not migrate bolt database %q: %v", db.Path(), err)
+	}
+}
+
+// Apply fn to each record of the named buckets that exist, saving the ones it changes
+// Fields fn doesn't touch keep their stored values, so fields unknown to this build survive
+func rewriteRecords(tx *bolt.Tx, bucketNames []string, fn func(rec map[string]json.RawMessage) (bool, error)) (int, error) {
+	changed := 0
+	for _, bucketName := range bucketNames {
+		b := tx.Bucket([]byte(bucketName))
+		if b == nil {
+			continue
+		}
+
+		updates := make(map[string][]byte)
+		err := b.ForEach(func(k, v []byte) error {
+			rec := make(map[string]json.RawMessage)
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return fmt.Errorf("Record %s in bucket '%s' :: %s", k, bucketName, err.Error())
+			}
+			isChanged, err := fn(rec)
+			if err != nil || !isChanged {
+				return err
+			}
+			bts, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			updates[string(k)] = bts
+			return nil
+		})
+		if err != nil {
+			return changed, err
+		}
+
+		// Buckets can't be changed while iterating over them
+		for k, v := range updates {
+			if err = b.Put([]byte(k), v); err != nil {
+				return changed, err
+			}
+		}
+		changed += len(updates)
+	}
+	return changed, nil
+}
+
+func migrateCreatedTs(tx *bolt.Tx) (int, error) {
+	return rewriteRecords(tx, []string{BOLTDB_TASK_BUCKET, BOLTDB_TASK_QUEUE_BUCKET}, func(rec map[string]json.RawMessage) (bool, error) {
+		var createdTs int64
+		if raw, ok := rec["createdTs"]; ok {
+			json.Unmarshal(raw, &createdTs)
+		}
+		if createdTs != 0 {
+			return false, nil
+		}
+
+		var id objectid.ObjectId
+		if err := json.Unmarshal(rec["id"], &id); err != nil || id.IsZero() {
+			return false, nil
+		}
+		rec["createdTs"] = json.RawMessage(strconv.FormatInt(id.Timestamp().Unix(), 10))
+		return true, nil
+	})
+}
+
+func migrateTaskStats(tx *bolt.Tx) (int, error) {
+	// Rebuilt from scratch so running it again doesn't count tasks twice
+	if tx.Bucket([]byte(BOLTDB_TASK_STATS_BUCKET)) != nil {
+		if err := tx.DeleteBucket([]byte(BOLTDB_TASK_STATS_BUCKET)); err != nil {
+			return 0, err
+		}
+	}
+	stats, err := tx.CreateBucket([]byte(BOLTDB_TASK_STATS_BUCKET))
+	if err != nil {
+		return 0, err
+	}
+	b := tx.Bucket([]byte(BOLTDB_TASK_BUCKET))
+	if b == nil {
+		return 0, nil
+	}
+
+	// Just the fields statistics need, as stored
+	var stored struct {
+		TypeId    string                 `json:"type"`
+		Tags      []string               `json:"tags"`
+		CreatedTs int64                  `json:"createdTs"`
+		StartedTs int64                  `json:"startedTs"`
+		History   []tasks.TaskTransition `json:"history"`
+	}
+	counted := 0
+	err = b.ForEach(func(k, v []byte) error {
+		stored.Tags, stored.History = nil, nil
+		if err := json.Unmarshal(v, &stored); err != nil {
+			return fmt.Errorf("Record %s in bucket '%s' :: %s", k, BOLTDB_TASK_BUCKET, err.Error())
+		}
+		t := &tasks.Task{
+			TypeId:    stored.TypeId,
+			Tags:      stored.Tags,
+			CreatedTs: stored.CreatedTs,
+			StartedTs: stored.StartedTs,
+			History:   stored.History,
+		}
+		for _, ch := range database.TaskStatsChangesFromHistory(t) {
+			if err := applyTaskStatsChange(stats, t, ch); err != nil {
+				return err
+			}
+		}
+		counted++
+		return nil
+	})
+	return counted, err
+}
+
+func migrateTaskStateCounts(tx *bolt.Tx) (int, error) {
+	// Rebuilt from scratch, like the statistics
+	if tx.Bucket([]byte(BOLTDB_TASK_STATE_COUNTS_BUCKET)) != nil {
+		if err := tx.DeleteBucket([]byte(BOLTDB_TASK_STATE_COUNTS_BUCKET)); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := tx.CreateBucket([]byte(BOLTDB_TASK_STATE_COUNTS_BUCKET)); err != nil {
+		return 0, err
+	}
+	b := tx.Bucket([]byte(BOLTDB_TASK_BUCKET))
+	if b == nil {
+		return 0, nil
+	}
+
+	var stored struct {
+		State string `json:"state"`
+	}
+	counted := 0
+	err := b.ForEach(func(k, v []byte) error {
+		stored.State = ""
+		if err := json.Unmarshal(v, &stored); err != nil {
+			return fmt.Errorf("Record %s in bucket '%s' :: %s", k, BOLTDB_TASK_BUCKET, err.Error())
+		}
+		counted++
+		return countTaskStateInTransaction(tx, "", stored.State)
+	})
+	return counted, err
+}
@@ -0,0 +1,156 @@
+package bolt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/tasks"
+	bolt "go.etcd.io/bbolt"
+)
+
+func openTestBoltFile(t *testing.T) *bolt.DB {
+	t.Helper()
+	path := fmt.Sprintf("%s/blanket.db", t.TempDir())
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	assert.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func storedSchemaVersion(db *bolt.DB) (version string) {
+	db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(BOLTDB_META_BUCKET)); b != nil {
+			version = string(b.Get([]byte(SCHEMA_VERSION_KEY)))
+		}
+		return nil
+	})
+	return
+}
+
+func TestMigrations(t *testing.T) {
+	// New files start at the current version
+	fresh := openTestBoltFile(t)
+	report, err := MigrateBoltDatabase(fresh, false)
+	assert.NoError(t, err)
+	assert.Equal(t, SchemaVersion, report.FromVersion)
+	assert.Empty(t, report.Steps)
+	assert.Equal(t, fmt.Sprint(SchemaVersion), storedSchemaVersion(fresh))
+
+	// A file written before schema versions, with a task missing createdTs, no statistics and no state counts
+	db := openTestBoltFile(t)
+	id := objectid.NewObjectId()
+	created := id.Timestamp().Unix()
+	db.Update(func(tx *bolt.Tx) error {
+		b, _ := tx.CreateBucketIfNotExists([]byte(BOLTDB_TASK_BUCKET))
+		return b.Put(IdBytes(id), []byte(fmt.Sprintf(`{"id": %q, "type": "echo", "state": "SUCCESS", "startedTs": %d, "oldField": 1, "history": [
+			{"ts": %d, "oldState": "", "newState": "WAITING"},
+			{"ts": %d, "oldState": "WAITING", "newState": "CLAIMED"},
+			{"ts": %d, "oldState": "CLAIMED", "newState": "RUNNING"},
+			{"ts": %d, "oldState": "RUNNING", "newState": "SUCCESS"}]}`, id.Hex(), created+5, created, created+5, created+5, created+65)))
+	})
+
+	report, err = MigrateBoltDatabase(db, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, report.FromVersion)
+	assert.Equal(t, []MigrationStep{{1, Migrations[0].Description, 1}, {2, Migrations[1].Description, 1}, {3, Migrations[2].Description, 1}}, report.Steps)
+	assert.Equal(t, "", storedSchemaVersion(db))
+
+	report, err = MigrateBoltDatabase(db, false)
+	assert.NoError(t, err)
+	assert.Len(t, report.Steps, 3)
+	assert.Equal(t, fmt.Sprint(SchemaVersion), storedSchemaVersion(db))
+
+	records, err := NewBlanketBoltDB(db).GetTaskStats(context.Background(), 0, created+3600)
+	assert.NoError(t, err)
+	var counts database.TaskStatsCounts
+	for _, rec := range records {
+		assert.Equal(t, "echo", rec.Type)
+		counts.Merge(&rec.Counts)
+	}
+	assert.Equal(t, 1, counts.Submitted)
+	assert.Equal(t, 1, counts.Claimed)
+	assert.Equal(t, map[string]int{"SUCCESS": 1}, counts.Finished)
+	assert.Equal(t, int64(5), counts.Wait.Sum)
+	assert.Equal(t, int64(60), counts.Duration.Sum)
+
+	byState, err := NewBlanketBoltDB(db).CountTasksByState(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"SUCCESS": 1}, byState)
+
+	var raw map[string]interface{}
+	var task tasks.Task
+	db.View(func(tx *bolt.Tx) error {
+		bts := tx.Bucket([]byte(BOLTDB_TASK_BUCKET)).Get(IdBytes(id))
+		json.Unmarshal(bts, &raw)
+		return json.Unmarshal(bts, &task)
+	})
+	assert.Equal(t, id.Timestamp().Unix(), task.CreatedTs)
+	assert.Equal(t, float64(1), raw["oldField"])
+
+	// Already up to date
+	report, err = MigrateBoltDatabase(db, false)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Steps)
+
+	// Written by a newer build
+	db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(BOLTDB_META_BUCKET)).Put([]byte(SCHEMA_VERSION_KEY), []byte(fmt.Sprint(SchemaVersion+1)))
+	})
+	_, err = MigrateBoltDatabase(db, false)
+	assert.Error(t, err)
+}
+
+func TestCheckSchemaVersion(t *testing.T) {
+	db := openTestBoltFile(t)
+	assert.NoError(t, CheckSchemaVersion(db))
+
+	// Tasks but no version: older, and left as it is
+	id := objectid.NewObjectId()
+	db.Update(func(tx *bolt.Tx) error {
+		b, _ := tx.CreateBucketIfNotExists([]byte(BOLTDB_TASK_BUCKET))
+		return b.Put(IdBytes(id), []byte(fmt.Sprintf(`{"id": %q, "type": "echo", "state": "SUCCESS"}`, id.Hex())))
+	})
+	err := CheckSchemaVersion(db)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "older")
+	}
+	assert.Equal(t, "", storedSchemaVersion(db))
+
+	_, err = MigrateBoltDatabase(db, false)
+	assert.NoError(t, err)
+	assert.NoError(t, CheckSchemaVersion(db))
+
+	db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(BOLTDB_META_BUCKET)).Put([]byte(SCHEMA_VERSION_KEY), []byte(fmt.Sprint(SchemaVersion+1)))
+	})
+	err = CheckSchemaVersion(db)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "newer")
+	}
+}
+
+func TestExport_ReadOnly(t *testing.T) {
+	db := openTestBoltFile(t)
+	_, err := MigrateBoltDatabase(db, false)
+	assert.NoError(t, err)
+	task := tasks.Task{Id: objectid.NewObjectId(), TypeId: "echo", State: "WAITING"}
+	assert.NoError(t, NewBlanketBoltDB(db).SaveTask(context.Background(), &task))
+	path := db.Path()
+	assert.NoError(t, db.Close())
+
+	ro, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	assert.NoError(t, err)
+	defer ro.Close()
+	assert.NoError(t, CheckSchemaVersion(ro))
+
+	var out strings.Builder
+	assert.NoError(t, NewBlanketBoltDB(ro).(database.Exporter).Export(context.Background(), &out))
+	assert.Contains(t, out.String(), task.Id.Hex())
+}
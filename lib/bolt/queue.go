@@ -1,6 +1,7 @@
 package bolt
 
 import (
+	"context"
 	"encoding/json"
 	"github.com/turtlemonvh/blanket/lib/database"
 	"github.com/turtlemonvh/blanket/lib/objectid"
@@ -24,6 +25,7 @@ func NewBlanketBoltQueue(db *bolt.DB) queue.BlanketQueue {
 
 		requiredBuckets := []string{
 			BOLTDB_TASK_QUEUE_BUCKET,
+			BOLTDB_SETTINGS_BUCKET,
 		}
 
 		for _, bucketName := range requiredBuckets {
@@ -56,8 +58,8 @@ func fetchTaskQueueBucket(tx *bolt.Tx) (b *bolt.Bucket, err error) {
 
 // Should add to the relevant queue(s) based on tags
 // Searching for a string of tags may be more complex on some platforms (e.g. rabbitmq; may require scanning)
-func (Q *BlanketBoltQueue) AddTask(t *tasks.Task) error {
-	return Q.db.Update(func(tx *bolt.Tx) error {
+func (Q *BlanketBoltQueue) AddTask(ctx context.Context, t *tasks.Task) error {
+	return updateContext(ctx, Q.db, func(tx *bolt.Tx) error {
 		b, err := fetchTaskQueueBucket(tx)
 		if b == nil {
 			return err
@@ -70,25 +72,77 @@ func (Q *BlanketBoltQueue) AddTask(t *tasks.Task) error {
 	})
 }
 
+// Change the tags on a queued task so the right workers can claim it
+// Tasks no longer in the queue are left alone; tasks already handed to a worker return queue.ErrTaskClaimed
+func (Q *BlanketBoltQueue) UpdateTaskTags(ctx context.Context, taskId objectid.ObjectId, tags []string) error {
+	return updateContext(ctx, Q.db, func(tx *bolt.Tx) error {
+		b, err := fetchTaskQueueBucket(tx)
+		if b == nil {
+			return err
+		}
+		bts := b.Get(IdBytes(taskId))
+		if bts == nil {
+			return nil
+		}
+
+		var t tasks.Task
+		if err = json.Unmarshal(bts, &t); err != nil {
+			return err
+		}
+		if t.WorkerId != *new(objectid.ObjectId) {
+			return queue.ErrTaskClaimed
+		}
+		t.Tags = tags
+
+		bts, err = json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		return b.Put(IdBytes(taskId), bts)
+	})
+}
+
 // Optional function that is called by a background daemon to move tasks that were supposed to be handled by a worker
 // but also are still in the queue (i.e. ack or nack function never got called)
 // - In rabbitmq and other queues this is handled for you with a configurable ttl on ack requests
 // - In mongo, postgres, bolt, claims are made by setting the workerId field
 // When cleaning up unacked, check if the task is in the database >state CLAIMED; if so, maybe just ack failed and we don't want to re-run and duplicate
-func (Q *BlanketBoltQueue) CleanupUnclaimedTasks() error {
+func (Q *BlanketBoltQueue) CleanupUnclaimedTasks(ctx context.Context) error {
 	// FIXME: Implement me
 	// Find all tasks in queue with a worker id that have a lastModifiedTs older than the TTL
 	// Set the WorkerId of those tasks back to ObjectId{} to allow them to get processed
 	return nil
 }
 
+// Queued tasks not yet handed to a worker, by task type
+func (Q *BlanketBoltQueue) CountTasks(ctx context.Context) (map[string]int, error) {
+	counts := make(map[string]int)
+	err := viewContext(ctx, Q.db, func(tx *bolt.Tx) error {
+		b, err := fetchTaskQueueBucket(tx)
+		if b == nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var t tasks.Task
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			if t.WorkerId == *new(objectid.ObjectId) {
+				counts[t.TypeId]++
+			}
+			return nil
+		})
+	})
+	return counts, err
+}
+
 // Claim a task in the queue; return functions to confirm or deny claim
 // Implementers can choose to make the ack and nack functions no-ops, with the side effect of less safety
 // Implementers can make the calculation of weights for tasks more complex
 // FIXME: Store with est. :: (completion time) = (time added) + (max time) / (task weight)
 // - this will make queuing of tasks more fair
 // See: https://www.rabbitmq.com/confirms.html
-func (Q *BlanketBoltQueue) ClaimTask(worker *worker.WorkerConf) (tasks.Task, func() error, func() error, error) {
+func (Q *BlanketBoltQueue) ClaimTask(ctx context.Context, worker *worker.WorkerConf) (tasks.Task, func() error, func() error, error) {
 	var task tasks.Task
 	var ackCallback func() error
 	var nackCallback func() error
@@ -103,28 +157,38 @@ func (Q *BlanketBoltQueue) ClaimTask(worker *worker.WorkerConf) (tasks.Task, fun
 		SmallestId:    objectid.NewObjectIdWithTime(time.Unix(0, 0)),
 		LargestId:     objectid.NewObjectIdWithTime(time.Unix(database.FAR_FUTURE_SECONDS, 0)),
 	}
-	ts, _, err := FindTasksInBoltDB(Q.db, BOLTDB_TASK_QUEUE_BUCKET, tc)
-	if err != nil {
-		return task, ackCallback, nackCallback, err
-	}
 
-	// No eligible task for this worker — normal steady state when the queue
-	// is drained or no queued task matches the worker's tags.
-	if len(ts) != 1 {
+	if worker.Draining {
 		return tasks.Task{}, ackCallback, nackCallback, queue.ErrQueueEmpty
 	}
-	task = ts[0]
 
-	// Mark task as claimed by this worker, and mark with last modified time
+	// Find the task and mark it as claimed by this worker in one transaction, so no other worker can take it in between
 	// Cleanup task will handle these markers hanging around in the database
-	err = Q.db.Update(func(tx *bolt.Tx) error {
+	err = updateContext(ctx, Q.db, func(tx *bolt.Tx) error {
 		b, err := fetchTaskQueueBucket(tx)
 		if b == nil {
 			return err
 		}
 
-		// Fetch task in queue; unmarshall over whatever already exists in this object
-		err = json.Unmarshal(b.Get(IdBytes(task.Id)), &task)
+		// Checked in the same transaction, so no claim gets through once the pause is saved
+		pause, err := queuePauseInTransaction(tx)
+		if err != nil {
+			return err
+		}
+		if pause.Paused {
+			return queue.ErrQueuePaused
+		}
+
+		// No eligible task for this worker — normal steady state when the queue
+		// is drained or no queued task matches the worker's tags.
+		ts, _, err := findTasksInBucket(ctx, b, tc)
+		if err != nil {
+			return err
+		}
+		if len(ts) != 1 {
+			return queue.ErrQueueEmpty
+		}
+		task = ts[0]
 
 		// Modify
 		task.LastUpdatedTs = time.Now().Unix()
@@ -137,6 +201,9 @@ func (Q *BlanketBoltQueue) ClaimTask(worker *worker.WorkerConf) (tasks.Task, fun
 		}
 		return b.Put(IdBytes(task.Id), bts)
 	})
+	if err != nil {
+		return tasks.Task{}, ackCallback, nackCallback, err
+	}
 
 	ackCallback = func() error {
 		// A function they can call after successfully claiming a task; ack
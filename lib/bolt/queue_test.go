@@ -1,8 +1,11 @@
 package bolt
 
 import (
+	"context"
 	"github.com/stretchr/testify/assert"
+	"github.com/turtlemonvh/blanket/lib/objectid"
 	"github.com/turtlemonvh/blanket/tasks"
+	"github.com/turtlemonvh/blanket/worker"
 	"testing"
 )
 
@@ -20,3 +23,23 @@ func TestSaveRetrieve(t *testing.T) {
 	assert.Equal(t, nfound, 0)
 	assert.Equal(t, err, nil)
 }
+
+func TestCountTasks(t *testing.T) {
+	ctx := context.Background()
+	Q, closefn := NewTestQueue()
+	defer closefn()
+
+	for _, typeId := range []string{"echo_task", "echo_task", "render_job"} {
+		assert.NoError(t, Q.AddTask(ctx, &tasks.Task{Id: objectid.NewObjectId(), TypeId: typeId}))
+	}
+	counts, err := Q.CountTasks(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"echo_task": 2, "render_job": 1}, counts)
+
+	// Claimed tasks aren't waiting any more, even before they are acked
+	_, _, _, err = Q.ClaimTask(ctx, &worker.WorkerConf{Id: objectid.NewObjectId()})
+	assert.NoError(t, err)
+	counts, err = Q.CountTasks(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, counts["echo_task"]+counts["render_job"])
+}
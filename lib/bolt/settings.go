@@ -0,0 +1,55 @@
+package bolt
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/turtlemonvh/blanket/lib/database"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// Server-wide settings, one record per key; not part of exports
+	BOLTDB_SETTINGS_BUCKET = "settings"
+	QUEUE_PAUSE_KEY        = "queuePause"
+)
+
+// Whether claims are paused; a file that was never paused isn't
+func (DB *BlanketBoltDB) GetQueuePause(ctx context.Context) (database.QueuePause, error) {
+	p := database.QueuePause{}
+	err := viewContext(ctx, DB.db, func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(BOLTDB_SETTINGS_BUCKET)) == nil {
+			return MakeBucketDNEError(BOLTDB_SETTINGS_BUCKET)
+		}
+		var err error
+		p, err = queuePauseInTransaction(tx)
+		return err
+	})
+	return p, err
+}
+
+// Like GetQueuePause, within a transaction the caller already has open
+func queuePauseInTransaction(tx *bolt.Tx) (database.QueuePause, error) {
+	p := database.QueuePause{}
+	b := tx.Bucket([]byte(BOLTDB_SETTINGS_BUCKET))
+	if b == nil {
+		return p, nil
+	}
+	if v := b.Get([]byte(QUEUE_PAUSE_KEY)); v != nil {
+		return p, json.Unmarshal(v, &p)
+	}
+	return p, nil
+}
+
+func (DB *BlanketBoltDB) SaveQueuePause(ctx context.Context, p *database.QueuePause) error {
+	return updateContext(ctx, DB.db, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BOLTDB_SETTINGS_BUCKET))
+		if b == nil {
+			return MakeBucketDNEError(BOLTDB_SETTINGS_BUCKET)
+		}
+		js, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(QUEUE_PAUSE_KEY), js)
+	})
+}
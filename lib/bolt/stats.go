@@ -0,0 +1,126 @@
+package bolt
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/tasks"
+	bolt "go.etcd.io/bbolt"
+	"strconv"
+)
+
+const (
+	// Keyed by the big-endian start of the hour, then the task type, so a cursor reads hours in order
+	BOLTDB_TASK_STATS_BUCKET = "task_stats"
+	// Number of stored tasks in each state, kept as tasks are written so counting doesn't read them
+	BOLTDB_TASK_STATE_COUNTS_BUCKET = "task_state_counts"
+)
+
+func taskStatsKey(hourTs int64, typeId string) []byte {
+	k := make([]byte, 8, 8+len(typeId))
+	binary.BigEndian.PutUint64(k, uint64(hourTs))
+	return append(k, typeId...)
+}
+
+// Count a change to a task as part of the transaction making it; old is nil for new tasks
+func recordTaskStatsInTransaction(tx *bolt.Tx, old *tasks.Task, t *tasks.Task, now int64) error {
+	ch, ok := database.NewTaskStatsChange(old, t, now)
+	if !ok {
+		return nil
+	}
+	b := tx.Bucket([]byte(BOLTDB_TASK_STATS_BUCKET))
+	if b == nil {
+		return MakeBucketDNEError(BOLTDB_TASK_STATS_BUCKET)
+	}
+	return applyTaskStatsChange(b, t, ch)
+}
+
+func applyTaskStatsChange(b *bolt.Bucket, t *tasks.Task, ch database.TaskStatsChange) error {
+	hourTs := database.TaskStatsHour(ch.Ts)
+	k := taskStatsKey(hourTs, t.TypeId)
+	rec := database.TaskStatsRecord{HourTs: hourTs, Type: t.TypeId}
+	if v := b.Get(k); v != nil {
+		if err := json.Unmarshal(v, &rec); err != nil {
+			return err
+		}
+	}
+	rec.Apply(t, ch)
+	js, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return b.Put(k, js)
+}
+
+// Records for every hour from fromHour up to to, oldest first
+func (DB *BlanketBoltDB) GetTaskStats(ctx context.Context, fromHour int64, to int64) ([]database.TaskStatsRecord, error) {
+	result := []database.TaskStatsRecord{}
+	err := viewContext(ctx, DB.db, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BOLTDB_TASK_STATS_BUCKET))
+		if b == nil {
+			return MakeBucketDNEError(BOLTDB_TASK_STATS_BUCKET)
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(taskStatsKey(fromHour, "")); k != nil && int64(binary.BigEndian.Uint64(k[:8])) < to; k, v = c.Next() {
+			rec := database.TaskStatsRecord{}
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			result = append(result, rec)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// Move a task from oldState to newState in the counts; "" is no state, for new and deleted tasks
+func countTaskStateInTransaction(tx *bolt.Tx, oldState string, newState string) error {
+	if oldState == newState {
+		return nil
+	}
+	b := tx.Bucket([]byte(BOLTDB_TASK_STATE_COUNTS_BUCKET))
+	if b == nil {
+		return MakeBucketDNEError(BOLTDB_TASK_STATE_COUNTS_BUCKET)
+	}
+	for state, delta := range map[string]int{oldState: -1, newState: 1} {
+		if state == "" {
+			continue
+		}
+		n := delta
+		if v := b.Get([]byte(state)); v != nil {
+			stored, err := strconv.Atoi(string(v))
+			if err != nil {
+				return fmt.Errorf("Invalid count '%s' for state '%s' :: %s", v, state, err.Error())
+			}
+			n += stored
+		}
+		if err := b.Put([]byte(state), []byte(strconv.Itoa(n))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Number of stored tasks in each state that has any
+func (DB *BlanketBoltDB) CountTasksByState(ctx context.Context) (map[string]int, error) {
+	result := make(map[string]int)
+	err := viewContext(ctx, DB.db, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BOLTDB_TASK_STATE_COUNTS_BUCKET))
+		if b == nil {
+			return MakeBucketDNEError(BOLTDB_TASK_STATE_COUNTS_BUCKET)
+		}
+		return b.ForEach(func(k, v []byte) error {
+			n, err := strconv.Atoi(string(v))
+			if err != nil {
+				return fmt.Errorf("Invalid count '%s' for state '%s' :: %s", v, k, err.Error())
+			}
+			if n != 0 {
+				result[string(k)] = n
+			}
+			return nil
+		})
+	})
+	return result, err
+}
@@ -0,0 +1,206 @@
+package bolt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/lib/webhooks"
+	"github.com/turtlemonvh/blanket/tasks"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	BOLTDB_WEBHOOK_BUCKET  = "webhooks"
+	BOLTDB_DELIVERY_BUCKET = "webhook_deliveries"
+	// Ids of deliveries still waiting to be sent, so the dispatcher doesn't scan the full history
+	BOLTDB_OUTBOX_BUCKET = "webhook_outbox"
+)
+
+// WEBHOOKS
+
+func (DB *BlanketBoltDB) GetWebhooks(ctx context.Context) ([]webhooks.Webhook, error) {
+	result := []webhooks.Webhook{}
+	err := viewContext(ctx, DB.db, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BOLTDB_WEBHOOK_BUCKET))
+		if b == nil {
+			return MakeBucketDNEError(BOLTDB_WEBHOOK_BUCKET)
+		}
+		return b.ForEach(func(k, v []byte) error {
+			w := webhooks.Webhook{}
+			if err := json.Unmarshal(v, &w); err != nil {
+				return err
+			}
+			result = append(result, w)
+			return nil
+		})
+	})
+	return result, err
+}
+
+func (DB *BlanketBoltDB) GetWebhook(ctx context.Context, webhookId objectid.ObjectId) (webhooks.Webhook, error) {
+	w := webhooks.Webhook{}
+	err := viewContext(ctx, DB.db, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BOLTDB_WEBHOOK_BUCKET))
+		if b == nil {
+			return MakeBucketDNEError(BOLTDB_WEBHOOK_BUCKET)
+		}
+		result := b.Get(IdBytes(webhookId))
+		if result == nil {
+			return database.ItemNotFoundError(fmt.Sprintf("No item for id %v", webhookId))
+		}
+		return json.Unmarshal(result, &w)
+	})
+	return w, err
+}
+
+func (DB *BlanketBoltDB) SaveWebhook(ctx context.Context, w *webhooks.Webhook) error {
+	return updateContext(ctx, DB.db, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BOLTDB_WEBHOOK_BUCKET))
+		if b == nil {
+			return MakeBucketDNEError(BOLTDB_WEBHOOK_BUCKET)
+		}
+		js, err := json.Marshal(w)
+		if err != nil {
+			return err
+		}
+		return b.Put(IdBytes(w.Id), js)
+	})
+}
+
+// Delivery history is kept after the webhook is removed
+func (DB *BlanketBoltDB) DeleteWebhook(ctx context.Context, webhookId objectid.ObjectId) error {
+	return updateContext(ctx, DB.db, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BOLTDB_WEBHOOK_BUCKET))
+		if b == nil {
+			return MakeBucketDNEError(BOLTDB_WEBHOOK_BUCKET)
+		}
+		if b.Get(IdBytes(webhookId)) == nil {
+			return database.ItemNotFoundError(fmt.Sprintf("No item for id %v", webhookId))
+		}
+		return b.Delete(IdBytes(webhookId))
+	})
+}
+
+// DELIVERIES
+
+// Save a delivery, adding it to or removing it from the outbox depending on its state
+func (DB *BlanketBoltDB) SaveWebhookDelivery(ctx context.Context, d *webhooks.Delivery) error {
+	return updateContext(ctx, DB.db, func(tx *bolt.Tx) error {
+		return saveDeliveryInTransaction(tx, d)
+	})
+}
+
+func saveDeliveryInTransaction(tx *bolt.Tx, d *webhooks.Delivery) error {
+	b := tx.Bucket([]byte(BOLTDB_DELIVERY_BUCKET))
+	if b == nil {
+		return MakeBucketDNEError(BOLTDB_DELIVERY_BUCKET)
+	}
+	outbox := tx.Bucket([]byte(BOLTDB_OUTBOX_BUCKET))
+	if outbox == nil {
+		return MakeBucketDNEError(BOLTDB_OUTBOX_BUCKET)
+	}
+	js, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	if err := b.Put(IdBytes(d.Id), js); err != nil {
+		return err
+	}
+	if d.State == webhooks.DELIVERY_PENDING {
+		return outbox.Put(IdBytes(d.Id), []byte{})
+	}
+	return outbox.Delete(IdBytes(d.Id))
+}
+
+// Queue webhook deliveries for a change to a task as part of the transaction making it; old is nil for new tasks
+// A crash can't lose a delivery for a change that was saved, and the payload is the task as it was changed
+func queueTaskDeliveriesInTransaction(tx *bolt.Tx, old *tasks.Task, t *tasks.Task) error {
+	name := webhooks.TaskEventName(old, t)
+	if name == "" {
+		return nil
+	}
+	b := tx.Bucket([]byte(BOLTDB_WEBHOOK_BUCKET))
+	if b == nil {
+		return MakeBucketDNEError(BOLTDB_WEBHOOK_BUCKET)
+	}
+	hooks := webhooks.ConfigWebhooks()
+	err := b.ForEach(func(k, v []byte) error {
+		w := webhooks.Webhook{}
+		if err := json.Unmarshal(v, &w); err != nil {
+			return err
+		}
+		hooks = append(hooks, w)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ds, err := webhooks.TaskDeliveries(hooks, name, t)
+	if err != nil {
+		return err
+	}
+	for i := range ds {
+		if err := saveDeliveryInTransaction(tx, &ds[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Most recent deliveries for a webhook, newest first
+func (DB *BlanketBoltDB) GetWebhookDeliveries(ctx context.Context, webhookId objectid.ObjectId, limit int) ([]webhooks.Delivery, error) {
+	result := []webhooks.Delivery{}
+	err := viewContext(ctx, DB.db, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BOLTDB_DELIVERY_BUCKET))
+		if b == nil {
+			return MakeBucketDNEError(BOLTDB_DELIVERY_BUCKET)
+		}
+		// FIXME: Scans the full history; index by webhook if this gets slow
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil && len(result) < limit; k, v = c.Prev() {
+			d := webhooks.Delivery{}
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			if d.WebhookId == webhookId {
+				result = append(result, d)
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+// Pending deliveries whose next attempt is due at or before now (unix seconds), oldest first
+func (DB *BlanketBoltDB) GetDueWebhookDeliveries(ctx context.Context, now int64, limit int) ([]webhooks.Delivery, error) {
+	result := []webhooks.Delivery{}
+	err := viewContext(ctx, DB.db, func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BOLTDB_DELIVERY_BUCKET))
+		if b == nil {
+			return MakeBucketDNEError(BOLTDB_DELIVERY_BUCKET)
+		}
+		outbox := tx.Bucket([]byte(BOLTDB_OUTBOX_BUCKET))
+		if outbox == nil {
+			return MakeBucketDNEError(BOLTDB_OUTBOX_BUCKET)
+		}
+		c := outbox.Cursor()
+		for k, _ := c.First(); k != nil && len(result) < limit; k, _ = c.Next() {
+			v := b.Get(k)
+			if v == nil {
+				continue
+			}
+			d := webhooks.Delivery{}
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			if d.NextAttemptTs <= now {
+				result = append(result, d)
+			}
+		}
+		return nil
+	})
+	return result, err
+}
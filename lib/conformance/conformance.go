@@ -0,0 +1,176 @@
+/*
+
+Tests every backend has to pass
+
+- A backend runs these from its own tests, with constructors for empty databases and queues:
+
+	func TestConformance(t *testing.T) {
+		conformance.RunDatabaseTests(t, NewTestDB)
+		conformance.RunQueueTests(t, NewTestQueue)
+		conformance.RunExportTests(t, NewTestBackend)
+		conformance.RunBackendTests(t, NewTestBackend)
+	}
+
+- Export and backend tests need a database and queue sharing storage, the way `blanket serve` runs them;
+  export tests also need a database that implements database.Exporter
+- Each subtest gets a fresh backend, so they don't depend on each other
+- They describe the contract in lib/database and lib/queue; anything they don't check (like the order tasks
+  are claimed in) is up to the backend
+
+*/
+
+package conformance
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/lib/queue"
+	"github.com/turtlemonvh/blanket/tasks"
+)
+
+// Makes an empty database; the returned function releases it
+type NewDatabaseFunc func() (database.BlanketDB, func())
+
+// Makes an empty queue; the returned function releases it
+type NewQueueFunc func() (queue.BlanketQueue, func())
+
+// Makes an empty database and a queue sharing its storage; the returned function releases both
+type NewBackendFunc func() (database.BlanketDB, queue.BlanketQueue, func())
+
+// Run every database test as a subtest of t
+func RunDatabaseTests(t *testing.T, newDB NewDatabaseFunc) {
+	for _, test := range []struct {
+		name string
+		f    func(t *testing.T, DB database.BlanketDB)
+	}{
+		{"Workers", testWorkers},
+		{"WorkerRevisions", testWorkerRevisions},
+		{"Tasks", testTasks},
+		{"TaskRevisions", testTaskRevisions},
+		{"TaskNotFound", testTaskNotFound},
+		{"TaskSearch", testTaskSearch},
+		{"TaskSearchPaging", testTaskSearchPaging},
+		{"TaskTransitions", testTaskTransitions},
+		{"TaskSteps", testTaskSteps},
+		{"TaskHooks", testTaskHooks},
+		{"TaskCancel", testTaskCancel},
+		{"Webhooks", testWebhooks},
+		{"WebhookDeliveries", testWebhookDeliveries},
+		{"TaskWebhookDeliveries", testTaskWebhookDeliveries},
+		{"Events", testEvents},
+		{"EventTrimming", testEventTrimming},
+		{"TaskStats", testTaskStats},
+		{"TaskStateCounts", testTaskStateCounts},
+		{"QueuePause", testQueuePause},
+		{"Canceled", testCanceled},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			DB, closefn := newDB()
+			defer closefn()
+			test.f(t, DB)
+		})
+	}
+}
+
+// Run every queue test as a subtest of t
+func RunQueueTests(t *testing.T, newQueue NewQueueFunc) {
+	for _, test := range []struct {
+		name string
+		f    func(t *testing.T, Q queue.BlanketQueue)
+	}{
+		{"ClaimAndAck", testClaimAndAck},
+		{"Nack", testNack},
+		{"ClaimTags", testClaimTags},
+		{"UpdateTaskTags", testQueueUpdateTaskTags},
+		{"ConcurrentClaims", testConcurrentClaims},
+		{"Canceled", testQueueCanceled},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			Q, closefn := newQueue()
+			defer closefn()
+			test.f(t, Q)
+		})
+	}
+}
+
+// Run every export and import test as a subtest of t
+func RunExportTests(t *testing.T, newBackend NewBackendFunc) {
+	for _, test := range []struct {
+		name string
+		f    func(t *testing.T, newBackend NewBackendFunc)
+	}{
+		{"ExportImport", testExportImport},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.f(t, newBackend)
+		})
+	}
+}
+
+// Run every test of a database and queue working together as a subtest of t
+func RunBackendTests(t *testing.T, newBackend NewBackendFunc) {
+	for _, test := range []struct {
+		name string
+		f    func(t *testing.T, DB database.BlanketDB, Q queue.BlanketQueue)
+	}{
+		{"ClaimPauseAndDrain", testClaimPauseAndDrain},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			DB, Q, closefn := newBackend()
+			defer closefn()
+			test.f(t, DB, Q)
+		})
+	}
+}
+
+// An id created at ts; n tells apart ids made in the same second
+func idAt(ts int64, n uint32) objectid.ObjectId {
+	id := objectid.NewObjectIdWithTime(time.Unix(ts, 0))
+	binary.BigEndian.PutUint32(id[8:], n)
+	return id
+}
+
+// A WAITING task created at ts
+func newTask(ts int64, n uint32, typeId string, tags ...string) *tasks.Task {
+	return &tasks.Task{
+		Id:            idAt(ts, n),
+		TypeId:        typeId,
+		State:         "WAITING",
+		Tags:          tags,
+		CreatedTs:     ts,
+		LastUpdatedTs: ts,
+		ExecEnv:       map[string]string{},
+	}
+}
+
+// Search configuration covering every task
+func allTasks() *database.TaskSearchConf {
+	return &database.TaskSearchConf{
+		Limit:      1000,
+		SmallestId: objectid.NewObjectIdWithTime(time.Unix(0, 0)),
+		LargestId:  objectid.NewObjectIdWithTime(time.Unix(database.FAR_FUTURE_SECONDS, 0)),
+	}
+}
+
+func taskIds(ts []tasks.Task) []objectid.ObjectId {
+	ids := []objectid.ObjectId{}
+	for _, t := range ts {
+		ids = append(ids, t.Id)
+	}
+	return ids
+}
+
+func assertNotFound(t *testing.T, err error, msgAndArgs ...interface{}) {
+	assert.IsType(t, database.ItemNotFoundError(""), err, msgAndArgs...)
+}
+
+// A database.CanceledError caused by cause
+func assertCanceled(t *testing.T, err error, cause error) {
+	assert.IsType(t, database.CanceledError{}, err)
+	assert.ErrorIs(t, err, cause)
+}
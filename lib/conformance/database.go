@@ -0,0 +1,772 @@
+package conformance
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/lib/webhooks"
+	"github.com/turtlemonvh/blanket/tasks"
+	"github.com/turtlemonvh/blanket/worker"
+)
+
+// WORKERS
+
+func testWorkers(t *testing.T, DB database.BlanketDB) {
+	ctx := context.Background()
+	ws, err := DB.GetWorkers(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, ws)
+
+	w1 := &worker.WorkerConf{Id: objectid.NewObjectId(), Tags: []string{"bash", "unix"}, Pid: 10, CheckInterval: 2}
+	w2 := &worker.WorkerConf{Id: objectid.NewObjectId(), Tags: []string{"python"}}
+	assert.NoError(t, DB.UpdateWorker(ctx, w1))
+	assert.NoError(t, DB.UpdateWorker(ctx, w2))
+
+	fetched, err := DB.GetWorker(ctx, w1.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, *w1, fetched)
+	ws, err = DB.GetWorkers(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, ws, 2)
+
+	// Stop and heartbeat only change their own field
+	stopped, err := DB.StopWorker(ctx, w1.Id)
+	assert.NoError(t, err)
+	assert.True(t, stopped.Stopped)
+	assert.Equal(t, w1.Tags, stopped.Tags)
+	beat, err := DB.HeartbeatWorker(ctx, w1.Id, 12345)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(12345), beat.LastHeardTs)
+	assert.True(t, beat.Stopped)
+	fetched, err = DB.GetWorker(ctx, w1.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, beat, fetched)
+
+	// So does draining, which can be undone
+	draining, err := DB.DrainWorker(ctx, w2.Id, true)
+	assert.NoError(t, err)
+	assert.True(t, draining.Draining)
+	assert.False(t, draining.Stopped)
+	assert.Equal(t, w2.Tags, draining.Tags)
+	resumed, err := DB.DrainWorker(ctx, w2.Id, false)
+	assert.NoError(t, err)
+	assert.False(t, resumed.Draining)
+	fetched, err = DB.GetWorker(ctx, w2.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, resumed, fetched)
+	w2.Revision = resumed.Revision
+
+	missing := objectid.NewObjectId()
+	_, err = DB.GetWorker(ctx, missing)
+	assertNotFound(t, err, "GetWorker")
+	_, err = DB.StopWorker(ctx, missing)
+	assertNotFound(t, err, "StopWorker")
+	_, err = DB.DrainWorker(ctx, missing, true)
+	assertNotFound(t, err, "DrainWorker")
+	_, err = DB.HeartbeatWorker(ctx, missing, 1)
+	assertNotFound(t, err, "HeartbeatWorker")
+
+	// Deleting is idempotent
+	assert.NoError(t, DB.DeleteWorker(ctx, w1.Id))
+	assert.NoError(t, DB.DeleteWorker(ctx, w1.Id))
+	_, err = DB.GetWorker(ctx, w1.Id)
+	assertNotFound(t, err)
+	ws, err = DB.GetWorkers(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []worker.WorkerConf{*w2}, ws)
+
+	assert.NoError(t, DB.CleanupStalledWorkers(ctx))
+}
+
+func testWorkerRevisions(t *testing.T, DB database.BlanketDB) {
+	ctx := context.Background()
+	w := &worker.WorkerConf{Id: objectid.NewObjectId()}
+	assert.NoError(t, DB.UpdateWorker(ctx, w))
+	assert.Equal(t, int64(1), w.Revision)
+
+	// Writes that read the current revision go through and bump it
+	stale := *w
+	w.Pid = 5
+	assert.NoError(t, DB.UpdateWorker(ctx, w))
+	assert.Equal(t, int64(2), w.Revision)
+
+	// Writes from an older read are refused, and change nothing
+	stale.Pid = 6
+	err := DB.UpdateWorker(ctx, &stale)
+	assert.Equal(t, database.RevisionConflictError{Id: w.Id.Hex(), Expected: 1, Actual: 2}, err)
+	fetched, err := DB.GetWorker(ctx, w.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, fetched.Pid)
+
+	// Field updates bump the revision too; revision 0 overwrites whatever is there
+	fetched, err = DB.HeartbeatWorker(ctx, w.Id, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), fetched.Revision)
+	stale.Revision = 0
+	assert.NoError(t, DB.UpdateWorker(ctx, &stale))
+	assert.Equal(t, int64(4), stale.Revision)
+}
+
+// TASKS
+
+func testTasks(t *testing.T, DB database.BlanketDB) {
+	ctx := context.Background()
+	now := time.Now().Unix()
+	task := newTask(now, 1, "echo_task", "bash")
+	task.ExecEnv["NAME"] = "value"
+	assert.NoError(t, DB.SaveTask(ctx, task))
+	assert.Equal(t, int64(1), task.Revision)
+
+	fetched, err := DB.GetTask(ctx, task.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, *task, fetched)
+
+	assert.NoError(t, DB.UpdateTaskProgress(ctx, task.Id, 40))
+	assert.NoError(t, DB.UpdateTaskTags(ctx, task.Id, []string{"bash", "gpu"}))
+	fetched, err = DB.GetTask(ctx, task.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, 40, fetched.Progress)
+	assert.Equal(t, []string{"bash", "gpu"}, fetched.Tags)
+	assert.Equal(t, "value", fetched.ExecEnv["NAME"])
+	assert.Equal(t, int64(3), fetched.Revision)
+	assert.GreaterOrEqual(t, fetched.LastUpdatedTs, now)
+
+	// Deleting is idempotent
+	assert.NoError(t, DB.DeleteTask(ctx, task.Id))
+	assert.NoError(t, DB.DeleteTask(ctx, task.Id))
+	_, err = DB.GetTask(ctx, task.Id)
+	assertNotFound(t, err)
+
+	assert.NoError(t, DB.CleanupStalledTasks(ctx))
+}
+
+func testTaskRevisions(t *testing.T, DB database.BlanketDB) {
+	ctx := context.Background()
+	task := newTask(time.Now().Unix(), 1, "echo_task")
+	assert.NoError(t, DB.SaveTask(ctx, task))
+	stale := *task
+
+	task.State = "CLAIMED"
+	assert.NoError(t, DB.SaveTask(ctx, task))
+	assert.Equal(t, int64(2), task.Revision)
+
+	stale.State = "STOPPED"
+	err := DB.SaveTask(ctx, &stale)
+	assert.Equal(t, database.RevisionConflictError{Id: task.Id.Hex(), Expected: 1, Actual: 2}, err)
+	fetched, err := DB.GetTask(ctx, task.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, "CLAIMED", fetched.State)
+
+	stale.Revision = 0
+	assert.NoError(t, DB.SaveTask(ctx, &stale))
+	assert.Equal(t, int64(3), stale.Revision)
+}
+
+func testTaskNotFound(t *testing.T, DB database.BlanketDB) {
+	ctx := context.Background()
+	missing := objectid.NewObjectId()
+	exitCode := 0
+
+	_, err := DB.GetTask(ctx, missing)
+	assertNotFound(t, err, "GetTask")
+	assertNotFound(t, DB.RunTask(ctx, missing, &database.TaskRunConfig{}), "RunTask")
+	assertNotFound(t, DB.FinishTask(ctx, missing, "SUCCESS", "", "", &exitCode), "FinishTask")
+	assertNotFound(t, DB.RequestTaskCancel(ctx, missing, false, ""), "RequestTaskCancel")
+	assertNotFound(t, DB.UpdateTaskCancel(ctx, missing, "", ""), "UpdateTaskCancel")
+	assertNotFound(t, DB.UpdateTaskProgress(ctx, missing, 10), "UpdateTaskProgress")
+	assertNotFound(t, DB.UpdateTaskTags(ctx, missing, []string{}), "UpdateTaskTags")
+	assertNotFound(t, DB.UpdateTaskStep(ctx, missing, 0, "RUNNING", 0), "UpdateTaskStep")
+	assertNotFound(t, DB.UpdateTaskHook(ctx, missing, "notify", "RUNNING", 0, ""), "UpdateTaskHook")
+	_, err = DB.GetWebhook(ctx, missing)
+	assertNotFound(t, err, "GetWebhook")
+	assertNotFound(t, DB.DeleteWebhook(ctx, missing), "DeleteWebhook")
+}
+
+func testTaskSearch(t *testing.T, DB database.BlanketDB) {
+	ctx := context.Background()
+	base := time.Now().Unix() - 100
+	echo := newTask(base, 1, "echo_task", "bash")
+	gpu := newTask(base+1, 2, "train_model", "bash", "gpu")
+	done := newTask(base+2, 3, "echo_task")
+	done.State = "SUCCESS"
+	claimed := newTask(base+3, 4, "train_model", "gpu")
+	claimed.State = "CLAIMED"
+	claimed.WorkerId = objectid.NewObjectId()
+	for _, task := range []*tasks.Task{echo, gpu, done, claimed} {
+		assert.NoError(t, DB.SaveTask(ctx, task))
+	}
+
+	search := func(edit func(tc *database.TaskSearchConf)) []objectid.ObjectId {
+		tc := allTasks()
+		edit(tc)
+		ts, _, err := DB.GetTasks(ctx, tc)
+		assert.NoError(t, err)
+		return taskIds(ts)
+	}
+	ids := func(ts ...*tasks.Task) []objectid.ObjectId {
+		result := []objectid.ObjectId{}
+		for _, task := range ts {
+			result = append(result, task.Id)
+		}
+		return result
+	}
+
+	// Oldest first, unless reversed
+	assert.Equal(t, ids(echo, gpu, done, claimed), search(func(tc *database.TaskSearchConf) {}))
+	assert.Equal(t, ids(claimed, done, gpu, echo), search(func(tc *database.TaskSearchConf) { tc.ReverseSort = true }))
+
+	assert.Equal(t, ids(echo, done), search(func(tc *database.TaskSearchConf) {
+		tc.AllowedTaskTypes = map[string]bool{"echo_task": true}
+	}))
+	assert.Equal(t, ids(echo, gpu), search(func(tc *database.TaskSearchConf) {
+		tc.AllowedTaskStates = map[string]bool{"WAITING": true}
+	}))
+	// Required tags must all be on the task
+	assert.Equal(t, ids(gpu), search(func(tc *database.TaskSearchConf) { tc.RequiredTags = []string{"gpu", "bash"} }))
+	// Every tag on the task must be in the max tags
+	assert.Equal(t, ids(echo, done), search(func(tc *database.TaskSearchConf) { tc.MaxTags = []string{"bash"} }))
+	assert.Equal(t, ids(echo, gpu, done), search(func(tc *database.TaskSearchConf) { tc.JustUnclaimed = true }))
+	// Id bounds are inclusive
+	assert.Equal(t, ids(gpu, done), search(func(tc *database.TaskSearchConf) {
+		tc.SmallestId = objectid.NewObjectIdWithTime(time.Unix(base+1, 0))
+		tc.LargestId = done.Id
+	}))
+
+	q, err := database.ParseTaskQuery("type=train_model OR state=SUCCESS")
+	assert.NoError(t, err)
+	assert.Equal(t, ids(gpu, done, claimed), search(func(tc *database.TaskSearchConf) { tc.Query = q }))
+
+	// Counts without the tasks
+	tc := allTasks()
+	tc.JustCounts = true
+	tc.AllowedTaskTypes = map[string]bool{"train_model": true}
+	ts, n, err := DB.GetTasks(ctx, tc)
+	assert.NoError(t, err)
+	assert.Empty(t, ts)
+	assert.Equal(t, 2, n)
+}
+
+func testTaskSearchPaging(t *testing.T, DB database.BlanketDB) {
+	ctx := context.Background()
+	// Started in the opposite order to their creation
+	now := time.Now().Unix()
+	var created []objectid.ObjectId
+	for i := 0; i < 5; i++ {
+		task := newTask(now-10+int64(i), uint32(i), "echo_task")
+		task.State = "RUNNING"
+		task.StartedTs = now - int64(i)
+		assert.NoError(t, DB.SaveTask(ctx, task))
+		created = append(created, task.Id)
+	}
+
+	tc := allTasks()
+	tc.Limit, tc.Offset = 2, 1
+	ts, _, err := DB.GetTasks(ctx, tc)
+	assert.NoError(t, err)
+	assert.Equal(t, created[1:3], taskIds(ts))
+
+	tc = allTasks()
+	tc.Limit, tc.CountAll = 2, true
+	ts, n, err := DB.GetTasks(ctx, tc)
+	assert.NoError(t, err)
+	assert.Len(t, ts, 2)
+	assert.Equal(t, 5, n)
+
+	// Cursors carry on where the last page ended, for every sort
+	readAll := func(sortBy string, reverse bool) []objectid.ObjectId {
+		ids := []objectid.ObjectId{}
+		var cursor *database.TaskCursor
+		for page := 0; page < 10; page++ {
+			tc := allTasks()
+			tc.Limit, tc.Sort, tc.ReverseSort, tc.Cursor = 2, sortBy, reverse, cursor
+			p, err := database.GetTaskPage(ctx, DB, tc)
+			assert.NoError(t, err)
+			ids = append(ids, taskIds(p.Items)...)
+			if p.NextCursor == "" {
+				break
+			}
+			cursor, err = database.DecodeTaskCursor(p.NextCursor)
+			assert.NoError(t, err)
+		}
+		return ids
+	}
+	reversed := []objectid.ObjectId{}
+	for i := len(created) - 1; i >= 0; i-- {
+		reversed = append(reversed, created[i])
+	}
+	assert.Equal(t, created, readAll(database.SORT_CREATED, false))
+	assert.Equal(t, reversed, readAll(database.SORT_CREATED, true))
+	assert.Equal(t, reversed, readAll(database.SORT_STARTED, false))
+	assert.Equal(t, created, readAll(database.SORT_STARTED, true))
+}
+
+func testTaskTransitions(t *testing.T, DB database.BlanketDB) {
+	ctx := context.Background()
+	now := time.Now().Unix()
+	task := newTask(now, 1, "echo_task")
+	assert.NoError(t, DB.SaveTask(ctx, task))
+
+	// Only claimed tasks can start running
+	assert.Error(t, DB.RunTask(ctx, task.Id, &database.TaskRunConfig{LastUpdatedTs: now}))
+
+	task.State = "CLAIMED"
+	task.WorkerId = objectid.NewObjectId()
+	assert.NoError(t, DB.SaveTask(ctx, task))
+	assert.NoError(t, DB.RunTask(ctx, task.Id, &database.TaskRunConfig{Timeout: 60, LastUpdatedTs: now, Pid: 42, TypeDigest: "abc"}))
+	fetched, err := DB.GetTask(ctx, task.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, "RUNNING", fetched.State)
+	assert.Equal(t, int64(60), fetched.Timeout)
+	assert.Equal(t, 42, fetched.Pid)
+	assert.Equal(t, "abc", fetched.TypeDigest)
+	assert.Error(t, DB.RunTask(ctx, task.Id, &database.TaskRunConfig{LastUpdatedTs: now}))
+
+	exitCode := 0
+	assert.NoError(t, DB.FinishTask(ctx, task.Id, "SUCCESS", "", "done", &exitCode))
+	fetched, err = DB.GetTask(ctx, task.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, "SUCCESS", fetched.State)
+	assert.Equal(t, 100, fetched.Progress)
+	assert.Equal(t, &exitCode, fetched.ExitCode)
+	if assert.NotEmpty(t, fetched.History) {
+		last := fetched.History[len(fetched.History)-1]
+		assert.Equal(t, "RUNNING", last.OldState)
+		assert.Equal(t, "SUCCESS", last.NewState)
+		assert.Equal(t, tasks.WorkerActor(task.WorkerId), last.Actor)
+		assert.Equal(t, "done", last.Reason)
+	}
+
+	// Finished tasks stay finished
+	assert.Error(t, DB.FinishTask(ctx, task.Id, "ERROR", "", "", nil))
+	assert.Error(t, DB.RunTask(ctx, task.Id, &database.TaskRunConfig{LastUpdatedTs: now}))
+
+	// Tasks can be stopped before they are claimed
+	waiting := newTask(now, 2, "echo_task")
+	assert.NoError(t, DB.SaveTask(ctx, waiting))
+	assert.NoError(t, DB.FinishTask(ctx, waiting.Id, "STOPPED", tasks.ACTOR_API, "", nil))
+	fetched, err = DB.GetTask(ctx, waiting.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, "STOPPED", fetched.State)
+	assert.Nil(t, fetched.ExitCode)
+	assert.Equal(t, tasks.ACTOR_API, fetched.History[len(fetched.History)-1].Actor)
+}
+
+func testTaskSteps(t *testing.T, DB database.BlanketDB) {
+	ctx := context.Background()
+	task := newTask(time.Now().Unix(), 1, "build")
+	task.Steps = []tasks.TaskStep{{Name: "compile", State: "WAITING"}, {Name: "test", State: "WAITING"}}
+	assert.NoError(t, DB.SaveTask(ctx, task))
+
+	// Steps only change while the task runs
+	assert.Error(t, DB.UpdateTaskStep(ctx, task.Id, 0, "RUNNING", 0))
+	task.State = "RUNNING"
+	assert.NoError(t, DB.SaveTask(ctx, task))
+
+	assert.NoError(t, DB.UpdateTaskStep(ctx, task.Id, 0, "SUCCESS", 0))
+	assert.NoError(t, DB.UpdateTaskStep(ctx, task.Id, 1, "ERROR", 2))
+	assert.Error(t, DB.UpdateTaskStep(ctx, task.Id, 2, "RUNNING", 0))
+	assert.Error(t, DB.UpdateTaskStep(ctx, task.Id, 0, "BOGUS", 0))
+	fetched, err := DB.GetTask(ctx, task.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, "SUCCESS", fetched.Steps[0].State)
+	assert.Equal(t, 2, fetched.Steps[1].ExitCode)
+	assert.Equal(t, "test", fetched.FailedStep)
+	assert.Equal(t, 100, fetched.Progress)
+}
+
+func testTaskHooks(t *testing.T, DB database.BlanketDB) {
+	ctx := context.Background()
+	task := newTask(time.Now().Unix(), 1, "build")
+	task.Hooks = []tasks.TaskHook{{Name: "notify", State: "WAITING"}}
+	assert.NoError(t, DB.SaveTask(ctx, task))
+
+	// Hooks run once the task is claimed, including after it finishes
+	assert.Error(t, DB.UpdateTaskHook(ctx, task.Id, "notify", "RUNNING", 0, ""))
+	task.State = "SUCCESS"
+	assert.NoError(t, DB.SaveTask(ctx, task))
+	followUp := objectid.NewObjectId().Hex()
+	assert.NoError(t, DB.UpdateTaskHook(ctx, task.Id, "notify", "SUCCESS", 0, followUp))
+	assert.Error(t, DB.UpdateTaskHook(ctx, task.Id, "missing", "SUCCESS", 0, ""))
+	fetched, err := DB.GetTask(ctx, task.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, "SUCCESS", fetched.Hooks[0].State)
+	assert.Equal(t, followUp, fetched.Hooks[0].FollowUpTaskId)
+}
+
+func testTaskCancel(t *testing.T, DB database.BlanketDB) {
+	ctx := context.Background()
+	task := newTask(time.Now().Unix(), 1, "echo_task")
+	assert.NoError(t, DB.SaveTask(ctx, task))
+
+	// Only tasks a worker has can be asked to stop
+	assert.Error(t, DB.RequestTaskCancel(ctx, task.Id, false, ""))
+	task.State = "RUNNING"
+	task.WorkerId = objectid.NewObjectId()
+	assert.NoError(t, DB.SaveTask(ctx, task))
+	assert.Error(t, DB.UpdateTaskCancel(ctx, task.Id, "", ""))
+
+	// Later requests can add force, but not take it away
+	assert.NoError(t, DB.RequestTaskCancel(ctx, task.Id, true, "too slow"))
+	assert.NoError(t, DB.RequestTaskCancel(ctx, task.Id, false, ""))
+	fetched, err := DB.GetTask(ctx, task.Id)
+	assert.NoError(t, err)
+	if assert.NotNil(t, fetched.Cancellation) {
+		assert.True(t, fetched.Cancellation.Force)
+		assert.Equal(t, "too slow", fetched.Cancellation.Reason)
+		assert.NotZero(t, fetched.Cancellation.RequestedTs)
+		assert.Zero(t, fetched.Cancellation.AcknowledgedTs)
+	}
+
+	// Acknowledging keeps the task running; an outcome stops it
+	assert.NoError(t, DB.UpdateTaskCancel(ctx, task.Id, "", ""))
+	assert.Error(t, DB.UpdateTaskCancel(ctx, task.Id, "", "BOGUS"))
+	fetched, err = DB.GetTask(ctx, task.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, "RUNNING", fetched.State)
+	assert.NotZero(t, fetched.Cancellation.AcknowledgedTs)
+
+	assert.NoError(t, DB.UpdateTaskCancel(ctx, task.Id, "", tasks.CANCEL_KILLED))
+	fetched, err = DB.GetTask(ctx, task.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, "STOPPED", fetched.State)
+	assert.Equal(t, tasks.CANCEL_KILLED, fetched.Cancellation.Outcome)
+	assert.Equal(t, "too slow", fetched.History[len(fetched.History)-1].Reason)
+	assert.Error(t, DB.UpdateTaskCancel(ctx, task.Id, "", tasks.CANCEL_KILLED))
+}
+
+// WEBHOOKS
+
+func testWebhooks(t *testing.T, DB database.BlanketDB) {
+	ctx := context.Background()
+	hooks, err := DB.GetWebhooks(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, hooks)
+
+	w := &webhooks.Webhook{Id: objectid.NewObjectId(), URL: "http://localhost/hook", Events: []string{"task.finished"}}
+	assert.NoError(t, DB.SaveWebhook(ctx, w))
+	fetched, err := DB.GetWebhook(ctx, w.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, *w, fetched)
+
+	w.URL = "http://localhost/other"
+	assert.NoError(t, DB.SaveWebhook(ctx, w))
+	hooks, err = DB.GetWebhooks(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []webhooks.Webhook{*w}, hooks)
+
+	assert.NoError(t, DB.DeleteWebhook(ctx, w.Id))
+	assertNotFound(t, DB.DeleteWebhook(ctx, w.Id))
+	hooks, err = DB.GetWebhooks(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, hooks)
+}
+
+func testWebhookDeliveries(t *testing.T, DB database.BlanketDB) {
+	ctx := context.Background()
+	now := time.Now().Unix()
+	hookId, otherId := objectid.NewObjectId(), objectid.NewObjectId()
+	var saved []webhooks.Delivery
+	for i, nextAttempt := range []int64{now - 10, now + 60, now - 5} {
+		d := webhooks.Delivery{
+			Id:            idAt(now, uint32(i)),
+			WebhookId:     hookId,
+			Event:         "task.finished",
+			State:         webhooks.DELIVERY_PENDING,
+			CreatedTs:     now,
+			NextAttemptTs: nextAttempt,
+		}
+		assert.NoError(t, DB.SaveWebhookDelivery(ctx, &d))
+		saved = append(saved, d)
+	}
+	other := webhooks.Delivery{Id: idAt(now, 9), WebhookId: otherId, State: webhooks.DELIVERY_PENDING, NextAttemptTs: now}
+	assert.NoError(t, DB.SaveWebhookDelivery(ctx, &other))
+
+	// Due deliveries, oldest first
+	due, err := DB.GetDueWebhookDeliveries(ctx, now, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []objectid.ObjectId{saved[0].Id, saved[2].Id, other.Id}, deliveryIds(due))
+	due, err = DB.GetDueWebhookDeliveries(ctx, now, 1)
+	assert.NoError(t, err)
+	assert.Len(t, due, 1)
+
+	// Delivered ones leave the outbox but stay in the history, newest first
+	saved[0].State = webhooks.DELIVERY_DELIVERED
+	saved[0].DeliveredTs = now
+	assert.NoError(t, DB.SaveWebhookDelivery(ctx, &saved[0]))
+	due, err = DB.GetDueWebhookDeliveries(ctx, now+60, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []objectid.ObjectId{saved[1].Id, saved[2].Id, other.Id}, deliveryIds(due))
+
+	history, err := DB.GetWebhookDeliveries(ctx, hookId, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []objectid.ObjectId{saved[2].Id, saved[1].Id, saved[0].Id}, deliveryIds(history))
+	assert.Equal(t, webhooks.DELIVERY_DELIVERED, history[2].State)
+	history, err = DB.GetWebhookDeliveries(ctx, hookId, 2)
+	assert.NoError(t, err)
+	assert.Len(t, history, 2)
+}
+
+func testTaskWebhookDeliveries(t *testing.T, DB database.BlanketDB) {
+	ctx := context.Background()
+	hook := &webhooks.Webhook{Id: objectid.NewObjectId(), URL: "http://localhost/hook"}
+	assert.NoError(t, DB.SaveWebhook(ctx, hook))
+	finishedOnly := &webhooks.Webhook{Id: objectid.NewObjectId(), URL: "http://localhost/done", Events: []string{"task.finished"}}
+	assert.NoError(t, DB.SaveWebhook(ctx, finishedOnly))
+
+	// Creating and updating without a change of state queue nothing
+	task := newTask(time.Now().Unix(), 1, "echo_task")
+	assert.NoError(t, DB.SaveTask(ctx, task))
+	assert.NoError(t, DB.UpdateTaskProgress(ctx, task.Id, 10))
+	due, err := DB.GetDueWebhookDeliveries(ctx, database.FAR_FUTURE_SECONDS, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, due)
+
+	// Each transition is queued along with it, with the task as it was changed
+	task.State = "CLAIMED"
+	task.Revision = 0
+	assert.NoError(t, DB.SaveTask(ctx, task))
+	assert.NoError(t, DB.RunTask(ctx, task.Id, &database.TaskRunConfig{LastUpdatedTs: time.Now().Unix()}))
+	assert.NoError(t, DB.FinishTask(ctx, task.Id, "SUCCESS", tasks.ACTOR_API, "", nil))
+
+	due, err = DB.GetDueWebhookDeliveries(ctx, database.FAR_FUTURE_SECONDS, 10)
+	assert.NoError(t, err)
+	type sent struct{ WebhookId, Event, State string }
+	got := []sent{}
+	for _, d := range due {
+		e := webhooks.Event{}
+		assert.NoError(t, json.Unmarshal(d.Payload, &e))
+		if assert.NotNil(t, e.Task) {
+			assert.Equal(t, task.Id, e.Task.Id)
+			assert.Equal(t, d.Id, e.DeliveryId)
+			got = append(got, sent{d.WebhookId.Hex(), d.Event, e.Task.State})
+		}
+	}
+	assert.ElementsMatch(t, []sent{
+		{hook.Id.Hex(), "task.claimed", "CLAIMED"},
+		{hook.Id.Hex(), "task.running", "RUNNING"},
+		{hook.Id.Hex(), "task.finished", "SUCCESS"},
+		{finishedOnly.Id.Hex(), "task.finished", "SUCCESS"},
+	}, got)
+}
+
+func deliveryIds(ds []webhooks.Delivery) []objectid.ObjectId {
+	ids := []objectid.ObjectId{}
+	for _, d := range ds {
+		ids = append(ids, d.Id)
+	}
+	return ids
+}
+
+// EVENTS AND STATISTICS
+
+func testEvents(t *testing.T, DB database.BlanketDB) {
+	ctx := context.Background()
+	events, err := DB.GetEvents(ctx, 0, 100)
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+
+	task := newTask(time.Now().Unix(), 1, "echo_task")
+	assert.NoError(t, DB.SaveTask(ctx, task))
+	assert.NoError(t, DB.UpdateTaskProgress(ctx, task.Id, 10))
+	assert.NoError(t, DB.FinishTask(ctx, task.Id, "STOPPED", tasks.ACTOR_API, "", nil))
+	assert.NoError(t, DB.DeleteTask(ctx, task.Id))
+	w := &worker.WorkerConf{Id: objectid.NewObjectId()}
+	assert.NoError(t, DB.UpdateWorker(ctx, w))
+	_, err = DB.HeartbeatWorker(ctx, w.Id, 1) // not a change of state
+	assert.NoError(t, err)
+	_, err = DB.DrainWorker(ctx, w.Id, true)
+	assert.NoError(t, err)
+	_, err = DB.StopWorker(ctx, w.Id)
+	assert.NoError(t, err)
+	assert.NoError(t, DB.DeleteWorker(ctx, w.Id))
+
+	type change struct{ Type, EntityId, OldState, NewState string }
+	expected := []change{
+		{database.EVENT_TASK_CREATED, task.Id.Hex(), "", "WAITING"},
+		{database.EVENT_TASK_UPDATED, task.Id.Hex(), "WAITING", "WAITING"},
+		{database.EVENT_TASK_UPDATED, task.Id.Hex(), "WAITING", "STOPPED"},
+		{database.EVENT_TASK_DELETED, task.Id.Hex(), "STOPPED", ""},
+		{database.EVENT_WORKER_CREATED, w.Id.Hex(), "", "RUNNING"},
+		{database.EVENT_WORKER_UPDATED, w.Id.Hex(), "RUNNING", "DRAINING"},
+		{database.EVENT_WORKER_UPDATED, w.Id.Hex(), "DRAINING", "STOPPED"},
+		{database.EVENT_WORKER_DELETED, w.Id.Hex(), "STOPPED", ""},
+	}
+	events, err = DB.GetEvents(ctx, 0, 100)
+	assert.NoError(t, err)
+	changes := []change{}
+	for i, e := range events {
+		changes = append(changes, change{e.Type, e.EntityId.Hex(), e.OldState, e.NewState})
+		if i > 0 {
+			assert.Greater(t, e.Seq, events[i-1].Seq)
+		}
+	}
+	assert.Equal(t, expected, changes)
+
+	// Reading resumes after a sequence number
+	if len(events) == len(expected) {
+		page, err := DB.GetEvents(ctx, events[2].Seq, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, []database.Event{events[3], events[4]}, page)
+		page, err = DB.GetEvents(ctx, events[len(events)-1].Seq, 2)
+		assert.NoError(t, err)
+		assert.Empty(t, page)
+	}
+}
+
+func testEventTrimming(t *testing.T, DB database.BlanketDB) {
+	ctx := context.Background()
+	first, err := DB.FirstEventSeq(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), first)
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, DB.SaveTask(ctx, newTask(time.Now().Unix(), uint32(i), "echo_task")))
+	}
+	events, err := DB.GetEvents(ctx, 0, 100)
+	assert.NoError(t, err)
+	assert.Len(t, events, 3)
+
+	n, err := DB.TrimEvents(ctx, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	first, err = DB.FirstEventSeq(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, events[0].Seq, first)
+
+	// Numbering carries on after everything is trimmed
+	n, err = DB.TrimEvents(ctx, time.Now().Unix()+1)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	first, err = DB.FirstEventSeq(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, events[2].Seq+1, first)
+
+	assert.NoError(t, DB.SaveTask(ctx, newTask(time.Now().Unix(), 9, "echo_task")))
+	kept, err := DB.GetEvents(ctx, 0, 100)
+	assert.NoError(t, err)
+	if assert.Len(t, kept, 1) {
+		assert.Equal(t, events[2].Seq+1, kept[0].Seq)
+	}
+	kept, err = DB.GetEvents(ctx, events[0].Seq, 100)
+	assert.NoError(t, err)
+	assert.Len(t, kept, 1)
+}
+
+func testTaskStats(t *testing.T, DB database.BlanketDB) {
+	ctx := context.Background()
+	now := time.Now().Unix()
+	for i, state := range []string{"SUCCESS", "ERROR", ""} {
+		task := newTask(now-30, uint32(i), "echo_task", "bash")
+		assert.NoError(t, DB.SaveTask(ctx, task))
+		if state == "" {
+			continue
+		}
+		task.State, task.StartedTs = "CLAIMED", now-20
+		assert.NoError(t, DB.SaveTask(ctx, task))
+		assert.NoError(t, DB.RunTask(ctx, task.Id, &database.TaskRunConfig{LastUpdatedTs: now}))
+		assert.NoError(t, DB.FinishTask(ctx, task.Id, state, "", "", nil))
+	}
+
+	records, err := DB.GetTaskStats(ctx, database.TaskStatsHour(now-3600), now+1)
+	assert.NoError(t, err)
+	for _, rec := range records {
+		assert.Equal(t, database.TaskStatsHour(rec.HourTs), rec.HourTs)
+		assert.Equal(t, "echo_task", rec.Type)
+	}
+
+	report := database.SummarizeTaskStats(records, &database.TaskStatsQuery{From: now - 3600, To: now + 1, Bucket: database.STATS_BUCKET_HOUR})
+	assert.Equal(t, 3, report.Totals.Submitted)
+	assert.Equal(t, 2, report.Totals.Claimed)
+	assert.Equal(t, map[string]int{"SUCCESS": 1, "ERROR": 1}, report.Totals.Finished)
+	assert.Equal(t, int64(2), report.Totals.Duration.Count)
+	assert.Equal(t, 3, report.ByTag["bash"].Submitted)
+
+	// Nothing outside the range
+	records, err = DB.GetTaskStats(ctx, database.TaskStatsHour(now-7200), database.TaskStatsHour(now-3600))
+	assert.NoError(t, err)
+	assert.Empty(t, records)
+}
+
+func testTaskStateCounts(t *testing.T, DB database.BlanketDB) {
+	ctx := context.Background()
+	counts, err := DB.CountTasksByState(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, counts)
+
+	now := time.Now().Unix()
+	var saved []*tasks.Task
+	for i := 0; i < 3; i++ {
+		task := newTask(now, uint32(i), "echo_task", "bash")
+		assert.NoError(t, DB.SaveTask(ctx, task))
+		saved = append(saved, task)
+	}
+	saved[0].State = "CLAIMED"
+	assert.NoError(t, DB.SaveTask(ctx, saved[0]))
+	assert.NoError(t, DB.RunTask(ctx, saved[0].Id, &database.TaskRunConfig{LastUpdatedTs: now}))
+	assert.NoError(t, DB.FinishTask(ctx, saved[0].Id, "SUCCESS", "", "", nil))
+	// Changes that keep the state don't move the counts
+	assert.NoError(t, DB.UpdateTaskProgress(ctx, saved[1].Id, 50))
+	assert.NoError(t, DB.DeleteTask(ctx, saved[2].Id))
+	assert.NoError(t, DB.DeleteTask(ctx, saved[2].Id))
+
+	counts, err = DB.CountTasksByState(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"SUCCESS": 1, "WAITING": 1}, counts)
+}
+
+// SETTINGS
+
+func testQueuePause(t *testing.T, DB database.BlanketDB) {
+	ctx := context.Background()
+	p, err := DB.GetQueuePause(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, database.QueuePause{}, p)
+
+	paused := database.QueuePause{Paused: true, Reason: "upgrade", ChangedTs: 12345}
+	assert.NoError(t, DB.SaveQueuePause(ctx, &paused))
+	p, err = DB.GetQueuePause(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, paused, p)
+
+	resumed := database.QueuePause{ChangedTs: 12346}
+	assert.NoError(t, DB.SaveQueuePause(ctx, &resumed))
+	p, err = DB.GetQueuePause(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, resumed, p)
+}
+
+func testCanceled(t *testing.T, DB database.BlanketDB) {
+	task := newTask(time.Now().Unix(), 1, "echo_task")
+	assert.NoError(t, DB.SaveTask(context.Background(), task))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Reads and writes give up once the context is done, and writes change nothing
+	_, _, err := DB.GetTasks(ctx, allTasks())
+	assertCanceled(t, err, context.Canceled)
+	_, err = DB.GetTask(ctx, task.Id)
+	assertCanceled(t, err, context.Canceled)
+	assertCanceled(t, DB.UpdateTaskProgress(ctx, task.Id, 50), context.Canceled)
+	assertCanceled(t, DB.SaveTask(ctx, newTask(time.Now().Unix(), 2, "echo_task")), context.Canceled)
+	_, err = DB.GetWorkers(ctx)
+	assertCanceled(t, err, context.Canceled)
+	_, err = DB.GetQueuePause(ctx)
+	assertCanceled(t, err, context.Canceled)
+
+	ts, _, err := DB.GetTasks(context.Background(), allTasks())
+	assert.NoError(t, err)
+	if assert.Len(t, ts, 1) {
+		assert.Equal(t, 0, ts[0].Progress)
+	}
+
+	// Deadlines are told apart from cancellations
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	_, _, err = DB.GetTasks(expired, allTasks())
+	assertCanceled(t, err, context.DeadlineExceeded)
+}
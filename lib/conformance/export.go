@@ -0,0 +1,127 @@
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/lib/webhooks"
+	"github.com/turtlemonvh/blanket/tasks"
+	"github.com/turtlemonvh/blanket/worker"
+)
+
+// Records in an export, by kind
+func countExport(t *testing.T, DB database.BlanketDB) map[string]int {
+	ctx := context.Background()
+	var buf bytes.Buffer
+	assert.NoError(t, DB.(database.Exporter).Export(ctx, &buf))
+	counts := make(map[string]int)
+	dec := json.NewDecoder(&buf)
+	for {
+		var rec database.ExportRecord
+		if dec.Decode(&rec) != nil {
+			return counts
+		}
+		counts[rec.Kind]++
+	}
+}
+
+func testExportImport(t *testing.T, newBackend NewBackendFunc) {
+	ctx := context.Background()
+	src, Q, closefn := newBackend()
+	defer closefn()
+
+	w := worker.WorkerConf{Id: objectid.NewObjectId(), Tags: []string{"bash"}}
+	assert.NoError(t, src.UpdateWorker(ctx, &w))
+	first := tasks.Task{Id: objectid.NewObjectId(), TypeId: "echo", State: "SUCCESS", WorkerId: w.Id}
+	first.ResultDir = "/results/" + first.Id.Hex()
+	assert.NoError(t, src.SaveTask(ctx, &first))
+	rerun := tasks.Task{Id: objectid.NewObjectId(), TypeId: "echo", State: "WAITING", RerunOf: first.Id.Hex()}
+	assert.NoError(t, src.SaveTask(ctx, &rerun))
+	assert.NoError(t, Q.AddTask(ctx, &rerun))
+	hook := webhooks.Webhook{Id: objectid.NewObjectId(), URL: "http://example.com"}
+	assert.NoError(t, src.SaveWebhook(ctx, &hook))
+
+	var export bytes.Buffer
+	assert.NoError(t, src.(database.Exporter).Export(ctx, &export))
+	assert.True(t, strings.HasPrefix(export.String(), `{"kind":"header","data":{"version":1,`))
+	all := map[string]int{"header": 1, "worker": 1, "task": 2, "queue": 1, "webhook": 1}
+	assert.Equal(t, all, countExport(t, src))
+
+	dst, _, dstclose := newBackend()
+	defer dstclose()
+	importer := dst.(database.Exporter)
+
+	report, err := importer.Import(ctx, bytes.NewReader(export.Bytes()), database.ImportOptions{Mode: database.IMPORT_MERGE})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"worker": 1, "task": 2, "queue": 1, "webhook": 1}, report.Imported)
+	assert.Equal(t, all, countExport(t, dst))
+	fetched, err := dst.GetTask(ctx, rerun.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, rerun.RerunOf, fetched.RerunOf)
+
+	// Everything is already there
+	report, err = importer.Import(ctx, bytes.NewReader(export.Bytes()), database.ImportOptions{Mode: database.IMPORT_MERGE})
+	assert.NoError(t, err)
+	assert.Empty(t, report.Imported)
+	assert.Equal(t, map[string]int{"worker": 1, "task": 2, "queue": 1, "webhook": 1}, report.Skipped)
+
+	// Copies under new ids, with references following them
+	report, err = importer.Import(ctx, bytes.NewReader(export.Bytes()), database.ImportOptions{Mode: database.IMPORT_MERGE, RemapIds: true})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"worker": 1, "task": 2, "queue": 1, "webhook": 1}, report.Remapped)
+	assert.Equal(t, map[string]int{"header": 1, "worker": 2, "task": 4, "queue": 2, "webhook": 2}, countExport(t, dst))
+	byState, err := dst.CountTasksByState(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"SUCCESS": 2, "WAITING": 2}, byState)
+
+	ts, _, err := dst.GetTasks(ctx, &database.TaskSearchConf{
+		Limit:      10,
+		SmallestId: objectid.NewObjectIdWithTime(first.Id.Timestamp()),
+		LargestId:  objectid.NewObjectIdWithTime(first.Id.Timestamp().Add(1e12)),
+	})
+	assert.NoError(t, err)
+	assert.Len(t, ts, 4)
+	byId := make(map[string]tasks.Task)
+	for _, tsk := range ts {
+		byId[tsk.Id.Hex()] = tsk
+	}
+	for _, tsk := range ts {
+		if tsk.RerunOf == "" || tsk.Id == rerun.Id {
+			continue
+		}
+		copied := byId[tsk.RerunOf]
+		assert.NotEqual(t, first.Id, copied.Id)
+		assert.NotEqual(t, w.Id, copied.WorkerId)
+		assert.Equal(t, "/results/"+copied.Id.Hex(), copied.ResultDir)
+	}
+
+	report, err = importer.Import(ctx, bytes.NewReader(export.Bytes()), database.ImportOptions{Mode: database.IMPORT_REPLACE})
+	assert.NoError(t, err)
+	assert.Equal(t, all, countExport(t, dst))
+	byState, err = dst.CountTasksByState(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"SUCCESS": 1, "WAITING": 1}, byState)
+
+	// Bad exports change nothing
+	bad := []string{
+		"",
+		`{"kind":"task","data":{}}`,
+		`{"kind":"header","data":{"version":99}}`,
+		`{"kind":"header","data":{"version":1}}` + "\n" + `{"kind":"schedule","data":{}}`,
+		export.String() + `{"kind":"task","data":{"state":"WAITING"}}`,
+		export.String() + `{"kind":"task"`,
+	}
+	for _, b := range bad {
+		_, err = importer.Import(ctx, strings.NewReader(b), database.ImportOptions{Mode: database.IMPORT_REPLACE})
+		assert.Error(t, err, b)
+	}
+	_, err = importer.Import(ctx, bytes.NewReader(export.Bytes()), database.ImportOptions{Mode: "overwrite"})
+	assert.Error(t, err)
+	assert.Equal(t, all, countExport(t, dst))
+}
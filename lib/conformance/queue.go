@@ -0,0 +1,220 @@
+package conformance
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/lib/queue"
+	"github.com/turtlemonvh/blanket/worker"
+)
+
+func newWorker(tags ...string) *worker.WorkerConf {
+	return &worker.WorkerConf{Id: objectid.NewObjectId(), Tags: tags}
+}
+
+func testClaimAndAck(t *testing.T, Q queue.BlanketQueue) {
+	ctx := context.Background()
+	w := newWorker("bash")
+	_, _, _, err := Q.ClaimTask(ctx, w)
+	assert.Equal(t, queue.ErrQueueEmpty, err)
+	counts, err := Q.CountTasks(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, counts)
+
+	task := newTask(time.Now().Unix(), 1, "echo_task", "bash")
+	task.ExecEnv["NAME"] = "value"
+	assert.NoError(t, Q.AddTask(ctx, task))
+	assert.NoError(t, Q.AddTask(ctx, newTask(time.Now().Unix(), 2, "render_job", "bash")))
+	counts, err = Q.CountTasks(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"echo_task": 1, "render_job": 1}, counts)
+
+	claimed, ack, nack, err := Q.ClaimTask(ctx, w)
+	assert.NoError(t, err)
+	assert.NotNil(t, ack)
+	assert.NotNil(t, nack)
+	assert.Equal(t, w.Id, claimed.WorkerId)
+	if claimed.Id == task.Id {
+		assert.Equal(t, "value", claimed.ExecEnv["NAME"])
+	}
+
+	// Claimed tasks are not counted or handed out again, even before they are acked
+	counts, err = Q.CountTasks(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, counts, 1)
+	second, secondAck, _, err := Q.ClaimTask(ctx, newWorker("bash"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, claimed.Id, second.Id)
+	_, _, _, err = Q.ClaimTask(ctx, newWorker("bash"))
+	assert.Equal(t, queue.ErrQueueEmpty, err)
+
+	// Acked tasks are gone for good
+	assert.NoError(t, ack())
+	assert.NoError(t, secondAck())
+	_, _, _, err = Q.ClaimTask(ctx, w)
+	assert.Equal(t, queue.ErrQueueEmpty, err)
+	counts, err = Q.CountTasks(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, counts)
+
+	assert.NoError(t, Q.CleanupUnclaimedTasks(ctx))
+}
+
+func testNack(t *testing.T, Q queue.BlanketQueue) {
+	ctx := context.Background()
+	task := newTask(time.Now().Unix(), 1, "echo_task")
+	assert.NoError(t, Q.AddTask(ctx, task))
+
+	claimed, _, nack, err := Q.ClaimTask(ctx, newWorker())
+	assert.NoError(t, err)
+	assert.Equal(t, task.Id, claimed.Id)
+	assert.NoError(t, nack())
+
+	// Nacked tasks can be claimed by anyone again
+	other := newWorker()
+	claimed, ack, _, err := Q.ClaimTask(ctx, other)
+	assert.NoError(t, err)
+	assert.Equal(t, task.Id, claimed.Id)
+	assert.Equal(t, other.Id, claimed.WorkerId)
+	assert.NoError(t, ack())
+}
+
+func testClaimTags(t *testing.T, Q queue.BlanketQueue) {
+	ctx := context.Background()
+	gpu := newTask(time.Now().Unix(), 1, "train_model", "python", "gpu")
+	assert.NoError(t, Q.AddTask(ctx, gpu))
+
+	// Workers need every tag on the task
+	_, _, _, err := Q.ClaimTask(ctx, newWorker("python"))
+	assert.Equal(t, queue.ErrQueueEmpty, err)
+	claimed, ack, _, err := Q.ClaimTask(ctx, newWorker("python", "gpu", "bash"))
+	assert.NoError(t, err)
+	assert.Equal(t, gpu.Id, claimed.Id)
+	assert.NoError(t, ack())
+
+	// Tasks without tags go to any worker
+	assert.NoError(t, Q.AddTask(ctx, newTask(time.Now().Unix(), 2, "echo_task")))
+	_, ack, _, err = Q.ClaimTask(ctx, newWorker("python"))
+	assert.NoError(t, err)
+	assert.NoError(t, ack())
+}
+
+func testQueueUpdateTaskTags(t *testing.T, Q queue.BlanketQueue) {
+	ctx := context.Background()
+	task := newTask(time.Now().Unix(), 1, "train_model", "gpu")
+	assert.NoError(t, Q.AddTask(ctx, task))
+
+	// Tasks that aren't queued are left alone
+	assert.NoError(t, Q.UpdateTaskTags(ctx, objectid.NewObjectId(), []string{"cpu"}))
+
+	assert.NoError(t, Q.UpdateTaskTags(ctx, task.Id, []string{"cpu"}))
+	_, _, _, err := Q.ClaimTask(ctx, newWorker("gpu"))
+	assert.Equal(t, queue.ErrQueueEmpty, err)
+	claimed, _, nack, err := Q.ClaimTask(ctx, newWorker("cpu"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cpu"}, claimed.Tags)
+
+	// Too late once a worker has it
+	assert.Equal(t, queue.ErrTaskClaimed, Q.UpdateTaskTags(ctx, task.Id, []string{"gpu"}))
+	assert.NoError(t, nack())
+	assert.NoError(t, Q.UpdateTaskTags(ctx, task.Id, []string{"gpu"}))
+	claimed, _, _, err = Q.ClaimTask(ctx, newWorker("gpu"))
+	assert.NoError(t, err)
+	assert.Equal(t, task.Id, claimed.Id)
+}
+
+func testConcurrentClaims(t *testing.T, Q queue.BlanketQueue) {
+	ctx := context.Background()
+	const nTasks, nWorkers = 40, 8
+	now := time.Now().Unix()
+	for i := 0; i < nTasks; i++ {
+		assert.NoError(t, Q.AddTask(ctx, newTask(now, uint32(i), "echo_task")))
+	}
+
+	// Every task goes to exactly one worker
+	var mu sync.Mutex
+	claims := make(map[objectid.ObjectId]int)
+	var wg sync.WaitGroup
+	for i := 0; i < nWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := newWorker()
+			for {
+				task, ack, _, err := Q.ClaimTask(ctx, w)
+				if err == queue.ErrQueueEmpty {
+					return
+				}
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, w.Id, task.WorkerId)
+				mu.Lock()
+				claims[task.Id]++
+				mu.Unlock()
+				assert.NoError(t, ack())
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, claims, nTasks)
+	for id, n := range claims {
+		assert.Equal(t, 1, n, "task %s claimed %d times", id.Hex(), n)
+	}
+	counts, err := Q.CountTasks(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, counts)
+}
+
+func testQueueCanceled(t *testing.T, Q queue.BlanketQueue) {
+	task := newTask(time.Now().Unix(), 1, "echo_task")
+	assert.NoError(t, Q.AddTask(context.Background(), task))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, _, err := Q.ClaimTask(ctx, newWorker())
+	assertCanceled(t, err, context.Canceled)
+	assertCanceled(t, Q.AddTask(ctx, newTask(time.Now().Unix(), 2, "echo_task")), context.Canceled)
+	_, err = Q.CountTasks(ctx)
+	assertCanceled(t, err, context.Canceled)
+
+	// Nothing was claimed or added
+	counts, err := Q.CountTasks(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"echo_task": 1}, counts)
+}
+
+func testClaimPauseAndDrain(t *testing.T, DB database.BlanketDB, Q queue.BlanketQueue) {
+	ctx := context.Background()
+	task := newTask(time.Now().Unix(), 1, "echo_task", "bash")
+	assert.NoError(t, Q.AddTask(ctx, task))
+	w := newWorker("bash")
+
+	// Pausing in the database holds every claim, and the task stays queued
+	assert.NoError(t, DB.SaveQueuePause(ctx, &database.QueuePause{Paused: true, Reason: "upgrade"}))
+	_, _, _, err := Q.ClaimTask(ctx, w)
+	assert.Equal(t, queue.ErrQueuePaused, err)
+	assert.True(t, errors.Is(err, queue.ErrQueueEmpty))
+	counts, err := Q.CountTasks(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"echo_task": 1}, counts)
+
+	// Draining workers get nothing even once claims are resumed
+	assert.NoError(t, DB.SaveQueuePause(ctx, &database.QueuePause{}))
+	draining := newWorker("bash")
+	draining.Draining = true
+	_, _, _, err = Q.ClaimTask(ctx, draining)
+	assert.Equal(t, queue.ErrQueueEmpty, err)
+
+	claimed, ack, _, err := Q.ClaimTask(ctx, w)
+	assert.NoError(t, err)
+	assert.Equal(t, task.Id, claimed.Id)
+	assert.NoError(t, ack())
+}
@@ -1,11 +1,13 @@
 package database
 
 import (
+	"context"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/cast"
 	"github.com/turtlemonvh/blanket/lib"
 	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/lib/webhooks"
 	"github.com/turtlemonvh/blanket/tasks"
 	"github.com/turtlemonvh/blanket/worker"
 	"strconv"
@@ -22,34 +24,65 @@ import (
 NOTES:
 - All databases must use bson primary keys assigned by the application
 
+CONTEXTS:
+- every function takes the context of the request it is for, and gives up with a CanceledError once it is done
+- backends check the context before starting and while scanning, but a write that has started is finished
+
+REVISIONS:
+- every stored task and worker carries a revision that is bumped on each write
+- SaveTask and UpdateWorker write the whole record; if its revision is not 0 it must match the stored one, or
+  a RevisionConflictError is returned and nothing is written
+- the other update functions change single fields inside a transaction, so they can't clobber anything else
+
 FIXME:
-- atomic updates to certain worker fields so whole object isn't overwritten each time
-	- could do this with a hash of the object in a generic way, but that requires transactions, which mongo doesn't have
 - add "not found" errors
 - make sure bolt is only referenced here and in the queue file
 - will need to query queue for any tasks in WAITING state
-- add specific functions for heartbeats, since they need to check if they're getting killed AND set a value
-	- we don't want either thing (heartbeat or kill message) to overwrite what is there
-	- whenever we set a single field, we need isolation (like for updateTaskProgress)
 
 */
 
 type BlanketDB interface {
 	// Worker functions
-	GetWorkers() ([]worker.WorkerConf, error)
-	GetWorker(workerId objectid.ObjectId) (worker.WorkerConf, error)
-	DeleteWorker(workerId objectid.ObjectId) error
-	UpdateWorker(worker *worker.WorkerConf) error
-	CleanupStalledWorkers() error
+	GetWorkers(ctx context.Context) ([]worker.WorkerConf, error)
+	GetWorker(ctx context.Context, workerId objectid.ObjectId) (worker.WorkerConf, error)
+	DeleteWorker(ctx context.Context, workerId objectid.ObjectId) error
+	UpdateWorker(ctx context.Context, worker *worker.WorkerConf) error
+	StopWorker(ctx context.Context, workerId objectid.ObjectId) (worker.WorkerConf, error)
+	DrainWorker(ctx context.Context, workerId objectid.ObjectId, draining bool) (worker.WorkerConf, error)
+	HeartbeatWorker(ctx context.Context, workerId objectid.ObjectId, ts int64) (worker.WorkerConf, error)
+	CleanupStalledWorkers(ctx context.Context) error
 	// Task functions
-	GetTask(taskId objectid.ObjectId) (tasks.Task, error)
-	DeleteTask(taskId objectid.ObjectId) error
-	GetTasks(tc *TaskSearchConf) ([]tasks.Task, int, error)
-	SaveTask(t *tasks.Task) error
-	RunTask(taskId objectid.ObjectId, fields *TaskRunConfig) error
-	FinishTask(taskId objectid.ObjectId, newState string) error
-	UpdateTaskProgress(taskId objectid.ObjectId, progress int) error
-	CleanupStalledTasks() error
+	GetTask(ctx context.Context, taskId objectid.ObjectId) (tasks.Task, error)
+	DeleteTask(ctx context.Context, taskId objectid.ObjectId) error
+	GetTasks(ctx context.Context, tc *TaskSearchConf) ([]tasks.Task, int, error)
+	SaveTask(ctx context.Context, t *tasks.Task) error
+	RunTask(ctx context.Context, taskId objectid.ObjectId, fields *TaskRunConfig) error
+	FinishTask(ctx context.Context, taskId objectid.ObjectId, newState string, actor string, reason string, exitCode *int) error
+	RequestTaskCancel(ctx context.Context, taskId objectid.ObjectId, force bool, reason string) error
+	UpdateTaskCancel(ctx context.Context, taskId objectid.ObjectId, actor string, outcome string) error
+	UpdateTaskProgress(ctx context.Context, taskId objectid.ObjectId, progress int) error
+	UpdateTaskTags(ctx context.Context, taskId objectid.ObjectId, tags []string) error
+	UpdateTaskStep(ctx context.Context, taskId objectid.ObjectId, step int, state string, exitCode int) error
+	UpdateTaskHook(ctx context.Context, taskId objectid.ObjectId, hook string, state string, exitCode int, followUpTaskId string) error
+	CleanupStalledTasks(ctx context.Context) error
+	// Webhook functions
+	GetWebhooks(ctx context.Context) ([]webhooks.Webhook, error)
+	GetWebhook(ctx context.Context, webhookId objectid.ObjectId) (webhooks.Webhook, error)
+	SaveWebhook(ctx context.Context, w *webhooks.Webhook) error
+	DeleteWebhook(ctx context.Context, webhookId objectid.ObjectId) error
+	SaveWebhookDelivery(ctx context.Context, d *webhooks.Delivery) error
+	GetWebhookDeliveries(ctx context.Context, webhookId objectid.ObjectId, limit int) ([]webhooks.Delivery, error)
+	GetDueWebhookDeliveries(ctx context.Context, now int64, limit int) ([]webhooks.Delivery, error)
+	// Event log functions
+	GetEvents(ctx context.Context, since uint64, limit int) ([]Event, error)
+	FirstEventSeq(ctx context.Context) (uint64, error)
+	TrimEvents(ctx context.Context, before int64) (int, error)
+	// Statistics functions
+	GetTaskStats(ctx context.Context, fromHour int64, to int64) ([]TaskStatsRecord, error)
+	CountTasksByState(ctx context.Context) (map[string]int, error)
+	// Settings functions
+	GetQueuePause(ctx context.Context) (QueuePause, error)
+	SaveQueuePause(ctx context.Context, p *QueuePause) error
 }
 
 var (
@@ -73,6 +106,56 @@ type TaskSearchConf struct {
 	LargestId         objectid.ObjectId
 	AllowedTaskStates map[string]bool
 	AllowedTaskTypes  map[string]bool
+	Sort              string      // see ValidTaskSorts; "" is SORT_CREATED
+	Cursor            *TaskCursor // start after this task
+	CountAll          bool        // count every match, not just those up to the limit
+	Query             *TaskQuery  // a `q` expression; see ParseTaskQuery
+}
+
+// True if the task passes every filter; ids, sort and paging are left to the caller
+func (tc *TaskSearchConf) Matches(t *tasks.Task) bool {
+	if tc.JustUnclaimed && !t.WorkerId.IsZero() {
+		return false
+	}
+	if len(tc.AllowedTaskTypes) != 0 && !tc.AllowedTaskTypes[t.TypeId] {
+		return false
+	}
+	if len(tc.AllowedTaskStates) != 0 && !tc.AllowedTaskStates[t.State] {
+		return false
+	}
+
+	// All tags in tc.RequiredTags must be present on the task
+	for _, requestedTag := range tc.RequiredTags {
+		found := false
+		for _, existingTag := range t.Tags {
+			if requestedTag == existingTag {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	// All tags on the task must be present in tc.MaxTags
+	if len(tc.MaxTags) > 0 {
+		for _, existingTag := range t.Tags {
+			found := false
+			for _, allowedTag := range tc.MaxTags {
+				if allowedTag == existingTag {
+					found = true
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+
+	if tc.Query != nil && !tc.Query.Matches(t) {
+		return false
+	}
+	return true
 }
 
 type ItemNotFoundError string
@@ -81,6 +164,39 @@ func (e ItemNotFoundError) Error() string {
 	return fmt.Sprintf("Item not found: %s", string(e))
 }
 
+// Returned when the context of a call is done before the call could finish
+// Wraps the context's error, so errors.Is works with context.Canceled and context.DeadlineExceeded
+type CanceledError struct {
+	Err error
+}
+
+func (e CanceledError) Error() string {
+	return fmt.Sprintf("Request abandoned: %s", e.Err.Error())
+}
+
+func (e CanceledError) Unwrap() error {
+	return e.Err
+}
+
+// A CanceledError if ctx is done, else nil
+func CheckContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return CanceledError{err}
+	}
+	return nil
+}
+
+// Returned by whole-record writes when the record changed since it was read
+type RevisionConflictError struct {
+	Id       string
+	Expected int64
+	Actual   int64
+}
+
+func (e RevisionConflictError) Error() string {
+	return fmt.Sprintf("Revision conflict on %s: expected revision %d, found %d", e.Id, e.Expected, e.Actual)
+}
+
 // parseFilterTime parses a user-supplied date/time in one of several formats
 // and falls back to unix seconds. Returns (time, true) on success.
 // Supported shapes: unix int, RFC3339, "2006-01-02T15:04" (datetime-local),
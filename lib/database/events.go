@@ -0,0 +1,55 @@
+package database
+
+import (
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/worker"
+)
+
+/*
+
+Every change the database makes to a task or worker is also appended to an event log, in the same
+transaction as the change itself. Events are numbered with a sequence that only goes up, so API
+clients can read the log from any point and pick up where they left off after a disconnect.
+
+*/
+
+// Event types
+const (
+	EVENT_TASK_CREATED   = "task.created"
+	EVENT_TASK_UPDATED   = "task.updated"
+	EVENT_TASK_DELETED   = "task.deleted"
+	EVENT_WORKER_CREATED = "worker.created"
+	EVENT_WORKER_UPDATED = "worker.updated"
+	EVENT_WORKER_DELETED = "worker.deleted"
+)
+
+var ValidEventTypes = []string{
+	EVENT_TASK_CREATED,
+	EVENT_TASK_UPDATED,
+	EVENT_TASK_DELETED,
+	EVENT_WORKER_CREATED,
+	EVENT_WORKER_UPDATED,
+	EVENT_WORKER_DELETED,
+}
+
+// One entry in the event log
+// An update that doesn't change the state (e.g. progress) has the same OldState and NewState
+type Event struct {
+	Seq      uint64            `json:"seq"`
+	Ts       int64             `json:"ts"`
+	Type     string            `json:"type"` // see ValidEventTypes
+	EntityId objectid.ObjectId `json:"entityId"`
+	OldState string            `json:"oldState"` // empty for created events
+	NewState string            `json:"newState"` // empty for deleted events
+}
+
+// State of a worker as recorded in events
+func WorkerState(w *worker.WorkerConf) string {
+	if w.Stopped {
+		return "STOPPED"
+	}
+	if w.Draining {
+		return "DRAINING"
+	}
+	return "RUNNING"
+}
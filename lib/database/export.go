@@ -0,0 +1,309 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/lib/webhooks"
+	"github.com/turtlemonvh/blanket/tasks"
+	"github.com/turtlemonvh/blanket/worker"
+	"io"
+	"path"
+)
+
+/*
+
+Exports are JSON Lines: a header record, then one record per stored item.
+
+    {"kind": "header", "data": {"version": 1, "exportedTs": 1700000000}}
+    {"kind": "worker", "data": {...}}
+    {"kind": "task", "data": {...}}
+    {"kind": "queue", "data": {...}}
+    {"kind": "webhook", "data": {...}}
+
+The format doesn't depend on the backend, so an export from one can be imported into another.
+Webhook deliveries, the event log and task statistics are not exported; imports count imported tasks
+in the statistics from their histories.
+
+*/
+
+// Version of the export format written by this build; newer exports are refused on import
+const EXPORT_FORMAT_VERSION = 1
+
+// Kinds of export record
+const (
+	EXPORT_HEADER  = "header"
+	EXPORT_WORKER  = "worker"
+	EXPORT_TASK    = "task"
+	EXPORT_QUEUE   = "queue" // a task waiting in the queue; shares its id with the task record
+	EXPORT_WEBHOOK = "webhook"
+)
+
+var ValidExportKinds = []string{EXPORT_WORKER, EXPORT_TASK, EXPORT_QUEUE, EXPORT_WEBHOOK}
+
+// How an import treats what is already stored
+const (
+	IMPORT_MERGE   = "merge"   // keep existing items; imported items whose id is taken are skipped, or given a new id with RemapIds
+	IMPORT_REPLACE = "replace" // remove existing workers, tasks, queue entries and webhooks first
+)
+
+var ValidImportModes = []string{IMPORT_MERGE, IMPORT_REPLACE}
+
+// One line of an export
+type ExportRecord struct {
+	Kind string          `json:"kind"`
+	Data json.RawMessage `json:"data"`
+}
+
+type ExportHeader struct {
+	Version    int   `json:"version"`
+	ExportedTs int64 `json:"exportedTs"`
+}
+
+type ImportOptions struct {
+	Mode     string // see ValidImportModes
+	RemapIds bool   // in merge mode, give items whose id is taken a new id instead of skipping them
+}
+
+// What an import did, counted by kind
+type ImportReport struct {
+	Mode     string         `json:"mode"`
+	Imported map[string]int `json:"imported"`
+	Skipped  map[string]int `json:"skipped"`  // id already taken
+	Remapped map[string]int `json:"remapped"` // imported under a new id
+}
+
+// Implemented by backends that can write and load a portable copy of what they store
+type Exporter interface {
+	// Write a consistent snapshot
+	Export(ctx context.Context, w io.Writer) error
+	// Load an export; nothing is changed if any record is invalid
+	Import(ctx context.Context, r io.Reader, opts ImportOptions) (ImportReport, error)
+}
+
+func NewImportReport(opts ImportOptions) ImportReport {
+	return ImportReport{
+		Mode:     opts.Mode,
+		Imported: make(map[string]int),
+		Skipped:  make(map[string]int),
+		Remapped: make(map[string]int),
+	}
+}
+
+// Read and check every record of an export, without the header
+func ReadExport(r io.Reader) ([]ExportRecord, error) {
+	dec := json.NewDecoder(r)
+
+	var header ExportRecord
+	if err := dec.Decode(&header); err != nil {
+		return nil, fmt.Errorf("Could not read export header :: %s", err.Error())
+	}
+	if header.Kind != EXPORT_HEADER {
+		return nil, fmt.Errorf("Export must start with a '%s' record; found '%s'", EXPORT_HEADER, header.Kind)
+	}
+	var h ExportHeader
+	if err := json.Unmarshal(header.Data, &h); err != nil {
+		return nil, fmt.Errorf("Could not read export header :: %s", err.Error())
+	}
+	if h.Version < 1 || h.Version > EXPORT_FORMAT_VERSION {
+		return nil, fmt.Errorf("Unsupported export version %d; this build reads versions 1 to %d", h.Version, EXPORT_FORMAT_VERSION)
+	}
+
+	var records []ExportRecord
+	for line := 2; ; line++ {
+		var rec ExportRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("Record %d :: %s", line, err.Error())
+		}
+
+		isValid := false
+		for _, k := range ValidExportKinds {
+			if rec.Kind == k {
+				isValid = true
+			}
+		}
+		if !isValid {
+			return nil, fmt.Errorf("Record %d has unknown kind '%s'; must be one of: %v", line, rec.Kind, ValidExportKinds)
+		}
+		records = append(records, rec)
+	}
+}
+
+// An export record decoded far enough to know its id
+type ImportItem struct {
+	Kind    string
+	Id      objectid.ObjectId
+	Task    *tasks.Task // tasks and queue entries
+	Worker  *worker.WorkerConf
+	Webhook *webhooks.Webhook
+}
+
+// Read, check and decode every record of an export for opts, before anything is written
+func DecodeExport(r io.Reader, opts ImportOptions) ([]ImportItem, error) {
+	if opts.Mode != IMPORT_MERGE && opts.Mode != IMPORT_REPLACE {
+		return nil, fmt.Errorf("Invalid import mode '%s'; must be one of: %v", opts.Mode, ValidImportModes)
+	}
+
+	records, err := ReadExport(r)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]ImportItem, len(records))
+	for i, rec := range records {
+		item := ImportItem{Kind: rec.Kind}
+		switch rec.Kind {
+		case EXPORT_TASK, EXPORT_QUEUE:
+			item.Task = &tasks.Task{}
+			err = json.Unmarshal(rec.Data, item.Task)
+			item.Id = item.Task.Id
+		case EXPORT_WORKER:
+			item.Worker = &worker.WorkerConf{}
+			err = json.Unmarshal(rec.Data, item.Worker)
+			item.Id = item.Worker.Id
+		case EXPORT_WEBHOOK:
+			item.Webhook = &webhooks.Webhook{}
+			err = json.Unmarshal(rec.Data, item.Webhook)
+			item.Id = item.Webhook.Id
+		}
+		// Records are numbered from the header
+		if err != nil {
+			return nil, fmt.Errorf("Record %d (%s) :: %s", i+2, rec.Kind, err.Error())
+		}
+		if item.Id.IsZero() {
+			return nil, fmt.Errorf("Record %d (%s) has no id", i+2, rec.Kind)
+		}
+		items[i] = item
+	}
+	return items, nil
+}
+
+// Where ImportItems writes; backends wrap whatever they store items in
+type ImportTarget interface {
+	// True if an item of this kind is stored under id
+	Has(kind string, id objectid.ObjectId) bool
+	// Store an item of this kind: a *tasks.Task, *worker.WorkerConf or *webhooks.Webhook
+	// Imported tasks are not counted in statistics yet; see TaskStatsChangesFromHistory
+	Put(kind string, id objectid.ObjectId, value interface{}) error
+}
+
+// Write decoded items following opts; in replace mode the target must already be empty
+// Backends call this inside whatever makes the whole import succeed or fail together
+func ImportItems(items []ImportItem, opts ImportOptions, target ImportTarget) (ImportReport, error) {
+	report := NewImportReport(opts)
+
+	// Decide on the id of every worker, task and webhook first so references can follow them
+	// Queue entries share the id of their task
+	newIds := map[string]map[objectid.ObjectId]objectid.ObjectId{
+		EXPORT_WORKER:  {},
+		EXPORT_TASK:    {},
+		EXPORT_WEBHOOK: {},
+	}
+	skipped := map[string]map[objectid.ObjectId]bool{
+		EXPORT_WORKER:  {},
+		EXPORT_TASK:    {},
+		EXPORT_WEBHOOK: {},
+	}
+	for _, item := range items {
+		if item.Kind == EXPORT_QUEUE || !target.Has(item.Kind, item.Id) {
+			continue
+		}
+		if opts.RemapIds {
+			newIds[item.Kind][item.Id] = RemapId(item.Id)
+		} else {
+			skipped[item.Kind][item.Id] = true
+		}
+	}
+	taskIds := newIds[EXPORT_TASK]
+	workerIds := newIds[EXPORT_WORKER]
+
+	for _, item := range items {
+		var value interface{}
+		id := item.Id
+		switch item.Kind {
+		case EXPORT_TASK, EXPORT_QUEUE:
+			if skipped[EXPORT_TASK][id] {
+				report.Skipped[item.Kind]++
+				continue
+			}
+			if newId, ok := taskIds[id]; ok {
+				id = newId
+			} else if item.Kind == EXPORT_QUEUE && target.Has(item.Kind, id) {
+				// Already queued
+				report.Skipped[item.Kind]++
+				continue
+			}
+			remapTaskReferences(item.Task, taskIds, workerIds)
+			value = item.Task
+		case EXPORT_WORKER:
+			if skipped[item.Kind][id] {
+				report.Skipped[item.Kind]++
+				continue
+			}
+			if newId, ok := workerIds[id]; ok {
+				id = newId
+				item.Worker.Id = newId
+			}
+			value = item.Worker
+		case EXPORT_WEBHOOK:
+			if skipped[item.Kind][id] {
+				report.Skipped[item.Kind]++
+				continue
+			}
+			if newId, ok := newIds[item.Kind][id]; ok {
+				id = newId
+				item.Webhook.Id = newId
+			}
+			value = item.Webhook
+		}
+
+		if id != item.Id {
+			report.Remapped[item.Kind]++
+		}
+		if err := target.Put(item.Kind, id, value); err != nil {
+			return report, err
+		}
+		report.Imported[item.Kind]++
+	}
+	return report, nil
+}
+
+// A new id with the same timestamp, so remapped items keep their place in time-ordered listings
+func RemapId(id objectid.ObjectId) objectid.ObjectId {
+	newId := objectid.NewObjectId()
+	copy(newId[:4], id[:4])
+	return newId
+}
+
+// Point a task's id and the ids it refers to at their remapped values
+func remapTaskReferences(t *tasks.Task, taskIds map[objectid.ObjectId]objectid.ObjectId, workerIds map[objectid.ObjectId]objectid.ObjectId) {
+	remapHex := func(hex string) string {
+		if !objectid.IsObjectIdHex(hex) {
+			return hex
+		}
+		if newId, ok := taskIds[objectid.ObjectIdHex(hex)]; ok {
+			return newId.Hex()
+		}
+		return hex
+	}
+
+	if newId, ok := taskIds[t.Id]; ok {
+		// Result directories are named after the task
+		if t.ResultDir != "" && path.Base(t.ResultDir) == t.Id.Hex() {
+			t.ResultDir = path.Join(path.Dir(t.ResultDir), newId.Hex())
+		}
+		t.Id = newId
+	}
+	if newId, ok := workerIds[t.WorkerId]; ok {
+		t.WorkerId = newId
+	}
+	t.ParentId = remapHex(t.ParentId)
+	t.RerunOf = remapHex(t.RerunOf)
+	for i := range t.Hooks {
+		t.Hooks[i].FollowUpTaskId = remapHex(t.Hooks[i].FollowUpTaskId)
+	}
+}
@@ -0,0 +1,16 @@
+package database
+
+/*
+
+Claims can be paused across the whole server, e.g. to hold work while it is upgraded. The pause is kept in the
+database so it lasts through a restart. Tasks can still be submitted while it is on; they wait in the queue
+until claims are resumed.
+
+*/
+
+// Whether workers may claim tasks
+type QueuePause struct {
+	Paused    bool   `json:"paused"`
+	Reason    string `json:"reason"`    // given when pausing; shown in the UI
+	ChangedTs int64  `json:"changedTs"` // when it was last paused or resumed
+}
@@ -0,0 +1,600 @@
+package database
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/turtlemonvh/blanket/tasks"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+
+Task queries are expressions passed as `q` to task listings, e.g.
+
+    type=train env.DATASET=foo (state=ERROR OR exitCode!=0) finished>-24h
+
+A term is either `field op value` or a bare word. Terms next to each other must all match; `OR` joins
+alternatives, `NOT` or a leading `-` negates the term after it, and parentheses group. `NOT` binds tightest,
+then AND, then OR. Keywords are upper case. Values with spaces or operators in them go in double quotes.
+
+Bare words match, ignoring case, anywhere in a task's type, tags or environment values.
+
+Fields and the operators they take:
+
+    id, type, state, worker, parent, rerunOf, failedStep   = != ~
+    tag                                                    = != ~   (any of the task's tags)
+    env.NAME                                               = != ~   (an environment variable)
+    created, started, finished, updated                    = != < <= > >=
+    duration, exitCode, progress                           = != < <= > >=
+
+`~` is a case insensitive substring match. Times are unix seconds, a date as accepted by `createdAfter`,
+or relative to now like `-2h` or `-7d`. Durations are seconds or like `90s`, `5m`, `2h`, `1d`.
+A field that isn't set (a task that hasn't started or finished, an env var it doesn't have) only matches
+`field=none`, and `field!=none` matches tasks where it is set.
+
+Queries are evaluated on each task in memory, so any backend that filters with TaskSearchConf.Matches
+supports them.
+
+*/
+
+// A parsed query
+type TaskQuery struct {
+	text string
+	root queryNode
+}
+
+// The query as it was written
+func (q *TaskQuery) String() string {
+	return q.text
+}
+
+// True if the task matches the query
+func (q *TaskQuery) Matches(t *tasks.Task) bool {
+	return q.root.matches(t)
+}
+
+// Read the `q` query parameter into the search
+func TaskQueryFromContext(c *gin.Context, tc *TaskSearchConf) error {
+	raw := strings.TrimSpace(c.Query("q"))
+	if raw == "" {
+		return nil
+	}
+	q, err := ParseTaskQuery(raw)
+	if err != nil {
+		return err
+	}
+	tc.Query = q
+	return nil
+}
+
+// Parse a query expression; see the package docs for the syntax
+func ParseTaskQuery(text string) (*TaskQuery, error) {
+	toks, err := lexTaskQuery(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{toks: toks, now: time.Now()}
+	if len(toks) == 0 {
+		return nil, fmt.Errorf("Empty query")
+	}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("Unexpected '%s' in query", p.toks[p.pos].text)
+	}
+	return &TaskQuery{text: text, root: root}, nil
+}
+
+/*
+ * Lexing
+ */
+
+type queryTokenKind int
+
+const (
+	tokWord queryTokenKind = iota
+	tokLParen
+	tokRParen
+)
+
+type queryToken struct {
+	kind queryTokenKind
+	text string // as written, for errors
+	// For words; op is "" for bare words and keywords
+	field  string
+	op     string
+	value  string
+	quoted bool // some of the word was in quotes, so it is never a keyword
+}
+
+// Longest first, so `<=` isn't read as `<`
+var queryOps = []string{"!=", "<=", ">=", "=", "<", ">", "~"}
+
+func lexTaskQuery(text string) ([]queryToken, error) {
+	var toks []queryToken
+	i := 0
+	for i < len(text) {
+		ch := text[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n':
+			i++
+		case ch == '(':
+			toks = append(toks, queryToken{kind: tokLParen, text: "("})
+			i++
+		case ch == ')':
+			toks = append(toks, queryToken{kind: tokRParen, text: ")"})
+			i++
+		default:
+			tok, next, err := lexQueryWord(text, i)
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, tok)
+			i = next
+		}
+	}
+	return toks, nil
+}
+
+// Read one word starting at start, splitting it on the first operator outside quotes
+func lexQueryWord(text string, start int) (queryToken, int, error) {
+	tok := queryToken{kind: tokWord}
+	var buf strings.Builder
+	i := start
+	for i < len(text) {
+		ch := text[i]
+		if ch == ' ' || ch == '\t' || ch == '\n' || ch == '(' || ch == ')' {
+			break
+		}
+		if ch == '"' {
+			end := strings.IndexByte(text[i+1:], '"')
+			if end < 0 {
+				return tok, 0, fmt.Errorf("Unclosed quote in query at position %d", i+1)
+			}
+			buf.WriteString(text[i+1 : i+1+end])
+			tok.quoted = true
+			i += end + 2
+			continue
+		}
+		if tok.op == "" && !tok.quoted {
+			for _, op := range queryOps {
+				if strings.HasPrefix(text[i:], op) {
+					tok.field = buf.String()
+					tok.op = op
+					buf.Reset()
+					i += len(op)
+					break
+				}
+			}
+			if tok.op != "" {
+				continue
+			}
+		}
+		buf.WriteByte(ch)
+		i++
+	}
+	tok.text = text[start:i]
+	tok.value = buf.String()
+	if tok.op != "" && tok.field == "" {
+		return tok, 0, fmt.Errorf("Missing field before '%s' in query term '%s'", tok.op, tok.text)
+	}
+	if tok.op != "" && tok.value == "" && !tok.quoted {
+		return tok, 0, fmt.Errorf("Missing value after '%s' in query term '%s'", tok.op, tok.text)
+	}
+	return tok, i, nil
+}
+
+/*
+ * Parsing
+ */
+
+type queryParser struct {
+	toks []queryToken
+	pos  int
+	now  time.Time
+}
+
+func (p *queryParser) peek() *queryToken {
+	if p.pos >= len(p.toks) {
+		return nil
+	}
+	return &p.toks[p.pos]
+}
+
+func (p *queryParser) isKeyword(word string) bool {
+	tok := p.peek()
+	return tok != nil && tok.kind == tokWord && tok.op == "" && !tok.quoted && tok.value == word
+}
+
+func (p *queryParser) parseOr() (queryNode, error) {
+	node, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	or := orNode{node}
+	for p.isKeyword("OR") {
+		p.pos++
+		next, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		or = append(or, next)
+	}
+	if len(or) == 1 {
+		return node, nil
+	}
+	return or, nil
+}
+
+func (p *queryParser) parseAnd() (queryNode, error) {
+	var and andNode
+	for {
+		tok := p.peek()
+		if tok == nil || tok.kind == tokRParen || p.isKeyword("OR") {
+			break
+		}
+		if p.isKeyword("AND") {
+			p.pos++
+			continue
+		}
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		and = append(and, node)
+	}
+	switch len(and) {
+	case 0:
+		if tok := p.peek(); tok != nil {
+			return nil, fmt.Errorf("Expected a term before '%s' in query", tok.text)
+		}
+		return nil, fmt.Errorf("Query ends where a term was expected")
+	case 1:
+		return and[0], nil
+	}
+	return and, nil
+}
+
+func (p *queryParser) parseNot() (queryNode, error) {
+	if p.isKeyword("NOT") {
+		p.pos++
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{node}, nil
+	}
+	tok := p.peek()
+	if tok == nil {
+		return nil, fmt.Errorf("Query ends where a term was expected")
+	}
+	// A leading `-` on a word negates it, so `-state=ERROR` is `NOT state=ERROR`
+	if tok.kind == tokWord && strings.HasPrefix(tok.text, "-") && len(tok.text) > 1 {
+		negated := *tok
+		if negated.op != "" {
+			negated.field = strings.TrimPrefix(negated.field, "-")
+		} else {
+			negated.value = strings.TrimPrefix(negated.value, "-")
+		}
+		negated.text = strings.TrimPrefix(negated.text, "-")
+		p.toks[p.pos] = negated
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{node}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *queryParser) parsePrimary() (queryNode, error) {
+	tok := p.peek()
+	p.pos++
+	switch tok.kind {
+	case tokLParen:
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if next := p.peek(); next == nil || next.kind != tokRParen {
+			return nil, fmt.Errorf("Missing ')' in query")
+		}
+		p.pos++
+		return node, nil
+	case tokRParen:
+		return nil, fmt.Errorf("Unexpected ')' in query")
+	}
+	if tok.op == "" {
+		if tok.value == "" {
+			return nil, fmt.Errorf("Empty term in query")
+		}
+		return textNode(strings.ToLower(tok.value)), nil
+	}
+	return p.parseTerm(tok)
+}
+
+/*
+ * Terms
+ */
+
+// How a field's value is read from a task and compared
+type queryFieldKind int
+
+const (
+	fieldString queryFieldKind = iota
+	fieldTime
+	fieldDuration
+	fieldNumber
+)
+
+type queryField struct {
+	kind queryFieldKind
+	// Returns the value and whether it is set
+	str func(t *tasks.Task) (string, bool)
+	num func(t *tasks.Task) (int64, bool)
+}
+
+func stringField(fn func(t *tasks.Task) string) queryField {
+	return queryField{kind: fieldString, str: func(t *tasks.Task) (string, bool) {
+		v := fn(t)
+		return v, v != ""
+	}}
+}
+
+func timeField(fn func(t *tasks.Task) int64) queryField {
+	return queryField{kind: fieldTime, num: func(t *tasks.Task) (int64, bool) {
+		v := fn(t)
+		return v, v != 0
+	}}
+}
+
+var queryFields = map[string]queryField{
+	"id":    stringField(func(t *tasks.Task) string { return t.Id.Hex() }),
+	"type":  stringField(func(t *tasks.Task) string { return t.TypeId }),
+	"state": stringField(func(t *tasks.Task) string { return t.State }),
+	"worker": stringField(func(t *tasks.Task) string {
+		if t.WorkerId.IsZero() {
+			return ""
+		}
+		return t.WorkerId.Hex()
+	}),
+	"parent":     stringField(func(t *tasks.Task) string { return t.ParentId }),
+	"rerunOf":    stringField(func(t *tasks.Task) string { return t.RerunOf }),
+	"failedStep": stringField(func(t *tasks.Task) string { return t.FailedStep }),
+	"created":    timeField(func(t *tasks.Task) int64 { return t.CreatedTs }),
+	"started":    timeField(func(t *tasks.Task) int64 { return t.StartedTs }),
+	"finished":   timeField(func(t *tasks.Task) int64 { return t.FinishedTs() }),
+	"updated":    timeField(func(t *tasks.Task) int64 { return t.LastUpdatedTs }),
+	"duration": {kind: fieldDuration, num: func(t *tasks.Task) (int64, bool) {
+		return TaskSortValue(t, SORT_DURATION), t.StartedTs != 0
+	}},
+	"exitCode": {kind: fieldNumber, num: func(t *tasks.Task) (int64, bool) {
+		if t.ExitCode == nil {
+			return 0, false
+		}
+		return int64(*t.ExitCode), true
+	}},
+	"progress": {kind: fieldNumber, num: func(t *tasks.Task) (int64, bool) {
+		return int64(t.Progress), true
+	}},
+}
+
+func (p *queryParser) parseTerm(tok *queryToken) (queryNode, error) {
+	isNone := tok.value == "none" && !tok.quoted
+	if isNone && tok.op != "=" && tok.op != "!=" {
+		return nil, fmt.Errorf("Only = and != can be used with none, in '%s'", tok.text)
+	}
+
+	switch {
+	case tok.field == "tag":
+		if tok.op != "=" && tok.op != "!=" && tok.op != "~" {
+			return nil, fmt.Errorf("Field 'tag' takes =, != or ~, in '%s'", tok.text)
+		}
+		if isNone {
+			return &tagNode{op: tok.op, none: true}, nil
+		}
+		return &tagNode{op: tok.op, value: tok.value}, nil
+	case strings.HasPrefix(tok.field, "env."):
+		name := strings.TrimPrefix(tok.field, "env.")
+		if name == "" {
+			return nil, fmt.Errorf("Missing variable name in '%s'", tok.text)
+		}
+		field := queryField{kind: fieldString, str: func(t *tasks.Task) (string, bool) {
+			v, ok := t.ExecEnv[name]
+			return v, ok
+		}}
+		return p.newTermNode(tok, field, isNone)
+	}
+
+	field, ok := queryFields[tok.field]
+	if !ok {
+		return nil, fmt.Errorf("Unknown field '%s' in query; use one of id, type, state, worker, parent, rerunOf, failedStep, tag, env.NAME, created, started, finished, updated, duration, exitCode, progress", tok.field)
+	}
+	return p.newTermNode(tok, field, isNone)
+}
+
+func (p *queryParser) newTermNode(tok *queryToken, field queryField, isNone bool) (queryNode, error) {
+	node := &termNode{field: field, op: tok.op, none: isNone}
+	if isNone {
+		return node, nil
+	}
+
+	if field.kind == fieldString {
+		if tok.op != "=" && tok.op != "!=" && tok.op != "~" {
+			return nil, fmt.Errorf("Field '%s' takes =, != or ~, in '%s'", tok.field, tok.text)
+		}
+		node.str = tok.value
+		if tok.op == "~" {
+			node.str = strings.ToLower(tok.value)
+		}
+		return node, nil
+	}
+
+	if tok.op == "~" {
+		return nil, fmt.Errorf("Field '%s' can't be used with ~, in '%s'", tok.field, tok.text)
+	}
+	var err error
+	switch field.kind {
+	case fieldTime:
+		node.num, err = parseRelativeTime(tok.value, p.now)
+	case fieldDuration:
+		node.num, err = parseQueryDuration(tok.value)
+	default:
+		node.num, err = strconv.ParseInt(tok.value, 10, 64)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid value for '%s' in '%s' :: %s", tok.field, tok.text, err.Error())
+	}
+	return node, nil
+}
+
+// Seconds, or a Go duration, which may also use d for days
+func parseQueryDuration(raw string) (int64, error) {
+	if sec, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return sec, nil
+	}
+	if days, ok := strings.CutSuffix(raw, "d"); ok {
+		if n, err := strconv.ParseInt(days, 10, 64); err == nil {
+			return n * 24 * 60 * 60, nil
+		}
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("expected seconds or a duration like 90s, 5m, 2h or 1d")
+	}
+	return int64(d.Seconds()), nil
+}
+
+/*
+ * Evaluation
+ */
+
+type queryNode interface {
+	matches(t *tasks.Task) bool
+}
+
+type andNode []queryNode
+
+func (n andNode) matches(t *tasks.Task) bool {
+	for _, child := range n {
+		if !child.matches(t) {
+			return false
+		}
+	}
+	return true
+}
+
+type orNode []queryNode
+
+func (n orNode) matches(t *tasks.Task) bool {
+	for _, child := range n {
+		if child.matches(t) {
+			return true
+		}
+	}
+	return false
+}
+
+type notNode struct {
+	node queryNode
+}
+
+func (n notNode) matches(t *tasks.Task) bool {
+	return !n.node.matches(t)
+}
+
+// A bare word, in lower case
+type textNode string
+
+func (n textNode) matches(t *tasks.Task) bool {
+	needle := string(n)
+	if strings.Contains(strings.ToLower(t.TypeId), needle) {
+		return true
+	}
+	for _, tag := range t.Tags {
+		if strings.Contains(strings.ToLower(tag), needle) {
+			return true
+		}
+	}
+	for _, v := range t.ExecEnv {
+		if strings.Contains(strings.ToLower(v), needle) {
+			return true
+		}
+	}
+	return false
+}
+
+type termNode struct {
+	field queryField
+	op    string
+	none  bool
+	str   string
+	num   int64
+}
+
+func (n *termNode) matches(t *tasks.Task) bool {
+	if n.field.kind == fieldString {
+		v, isSet := n.field.str(t)
+		if n.none {
+			return isSet == (n.op == "!=")
+		}
+		if !isSet {
+			return false
+		}
+		switch n.op {
+		case "=":
+			return v == n.str
+		case "!=":
+			return v != n.str
+		}
+		return strings.Contains(strings.ToLower(v), n.str)
+	}
+
+	v, isSet := n.field.num(t)
+	if n.none {
+		return isSet == (n.op == "!=")
+	}
+	if !isSet {
+		return false
+	}
+	switch n.op {
+	case "=":
+		return v == n.num
+	case "!=":
+		return v != n.num
+	case "<":
+		return v < n.num
+	case "<=":
+		return v <= n.num
+	case ">":
+		return v > n.num
+	}
+	return v >= n.num
+}
+
+// Matches against any of a task's tags
+type tagNode struct {
+	op    string
+	none  bool
+	value string
+}
+
+func (n *tagNode) matches(t *tasks.Task) bool {
+	if n.none {
+		return (len(t.Tags) == 0) == (n.op == "=")
+	}
+	has := false
+	for _, tag := range t.Tags {
+		if n.op == "~" && strings.Contains(strings.ToLower(tag), strings.ToLower(n.value)) || n.op != "~" && tag == n.value {
+			has = true
+		}
+	}
+	if n.op == "!=" {
+		return !has
+	}
+	return has
+}
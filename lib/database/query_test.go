@@ -0,0 +1,106 @@
+package database
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/tasks"
+	"testing"
+	"time"
+)
+
+func TestTaskQuery(t *testing.T) {
+	now := time.Now().Unix()
+	one := 1
+	failed := tasks.Task{
+		Id:            objectid.NewObjectId(),
+		TypeId:        "train_model",
+		State:         "ERROR",
+		Tags:          []string{"gpu", "python"},
+		ExecEnv:       map[string]string{"DATASET": "foo", "NOTE": "Nightly Run"},
+		CreatedTs:     now - 7200,
+		StartedTs:     now - 3600,
+		LastUpdatedTs: now - 600,
+		WorkerId:      objectid.NewObjectId(),
+		ExitCode:      &one,
+		History:       []tasks.TaskTransition{{Ts: now - 600, NewState: "ERROR"}},
+	}
+	waiting := tasks.Task{
+		Id:            objectid.NewObjectId(),
+		TypeId:        "echo_task",
+		State:         "WAITING",
+		Tags:          []string{"bash"},
+		ExecEnv:       map[string]string{"DATASET": "bar"},
+		CreatedTs:     now - 60,
+		LastUpdatedTs: now - 60,
+	}
+
+	cases := []struct {
+		q       string
+		failed  bool
+		waiting bool
+	}{
+		{"env.DATASET=foo", true, false},
+		{"env.DATASET!=foo", false, true},
+		{"env.NOTE=none", false, true},
+		{`env.NOTE="Nightly Run"`, true, false},
+		{"env.NOTE~nightly", true, false},
+		{"state=ERROR OR state=WAITING", true, true},
+		{"state=ERROR state=WAITING", false, false},
+		{"type=echo_task AND tag=bash", false, true},
+		{"-tag=gpu", false, true},
+		{"NOT (tag=gpu OR tag=bash)", false, false},
+		{"tag~PY", true, false},
+		{"tag=none", false, false},
+		{"started>-2h", true, false},
+		{"started=none", false, true},
+		{"finished<-5m", true, false},
+		{"finished!=none", true, false},
+		{"created>-1h", false, true},
+		{"duration>=50m duration<1h", true, false},
+		{"exitCode!=0", true, false},
+		{"exitCode=none", false, true},
+		{"worker!=none", true, false},
+		{"worker=" + failed.WorkerId.Hex(), true, false},
+		{"id=" + waiting.Id.Hex(), false, true},
+		{"progress=0", true, true},
+		{"nightly", true, false},
+		{"BAR", false, true},
+		{"python OR bash", true, true},
+	}
+	for _, tc := range cases {
+		q, err := ParseTaskQuery(tc.q)
+		if !assert.NoError(t, err, tc.q) {
+			continue
+		}
+		assert.Equal(t, tc.failed, q.Matches(&failed), "%s on failed task", tc.q)
+		assert.Equal(t, tc.waiting, q.Matches(&waiting), "%s on waiting task", tc.q)
+	}
+
+	// Filters with a query only keep matches
+	conf := &TaskSearchConf{}
+	conf.Query, _ = ParseTaskQuery("env.DATASET=bar")
+	assert.False(t, conf.Matches(&failed))
+	assert.True(t, conf.Matches(&waiting))
+
+	for _, bad := range []string{
+		"",
+		"color=red",
+		"state<ERROR",
+		"started~2020",
+		"started>yesterday",
+		"duration>forever",
+		"exitCode=one",
+		"created>none",
+		"=foo",
+		"state=",
+		`env.NOTE="open`,
+		"(state=ERROR",
+		"state=ERROR)",
+		"state=ERROR OR",
+		"NOT",
+		"env.=foo",
+	} {
+		_, err := ParseTaskQuery(bad)
+		assert.Error(t, err, bad)
+	}
+}
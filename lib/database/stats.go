@@ -0,0 +1,461 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/turtlemonvh/blanket/tasks"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+
+Task statistics are kept as one record per hour per task type, updated in the same transaction as the
+change to the task that they count. A record counts tasks submitted, claimed and finished in that hour,
+and keeps histograms of how long tasks waited in the queue and how long they ran, for the type as a whole
+and for each tag. Reports add records up into hourly or daily buckets, so they cost the same however
+many tasks there are, and they outlive tasks removed by garbage collection.
+
+Percentiles are estimated from the histograms, so they are only as precise as StatsHistogramBounds.
+
+*/
+
+// Upper bounds in seconds of each histogram bucket; a last bucket holds anything longer
+var StatsHistogramBounds = []int64{1, 2, 5, 10, 30, 60, 120, 300, 600, 1800, 3600, 7200, 14400, 43200, 86400}
+
+// How reports bucket time
+const (
+	STATS_BUCKET_HOUR = "hour"
+	STATS_BUCKET_DAY  = "day"
+)
+
+var ValidStatsBuckets = []string{STATS_BUCKET_HOUR, STATS_BUCKET_DAY}
+
+// Most buckets a report can have
+const MAX_STATS_BUCKETS = 2000
+
+// Counts of times, in seconds, by StatsHistogramBounds
+type StatsHistogram struct {
+	Counts []int64 `json:"counts"`
+	Count  int64   `json:"count"`
+	Sum    int64   `json:"sum"`
+	Max    int64   `json:"max"`
+}
+
+func (h *StatsHistogram) Add(seconds int64) {
+	if seconds < 0 {
+		seconds = 0
+	}
+	if len(h.Counts) != len(StatsHistogramBounds)+1 {
+		h.Counts = make([]int64, len(StatsHistogramBounds)+1)
+	}
+	i := sort.Search(len(StatsHistogramBounds), func(i int) bool { return seconds <= StatsHistogramBounds[i] })
+	h.Counts[i]++
+	h.Count++
+	h.Sum += seconds
+	if seconds > h.Max {
+		h.Max = seconds
+	}
+}
+
+func (h *StatsHistogram) Merge(o *StatsHistogram) {
+	if o.Count == 0 {
+		return
+	}
+	if len(h.Counts) != len(StatsHistogramBounds)+1 {
+		h.Counts = make([]int64, len(StatsHistogramBounds)+1)
+	}
+	for i, n := range o.Counts {
+		h.Counts[i] += n
+	}
+	h.Count += o.Count
+	h.Sum += o.Sum
+	if o.Max > h.Max {
+		h.Max = o.Max
+	}
+}
+
+// Estimate the time at or under which fraction p of the counted times fall
+// Times are assumed to be spread evenly through their bucket
+func (h *StatsHistogram) Percentile(p float64) float64 {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := p * float64(h.Count)
+	var seen float64
+	for i, n := range h.Counts {
+		if n == 0 || seen+float64(n) < rank {
+			seen += float64(n)
+			continue
+		}
+		var lower, upper float64
+		if i > 0 {
+			lower = float64(StatsHistogramBounds[i-1])
+		}
+		if i < len(StatsHistogramBounds) {
+			upper = float64(StatsHistogramBounds[i])
+		} else {
+			upper = float64(h.Max)
+		}
+		if upper > float64(h.Max) {
+			upper = float64(h.Max)
+		}
+		if upper < lower {
+			return upper
+		}
+		return lower + (upper-lower)*(rank-seen)/float64(n)
+	}
+	return float64(h.Max)
+}
+
+// Counts for one type, or one tag of a type, in one hour
+type TaskStatsCounts struct {
+	Submitted int            `json:"submitted"`
+	Claimed   int            `json:"claimed"`
+	Finished  map[string]int `json:"finished"` // by the state the task finished in
+	Wait      StatsHistogram `json:"wait"`     // from submission until claimed
+	Duration  StatsHistogram `json:"duration"` // from start until finished, for tasks that started
+}
+
+func (sc *TaskStatsCounts) Merge(o *TaskStatsCounts) {
+	sc.Submitted += o.Submitted
+	sc.Claimed += o.Claimed
+	if sc.Finished == nil {
+		sc.Finished = make(map[string]int)
+	}
+	for state, n := range o.Finished {
+		sc.Finished[state] += n
+	}
+	sc.Wait.Merge(&o.Wait)
+	sc.Duration.Merge(&o.Duration)
+}
+
+// What one hour of one task type adds up to; what backends store
+type TaskStatsRecord struct {
+	HourTs int64                       `json:"hourTs"`
+	Type   string                      `json:"type"`
+	Counts TaskStatsCounts             `json:"counts"`
+	Tags   map[string]*TaskStatsCounts `json:"tags"`
+}
+
+// The start of the hour a time falls in
+func TaskStatsHour(ts int64) int64 {
+	return ts - ts%3600
+}
+
+// What a change to a task adds to its statistics
+type TaskStatsChange struct {
+	Ts            int64 // when it happened
+	Submitted     bool
+	Claimed       bool
+	Wait          int64
+	FinishedState string // "" if the task didn't finish
+	Duration      int64
+	HasDuration   bool // finished after starting
+}
+
+// The change between old, nil for a new task, and t, at time now
+// Returns false if nothing is counted, as for changes that keep the state
+func NewTaskStatsChange(old *tasks.Task, t *tasks.Task, now int64) (TaskStatsChange, bool) {
+	ch := TaskStatsChange{Ts: now}
+	oldState := ""
+	if old != nil {
+		oldState = old.State
+	} else {
+		ch.Submitted = true
+	}
+	if t.State != oldState {
+		if t.State == "CLAIMED" {
+			ch.Claimed = true
+			ch.Wait = now - t.CreatedTs
+		}
+		if isTerminalState(t.State) && !isTerminalState(oldState) {
+			ch.FinishedState = t.State
+			if t.StartedTs != 0 {
+				ch.Duration = now - t.StartedTs
+				ch.HasDuration = true
+			}
+		}
+	}
+	return ch, ch.Submitted || ch.Claimed || ch.FinishedState != ""
+}
+
+func isTerminalState(state string) bool {
+	for _, s := range tasks.ValidTerminalTaskStates {
+		if state == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Count a change to a task of this record's type, under the task's tags too
+func (rec *TaskStatsRecord) Apply(t *tasks.Task, ch TaskStatsChange) {
+	ch.applyTo(&rec.Counts)
+	if rec.Tags == nil {
+		rec.Tags = make(map[string]*TaskStatsCounts)
+	}
+	for _, tag := range t.Tags {
+		if rec.Tags[tag] == nil {
+			rec.Tags[tag] = &TaskStatsCounts{}
+		}
+		ch.applyTo(rec.Tags[tag])
+	}
+}
+
+func (ch TaskStatsChange) applyTo(sc *TaskStatsCounts) {
+	if ch.Submitted {
+		sc.Submitted++
+	}
+	if ch.Claimed {
+		sc.Claimed++
+		sc.Wait.Add(ch.Wait)
+	}
+	if ch.FinishedState != "" {
+		if sc.Finished == nil {
+			sc.Finished = make(map[string]int)
+		}
+		sc.Finished[ch.FinishedState]++
+		if ch.HasDuration {
+			sc.Duration.Add(ch.Duration)
+		}
+	}
+}
+
+// Replay a task's history as the changes it would have counted as they happened
+// Used to build statistics for tasks stored before they were kept
+func TaskStatsChangesFromHistory(t *tasks.Task) []TaskStatsChange {
+	changes := []TaskStatsChange{{Ts: t.CreatedTs, Submitted: true}}
+	prev := tasks.Task{CreatedTs: t.CreatedTs, StartedTs: t.StartedTs}
+	for _, tr := range t.History {
+		if tr.OldState == "" {
+			// The submission, already counted
+			prev.State = tr.NewState
+			continue
+		}
+		next := prev
+		next.State = tr.NewState
+		if ch, ok := NewTaskStatsChange(&prev, &next, tr.Ts); ok {
+			changes = append(changes, ch)
+		}
+		prev = next
+	}
+	return changes
+}
+
+/*
+ * Reports
+ */
+
+// Which statistics a report covers
+type TaskStatsQuery struct {
+	From   int64  // unix seconds, inclusive
+	To     int64  // unix seconds, exclusive
+	Bucket string // see ValidStatsBuckets
+	Types  map[string]bool
+	Tag    string // only count tasks with this tag
+}
+
+// Read a stats query from `from`, `to`, `bucket`, `types` and `tag`
+// Times take the same forms as times in task queries; the default is the last day, by hour
+func TaskStatsQueryFromContext(c *gin.Context) (*TaskStatsQuery, error) {
+	now := time.Now()
+	sq := &TaskStatsQuery{
+		From:   now.Add(-24 * time.Hour).Unix(),
+		To:     now.Unix() + 1,
+		Bucket: c.DefaultQuery("bucket", STATS_BUCKET_HOUR),
+		Types:  make(map[string]bool),
+		Tag:    c.Query("tag"),
+	}
+	if sq.Bucket != STATS_BUCKET_HOUR && sq.Bucket != STATS_BUCKET_DAY {
+		return nil, fmt.Errorf("Invalid bucket '%s'; must be one of: %v", sq.Bucket, ValidStatsBuckets)
+	}
+
+	var err error
+	for param, ts := range map[string]*int64{"from": &sq.From, "to": &sq.To} {
+		if raw := c.Query(param); raw != "" {
+			if *ts, err = parseRelativeTime(raw, now); err != nil {
+				return nil, fmt.Errorf("Invalid '%s' :: %s", param, err.Error())
+			}
+		}
+	}
+	if sq.To <= sq.From {
+		return nil, fmt.Errorf("'to' must be after 'from'")
+	}
+	if (sq.To-sq.From)/sq.bucketSeconds() > MAX_STATS_BUCKETS {
+		return nil, fmt.Errorf("Range covers more than %d buckets; use a shorter range or a larger bucket", MAX_STATS_BUCKETS)
+	}
+
+	for _, typeId := range collectCSV(c, "types") {
+		sq.Types[typeId] = true
+	}
+	return sq, nil
+}
+
+func (sq *TaskStatsQuery) bucketSeconds() int64 {
+	if sq.Bucket == STATS_BUCKET_DAY {
+		return 24 * 3600
+	}
+	return 3600
+}
+
+// The start of the bucket a time falls in; days are UTC
+func (sq *TaskStatsQuery) bucketStart(ts int64) int64 {
+	return ts - ts%sq.bucketSeconds()
+}
+
+// Times in seconds
+type TaskStatsTimes struct {
+	Count int64   `json:"count"`
+	Mean  float64 `json:"mean"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P95   float64 `json:"p95"`
+	P99   float64 `json:"p99"`
+	Max   int64   `json:"max"`
+}
+
+func newTaskStatsTimes(h *StatsHistogram) TaskStatsTimes {
+	st := TaskStatsTimes{Count: h.Count, Max: h.Max}
+	if h.Count > 0 {
+		st.Mean = float64(h.Sum) / float64(h.Count)
+		st.P50 = h.Percentile(0.5)
+		st.P90 = h.Percentile(0.9)
+		st.P95 = h.Percentile(0.95)
+		st.P99 = h.Percentile(0.99)
+	}
+	return st
+}
+
+// Statistics for some set of tasks over some time
+type TaskStatsSummary struct {
+	Submitted    int            `json:"submitted"`
+	Claimed      int            `json:"claimed"`
+	Finished     map[string]int `json:"finished"`
+	SuccessRatio float64        `json:"successRatio"` // SUCCESS over all finished; 0 if none finished
+	Wait         TaskStatsTimes `json:"wait"`
+	Duration     TaskStatsTimes `json:"duration"`
+}
+
+func newTaskStatsSummary(sc *TaskStatsCounts) TaskStatsSummary {
+	sum := TaskStatsSummary{
+		Submitted: sc.Submitted,
+		Claimed:   sc.Claimed,
+		Finished:  make(map[string]int),
+		Wait:      newTaskStatsTimes(&sc.Wait),
+		Duration:  newTaskStatsTimes(&sc.Duration),
+	}
+	finished := 0
+	for state, n := range sc.Finished {
+		sum.Finished[state] = n
+		finished += n
+	}
+	if finished > 0 {
+		sum.SuccessRatio = float64(sc.Finished["SUCCESS"]) / float64(finished)
+	}
+	return sum
+}
+
+type TaskStatsBucket struct {
+	Ts int64 `json:"ts"` // start of the bucket
+	TaskStatsSummary
+}
+
+type TaskStatsReport struct {
+	From    int64                       `json:"from"`
+	To      int64                       `json:"to"`
+	Bucket  string                      `json:"bucket"`
+	Totals  TaskStatsSummary            `json:"totals"`
+	ByType  map[string]TaskStatsSummary `json:"byType"`
+	ByTag   map[string]TaskStatsSummary `json:"byTag"`
+	Buckets []TaskStatsBucket           `json:"buckets"` // every bucket in the range, oldest first
+}
+
+// Add up records into a report
+// Records are hourly, so a range that doesn't start on the hour includes the whole first hour
+func SummarizeTaskStats(records []TaskStatsRecord, sq *TaskStatsQuery) TaskStatsReport {
+	var totals TaskStatsCounts
+	byType := make(map[string]*TaskStatsCounts)
+	byTag := make(map[string]*TaskStatsCounts)
+	byBucket := make(map[int64]*TaskStatsCounts)
+
+	for i := range records {
+		rec := &records[i]
+		if rec.HourTs+3600 <= sq.From || rec.HourTs >= sq.To {
+			continue
+		}
+		if len(sq.Types) > 0 && !sq.Types[rec.Type] {
+			continue
+		}
+		counts := &rec.Counts
+		if sq.Tag != "" {
+			if counts = rec.Tags[sq.Tag]; counts == nil {
+				continue
+			}
+		}
+
+		totals.Merge(counts)
+		mergeStatsInto(byType, rec.Type, counts)
+		mergeStatsInto(byBucket, sq.bucketStart(rec.HourTs), counts)
+		for tag, tc := range rec.Tags {
+			if sq.Tag == "" || tag == sq.Tag {
+				mergeStatsInto(byTag, tag, tc)
+			}
+		}
+	}
+
+	report := TaskStatsReport{
+		From:    sq.From,
+		To:      sq.To,
+		Bucket:  sq.Bucket,
+		Totals:  newTaskStatsSummary(&totals),
+		ByType:  make(map[string]TaskStatsSummary),
+		ByTag:   make(map[string]TaskStatsSummary),
+		Buckets: []TaskStatsBucket{},
+	}
+	for typeId, sc := range byType {
+		report.ByType[typeId] = newTaskStatsSummary(sc)
+	}
+	for tag, sc := range byTag {
+		report.ByTag[tag] = newTaskStatsSummary(sc)
+	}
+	for ts := sq.bucketStart(sq.From); ts < sq.To; ts += sq.bucketSeconds() {
+		sc := byBucket[ts]
+		if sc == nil {
+			sc = &TaskStatsCounts{}
+		}
+		report.Buckets = append(report.Buckets, TaskStatsBucket{Ts: ts, TaskStatsSummary: newTaskStatsSummary(sc)})
+	}
+	return report
+}
+
+func mergeStatsInto[K comparable](m map[K]*TaskStatsCounts, key K, sc *TaskStatsCounts) {
+	if m[key] == nil {
+		m[key] = &TaskStatsCounts{}
+	}
+	m[key].Merge(sc)
+}
+
+// Fetch and add up the statistics a query asks for
+func GetTaskStatsReport(ctx context.Context, db BlanketDB, sq *TaskStatsQuery) (TaskStatsReport, error) {
+	records, err := db.GetTaskStats(ctx, TaskStatsHour(sq.From), sq.To)
+	if err != nil {
+		return TaskStatsReport{}, err
+	}
+	return SummarizeTaskStats(records, sq), nil
+}
+
+// Unix seconds, a date, or a duration before now like -2h
+func parseRelativeTime(raw string, now time.Time) (int64, error) {
+	if rest, ok := strings.CutPrefix(raw, "-"); ok {
+		if d, err := parseQueryDuration(rest); err == nil {
+			return now.Unix() - d, nil
+		}
+	}
+	if t, ok := parseFilterTime(raw); ok {
+		return t.Unix(), nil
+	}
+	return 0, fmt.Errorf("expected unix seconds, a date like 2006-01-02, or a relative time like -2h")
+}
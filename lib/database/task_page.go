@@ -0,0 +1,183 @@
+package database
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/tasks"
+	"sort"
+)
+
+/*
+
+Task listings are paged with cursors rather than offsets.
+
+A cursor records the sort order and the sort value and id of the last task on a page. The next page starts
+with the first task after it, so pages don't shift as tasks are added or removed, and sorting by creation time
+(by id, which is how tasks are stored) seeks straight to the cursor instead of walking past earlier pages.
+Other sorts have no index to seek in, so they read every matching task.
+
+*/
+
+// Orders a task listing can be sorted in; ties are broken by id
+const (
+	SORT_CREATED  = "created" // the default
+	SORT_STARTED  = "started"
+	SORT_UPDATED  = "updated"
+	SORT_DURATION = "duration" // from start to last update; 0 if not started
+)
+
+var ValidTaskSorts = []string{SORT_CREATED, SORT_STARTED, SORT_UPDATED, SORT_DURATION}
+
+// One page of a task listing
+type TaskPage struct {
+	Items      []tasks.Task `json:"items"`
+	NextCursor string       `json:"nextCursor"` // "" on the last page
+	Total      int          `json:"total"`      // tasks matching the filters on every page; -1 if not counted
+}
+
+// Where a page ended
+type TaskCursor struct {
+	Sort    string            `json:"s"`
+	Reverse bool              `json:"r"`
+	Value   int64             `json:"v"`
+	Id      objectid.ObjectId `json:"i"`
+}
+
+// A cursor for the page after t
+func NewTaskCursor(t *tasks.Task, sortBy string, reverse bool) *TaskCursor {
+	if sortBy == "" {
+		sortBy = SORT_CREATED
+	}
+	return &TaskCursor{Sort: sortBy, Reverse: reverse, Value: TaskSortValue(t, sortBy), Id: t.Id}
+}
+
+// The opaque form sent to clients
+func (cur *TaskCursor) Encode() string {
+	bts, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(bts)
+}
+
+func DecodeTaskCursor(s string) (*TaskCursor, error) {
+	cur := &TaskCursor{}
+	bts, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(bts, cur)
+	}
+	if err != nil || cur.Id.IsZero() {
+		return nil, fmt.Errorf("Invalid cursor; use the nextCursor of a previous page")
+	}
+	return cur, nil
+}
+
+// True if t belongs on a page after the cursor
+func (cur *TaskCursor) Precedes(t *tasks.Task) bool {
+	return taskBefore(cur.Value, cur.Id, TaskSortValue(t, cur.Sort), t.Id, cur.Reverse)
+}
+
+// The value a task is sorted by, other than its id
+func TaskSortValue(t *tasks.Task, sortBy string) int64 {
+	switch sortBy {
+	case SORT_STARTED:
+		return t.StartedTs
+	case SORT_UPDATED:
+		return t.LastUpdatedTs
+	case SORT_DURATION:
+		if t.StartedTs == 0 {
+			return 0
+		}
+		return t.LastUpdatedTs - t.StartedTs
+	}
+	return 0
+}
+
+func taskBefore(aValue int64, aId objectid.ObjectId, bValue int64, bId objectid.ObjectId, reverse bool) bool {
+	if aValue == bValue {
+		if reverse {
+			return aId.Hex() > bId.Hex()
+		}
+		return aId.Hex() < bId.Hex()
+	}
+	if reverse {
+		return aValue > bValue
+	}
+	return aValue < bValue
+}
+
+// Sort tasks that matched a search and cut out the page it asks for
+// For backends that can't sort in storage
+func SortAndPageTasks(matched []tasks.Task, tc *TaskSearchConf) []tasks.Task {
+	sort.Slice(matched, func(i, j int) bool {
+		return taskBefore(TaskSortValue(&matched[i], tc.Sort), matched[i].Id, TaskSortValue(&matched[j], tc.Sort), matched[j].Id, tc.ReverseSort)
+	})
+
+	start := 0
+	if tc.Cursor != nil {
+		start = sort.Search(len(matched), func(i int) bool {
+			return tc.Cursor.Precedes(&matched[i])
+		})
+	}
+	start += tc.Offset
+	if start > len(matched) {
+		start = len(matched)
+	}
+	end := len(matched)
+	if tc.Limit < end-start {
+		end = start + tc.Limit
+	}
+	return matched[start:end]
+}
+
+// Set the sort, cursor and counting options of a search from `sort`, `cursor` and `total` query parameters
+func TaskPageConfFromContext(c *gin.Context, tc *TaskSearchConf) error {
+	tc.Sort = c.DefaultQuery("sort", SORT_CREATED)
+	isValid := false
+	for _, s := range ValidTaskSorts {
+		if tc.Sort == s {
+			isValid = true
+		}
+	}
+	if !isValid {
+		return fmt.Errorf("Invalid sort '%s'; must be one of: %v", tc.Sort, ValidTaskSorts)
+	}
+
+	if raw := c.Query("cursor"); raw != "" {
+		cur, err := DecodeTaskCursor(raw)
+		if err != nil {
+			return err
+		}
+		if cur.Sort != tc.Sort || cur.Reverse != tc.ReverseSort {
+			return fmt.Errorf("Cursor is for a different sort order; pass the same sort and reverseSort as the first page")
+		}
+		tc.Cursor = cur
+	}
+
+	// Counting every match reads past the page, so only do it when asked
+	tc.CountAll = c.Query("total") == "true"
+	return nil
+}
+
+// Fetch one page of a search, with the cursor for the next
+func GetTaskPage(ctx context.Context, db BlanketDB, tc *TaskSearchConf) (TaskPage, error) {
+	// Ask for one more than the page holds to find out if there is a next page
+	limit := tc.Limit
+	tc.Limit++
+	ts, nfound, err := db.GetTasks(ctx, tc)
+	tc.Limit = limit
+	if err != nil {
+		return TaskPage{}, err
+	}
+
+	page := TaskPage{Items: ts, Total: -1}
+	if limit > 0 && len(ts) > limit {
+		page.Items = ts[:limit]
+		page.NextCursor = NewTaskCursor(&ts[limit-1], tc.Sort, tc.ReverseSort).Encode()
+	}
+	if tc.CountAll {
+		page.Total = nfound
+	}
+	return page, nil
+}
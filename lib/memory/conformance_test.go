@@ -0,0 +1,23 @@
+package memory
+
+import (
+	"github.com/turtlemonvh/blanket/lib/conformance"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/lib/queue"
+	"testing"
+)
+
+func TestConformance(t *testing.T) {
+	conformance.RunDatabaseTests(t, func() (database.BlanketDB, func()) {
+		return NewBlanketMemoryDB(NewStore()), func() {}
+	})
+	conformance.RunQueueTests(t, func() (queue.BlanketQueue, func()) {
+		return NewBlanketMemoryQueue(NewStore()), func() {}
+	})
+	newBackend := func() (database.BlanketDB, queue.BlanketQueue, func()) {
+		s := NewStore()
+		return NewBlanketMemoryDB(s), NewBlanketMemoryQueue(s), func() {}
+	}
+	conformance.RunExportTests(t, newBackend)
+	conformance.RunBackendTests(t, newBackend)
+}
@@ -0,0 +1,424 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/tasks"
+	"github.com/turtlemonvh/blanket/worker"
+	"time"
+)
+
+// Concrete functions
+type BlanketMemoryDB struct {
+	s *Store
+}
+
+func NewBlanketMemoryDB(s *Store) database.BlanketDB {
+	return &BlanketMemoryDB{s}
+}
+
+// Run f with the store locked, unless ctx is done by the time the lock is free
+func (DB *BlanketMemoryDB) update(ctx context.Context, f func(d *storeData) error) error {
+	return DB.s.update(ctx, f)
+}
+
+// WORKERS
+
+// Get all workers
+func (DB *BlanketMemoryDB) GetWorkers(ctx context.Context) ([]worker.WorkerConf, error) {
+	ws := []worker.WorkerConf{}
+	err := DB.update(ctx, func(d *storeData) error {
+		for _, id := range sortedIds(d.workers) {
+			w := worker.WorkerConf{}
+			if err := json.Unmarshal(d.workers[id], &w); err != nil {
+				return err
+			}
+			ws = append(ws, w)
+		}
+		return nil
+	})
+	return ws, err
+}
+
+func (DB *BlanketMemoryDB) GetWorker(ctx context.Context, workerId objectid.ObjectId) (worker.WorkerConf, error) {
+	w := worker.WorkerConf{}
+	err := DB.update(ctx, func(d *storeData) error {
+		result := d.workers[workerId]
+		if result == nil {
+			return database.ItemNotFoundError(fmt.Sprintf("No item for id %v", workerId))
+		}
+		return json.Unmarshal(result, &w)
+	})
+	return w, err
+}
+
+// Write the whole worker record, creating it if it doesn't exist
+// A non-zero w.Revision must match the stored revision; w.Revision is set to the new revision
+func (DB *BlanketMemoryDB) UpdateWorker(ctx context.Context, w *worker.WorkerConf) error {
+	return DB.update(ctx, func(d *storeData) error {
+		eventType, oldState := database.EVENT_WORKER_CREATED, ""
+		old := worker.WorkerConf{}
+		if existing := d.workers[w.Id]; existing != nil {
+			if err := json.Unmarshal(existing, &old); err != nil {
+				return err
+			}
+			eventType, oldState = database.EVENT_WORKER_UPDATED, database.WorkerState(&old)
+		}
+		if w.Revision != 0 && w.Revision != old.Revision {
+			return database.RevisionConflictError{Id: w.Id.Hex(), Expected: w.Revision, Actual: old.Revision}
+		}
+
+		next := *w
+		next.Revision = old.Revision + 1
+		if err := d.putWorker(&next); err != nil {
+			return err
+		}
+		w.Revision = next.Revision
+		d.appendEvent(eventType, w.Id, oldState, database.WorkerState(w))
+		return nil
+	})
+}
+
+// Mark the worker stopped without touching its other fields
+func (DB *BlanketMemoryDB) StopWorker(ctx context.Context, workerId objectid.ObjectId) (worker.WorkerConf, error) {
+	return DB.modifyWorker(ctx, workerId, func(w *worker.WorkerConf) error {
+		w.Stopped = true
+		return nil
+	})
+}
+
+// Stop or let the worker take new tasks without touching its other fields
+func (DB *BlanketMemoryDB) DrainWorker(ctx context.Context, workerId objectid.ObjectId, draining bool) (worker.WorkerConf, error) {
+	return DB.modifyWorker(ctx, workerId, func(w *worker.WorkerConf) error {
+		w.Draining = draining
+		return nil
+	})
+}
+
+// Record that the worker checked in, returning its record so it can see if it has been stopped
+func (DB *BlanketMemoryDB) HeartbeatWorker(ctx context.Context, workerId objectid.ObjectId, ts int64) (worker.WorkerConf, error) {
+	return DB.modifyWorker(ctx, workerId, func(w *worker.WorkerConf) error {
+		w.LastHeardTs = ts
+		return nil
+	})
+}
+
+func (DB *BlanketMemoryDB) DeleteWorker(ctx context.Context, workerId objectid.ObjectId) error {
+	return DB.update(ctx, func(d *storeData) error {
+		existing := d.workers[workerId]
+		if existing == nil {
+			return nil
+		}
+		old := worker.WorkerConf{}
+		if err := json.Unmarshal(existing, &old); err != nil {
+			return err
+		}
+		delete(d.workers, workerId)
+		d.appendEvent(database.EVENT_WORKER_DELETED, workerId, database.WorkerState(&old), "")
+		return nil
+	})
+}
+
+// Nothing to clean up; see the bolt backend
+func (DB *BlanketMemoryDB) CleanupStalledWorkers(ctx context.Context) error {
+	return nil
+}
+
+// Like modifyTask, for workers; returns the worker as saved
+// Only changes of state are logged, so heartbeats don't flood the event log
+func (DB *BlanketMemoryDB) modifyWorker(ctx context.Context, workerId objectid.ObjectId, f func(w *worker.WorkerConf) error) (worker.WorkerConf, error) {
+	var w worker.WorkerConf
+	err := DB.update(ctx, func(d *storeData) error {
+		bts := d.workers[workerId]
+		if bts == nil {
+			return database.ItemNotFoundError(workerId.Hex())
+		}
+		if err := json.Unmarshal(bts, &w); err != nil {
+			return err
+		}
+
+		oldState := database.WorkerState(&w)
+		if err := f(&w); err != nil {
+			return err
+		}
+		w.Revision++
+		if err := d.putWorker(&w); err != nil {
+			return err
+		}
+		if newState := database.WorkerState(&w); newState != oldState {
+			d.appendEvent(database.EVENT_WORKER_UPDATED, w.Id, oldState, newState)
+		}
+		return nil
+	})
+	return w, err
+}
+
+func (d *storeData) putWorker(w *worker.WorkerConf) error {
+	bts, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	d.workers[w.Id] = bts
+	return nil
+}
+
+// TASKS
+
+func (DB *BlanketMemoryDB) GetTask(ctx context.Context, taskId objectid.ObjectId) (tasks.Task, error) {
+	var task tasks.Task
+	err := DB.update(ctx, func(d *storeData) (err error) {
+		task, err = d.getTask(taskId)
+		return err
+	})
+	return task, err
+}
+
+// Returns a list of tasks, the number found, and any error; counts the same way as the bolt backend
+func (DB *BlanketMemoryDB) GetTasks(ctx context.Context, tc *database.TaskSearchConf) ([]tasks.Task, int, error) {
+	var result []tasks.Task
+	var nfound int
+	err := DB.update(ctx, func(d *storeData) error {
+		var err error
+		result, nfound, err = findTasks(ctx, d.tasks, tc)
+		return err
+	})
+	return result, nfound, err
+}
+
+func (DB *BlanketMemoryDB) DeleteTask(ctx context.Context, taskId objectid.ObjectId) error {
+	return DB.update(ctx, func(d *storeData) error {
+		old, err := d.getTask(taskId)
+		if _, ok := err.(database.ItemNotFoundError); ok {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		delete(d.tasks, taskId)
+		d.countTaskState(old.State, "")
+		d.appendEvent(database.EVENT_TASK_DELETED, taskId, old.State, "")
+		return nil
+	})
+}
+
+// progress is a number [0:100]
+func (DB *BlanketMemoryDB) UpdateTaskProgress(ctx context.Context, taskId objectid.ObjectId, progress int) error {
+	return DB.modifyTask(ctx, taskId, func(t *tasks.Task) error {
+		t.Progress = progress
+		return nil
+	})
+}
+
+// Replace the tags on a task; the queue entry is updated separately
+func (DB *BlanketMemoryDB) UpdateTaskTags(ctx context.Context, taskId objectid.ObjectId, tags []string) error {
+	return DB.modifyTask(ctx, taskId, func(t *tasks.Task) error {
+		t.Tags = tags
+		return nil
+	})
+}
+
+// Record the state of one step of a multi-step task
+// Progress is set from the number of finished steps
+func (DB *BlanketMemoryDB) UpdateTaskStep(ctx context.Context, taskId objectid.ObjectId, step int, state string, exitCode int) error {
+	return DB.modifyTask(ctx, taskId, func(t *tasks.Task) error {
+		if t.State != "RUNNING" {
+			return fmt.Errorf("Task found in unexpected state; found '%s', expected 'RUNNING'", t.State)
+		}
+		t.LastUpdatedTs = time.Now().Unix()
+		return t.UpdateStep(step, state, exitCode, t.LastUpdatedTs)
+	})
+}
+
+// Record the state of one hook of a task
+// Hooks also run after the task has finished, so any state but WAITING is accepted
+func (DB *BlanketMemoryDB) UpdateTaskHook(ctx context.Context, taskId objectid.ObjectId, hook string, state string, exitCode int, followUpTaskId string) error {
+	return DB.modifyTask(ctx, taskId, func(t *tasks.Task) error {
+		if t.State == "WAITING" {
+			return fmt.Errorf("Task found in unexpected state; found 'WAITING', expected the task to be claimed")
+		}
+		t.LastUpdatedTs = time.Now().Unix()
+		return t.UpdateHook(hook, state, exitCode, followUpTaskId, t.LastUpdatedTs)
+	})
+}
+
+// Nothing to clean up; see the bolt backend
+func (DB *BlanketMemoryDB) CleanupStalledTasks(ctx context.Context) error {
+	return nil
+}
+
+// Any task with the same id is overwritten, unless t.Revision is set and doesn't match
+// t.Revision is set to the new revision
+func (DB *BlanketMemoryDB) SaveTask(ctx context.Context, t *tasks.Task) error {
+	return DB.update(ctx, func(d *storeData) error {
+		eventType, oldState := database.EVENT_TASK_CREATED, ""
+		var oldTask *tasks.Task
+		old, err := d.getTask(t.Id)
+		if err == nil {
+			eventType, oldState, oldTask = database.EVENT_TASK_UPDATED, old.State, &old
+		} else if _, ok := err.(database.ItemNotFoundError); !ok {
+			return err
+		}
+		if t.Revision != 0 && t.Revision != old.Revision {
+			return database.RevisionConflictError{Id: t.Id.Hex(), Expected: t.Revision, Actual: old.Revision}
+		}
+
+		next := *t
+		next.Revision = old.Revision + 1
+		if err := d.putTask(&next); err != nil {
+			return err
+		}
+		t.Revision = next.Revision
+		if err := d.recordTaskStats(oldTask, t, time.Now().Unix()); err != nil {
+			return err
+		}
+		d.countTaskState(oldState, t.State)
+		if err := d.queueTaskDeliveries(oldTask, t); err != nil {
+			return err
+		}
+		d.appendEvent(eventType, t.Id, oldState, t.State)
+		return nil
+	})
+}
+
+func (DB *BlanketMemoryDB) RunTask(ctx context.Context, taskId objectid.ObjectId, fields *database.TaskRunConfig) error {
+	return DB.modifyTask(ctx, taskId, func(t *tasks.Task) error {
+		if t.State != "CLAIMED" {
+			return fmt.Errorf("Task found in unexpected state; found '%s', expected 'CLAIMED'", t.State)
+		}
+		t.Transition("RUNNING", tasks.WorkerActor(t.WorkerId), "", fields.LastUpdatedTs)
+		t.Progress = 0
+		t.Timeout = int64(fields.Timeout)
+		t.LastUpdatedTs = int64(fields.LastUpdatedTs)
+		t.Pid = fields.Pid
+		t.TypeDigest = fields.TypeDigest
+		return nil
+	})
+}
+
+// Ask the worker that has a task to stop it
+// A second request can add force or change the reason
+func (DB *BlanketMemoryDB) RequestTaskCancel(ctx context.Context, taskId objectid.ObjectId, force bool, reason string) error {
+	return DB.modifyTask(ctx, taskId, func(t *tasks.Task) error {
+		if t.State != "RUNNING" && t.State != "CLAIMED" {
+			return fmt.Errorf("Task found in unexpected state; found '%s', expected 'CLAIMED' or 'RUNNING'", t.State)
+		}
+		if t.Cancellation == nil {
+			t.Cancellation = &tasks.TaskCancellation{RequestedTs: time.Now().Unix()}
+		}
+		t.Cancellation.Force = t.Cancellation.Force || force
+		if reason != "" {
+			t.Cancellation.Reason = reason
+		}
+		return nil
+	})
+}
+
+// Record progress on a cancel request
+// An empty outcome only acknowledges the request; otherwise the task moves to STOPPED
+// An empty actor means the worker that claimed the task
+func (DB *BlanketMemoryDB) UpdateTaskCancel(ctx context.Context, taskId objectid.ObjectId, actor string, outcome string) error {
+	return DB.modifyTask(ctx, taskId, func(t *tasks.Task) error {
+		if t.Cancellation == nil {
+			return fmt.Errorf("Task has no cancel request")
+		}
+		if t.State != "RUNNING" && t.State != "CLAIMED" {
+			return fmt.Errorf("Task found in unexpected state; found '%s', expected 'CLAIMED' or 'RUNNING'", t.State)
+		}
+		isValid := outcome == ""
+		for _, o := range tasks.ValidCancelOutcomes {
+			if outcome == o {
+				isValid = true
+				break
+			}
+		}
+		if !isValid {
+			return fmt.Errorf("Invalid cancel outcome '%s'; must be one of: %v", outcome, tasks.ValidCancelOutcomes)
+		}
+		if actor == "" {
+			actor = tasks.WorkerActor(t.WorkerId)
+		}
+
+		t.LastUpdatedTs = time.Now().Unix()
+		if t.Cancellation.AcknowledgedTs == 0 && outcome != tasks.CANCEL_UNACKNOWLEDGED {
+			t.Cancellation.AcknowledgedTs = t.LastUpdatedTs
+		}
+		if outcome != "" {
+			t.Cancellation.Outcome = outcome
+			t.Transition("STOPPED", actor, t.Cancellation.Reason, t.LastUpdatedTs)
+		}
+		return nil
+	})
+}
+
+// Set task to a terminal state
+// Checks that task is currently in the RUNNING state, or CLAIMED if it failed before it could start
+// Sets progress to 100 if the state is SUCCESS
+// An empty actor means the worker that claimed the task; exitCode is nil if the worker didn't report one
+func (DB *BlanketMemoryDB) FinishTask(ctx context.Context, taskId objectid.ObjectId, newState string, actor string, reason string, exitCode *int) error {
+	return DB.modifyTask(ctx, taskId, func(t *tasks.Task) error {
+		if t.State != "RUNNING" && t.State != "WAITING" && t.State != "CLAIMED" {
+			return fmt.Errorf("Task found in unexpected state; found '%s', expected 'RUNNING'", t.State)
+		}
+		if actor == "" {
+			actor = tasks.WorkerActor(t.WorkerId)
+		}
+		t.LastUpdatedTs = time.Now().Unix()
+		t.Transition(newState, actor, reason, t.LastUpdatedTs)
+		t.ExitCode = exitCode
+		if t.State == "SUCCESS" {
+			t.Progress = 100
+		}
+		return nil
+	})
+}
+
+// Change a task with f, bumping its revision and logging the change; nothing is saved if f returns an error
+func (DB *BlanketMemoryDB) modifyTask(ctx context.Context, taskId objectid.ObjectId, f func(t *tasks.Task) error) error {
+	return DB.update(ctx, func(d *storeData) error {
+		t, err := d.getTask(taskId)
+		if err != nil {
+			return err
+		}
+
+		old := t
+		if err = f(&t); err != nil {
+			return err
+		}
+		t.LastUpdatedTs = time.Now().Unix()
+		t.Revision++
+
+		if err = d.putTask(&t); err != nil {
+			return err
+		}
+		if err = d.recordTaskStats(&old, &t, t.LastUpdatedTs); err != nil {
+			return err
+		}
+		d.countTaskState(old.State, t.State)
+		if err = d.queueTaskDeliveries(&old, &t); err != nil {
+			return err
+		}
+		d.appendEvent(database.EVENT_TASK_UPDATED, t.Id, old.State, t.State)
+		return nil
+	})
+}
+
+func (d *storeData) getTask(taskId objectid.ObjectId) (t tasks.Task, err error) {
+	result := d.tasks[taskId]
+	if result == nil {
+		err = database.ItemNotFoundError(fmt.Sprintf("No item for id %v", taskId))
+		return
+	}
+	err = json.Unmarshal(result, &t)
+	return
+}
+
+func (d *storeData) putTask(t *tasks.Task) error {
+	bts, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	d.tasks[t.Id] = bts
+	return nil
+}
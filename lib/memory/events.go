@@ -0,0 +1,150 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/tasks"
+	"sort"
+	"time"
+)
+
+// EVENTS
+
+// Add an event to the log as part of the change it records
+func (d *storeData) appendEvent(eventType string, entityId objectid.ObjectId, oldState string, newState string) {
+	d.eventSeq++
+	d.events = append(d.events, database.Event{
+		Seq:      d.eventSeq,
+		Ts:       time.Now().Unix(),
+		Type:     eventType,
+		EntityId: entityId,
+		OldState: oldState,
+		NewState: newState,
+	})
+}
+
+// Events with a sequence number greater than since, oldest first
+func (DB *BlanketMemoryDB) GetEvents(ctx context.Context, since uint64, limit int) ([]database.Event, error) {
+	result := []database.Event{}
+	err := DB.update(ctx, func(d *storeData) error {
+		start := sort.Search(len(d.events), func(i int) bool {
+			return d.events[i].Seq > since
+		})
+		for i := start; i < len(d.events) && len(result) < limit; i++ {
+			result = append(result, d.events[i])
+		}
+		return nil
+	})
+	return result, err
+}
+
+// The sequence number of the oldest event kept, or of the next event if the log is empty
+func (DB *BlanketMemoryDB) FirstEventSeq(ctx context.Context) (uint64, error) {
+	var first uint64
+	err := DB.update(ctx, func(d *storeData) error {
+		first = d.eventSeq + 1
+		if len(d.events) > 0 {
+			first = d.events[0].Seq
+		}
+		return nil
+	})
+	return first, err
+}
+
+// Remove events from before the unix time before; returns how many were removed
+func (DB *BlanketMemoryDB) TrimEvents(ctx context.Context, before int64) (int, error) {
+	n := 0
+	err := DB.update(ctx, func(d *storeData) error {
+		for n < len(d.events) && d.events[n].Ts < before {
+			n++
+		}
+		d.events = append([]database.Event{}, d.events[n:]...)
+		return nil
+	})
+	return n, err
+}
+
+// STATISTICS
+
+// Count a change to a task as part of the change itself; old is nil for new tasks
+func (d *storeData) recordTaskStats(old *tasks.Task, t *tasks.Task, now int64) error {
+	ch, ok := database.NewTaskStatsChange(old, t, now)
+	if !ok {
+		return nil
+	}
+	return d.applyTaskStatsChange(t, ch)
+}
+
+func (d *storeData) applyTaskStatsChange(t *tasks.Task, ch database.TaskStatsChange) error {
+	k := taskStatsKey{database.TaskStatsHour(ch.Ts), t.TypeId}
+	rec := database.TaskStatsRecord{HourTs: k.hourTs, Type: k.typeId}
+	if v := d.stats[k]; v != nil {
+		if err := json.Unmarshal(v, &rec); err != nil {
+			return err
+		}
+	}
+	rec.Apply(t, ch)
+	js, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	d.stats[k] = js
+	return nil
+}
+
+// Move a task from oldState to newState in the counts; "" is no state, for new and deleted tasks
+func (d *storeData) countTaskState(oldState string, newState string) {
+	if oldState == newState {
+		return
+	}
+	if oldState != "" {
+		d.stateCounts[oldState]--
+	}
+	if newState != "" {
+		d.stateCounts[newState]++
+	}
+}
+
+// Records for every hour from fromHour up to to, oldest first
+func (DB *BlanketMemoryDB) GetTaskStats(ctx context.Context, fromHour int64, to int64) ([]database.TaskStatsRecord, error) {
+	result := []database.TaskStatsRecord{}
+	err := DB.update(ctx, func(d *storeData) error {
+		keys := []taskStatsKey{}
+		for k := range d.stats {
+			if k.hourTs >= fromHour && k.hourTs < to {
+				keys = append(keys, k)
+			}
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].hourTs != keys[j].hourTs {
+				return keys[i].hourTs < keys[j].hourTs
+			}
+			return keys[i].typeId < keys[j].typeId
+		})
+		for _, k := range keys {
+			rec := database.TaskStatsRecord{}
+			if err := json.Unmarshal(d.stats[k], &rec); err != nil {
+				return err
+			}
+			result = append(result, rec)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// Number of stored tasks in each state that has any
+func (DB *BlanketMemoryDB) CountTasksByState(ctx context.Context) (map[string]int, error) {
+	result := make(map[string]int)
+	err := DB.update(ctx, func(d *storeData) error {
+		for state, n := range d.stateCounts {
+			if n != 0 {
+				result[state] = n
+			}
+		}
+		return nil
+	})
+	return result, err
+}
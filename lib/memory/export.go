@@ -0,0 +1,119 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/tasks"
+	"io"
+	"time"
+)
+
+// The maps written by an export, in the order bolt writes its buckets
+func (d *storeData) exportMaps() []struct {
+	kind string
+	m    map[objectid.ObjectId][]byte
+} {
+	return []struct {
+		kind string
+		m    map[objectid.ObjectId][]byte
+	}{
+		{database.EXPORT_WORKER, d.workers},
+		{database.EXPORT_TASK, d.tasks},
+		{database.EXPORT_QUEUE, d.queue},
+		{database.EXPORT_WEBHOOK, d.webhooks},
+	}
+}
+
+// Write every worker, task, queue entry and webhook in the store
+func (DB *BlanketMemoryDB) Export(ctx context.Context, w io.Writer) error {
+	return DB.update(ctx, func(d *storeData) error {
+		enc := json.NewEncoder(w)
+
+		header, err := json.Marshal(database.ExportHeader{
+			Version:    database.EXPORT_FORMAT_VERSION,
+			ExportedTs: time.Now().Unix(),
+		})
+		if err != nil {
+			return err
+		}
+		if err = enc.Encode(database.ExportRecord{Kind: database.EXPORT_HEADER, Data: header}); err != nil {
+			return err
+		}
+
+		for _, em := range d.exportMaps() {
+			for _, id := range sortedIds(em.m) {
+				if err = database.CheckContext(ctx); err != nil {
+					return err
+				}
+				if err = enc.Encode(database.ExportRecord{Kind: em.kind, Data: em.m[id]}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Load an export; changes are made to a copy of the store, which replaces it only if every item is written
+func (DB *BlanketMemoryDB) Import(ctx context.Context, r io.Reader, opts database.ImportOptions) (database.ImportReport, error) {
+	items, err := database.DecodeExport(r, opts)
+	if err != nil {
+		return database.NewImportReport(opts), err
+	}
+
+	var report database.ImportReport
+	err = DB.update(ctx, func(d *storeData) error {
+		// Like bolt, replacing keeps webhook deliveries, the event log and settings
+		var next *storeData
+		if opts.Mode == database.IMPORT_REPLACE {
+			next = newStoreData()
+			next.deliveries, next.outbox, next.events, next.eventSeq = d.deliveries, d.outbox, d.events, d.eventSeq
+			next.queuePause = d.queuePause
+		} else {
+			next = d.clone()
+		}
+
+		target := &memoryImportTarget{d: next, maps: make(map[string]map[objectid.ObjectId][]byte)}
+		for _, em := range next.exportMaps() {
+			target.maps[em.kind] = em.m
+		}
+		if report, err = database.ImportItems(items, opts, target); err != nil {
+			return err
+		}
+		DB.s.data = next
+		return nil
+	})
+	return report, err
+}
+
+// The maps of the store being imported into, by export kind
+type memoryImportTarget struct {
+	d    *storeData
+	maps map[string]map[objectid.ObjectId][]byte
+}
+
+func (target *memoryImportTarget) Has(kind string, id objectid.ObjectId) bool {
+	return target.maps[kind][id] != nil
+}
+
+func (target *memoryImportTarget) Put(kind string, id objectid.ObjectId, value interface{}) error {
+	bts, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	target.maps[kind][id] = bts
+
+	// Statistics aren't exported, so count imported tasks from their history
+	// Imports only add tasks, so each one is new to the state counts
+	if t, ok := value.(*tasks.Task); ok && kind == database.EXPORT_TASK {
+		target.d.countTaskState("", t.State)
+		for _, ch := range database.TaskStatsChangesFromHistory(t) {
+			if err = target.d.applyTaskStatsChange(t, ch); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
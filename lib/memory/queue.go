@@ -0,0 +1,150 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/lib/queue"
+	"github.com/turtlemonvh/blanket/tasks"
+	"github.com/turtlemonvh/blanket/worker"
+	"time"
+)
+
+// Concrete functions
+type BlanketMemoryQueue struct {
+	s *Store
+}
+
+func NewBlanketMemoryQueue(s *Store) queue.BlanketQueue {
+	return &BlanketMemoryQueue{s}
+}
+
+func (Q *BlanketMemoryQueue) update(ctx context.Context, f func(d *storeData) error) error {
+	return Q.s.update(ctx, f)
+}
+
+func (Q *BlanketMemoryQueue) AddTask(ctx context.Context, t *tasks.Task) error {
+	return Q.update(ctx, func(d *storeData) error {
+		bts, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		d.queue[t.Id] = bts
+		return nil
+	})
+}
+
+// Change the tags on a queued task so the right workers can claim it
+// Tasks no longer in the queue are left alone; tasks already handed to a worker return queue.ErrTaskClaimed
+func (Q *BlanketMemoryQueue) UpdateTaskTags(ctx context.Context, taskId objectid.ObjectId, tags []string) error {
+	return Q.update(ctx, func(d *storeData) error {
+		bts := d.queue[taskId]
+		if bts == nil {
+			return nil
+		}
+
+		var t tasks.Task
+		if err := json.Unmarshal(bts, &t); err != nil {
+			return err
+		}
+		if !t.WorkerId.IsZero() {
+			return queue.ErrTaskClaimed
+		}
+		t.Tags = tags
+		return d.putQueued(&t)
+	})
+}
+
+// Claims are only lost with the process, which loses the whole queue too
+func (Q *BlanketMemoryQueue) CleanupUnclaimedTasks(ctx context.Context) error {
+	return nil
+}
+
+// Queued tasks not yet handed to a worker, by task type
+func (Q *BlanketMemoryQueue) CountTasks(ctx context.Context) (map[string]int, error) {
+	counts := make(map[string]int)
+	err := Q.update(ctx, func(d *storeData) error {
+		for _, bts := range d.queue {
+			var t tasks.Task
+			if err := json.Unmarshal(bts, &t); err != nil {
+				return err
+			}
+			if t.WorkerId.IsZero() {
+				counts[t.TypeId]++
+			}
+		}
+		return nil
+	})
+	return counts, err
+}
+
+// Claim the task the bolt queue would hand out: the newest unclaimed task the worker has every tag for
+// The returned functions remove the task from the queue, or hand it back
+func (Q *BlanketMemoryQueue) ClaimTask(ctx context.Context, worker *worker.WorkerConf) (tasks.Task, func() error, func() error, error) {
+	var task tasks.Task
+	tc := &database.TaskSearchConf{
+		Limit:         1,
+		ReverseSort:   true,
+		MaxTags:       worker.Tags,
+		JustUnclaimed: true,
+		SmallestId:    objectid.NewObjectIdWithTime(time.Unix(0, 0)),
+		LargestId:     objectid.NewObjectIdWithTime(time.Unix(database.FAR_FUTURE_SECONDS, 0)),
+	}
+
+	if worker.Draining {
+		return tasks.Task{}, nil, nil, queue.ErrQueueEmpty
+	}
+
+	err := Q.update(ctx, func(d *storeData) error {
+		if d.queuePause.Paused {
+			return queue.ErrQueuePaused
+		}
+		ts, _, err := findTasks(ctx, d.queue, tc)
+		if err != nil {
+			return err
+		}
+		if len(ts) != 1 {
+			return queue.ErrQueueEmpty
+		}
+		task = ts[0]
+		task.LastUpdatedTs = time.Now().Unix()
+		task.WorkerId = worker.Id
+		return d.putQueued(&task)
+	})
+	if err != nil {
+		return tasks.Task{}, nil, nil, err
+	}
+
+	ackCallback := func() error {
+		return Q.update(context.Background(), func(d *storeData) error {
+			delete(d.queue, task.Id)
+			return nil
+		})
+	}
+	nackCallback := func() error {
+		return Q.update(context.Background(), func(d *storeData) error {
+			bts := d.queue[task.Id]
+			if bts == nil {
+				return nil
+			}
+			var t tasks.Task
+			if err := json.Unmarshal(bts, &t); err != nil {
+				return err
+			}
+			t.LastUpdatedTs = time.Now().Unix()
+			t.WorkerId = *new(objectid.ObjectId)
+			return d.putQueued(&t)
+		})
+	}
+	return task, ackCallback, nackCallback, nil
+}
+
+func (d *storeData) putQueued(t *tasks.Task) error {
+	bts, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	d.queue[t.Id] = bts
+	return nil
+}
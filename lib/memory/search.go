@@ -0,0 +1,77 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/tasks"
+)
+
+// Tasks matching tc, and the number found; the count stops at the limit unless tc.CountAll is set
+// Walks the ids in order like the bolt cursor does, so both backends page and count the same way
+// Gives up with a database.CanceledError if ctx is done during the walk
+func findTasks(ctx context.Context, m map[objectid.ObjectId][]byte, tc *database.TaskSearchConf) ([]tasks.Task, int, error) {
+	result := []tasks.Task{}
+	nfound := 0
+	byId := tc.Sort == "" || tc.Sort == database.SORT_CREATED
+
+	// Where to start; when counting everything the walk covers the whole id range,
+	// and tasks up to the cursor are counted but not returned
+	smallest, largest := tc.SmallestId, tc.LargestId
+	if byId && tc.Cursor != nil && !tc.CountAll {
+		if tc.ReverseSort && bytes.Compare(tc.Cursor.Id[:], largest[:]) < 0 {
+			largest = tc.Cursor.Id
+		} else if !tc.ReverseSort && bytes.Compare(tc.Cursor.Id[:], smallest[:]) > 0 {
+			smallest = tc.Cursor.Id
+		}
+	}
+
+	ids := []objectid.ObjectId{}
+	for _, id := range sortedIds(m) {
+		if bytes.Compare(id[:], smallest[:]) >= 0 && bytes.Compare(id[:], largest[:]) <= 0 {
+			ids = append(ids, id)
+		}
+	}
+	if tc.ReverseSort {
+		for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+			ids[i], ids[j] = ids[j], ids[i]
+		}
+	}
+
+	matched := []tasks.Task{}
+	skipped := 0
+	for _, id := range ids {
+		if byId && nfound-skipped-tc.Offset == tc.Limit && !tc.CountAll {
+			break
+		}
+		if err := database.CheckContext(ctx); err != nil {
+			return nil, 0, err
+		}
+
+		t := tasks.Task{}
+		json.Unmarshal(m[id], &t)
+		if !tc.Matches(&t) {
+			continue
+		}
+		nfound += 1
+
+		if !byId {
+			matched = append(matched, t)
+			continue
+		}
+		if tc.Cursor != nil && !tc.Cursor.Precedes(&t) {
+			skipped += 1
+			continue
+		}
+		if n := nfound - skipped; n > tc.Offset && n-tc.Offset <= tc.Limit && !tc.JustCounts {
+			result = append(result, t)
+		}
+	}
+
+	if !byId && !tc.JustCounts {
+		result = database.SortAndPageTasks(matched, tc)
+	}
+	return result, nfound, nil
+}
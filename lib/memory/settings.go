@@ -0,0 +1,24 @@
+package memory
+
+import (
+	"context"
+	"github.com/turtlemonvh/blanket/lib/database"
+)
+
+// SETTINGS
+
+func (DB *BlanketMemoryDB) GetQueuePause(ctx context.Context) (database.QueuePause, error) {
+	var p database.QueuePause
+	err := DB.update(ctx, func(d *storeData) error {
+		p = d.queuePause
+		return nil
+	})
+	return p, err
+}
+
+func (DB *BlanketMemoryDB) SaveQueuePause(ctx context.Context, p *database.QueuePause) error {
+	return DB.update(ctx, func(d *storeData) error {
+		d.queuePause = *p
+		return nil
+	})
+}
@@ -0,0 +1,132 @@
+package memory
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"io"
+)
+
+/*
+
+Snapshots hold the whole store, unlike exports, which leave out what only makes sense to the server
+that wrote them. A restarted server gets back its pending webhook deliveries, its claim pause, and an
+event log whose numbering carries on, so clients resuming with `Last-Event-ID` don't miss anything.
+
+Files written before this format existed are exports; they still load, without those parts.
+
+*/
+
+const SNAPSHOT_FORMAT_VERSION = 1
+
+// Everything in a store; records are kept as stored, keyed by hex id
+type storeSnapshot struct {
+	Version    int                        `json:"snapshotVersion"`
+	Workers    map[string]json.RawMessage `json:"workers"`
+	Tasks      map[string]json.RawMessage `json:"tasks"`
+	Queue      map[string]json.RawMessage `json:"queue"`
+	Webhooks   map[string]json.RawMessage `json:"webhooks"`
+	Deliveries map[string]json.RawMessage `json:"deliveries"`
+	Outbox     []string                   `json:"outbox"`
+	Events     []database.Event           `json:"events"`
+	EventSeq   uint64                     `json:"eventSeq"`
+	Stats      []json.RawMessage          `json:"stats"`
+	QueuePause database.QueuePause        `json:"queuePause"`
+}
+
+func (d *storeData) snapshotMaps(snap *storeSnapshot) []struct {
+	kind string
+	m    map[objectid.ObjectId][]byte
+	s    *map[string]json.RawMessage
+} {
+	return []struct {
+		kind string
+		m    map[objectid.ObjectId][]byte
+		s    *map[string]json.RawMessage
+	}{
+		{database.EXPORT_WORKER, d.workers, &snap.Workers},
+		{database.EXPORT_TASK, d.tasks, &snap.Tasks},
+		{database.EXPORT_QUEUE, d.queue, &snap.Queue},
+		{database.EXPORT_WEBHOOK, d.webhooks, &snap.Webhooks},
+		{"delivery", d.deliveries, &snap.Deliveries},
+	}
+}
+
+func (d *storeData) writeSnapshot(w io.Writer) error {
+	snap := &storeSnapshot{
+		Version:    SNAPSHOT_FORMAT_VERSION,
+		Outbox:     []string{},
+		Events:     d.events,
+		EventSeq:   d.eventSeq,
+		Stats:      []json.RawMessage{},
+		QueuePause: d.queuePause,
+	}
+	for _, sm := range d.snapshotMaps(snap) {
+		*sm.s = make(map[string]json.RawMessage, len(sm.m))
+		for id, v := range sm.m {
+			(*sm.s)[id.Hex()] = v
+		}
+	}
+	for id := range d.outbox {
+		snap.Outbox = append(snap.Outbox, id.Hex())
+	}
+	for _, v := range d.stats {
+		snap.Stats = append(snap.Stats, v)
+	}
+	return json.NewEncoder(w).Encode(snap)
+}
+
+// Read a snapshot into new store data
+// Returns nil data with no error if bts isn't in the snapshot format, so it can be read as an export
+func readSnapshot(bts []byte) (*storeData, database.ImportReport, error) {
+	report := database.NewImportReport(database.ImportOptions{Mode: database.IMPORT_REPLACE})
+	snap := &storeSnapshot{}
+	if err := json.NewDecoder(bytes.NewReader(bts)).Decode(snap); err != nil || snap.Version == 0 {
+		return nil, report, nil
+	}
+	if snap.Version > SNAPSHOT_FORMAT_VERSION {
+		return nil, report, fmt.Errorf("Unsupported snapshot version %d; this build reads versions 1 to %d", snap.Version, SNAPSHOT_FORMAT_VERSION)
+	}
+
+	d := newStoreData()
+	for _, sm := range d.snapshotMaps(snap) {
+		for hex, v := range *sm.s {
+			if !objectid.IsObjectIdHex(hex) {
+				return nil, report, fmt.Errorf("Snapshot has an invalid %s id '%s'", sm.kind, hex)
+			}
+			sm.m[objectid.ObjectIdHex(hex)] = v
+		}
+		if len(sm.m) > 0 {
+			report.Imported[sm.kind] = len(sm.m)
+		}
+	}
+	// State counts aren't in snapshots; they are counted again from the tasks
+	var stored struct {
+		State string `json:"state"`
+	}
+	for id, v := range d.tasks {
+		stored.State = ""
+		if err := json.Unmarshal(v, &stored); err != nil {
+			return nil, report, fmt.Errorf("Snapshot has an invalid task %s :: %s", id.Hex(), err.Error())
+		}
+		d.countTaskState("", stored.State)
+	}
+	for _, hex := range snap.Outbox {
+		if !objectid.IsObjectIdHex(hex) {
+			return nil, report, fmt.Errorf("Snapshot has an invalid delivery id '%s'", hex)
+		}
+		d.outbox[objectid.ObjectIdHex(hex)] = true
+	}
+	for _, v := range snap.Stats {
+		rec := database.TaskStatsRecord{}
+		if err := json.Unmarshal(v, &rec); err != nil {
+			return nil, report, err
+		}
+		d.stats[taskStatsKey{rec.HourTs, rec.Type}] = v
+	}
+	d.events, d.eventSeq = snap.Events, snap.EventSeq
+	d.queuePause = snap.QueuePause
+	return d, report, nil
+}
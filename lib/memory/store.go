@@ -0,0 +1,188 @@
+/*
+
+A backend that keeps everything in process memory
+
+- For development servers and tests; nothing survives a restart unless snapshots are turned on
+- A Store plays the part of the bolt file: the database and queue made from one Store share it, the way
+  `blanket serve` shares one bolt file between them
+- Records are kept as JSON, like in bolt, so callers never share memory with what is stored
+- One lock covers the whole store, so every call is its own transaction
+
+*/
+
+package memory
+
+import (
+	"bytes"
+	"context"
+	log "github.com/sirupsen/logrus"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Store struct {
+	mu   sync.Mutex
+	data *storeData
+}
+
+type storeData struct {
+	workers    map[objectid.ObjectId][]byte
+	tasks      map[objectid.ObjectId][]byte
+	queue      map[objectid.ObjectId][]byte
+	webhooks   map[objectid.ObjectId][]byte
+	deliveries map[objectid.ObjectId][]byte
+	// Ids of deliveries still waiting to be sent
+	outbox map[objectid.ObjectId]bool
+	// Oldest first; eventSeq is the Seq of the last event added, which trimming leaves alone
+	events   []database.Event
+	eventSeq uint64
+	stats    map[taskStatsKey][]byte
+	// Number of tasks in each state, kept as tasks are written
+	stateCounts map[string]int
+	// Like bolt's settings, not part of exports; snapshots keep it
+	queuePause database.QueuePause
+}
+
+type taskStatsKey struct {
+	hourTs int64
+	typeId string
+}
+
+func NewStore() *Store {
+	return &Store{data: newStoreData()}
+}
+
+func newStoreData() *storeData {
+	return &storeData{
+		workers:     make(map[objectid.ObjectId][]byte),
+		tasks:       make(map[objectid.ObjectId][]byte),
+		queue:       make(map[objectid.ObjectId][]byte),
+		webhooks:    make(map[objectid.ObjectId][]byte),
+		deliveries:  make(map[objectid.ObjectId][]byte),
+		outbox:      make(map[objectid.ObjectId]bool),
+		stats:       make(map[taskStatsKey][]byte),
+		stateCounts: make(map[string]int),
+	}
+}
+
+// Run f with the store locked, unless ctx is done by the time the lock is free
+func (s *Store) update(ctx context.Context, f func(d *storeData) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := database.CheckContext(ctx); err != nil {
+		return err
+	}
+	return f(s.data)
+}
+
+// A copy to make changes to that can be thrown away; stored values are never modified in place, so they are shared
+func (d *storeData) clone() *storeData {
+	c := newStoreData()
+	for _, m := range []struct{ from, to map[objectid.ObjectId][]byte }{
+		{d.workers, c.workers},
+		{d.tasks, c.tasks},
+		{d.queue, c.queue},
+		{d.webhooks, c.webhooks},
+		{d.deliveries, c.deliveries},
+	} {
+		for k, v := range m.from {
+			m.to[k] = v
+		}
+	}
+	for k, v := range d.outbox {
+		c.outbox[k] = v
+	}
+	for k, v := range d.stats {
+		c.stats[k] = v
+	}
+	for k, v := range d.stateCounts {
+		c.stateCounts[k] = v
+	}
+	c.events = append(c.events, d.events...)
+	c.eventSeq = d.eventSeq
+	c.queuePause = d.queuePause
+	return c
+}
+
+// Ids in a map in increasing order, the order bolt keeps its keys in
+func sortedIds(m map[objectid.ObjectId][]byte) []objectid.ObjectId {
+	ids := make([]objectid.ObjectId, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(ids[i][:], ids[j][:]) < 0
+	})
+	return ids
+}
+
+// Write a snapshot of the store to path, replacing the file only once the snapshot is complete
+func (s *Store) SaveSnapshot(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	err = s.update(context.Background(), func(d *storeData) error {
+		return d.writeSnapshot(f)
+	})
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Replace the contents of the store with the snapshot at path; a missing file leaves the store as it is
+// Also loads exports, which is what snapshots used to be
+func (s *Store) LoadSnapshot(path string) (database.ImportReport, error) {
+	opts := database.ImportOptions{Mode: database.IMPORT_REPLACE}
+	bts, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return database.NewImportReport(opts), nil
+	} else if err != nil {
+		return database.NewImportReport(opts), err
+	}
+
+	d, report, err := readSnapshot(bts)
+	if err != nil {
+		return report, err
+	}
+	if d == nil {
+		return NewBlanketMemoryDB(s).(database.Exporter).Import(context.Background(), bytes.NewReader(bts), opts)
+	}
+	err = s.update(context.Background(), func(_ *storeData) error {
+		s.data = d
+		return nil
+	})
+	return report, err
+}
+
+// Save a snapshot to path every interval until stop is closed
+// Failures are logged and tried again at the next interval
+func (s *Store) RunSnapshots(path string, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := s.SaveSnapshot(path); err != nil {
+				log.WithFields(log.Fields{
+					"path": path,
+					"err":  err.Error(),
+				}).Warn("Could not save snapshot")
+			}
+		}
+	}
+}
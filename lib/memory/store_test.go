@@ -0,0 +1,132 @@
+package memory
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/lib/webhooks"
+	"github.com/turtlemonvh/blanket/tasks"
+	"github.com/turtlemonvh/blanket/worker"
+)
+
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "blanket.snapshot")
+
+	// Nothing to load yet
+	s := NewStore()
+	report, err := s.LoadSnapshot(path)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Imported)
+
+	DB, Q := NewBlanketMemoryDB(s), NewBlanketMemoryQueue(s)
+	w := worker.WorkerConf{Id: objectid.NewObjectId(), Tags: []string{"bash"}}
+	assert.NoError(t, DB.UpdateWorker(ctx, &w))
+	now := time.Now().Unix()
+	done := tasks.Task{Id: objectid.NewObjectId(), TypeId: "echo", State: "WAITING", CreatedTs: now}
+	assert.NoError(t, DB.SaveTask(ctx, &done))
+	assert.NoError(t, DB.FinishTask(ctx, done.Id, "SUCCESS", "", "", nil))
+	queued := tasks.Task{Id: objectid.NewObjectId(), TypeId: "echo", State: "WAITING", CreatedTs: now}
+	assert.NoError(t, DB.SaveTask(ctx, &queued))
+	assert.NoError(t, Q.AddTask(ctx, &queued))
+	hook := webhooks.Webhook{Id: objectid.NewObjectId(), URL: "http://localhost/hook", Events: []string{"task.finished"}}
+	assert.NoError(t, DB.SaveWebhook(ctx, &hook))
+	pending := webhooks.Delivery{Id: objectid.NewObjectId(), WebhookId: hook.Id, Event: "task.finished", State: webhooks.DELIVERY_PENDING, CreatedTs: now, NextAttemptTs: now}
+	assert.NoError(t, DB.SaveWebhookDelivery(ctx, &pending))
+	assert.NoError(t, DB.SaveQueuePause(ctx, &database.QueuePause{Paused: true, Reason: "upgrade", ChangedTs: now}))
+	events, err := DB.GetEvents(ctx, 0, 100)
+	assert.NoError(t, err)
+	assert.NoError(t, s.SaveSnapshot(path))
+
+	// A new process picks up where the last one stopped
+	restored := NewStore()
+	report, err = restored.LoadSnapshot(path)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"worker": 1, "task": 2, "queue": 1, "webhook": 1, "delivery": 1}, report.Imported)
+	rDB, rQ := NewBlanketMemoryDB(restored), NewBlanketMemoryQueue(restored)
+
+	// So does everything exports leave out: the event log, pending deliveries and the claim pause
+	restoredEvents, err := rDB.GetEvents(ctx, 0, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, events, restoredEvents)
+	due, err := rDB.GetDueWebhookDeliveries(ctx, now, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, due, 1) {
+		assert.Equal(t, pending.Id, due[0].Id)
+	}
+	pause, err := rDB.GetQueuePause(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "upgrade", pause.Reason)
+	assert.NoError(t, rDB.SaveQueuePause(ctx, &database.QueuePause{}))
+
+	fetched, err := rDB.GetTask(ctx, done.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, "SUCCESS", fetched.State)
+	byState, err := rDB.CountTasksByState(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"SUCCESS": 1, "WAITING": 1}, byState)
+	_, err = rDB.GetWorker(ctx, w.Id)
+	assert.NoError(t, err)
+	claimed, ack, _, err := rQ.ClaimTask(ctx, &w)
+	assert.NoError(t, err)
+	assert.Equal(t, queued.Id, claimed.Id)
+	assert.NoError(t, ack())
+
+	// Event numbering carries on
+	lastSeq := restoredEvents[len(restoredEvents)-1].Seq
+	assert.NoError(t, rDB.UpdateTaskProgress(ctx, claimed.Id, 10))
+	restoredEvents, err = rDB.GetEvents(ctx, lastSeq, 100)
+	assert.NoError(t, err)
+	if assert.Len(t, restoredEvents, 1) {
+		assert.Equal(t, lastSeq+1, restoredEvents[0].Seq)
+	}
+
+	// Statistics come back as they were
+	hour := database.TaskStatsHour(now)
+	stats, err := rDB.GetTaskStats(ctx, hour, hour+3600)
+	assert.NoError(t, err)
+	if assert.Len(t, stats, 1) {
+		assert.Equal(t, 2, stats[0].Counts.Submitted)
+		assert.Equal(t, 1, stats[0].Counts.Finished["SUCCESS"])
+	}
+
+	// Saving again replaces the file and leaves no temporary files behind
+	assert.NoError(t, restored.SaveSnapshot(path))
+	entries, err := os.ReadDir(filepath.Dir(path))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// A damaged snapshot is an error, and the store is left as it was
+	assert.NoError(t, os.WriteFile(path, []byte(`{"kind":"task"`), 0600))
+	_, err = restored.LoadSnapshot(path)
+	assert.Error(t, err)
+	_, err = rDB.GetTask(ctx, done.Id)
+	assert.NoError(t, err)
+}
+
+// Snapshots used to be exports, and those files still load
+func TestSnapshot_Export(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "blanket.snapshot")
+
+	s := NewStore()
+	task := tasks.Task{Id: objectid.NewObjectId(), TypeId: "echo", State: "WAITING", CreatedTs: time.Now().Unix()}
+	assert.NoError(t, NewBlanketMemoryDB(s).SaveTask(ctx, &task))
+	f, err := os.Create(path)
+	assert.NoError(t, err)
+	assert.NoError(t, NewBlanketMemoryDB(s).(database.Exporter).Export(ctx, f))
+	assert.NoError(t, f.Close())
+
+	restored := NewStore()
+	report, err := restored.LoadSnapshot(path)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"task": 1}, report.Imported)
+	_, err = NewBlanketMemoryDB(restored).GetTask(ctx, task.Id)
+	assert.NoError(t, err)
+}
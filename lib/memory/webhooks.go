@@ -0,0 +1,159 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/lib/webhooks"
+	"github.com/turtlemonvh/blanket/tasks"
+)
+
+// WEBHOOKS
+
+func (DB *BlanketMemoryDB) GetWebhooks(ctx context.Context) ([]webhooks.Webhook, error) {
+	result := []webhooks.Webhook{}
+	err := DB.update(ctx, func(d *storeData) error {
+		for _, id := range sortedIds(d.webhooks) {
+			w := webhooks.Webhook{}
+			if err := json.Unmarshal(d.webhooks[id], &w); err != nil {
+				return err
+			}
+			result = append(result, w)
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (DB *BlanketMemoryDB) GetWebhook(ctx context.Context, webhookId objectid.ObjectId) (webhooks.Webhook, error) {
+	w := webhooks.Webhook{}
+	err := DB.update(ctx, func(d *storeData) error {
+		result := d.webhooks[webhookId]
+		if result == nil {
+			return database.ItemNotFoundError(fmt.Sprintf("No item for id %v", webhookId))
+		}
+		return json.Unmarshal(result, &w)
+	})
+	return w, err
+}
+
+func (DB *BlanketMemoryDB) SaveWebhook(ctx context.Context, w *webhooks.Webhook) error {
+	return DB.update(ctx, func(d *storeData) error {
+		js, err := json.Marshal(w)
+		if err != nil {
+			return err
+		}
+		d.webhooks[w.Id] = js
+		return nil
+	})
+}
+
+// Delivery history is kept after the webhook is removed
+func (DB *BlanketMemoryDB) DeleteWebhook(ctx context.Context, webhookId objectid.ObjectId) error {
+	return DB.update(ctx, func(d *storeData) error {
+		if d.webhooks[webhookId] == nil {
+			return database.ItemNotFoundError(fmt.Sprintf("No item for id %v", webhookId))
+		}
+		delete(d.webhooks, webhookId)
+		return nil
+	})
+}
+
+// DELIVERIES
+
+// Save a delivery, adding it to or removing it from the outbox depending on its state
+func (DB *BlanketMemoryDB) SaveWebhookDelivery(ctx context.Context, dl *webhooks.Delivery) error {
+	return DB.update(ctx, func(d *storeData) error {
+		return d.putDelivery(dl)
+	})
+}
+
+func (d *storeData) putDelivery(dl *webhooks.Delivery) error {
+	js, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	d.deliveries[dl.Id] = js
+	if dl.State == webhooks.DELIVERY_PENDING {
+		d.outbox[dl.Id] = true
+	} else {
+		delete(d.outbox, dl.Id)
+	}
+	return nil
+}
+
+// Queue webhook deliveries for a change to a task along with the change; old is nil for new tasks
+func (d *storeData) queueTaskDeliveries(old *tasks.Task, t *tasks.Task) error {
+	name := webhooks.TaskEventName(old, t)
+	if name == "" {
+		return nil
+	}
+	hooks := webhooks.ConfigWebhooks()
+	for _, id := range sortedIds(d.webhooks) {
+		w := webhooks.Webhook{}
+		if err := json.Unmarshal(d.webhooks[id], &w); err != nil {
+			return err
+		}
+		hooks = append(hooks, w)
+	}
+
+	ds, err := webhooks.TaskDeliveries(hooks, name, t)
+	if err != nil {
+		return err
+	}
+	for i := range ds {
+		if err := d.putDelivery(&ds[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Most recent deliveries for a webhook, newest first
+func (DB *BlanketMemoryDB) GetWebhookDeliveries(ctx context.Context, webhookId objectid.ObjectId, limit int) ([]webhooks.Delivery, error) {
+	result := []webhooks.Delivery{}
+	err := DB.update(ctx, func(d *storeData) error {
+		ids := sortedIds(d.deliveries)
+		for i := len(ids) - 1; i >= 0 && len(result) < limit; i-- {
+			dl := webhooks.Delivery{}
+			if err := json.Unmarshal(d.deliveries[ids[i]], &dl); err != nil {
+				return err
+			}
+			if dl.WebhookId == webhookId {
+				result = append(result, dl)
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+// Pending deliveries whose next attempt is due at or before now (unix seconds), oldest first
+func (DB *BlanketMemoryDB) GetDueWebhookDeliveries(ctx context.Context, now int64, limit int) ([]webhooks.Delivery, error) {
+	result := []webhooks.Delivery{}
+	err := DB.update(ctx, func(d *storeData) error {
+		pending := make(map[objectid.ObjectId][]byte)
+		for id := range d.outbox {
+			pending[id] = d.deliveries[id]
+		}
+		for _, id := range sortedIds(pending) {
+			if len(result) == limit {
+				break
+			}
+			if pending[id] == nil {
+				continue
+			}
+			dl := webhooks.Delivery{}
+			if err := json.Unmarshal(pending[id], &dl); err != nil {
+				return err
+			}
+			if dl.NextAttemptTs <= now {
+				result = append(result, dl)
+			}
+		}
+		return nil
+	})
+	return result, err
+}
@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+	submitted := r.NewCounter("test_submitted_total", "Tasks submitted", "type")
+	depth := r.NewGauge("test_queue_depth", "Queued tasks", "type")
+	latency := r.NewHistogram("test_latency_seconds", "Latency", []float64{0.1, 1}, "route")
+	r.NewGauge("test_unused", "Never set")
+
+	submitted.Inc("echo")
+	submitted.Add(2, `say "hi"`)
+	depth.Set(4, "echo")
+	depth.SetAll(map[string]float64{"bash": 1})
+	latency.Observe(0.05, "/task/")
+	latency.Observe(0.1, "/task/")
+	latency.Observe(3, "/task/")
+
+	var buf bytes.Buffer
+	assert.NoError(t, r.Write(&buf))
+	assert.Equal(t, `# HELP test_latency_seconds Latency
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{route="/task/",le="0.1"} 2
+test_latency_seconds_bucket{route="/task/",le="1"} 2
+test_latency_seconds_bucket{route="/task/",le="+Inf"} 3
+test_latency_seconds_sum{route="/task/"} 3.15
+test_latency_seconds_count{route="/task/"} 3
+# HELP test_queue_depth Queued tasks
+# TYPE test_queue_depth gauge
+test_queue_depth{type="bash"} 1
+# HELP test_submitted_total Tasks submitted
+# TYPE test_submitted_total counter
+test_submitted_total{type="echo"} 1
+test_submitted_total{type="say \"hi\""} 2
+`, buf.String())
+
+	assert.Panics(t, func() { r.NewCounter("test_submitted_total", "Again") })
+	assert.Panics(t, func() { submitted.Inc() })
+	assert.Panics(t, func() { submitted.Add(-1, "echo") })
+}
@@ -1,9 +1,12 @@
 package queue
 
 import (
+	"context"
 	"errors"
+	"fmt"
 
 	"github.com/turtlemonvh/blanket/lib"
+	"github.com/turtlemonvh/blanket/lib/objectid"
 	"github.com/turtlemonvh/blanket/tasks"
 	"github.com/turtlemonvh/blanket/worker"
 )
@@ -14,9 +17,19 @@ import (
 // it to 204 No Content and the worker client returns a zero Task.
 var ErrQueueEmpty = errors.New("queue: no eligible tasks")
 
+// ErrTaskClaimed signals that a queued task has already been handed to a
+// worker, so changes to its queue entry would not be seen.
+var ErrTaskClaimed = errors.New("queue: task already claimed")
+
+// ErrQueuePaused signals that claims are paused across the server. It wraps
+// ErrQueueEmpty, so callers that only poll treat it the same way.
+var ErrQueuePaused = fmt.Errorf("queue: claims are paused: %w", ErrQueueEmpty)
+
 /*
 
 CAVEATS:
+- like the database, every function takes the context of its request and returns a database.CanceledError once
+  it is done
 - queues can define their own serialization for task objects; we use json strings stored as byte slices in boltdb
 
 FIXME:
@@ -25,9 +38,15 @@ FIXME:
 */
 
 type BlanketQueue interface {
-	AddTask(task *tasks.Task) error
-	ClaimTask(worker *worker.WorkerConf) (tasks.Task, func() error, func() error, error)
-	CleanupUnclaimedTasks() error
+	AddTask(ctx context.Context, task *tasks.Task) error
+	UpdateTaskTags(ctx context.Context, taskId objectid.ObjectId, tags []string) error
+	// The ack and nack functions aren't tied to ctx; a claim has to be settled even if its request went away
+	// Returns ErrQueuePaused while claims are paused in the database sharing the queue's storage, and
+	// ErrQueueEmpty to a draining worker
+	ClaimTask(ctx context.Context, worker *worker.WorkerConf) (tasks.Task, func() error, func() error, error)
+	CleanupUnclaimedTasks(ctx context.Context) error
+	// Queued tasks not yet handed to a worker, by task type
+	CountTasks(ctx context.Context) (map[string]int, error)
 }
 
 var (
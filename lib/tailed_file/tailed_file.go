@@ -58,8 +58,10 @@ func init() {
 			select {
 			case <-ticker.C:
 				// Update gauges
+				defaultTfc.Lock()
 				nTailedFiles.Set(int64(len(defaultTfc.fileList)))
-				nTailedFiles.Set(defaultTfc.GetSubscriberCount())
+				defaultTfc.Unlock()
+				nTailedFileSubscribers.Set(defaultTfc.GetSubscriberCount())
 			case <-quit:
 				ticker.Stop()
 				return
@@ -78,6 +80,8 @@ func NewTailedFileCollection() *TailedFileCollection {
 }
 
 func (tfc *TailedFileCollection) GetSubscriberCount() int64 {
+	tfc.Lock()
+	defer tfc.Unlock()
 	ntotal := 0
 	for _, tf := range tfc.fileList {
 		ntotal += len(tf.Subscribers)
@@ -0,0 +1,320 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/tasks"
+	"github.com/turtlemonvh/blanket/worker"
+	"net/url"
+	"time"
+)
+
+/*
+
+Outgoing webhooks for task and worker state transitions.
+
+- Subscriptions come from the `[[webhooks.subscriptions]]` config section or from the `/webhook/` API
+- Each event that matches a subscription is written to an outbox in the database as a Delivery
+- The server delivers pending entries in the background, retrying failures with exponential backoff
+- Every request body is signed with the subscription's secret; see Sign
+
+*/
+
+// Events sent to subscribers
+var ValidEvents = []string{
+	"task.claimed",
+	"task.running",
+	"task.finished",
+	"worker.registered",
+	"worker.draining",
+	"worker.resumed",
+	"worker.stopped",
+	"worker.deleted",
+}
+
+const (
+	SIGNATURE_HEADER = "X-Blanket-Signature"
+	EVENT_HEADER     = "X-Blanket-Event"
+	DELIVERY_HEADER  = "X-Blanket-Delivery"
+
+	// Delivery states
+	DELIVERY_PENDING   = "PENDING"
+	DELIVERY_DELIVERED = "DELIVERED"
+	DELIVERY_FAILED    = "FAILED" // gave up after too many attempts
+
+	MAX_RETRY_DELAY_SECONDS = 3600
+)
+
+// A subscription to events
+// Empty filters match everything; Types only matches task events
+type Webhook struct {
+	Id         objectid.ObjectId `json:"id"`
+	URL        string            `json:"url"`
+	Secret     string            `json:"secret,omitempty"`
+	Events     []string          `json:"events"` // see ValidEvents
+	Types      []string          `json:"types"`  // task types
+	Tags       []string          `json:"tags"`   // the task or worker must have all of these
+	States     []string          `json:"states"` // task state after the transition, or one of ValidWorkerStates
+	FromConfig bool              `json:"fromConfig"`
+	CreatedTs  int64             `json:"createdTs"`
+}
+
+// An event as sent to subscribers
+type Event struct {
+	DeliveryId objectid.ObjectId  `json:"id"`
+	Name       string             `json:"event"`
+	Ts         int64              `json:"timestamp"`
+	Task       *tasks.Task        `json:"task,omitempty"`
+	Worker     *worker.WorkerConf `json:"worker,omitempty"`
+}
+
+// One event queued for one webhook, along with its delivery history
+type Delivery struct {
+	Id            objectid.ObjectId `json:"id"`
+	WebhookId     objectid.ObjectId `json:"webhookId"`
+	Event         string            `json:"event"`
+	URL           string            `json:"url"`
+	Payload       json.RawMessage   `json:"payload"`
+	State         string            `json:"state"`
+	CreatedTs     int64             `json:"createdTs"`
+	NextAttemptTs int64             `json:"nextAttemptTs"`
+	DeliveredTs   int64             `json:"deliveredTs"`
+	Attempts      []Attempt         `json:"attempts"`
+}
+
+// The result of one try at delivering an event
+type Attempt struct {
+	Ts         int64  `json:"ts"`
+	StatusCode int    `json:"statusCode"`
+	Error      string `json:"error"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// States a worker event can be filtered on, as in database.WorkerState
+var ValidWorkerStates = []string{"RUNNING", "DRAINING", "STOPPED"}
+
+// Check a webhook before saving it
+func (w *Webhook) Validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Webhook 'url' must be an http or https URL; got '%s'", w.URL)
+	}
+	for _, e := range w.Events {
+		if !contains(ValidEvents, e) {
+			return fmt.Errorf("Invalid webhook event '%s'; must be one of: %v", e, ValidEvents)
+		}
+	}
+	for _, s := range w.States {
+		if !contains(tasks.ValidTaskStates, s) && !contains(ValidWorkerStates, s) {
+			return fmt.Errorf("Invalid webhook state '%s'; must be a task state (%v) or a worker state (%v)", s, tasks.ValidTaskStates, ValidWorkerStates)
+		}
+	}
+	return nil
+}
+
+// Copy of the webhook without its secret, for API responses
+func (w Webhook) Redacted() Webhook {
+	w.Secret = ""
+	return w
+}
+
+// Whether the webhook wants to hear about an event
+func (w *Webhook) Matches(e *Event) bool {
+	if len(w.Events) > 0 && !contains(w.Events, e.Name) {
+		return false
+	}
+	var state string
+	var tags []string
+	switch {
+	case e.Task != nil:
+		if len(w.Types) > 0 && !contains(w.Types, e.Task.TypeId) {
+			return false
+		}
+		state = e.Task.State
+		tags = e.Task.Tags
+	case e.Worker != nil:
+		if len(w.Types) > 0 {
+			return false
+		}
+		state = "RUNNING"
+		if e.Worker.Stopped {
+			state = "STOPPED"
+		} else if e.Worker.Draining {
+			state = "DRAINING"
+		}
+		tags = e.Worker.Tags
+	}
+	if len(w.States) > 0 && !contains(w.States, state) {
+		return false
+	}
+	for _, tag := range w.Tags {
+		if !contains(tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// Queue an event for a webhook
+// The payload is rendered now so later changes to the task or worker don't affect it
+func NewDelivery(w *Webhook, e Event) (Delivery, error) {
+	d := Delivery{
+		Id:        objectid.NewObjectId(),
+		WebhookId: w.Id,
+		Event:     e.Name,
+		URL:       w.URL,
+		State:     DELIVERY_PENDING,
+		CreatedTs: time.Now().Unix(),
+	}
+	d.NextAttemptTs = d.CreatedTs
+	e.DeliveryId = d.Id
+	payload, err := json.Marshal(e)
+	d.Payload = payload
+	return d, err
+}
+
+// The event to send for a change to a task, or "" if it has none; old is nil for new tasks
+// The database calls this in the transaction making the change, so no transition is published twice or missed
+func TaskEventName(old *tasks.Task, t *tasks.Task) string {
+	if old == nil || old.State == t.State {
+		return ""
+	}
+	switch {
+	case t.State == "CLAIMED":
+		return "task.claimed"
+	case t.State == "RUNNING":
+		return "task.running"
+	case contains(tasks.ValidTerminalTaskStates, t.State) && !contains(tasks.ValidTerminalTaskStates, old.State):
+		return "task.finished"
+	}
+	return ""
+}
+
+// Deliveries of an event about a task to every webhook in hooks that matches it
+// The payload is the task as it is after the transition, without its type snapshot, which can be large and is
+// available at /task/:id/type
+func TaskDeliveries(hooks []Webhook, name string, t *tasks.Task) ([]Delivery, error) {
+	task := *t
+	task.TypeSnapshot = nil
+	e := Event{Name: name, Ts: task.LastUpdatedTs, Task: &task}
+	ds := []Delivery{}
+	for i := range hooks {
+		if !hooks[i].Matches(&e) {
+			continue
+		}
+		d, err := NewDelivery(&hooks[i], e)
+		if err != nil {
+			return nil, err
+		}
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+// Record the result of an attempt and schedule the next one
+// Gives up once maxAttempts attempts have failed
+func (d *Delivery) RecordAttempt(a Attempt, maxAttempts int, baseDelaySeconds float64) {
+	d.Attempts = append(d.Attempts, a)
+	if a.Error == "" && a.StatusCode >= 200 && a.StatusCode < 300 {
+		d.State = DELIVERY_DELIVERED
+		d.DeliveredTs = a.Ts
+		d.NextAttemptTs = 0
+		return
+	}
+	if len(d.Attempts) >= maxAttempts {
+		d.State = DELIVERY_FAILED
+		d.NextAttemptTs = 0
+		return
+	}
+	d.NextAttemptTs = a.Ts + RetryDelay(len(d.Attempts), baseDelaySeconds)
+}
+
+// Seconds to wait before the next attempt after n failed attempts
+// Doubles each time, up to MAX_RETRY_DELAY_SECONDS
+func RetryDelay(n int, baseDelaySeconds float64) int64 {
+	delay := baseDelaySeconds
+	for i := 1; i < n && delay < MAX_RETRY_DELAY_SECONDS; i++ {
+		delay *= 2
+	}
+	if delay > MAX_RETRY_DELAY_SECONDS {
+		delay = MAX_RETRY_DELAY_SECONDS
+	}
+	return int64(delay)
+}
+
+// Signature sent in the X-Blanket-Signature header
+// Receivers should compute the HMAC-SHA256 of the raw body with the shared secret and compare
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Random secret for webhooks created without one
+func NewSecret() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Webhooks defined in the `[[webhooks.subscriptions]]` config section
+// Their ids are derived from the whole subscription so deliveries still line up with them after a restart
+func ConfigWebhooks() []Webhook {
+	var hooks []Webhook
+	for i, entry := range cast.ToSlice(viper.Get("webhooks.subscriptions")) {
+		conf := cast.ToStringMap(entry)
+		w := Webhook{
+			URL:        cast.ToString(conf["url"]),
+			Secret:     cast.ToString(conf["secret"]),
+			Events:     cast.ToStringSlice(conf["events"]),
+			Types:      cast.ToStringSlice(conf["types"]),
+			Tags:       cast.ToStringSlice(conf["tags"]),
+			States:     cast.ToStringSlice(conf["states"]),
+			FromConfig: true,
+		}
+		// Every field goes into the id, so subscriptions to the same url with other filters or secrets don't collide
+		js, err := json.Marshal(w)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"index": i,
+				"url":   w.URL,
+				"err":   err.Error(),
+			}).Warn("Skipping invalid webhook in config")
+			continue
+		}
+		sum := md5.Sum(js)
+		copy(w.Id[:], sum[:])
+		err = w.Validate()
+		if err == nil && w.Secret == "" {
+			err = fmt.Errorf("Webhook is missing required field 'secret'")
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"index": i,
+				"url":   w.URL,
+				"err":   err.Error(),
+			}).Warn("Skipping invalid webhook in config")
+			continue
+		}
+		hooks = append(hooks, w)
+	}
+	return hooks
+}
+
+func contains(vals []string, val string) bool {
+	for _, v := range vals {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/turtlemonvh/blanket/tasks"
+	"github.com/turtlemonvh/blanket/worker"
+)
+
+func TestWebhook_Matches(t *testing.T) {
+	task := &tasks.Task{TypeId: "echo_task", State: "ERROR", Tags: []string{"bash", "unix"}}
+	taskEvent := &Event{Name: "task.finished", Task: task}
+	workerEvent := &Event{Name: "worker.stopped", Worker: &worker.WorkerConf{Stopped: true, Tags: []string{"bash"}}}
+
+	all := Webhook{}
+	assert.True(t, all.Matches(taskEvent))
+	assert.True(t, all.Matches(workerEvent))
+
+	failures := Webhook{Types: []string{"echo_task"}, States: []string{"ERROR", "TIMEDOUT"}, Tags: []string{"unix"}}
+	assert.True(t, failures.Matches(taskEvent))
+	assert.False(t, failures.Matches(workerEvent))
+	task.State = "SUCCESS"
+	assert.False(t, failures.Matches(taskEvent))
+
+	workers := Webhook{Events: []string{"worker.stopped"}, States: []string{"STOPPED"}, Tags: []string{"bash"}}
+	assert.True(t, workers.Matches(workerEvent))
+	assert.False(t, workers.Matches(taskEvent))
+
+	draining := Webhook{States: []string{"DRAINING"}}
+	assert.False(t, draining.Matches(workerEvent))
+	assert.True(t, draining.Matches(&Event{Name: "worker.draining", Worker: &worker.WorkerConf{Draining: true}}))
+}
+
+func TestWebhook_Validate(t *testing.T) {
+	assert.NoError(t, (&Webhook{URL: "http://localhost:9999/hook", States: []string{"ERROR", "DRAINING"}}).Validate())
+	assert.Error(t, (&Webhook{URL: "http://localhost:9999/hook", States: []string{"PAUSED"}}).Validate())
+	assert.Error(t, (&Webhook{URL: "ftp://localhost/hook"}).Validate())
+}
+
+func TestDelivery_RecordAttempt(t *testing.T) {
+	w := Webhook{URL: "http://localhost:9999/hook"}
+	d, err := NewDelivery(&w, Event{Name: "task.running", Ts: 100, Task: &tasks.Task{State: "RUNNING"}})
+	assert.NoError(t, err)
+	assert.Equal(t, DELIVERY_PENDING, d.State)
+
+	// The delivery id is part of the payload so receivers can drop duplicates
+	var payload map[string]interface{}
+	assert.NoError(t, json.Unmarshal(d.Payload, &payload))
+	assert.Equal(t, d.Id.Hex(), payload["id"])
+	assert.Equal(t, "task.running", payload["event"])
+
+	d.RecordAttempt(Attempt{Ts: 1000, StatusCode: 500}, 3, 10)
+	assert.Equal(t, DELIVERY_PENDING, d.State)
+	assert.Equal(t, int64(1010), d.NextAttemptTs)
+	d.RecordAttempt(Attempt{Ts: 2000, Error: "connection refused"}, 3, 10)
+	assert.Equal(t, int64(2020), d.NextAttemptTs)
+	d.RecordAttempt(Attempt{Ts: 3000, StatusCode: 502}, 3, 10)
+	assert.Equal(t, DELIVERY_FAILED, d.State)
+	assert.Len(t, d.Attempts, 3)
+
+	assert.Equal(t, int64(MAX_RETRY_DELAY_SECONDS), RetryDelay(20, 10))
+
+	d, _ = NewDelivery(&w, Event{Name: "task.running"})
+	d.RecordAttempt(Attempt{Ts: 1000, StatusCode: 204}, 3, 10)
+	assert.Equal(t, DELIVERY_DELIVERED, d.State)
+	assert.Equal(t, int64(1000), d.DeliveredTs)
+}
+
+func TestSign(t *testing.T) {
+	// echo -n '{"event":"task.finished"}' | openssl dgst -sha256 -hmac secret
+	assert.Equal(t,
+		"sha256=69025628c9b95fb186f1e1d1a79fc301a41116ae56b588d2b83d2ac6ee0e81a1",
+		Sign("secret", []byte(`{"event":"task.finished"}`)),
+	)
+}
+
+func TestConfigWebhooks(t *testing.T) {
+	defer viper.Set("webhooks.subscriptions", nil)
+	viper.Set("webhooks.subscriptions", []interface{}{
+		map[string]interface{}{"url": "https://example.com/hook", "secret": "s3cret", "states": []interface{}{"ERROR"}},
+		map[string]interface{}{"url": "https://example.com/unsigned"},
+		map[string]interface{}{"url": "not a url", "secret": "x"},
+	})
+
+	hooks := ConfigWebhooks()
+	if assert.Len(t, hooks, 1) {
+		assert.True(t, hooks[0].FromConfig)
+		assert.Equal(t, []string{"ERROR"}, hooks[0].States)
+		// Ids stay the same across restarts
+		assert.Equal(t, hooks[0].Id, ConfigWebhooks()[0].Id)
+	}
+}
+
+func TestConfigWebhooks_SameURL(t *testing.T) {
+	defer viper.Set("webhooks.subscriptions", nil)
+	viper.Set("webhooks.subscriptions", []interface{}{
+		map[string]interface{}{"url": "https://example.com/hook", "secret": "a", "states": []interface{}{"ERROR"}},
+		map[string]interface{}{"url": "https://example.com/hook", "secret": "a", "states": []interface{}{"SUCCESS"}},
+		map[string]interface{}{"url": "https://example.com/hook", "secret": "b", "states": []interface{}{"ERROR"}},
+	})
+
+	hooks := ConfigWebhooks()
+	if assert.Len(t, hooks, 3) {
+		assert.NotEqual(t, hooks[0].Id, hooks[1].Id)
+		assert.NotEqual(t, hooks[0].Id, hooks[2].Id)
+		assert.NotEqual(t, hooks[1].Id, hooks[2].Id)
+	}
+}
+
+func TestTaskEventName(t *testing.T) {
+	waiting := &tasks.Task{State: "WAITING"}
+	claimed := &tasks.Task{State: "CLAIMED"}
+	running := &tasks.Task{State: "RUNNING"}
+	stopped := &tasks.Task{State: "STOPPED"}
+	assert.Equal(t, "", TaskEventName(nil, waiting))
+	assert.Equal(t, "task.claimed", TaskEventName(waiting, claimed))
+	assert.Equal(t, "task.running", TaskEventName(claimed, running))
+	assert.Equal(t, "task.finished", TaskEventName(running, stopped))
+	assert.Equal(t, "task.finished", TaskEventName(waiting, stopped))
+	assert.Equal(t, "", TaskEventName(running, running))
+	assert.Equal(t, "", TaskEventName(stopped, &tasks.Task{State: "ERROR"}))
+}
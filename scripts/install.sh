@@ -14,7 +14,7 @@ set -e
 
 REPO="turtlemonvh/blanket"
 RAW_BASE="https://raw.githubusercontent.com/$REPO/master"
-EXAMPLE_TYPES="echo_task.toml bash_task.toml python_hello.toml windows_echo.toml"
+EXAMPLE_TYPES="echo_task.toml bash_task.toml python_hello.toml windows_echo.toml pipeline_task.toml"
 
 # Detect OS
 OS=$(uname -s | tr '[:upper:]' '[:lower:]')
@@ -119,7 +119,7 @@ grep -q '<title>Blanket' <<<"$ui_body" || fail "/ui/ missing <title>Blanket"
 
 # /task/ starts empty.
 tasks_body="$(curl -fsS "$BASE/task/")"
-[[ "$tasks_body" == "[]" ]] || fail "/task/ should start empty, got '$tasks_body'"
+[[ "$tasks_body" == '{"items":[],"nextCursor":"","total":0}' ]] || fail "/task/ should start empty, got '$tasks_body'"
 
 # POST /task/ creates a task.
 create_resp="$(curl -fsS -X POST -H 'Content-Type: application/json' \
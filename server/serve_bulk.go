@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/lib/queue"
+	"github.com/turtlemonvh/blanket/tasks"
+	"io"
+	"math"
+	"net/http"
+)
+
+// Query parameters that select tasks for a bulk operation; see database.TaskSearchConfFromContext
+var bulkFilterParams = []string{"states", "types", "requiredTags", "maxTags", "createdAfter", "createdBefore", "q"}
+
+// Cancel, delete, rerun or retag many tasks at once
+// Tasks come from `ids` in the body, or else the same filters as `GET /task/`; without a `limit` every match is used
+// `?dryRun=true` only reports what matched
+func (s *ServerConfig) bulkTasks(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	var req tasks.BulkTaskRequest
+	err := json.NewDecoder(c.Request.Body).Decode(&req)
+	if err != nil && err != io.EOF {
+		c.String(http.StatusBadRequest, MakeErrorString("Error decoding JSON in request body."))
+		return
+	}
+
+	status, resp, err := s.runBulkTaskOp(c, c.Param("op"), &req, c.Query("dryRun") == "true")
+	if err != nil {
+		c.String(status, MakeErrorString(err.Error()))
+		return
+	}
+	c.JSON(status, resp)
+}
+
+// Shared by the API and the UI
+func (s *ServerConfig) runBulkTaskOp(c *gin.Context, op string, req *tasks.BulkTaskRequest, dryRun bool) (int, *tasks.BulkTaskResponse, error) {
+	isValid := false
+	for _, o := range tasks.ValidBulkOps {
+		if op == o {
+			isValid = true
+		}
+	}
+	if !isValid {
+		return http.StatusBadRequest, nil, fmt.Errorf("Invalid bulk operation '%s'; must be one of: %v", op, tasks.ValidBulkOps)
+	}
+	if op == tasks.BULK_RETAG && req.Tags == nil && len(req.AddTags) == 0 && len(req.RemoveTags) == 0 {
+		return http.StatusBadRequest, nil, fmt.Errorf("Retag needs at least one of 'tags', 'addTags' or 'removeTags'")
+	}
+
+	matched, missing, err := s.selectBulkTasks(c, req.Ids)
+	if err != nil {
+		return http.StatusBadRequest, nil, err
+	}
+
+	resp := &tasks.BulkTaskResponse{
+		Op:      op,
+		DryRun:  dryRun,
+		Matched: len(matched),
+		ByState: make(map[string]int),
+		Missing: missing,
+		Results: []tasks.BulkTaskResult{},
+	}
+	for _, t := range matched {
+		resp.ByState[t.State]++
+	}
+	if dryRun {
+		return http.StatusOK, resp, nil
+	}
+
+	for _, t := range matched {
+		result := s.applyBulkTaskOp(c.Request.Context(), op, &t, req)
+		if result.Error == "" {
+			resp.Succeeded++
+		} else {
+			resp.Failed++
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	for _, id := range missing {
+		resp.Failed++
+		resp.Results = append(resp.Results, tasks.BulkTaskResult{Id: id, Status: http.StatusNotFound, Error: "Task not found"})
+	}
+
+	log.WithFields(log.Fields{
+		"op":        op,
+		"matched":   resp.Matched,
+		"missing":   len(missing),
+		"succeeded": resp.Succeeded,
+		"failed":    resp.Failed,
+	}).Info("Finished bulk task operation")
+
+	return http.StatusOK, resp, nil
+}
+
+// Find the tasks a bulk operation applies to
+// Explicit ids win over filters; one or the other is required so an empty request can't match everything
+func (s *ServerConfig) selectBulkTasks(c *gin.Context, ids []string) ([]tasks.Task, []string, error) {
+	ctx := c.Request.Context()
+	var matched []tasks.Task
+	var missing []string
+
+	if len(ids) > 0 {
+		for _, id := range ids {
+			if !objectid.IsObjectIdHex(id) {
+				return nil, nil, fmt.Errorf("Invalid task id '%s'", id)
+			}
+		}
+		for _, id := range ids {
+			t, err := s.DB.GetTask(ctx, objectid.ObjectIdHex(id))
+			if err != nil {
+				if _, ok := err.(database.ItemNotFoundError); ok {
+					missing = append(missing, id)
+					continue
+				}
+				return nil, nil, err
+			}
+			matched = append(matched, t)
+		}
+		return matched, missing, nil
+	}
+
+	hasFilter := false
+	for _, p := range bulkFilterParams {
+		if c.Query(p) != "" {
+			hasFilter = true
+		}
+	}
+	if !hasFilter {
+		return nil, nil, fmt.Errorf("Pass 'ids' in the body or at least one filter (%v) in the query string", bulkFilterParams)
+	}
+
+	tc := database.TaskSearchConfFromContext(c)
+	if err := database.TaskQueryFromContext(c, tc); err != nil {
+		return nil, nil, err
+	}
+	if c.Query("limit") == "" {
+		tc.Limit = math.MaxInt32
+	}
+	tc.JustCounts = false
+	matched, _, err := s.DB.GetTasks(ctx, tc)
+	return matched, missing, err
+}
+
+func (s *ServerConfig) applyBulkTaskOp(ctx context.Context, op string, t *tasks.Task, req *tasks.BulkTaskRequest) tasks.BulkTaskResult {
+	result := tasks.BulkTaskResult{Id: t.Id.Hex()}
+
+	var err error
+	switch op {
+	case tasks.BULK_CANCEL:
+		result.Status, _, err = s.cancelTaskById(ctx, t.Id, req.Force, req.Reason)
+	case tasks.BULK_DELETE:
+		result.Status = http.StatusOK
+		if err = s.deleteTaskById(ctx, t.Id); err != nil {
+			result.Status = http.StatusInternalServerError
+		}
+	case tasks.BULK_RERUN:
+		var rerun *tasks.Task
+		result.Status, rerun, err = s.rerunTaskById(ctx, t.Id, req.Environment)
+		if rerun != nil {
+			result.NewTaskId = rerun.Id.Hex()
+		}
+	case tasks.BULK_RETAG:
+		result.Status, err = s.retagTaskById(ctx, t, req)
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// Change the tags on one task; WAITING tasks are changed in the queue first so workers see the new tags
+func (s *ServerConfig) retagTaskById(ctx context.Context, t *tasks.Task, req *tasks.BulkTaskRequest) (int, error) {
+	newTags := t.Tags
+	if req.Tags != nil {
+		newTags = req.Tags
+	}
+
+	tags := []string{}
+	seen := make(map[string]bool)
+	for _, tag := range append(append([]string{}, newTags...), req.AddTags...) {
+		if seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		removed := false
+		for _, r := range req.RemoveTags {
+			if tag == r {
+				removed = true
+			}
+		}
+		if !removed {
+			tags = append(tags, tag)
+		}
+	}
+
+	if t.State == "WAITING" {
+		err := s.Q.UpdateTaskTags(ctx, t.Id, tags)
+		if errors.Is(err, queue.ErrTaskClaimed) {
+			return http.StatusConflict, fmt.Errorf("Task was claimed by a worker before it could be retagged")
+		} else if err != nil {
+			return errorStatus(err), err
+		}
+	}
+
+	err := s.DB.UpdateTaskTags(ctx, t.Id, tags)
+	if err != nil {
+		return errorStatus(err), err
+	}
+	s.TaskEvents.Notify()
+	return http.StatusOK, nil
+}
@@ -0,0 +1,187 @@
+// Covered:
+//   - POST /task/bulk/:op request validation and dry runs: TestBulkTasks_DryRun
+//   - retag by id list, including queued tasks and missing ids: TestBulkTasks_Retag
+//   - cancel, rerun and delete by filter: TestBulkTasks_ByFilter
+//   - no request deadline, so every task is handled: TestBulkTasks_NoDeadline
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/tasks"
+	"github.com/turtlemonvh/blanket/worker"
+)
+
+func postBulk(t *testing.T, r http.Handler, path string, body string) (int, tasks.BulkTaskResponse) {
+	t.Helper()
+	var resp tasks.BulkTaskResponse
+	w := postJSON(r, path, body)
+	if w.Code == http.StatusOK {
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	}
+	return w.Code, resp
+}
+
+func TestBulkTasks_DryRun(t *testing.T) {
+	cleanup := setupTestTaskType(t)
+	defer cleanup()
+
+	s, scleanup := NewTestServer()
+	defer scleanup()
+	r := s.GetRouter()
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusCreated, postTask(r, "echo_task").Code)
+	}
+
+	code, _ := postBulk(t, r, "/task/bulk/explode?states=WAITING", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	// Neither ids nor a filter
+	code, _ = postBulk(t, r, "/task/bulk/delete", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = postBulk(t, r, "/task/bulk/retag?states=WAITING", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = postBulk(t, r, "/task/bulk/delete", `{"ids": ["nope"]}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, resp := postBulk(t, r, "/task/bulk/delete?states=WAITING&dryRun=true", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, resp.DryRun)
+	assert.Equal(t, 3, resp.Matched)
+	assert.Equal(t, map[string]int{"WAITING": 3}, resp.ByState)
+	assert.Empty(t, resp.Results)
+
+	req, _ := http.NewRequest("GET", "/task/", nil)
+	assertResponseLength(t, r, req, 3)
+}
+
+func TestBulkTasks_Retag(t *testing.T) {
+	ctx := context.Background()
+	cleanup := setupTestTaskType(t)
+	defer cleanup()
+
+	s, scleanup := NewTestServer()
+	defer scleanup()
+	r := s.GetRouter()
+
+	var first, second tasks.Task
+	json.Unmarshal(postTask(r, "echo_task").Body.Bytes(), &first)
+	json.Unmarshal(postTask(r, "echo_task").Body.Bytes(), &second)
+	missing := objectid.NewObjectId().Hex()
+
+	body := fmt.Sprintf(`{"ids": [%q, %q], "addTags": ["gpu"], "removeTags": ["unix"]}`, first.Id.Hex(), missing)
+	code, resp := postBulk(t, r, "/task/bulk/retag", body)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, resp.Matched)
+	assert.Equal(t, []string{missing}, resp.Missing)
+	assert.Equal(t, 1, resp.Succeeded)
+	assert.Equal(t, 1, resp.Failed)
+	if assert.Len(t, resp.Results, 2) {
+		assert.Equal(t, tasks.BulkTaskResult{Id: first.Id.Hex(), Status: http.StatusOK}, resp.Results[0])
+		assert.Equal(t, http.StatusNotFound, resp.Results[1].Status)
+	}
+
+	retagged, err := s.DB.GetTask(ctx, first.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bash", "gpu"}, retagged.Tags)
+	untouched, err := s.DB.GetTask(ctx, second.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bash", "unix"}, untouched.Tags)
+
+	// Workers claim from the queue, so it has to see the new tags too
+	gpuWorker := worker.WorkerConf{Id: objectid.NewObjectId(), Tags: []string{"bash", "gpu"}}
+	assert.NoError(t, s.DB.UpdateWorker(ctx, &gpuWorker))
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/task/claim/%s", gpuWorker.Id.Hex()), nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var claimed tasks.Task
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &claimed))
+	assert.Equal(t, first.Id, claimed.Id)
+	assert.Equal(t, []string{"bash", "gpu"}, claimed.Tags)
+}
+
+func TestBulkTasks_ByFilter(t *testing.T) {
+	ctx := context.Background()
+	cleanup := setupTestTaskType(t)
+	defer cleanup()
+
+	s, scleanup := NewTestServer()
+	defer scleanup()
+	r := s.GetRouter()
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusCreated, postTask(r, "echo_task").Code)
+	}
+
+	code, resp := postBulk(t, r, "/task/bulk/cancel?states=WAITING", `{"reason": "cleanup"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 3, resp.Succeeded)
+	for _, result := range resp.Results {
+		stopped, err := s.DB.GetTask(ctx, objectid.ObjectIdHex(result.Id))
+		assert.NoError(t, err)
+		assert.Equal(t, "STOPPED", stopped.State)
+		assert.Equal(t, "cleanup", stopped.History[len(stopped.History)-1].Reason)
+	}
+
+	// Finished tasks can't be cancelled again
+	code, resp = postBulk(t, r, "/task/bulk/cancel?states=STOPPED", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 3, resp.Failed)
+	assert.Equal(t, http.StatusConflict, resp.Results[0].Status)
+
+	code, resp = postBulk(t, r, "/task/bulk/rerun?states=STOPPED&limit=2", `{"environment": {"NAME": "again"}}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 2, resp.Succeeded)
+	for _, result := range resp.Results {
+		assert.Equal(t, http.StatusCreated, result.Status)
+		rerun, err := s.DB.GetTask(ctx, objectid.ObjectIdHex(result.NewTaskId))
+		assert.NoError(t, err)
+		assert.Equal(t, result.Id, rerun.RerunOf)
+		assert.Equal(t, "again", rerun.ExecEnv["NAME"])
+	}
+
+	code, resp = postBulk(t, r, "/task/bulk/delete?states=STOPPED", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 3, resp.Succeeded)
+
+	req, _ := http.NewRequest("GET", "/task/", nil)
+	assertResponseLength(t, r, req, 2)
+}
+
+func TestBulkTasks_NoDeadline(t *testing.T) {
+	cleanup := setupTestTaskType(t)
+	defer cleanup()
+
+	s, scleanup := NewTestServer()
+	defer scleanup()
+	r := s.GetRouter()
+
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusCreated, postTask(r, "echo_task").Code)
+	}
+
+	// Far shorter than any one task takes
+	viper.Set("server.requestTimeoutSeconds", 0.000001)
+	defer viper.Set("server.requestTimeoutSeconds", 0)
+	code, resp := postBulk(t, r, "/task/bulk/retag?states=WAITING", `{"addTags": ["gpu"]}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 5, resp.Succeeded)
+	assert.Equal(t, 0, resp.Failed)
+
+	w := postJSON(r, "/ops/gc", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	viper.Set("server.requestTimeoutSeconds", 0)
+	req, _ := http.NewRequest("GET", "/task/?requiredTags=gpu", nil)
+	assertResponseLength(t, r, req, 5)
+}
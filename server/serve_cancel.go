@@ -0,0 +1,217 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/tasks"
+	"math"
+	"net/http"
+	"time"
+)
+
+const (
+	// Longest a worker can wait on `GET /task/:id/cancel`, in seconds
+	MAX_CANCEL_WAIT_SECONDS = 60
+	// How often the server looks for cancel requests no worker picked up, in seconds
+	CANCEL_CHECK_INTERVAL_SECONDS = 5
+)
+
+// Called for stopping
+// WAITING tasks are stopped right away; CLAIMED and RUNNING tasks get a cancel request for their worker
+// `?force=true` kills the command instead of asking it to exit; `?reason=` is recorded in the task's history
+func (s *ServerConfig) cancelTask(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	taskId, err := s.getTaskId(c)
+	if err != nil {
+		return
+	}
+
+	status, cancellation, err := s.cancelTaskById(c.Request.Context(), taskId, c.Query("force") == "true", c.Query("reason"))
+	if err != nil {
+		c.String(status, MakeErrorString(err.Error()))
+		return
+	}
+	if cancellation == nil {
+		c.String(status, `{}`)
+		return
+	}
+	c.JSON(status, cancellation)
+}
+
+// Stop a WAITING task, or ask the worker of a CLAIMED or RUNNING one to stop it
+// Returns the status code to report, and the cancel request if one was made
+func (s *ServerConfig) cancelTaskById(ctx context.Context, taskId objectid.ObjectId, force bool, reason string) (int, *tasks.TaskCancellation, error) {
+	task, err := s.DB.GetTask(ctx, taskId)
+	if err != nil {
+		// Should already be there since we will write to db first before adding to queue
+		if _, ok := err.(database.ItemNotFoundError); ok {
+			return http.StatusNotFound, nil, err
+		}
+		return errorStatus(err), nil, err
+	}
+
+	switch task.State {
+	case "WAITING":
+		// The claim handler skips STOPPED tasks when they come out of the queue
+		err = s.DB.FinishTask(ctx, taskId, "STOPPED", tasks.ACTOR_API, reason, nil)
+		if err != nil {
+			return errorStatus(err), nil, err
+		}
+		s.TaskEvents.Notify()
+		s.taskFinished(taskId)
+		return http.StatusOK, nil, nil
+	case "CLAIMED", "RUNNING":
+		err = s.DB.RequestTaskCancel(ctx, taskId, force, reason)
+		if _, ok := err.(database.CanceledError); ok {
+			return errorStatus(err), nil, err
+		} else if err != nil {
+			return http.StatusConflict, nil, err
+		}
+		s.TaskEvents.Notify()
+		task, err = s.DB.GetTask(ctx, taskId)
+		if err != nil {
+			return errorStatus(err), nil, err
+		}
+		return http.StatusAccepted, task.Cancellation, nil
+	default:
+		return http.StatusConflict, nil, fmt.Errorf("Task is already finished in state '%s'", task.State)
+	}
+}
+
+// Wait for a cancel request on a task
+// Called by the worker while the task runs; returns the request, or 204 if none came within `?wait=` seconds
+func (s *ServerConfig) waitForTaskCancel(c *gin.Context) {
+	ctx := c.Request.Context()
+	c.Header("Content-Type", "application/json")
+
+	taskId, err := s.getTaskId(c)
+	if err != nil {
+		return
+	}
+	wait, err := waitParam(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, MakeErrorString(err.Error()))
+		return
+	}
+	if wait > MAX_CANCEL_WAIT_SECONDS*time.Second {
+		wait = MAX_CANCEL_WAIT_SECONDS * time.Second
+	}
+
+	// Subscribe before the first read so a request made in between isn't missed
+	changed := s.TaskEvents.Subscribe()
+	defer s.TaskEvents.Unsubscribe(changed)
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	for {
+		task, err := s.DB.GetTask(ctx, taskId)
+		if err != nil {
+			if _, ok := err.(database.ItemNotFoundError); ok {
+				c.String(http.StatusNotFound, MakeErrorString(err.Error()))
+				return
+			}
+			c.String(errorStatus(err), MakeErrorString(err.Error()))
+			return
+		}
+		if task.Cancellation != nil {
+			c.JSON(http.StatusOK, task.Cancellation)
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			c.Status(http.StatusNoContent)
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Called by the worker to acknowledge a cancel request, and again with `?outcome=` once the command is gone
+func (s *ServerConfig) updateTaskCancel(c *gin.Context) {
+	ctx := c.Request.Context()
+	c.Header("Content-Type", "application/json")
+
+	taskId, err := s.getTaskId(c)
+	if err != nil {
+		return
+	}
+
+	outcome := c.Query("outcome")
+	err = s.DB.UpdateTaskCancel(ctx, taskId, "", outcome)
+	if err != nil {
+		if _, ok := err.(database.ItemNotFoundError); ok {
+			c.String(http.StatusNotFound, MakeErrorString(err.Error()))
+			return
+		}
+		c.String(http.StatusBadRequest, MakeErrorString(err.Error()))
+		return
+	}
+
+	s.TaskEvents.Notify()
+	if outcome != "" {
+		s.taskFinished(taskId)
+	}
+	c.String(http.StatusOK, "{}")
+}
+
+// Stop tasks whose worker hasn't acknowledged a cancel request within `tasks.cancelAckTimeoutSeconds`
+// Runs in the background until stop is closed
+func (s *ServerConfig) RunCancelMonitor(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(CANCEL_CHECK_INTERVAL_SECONDS*1000*s.TimeMultiplier) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.stopUnacknowledgedCancels(time.Now().Unix())
+		}
+	}
+}
+
+func (s *ServerConfig) stopUnacknowledgedCancels(now int64) {
+	ctx := context.Background()
+	tc := &database.TaskSearchConf{
+		Limit:             math.MaxInt32,
+		SmallestId:        objectid.NewObjectIdWithTime(time.Unix(0, 0)),
+		LargestId:         objectid.NewObjectIdWithTime(time.Unix(database.FAR_FUTURE_SECONDS, 0)),
+		AllowedTaskStates: map[string]bool{"CLAIMED": true, "RUNNING": true},
+	}
+	active, _, err := s.DB.GetTasks(ctx, tc)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err.Error(),
+		}).Error("Could not list tasks to check cancel requests")
+		return
+	}
+
+	ackTimeout := viper.GetInt64("tasks.cancelAckTimeoutSeconds")
+	for _, t := range active {
+		cr := t.Cancellation
+		if cr == nil || cr.AcknowledgedTs != 0 || cr.RequestedTs+ackTimeout > now {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"taskId":      t.Id.Hex(),
+			"workerId":    t.WorkerId.Hex(),
+			"requestedTs": cr.RequestedTs,
+		}).Warn("Worker did not acknowledge cancel request; stopping task")
+		if err := s.DB.UpdateTaskCancel(ctx, t.Id, tasks.ACTOR_SYSTEM, tasks.CANCEL_UNACKNOWLEDGED); err != nil {
+			log.WithFields(log.Fields{
+				"err":    err.Error(),
+				"taskId": t.Id.Hex(),
+			}).Error("Could not stop task with unacknowledged cancel request")
+			continue
+		}
+		s.TaskEvents.Notify()
+		s.taskFinished(t.Id)
+	}
+}
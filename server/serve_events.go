@@ -0,0 +1,170 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/manucorporat/sse"
+	log "github.com/sirupsen/logrus"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Max events read from the database at a time
+	EVENT_BATCH_SIZE = 500
+	// How often a following stream checks for changes that didn't come with a notification, in seconds
+	EVENT_POLL_INTERVAL_SECONDS = 1
+	// Comment lines sent on an idle SSE stream so proxies don't close it, in seconds
+	EVENT_KEEPALIVE_SECONDS = 30
+)
+
+// Sent in place of events trimmed from the log before the client read them; see `events.maxAgeDays`
+type EventGap struct {
+	Type    string `json:"type"`    // always "gap"
+	Since   uint64 `json:"since"`   // where the client asked to resume
+	NextSeq uint64 `json:"nextSeq"` // the oldest event still kept, which the stream goes on from
+}
+
+// Stream the event log
+// Resumes after the sequence number in the `Last-Event-ID` header or `?since=`; starts from the oldest event kept otherwise
+// Resuming from before the oldest event kept sends a `gap` first
+// Sends SSE unless `?format=ndjson` is passed or `application/x-ndjson` is accepted
+// Keeps the connection open for new events unless `?follow=false` is passed
+func (s *ServerConfig) getEvents(c *gin.Context) {
+	ctx := c.Request.Context()
+	since, err := eventsSince(c)
+	if err != nil {
+		c.Header("Content-Type", "application/json")
+		c.String(http.StatusBadRequest, MakeErrorString(err.Error()))
+		return
+	}
+	ndjson := c.Query("format") == "ndjson" || strings.Contains(c.GetHeader("Accept"), "application/x-ndjson")
+	if ndjson {
+		c.Header("Content-Type", "application/x-ndjson")
+	} else {
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+	}
+
+	write := func(w io.Writer, e database.Event) {
+		if ndjson {
+			js, _ := json.Marshal(e)
+			fmt.Fprintf(w, "%s\n", js)
+			return
+		}
+		sse.Encode(w, sse.Event{
+			Id:    strconv.FormatUint(e.Seq, 10),
+			Event: e.Type,
+			Data:  e,
+		})
+	}
+	writeGap := func(w io.Writer, nextSeq uint64) {
+		gap := EventGap{Type: "gap", Since: since, NextSeq: nextSeq}
+		if ndjson {
+			js, _ := json.Marshal(gap)
+			fmt.Fprintf(w, "%s\n", js)
+			return
+		}
+		sse.Encode(w, sse.Event{
+			Id:    strconv.FormatUint(nextSeq-1, 10),
+			Event: gap.Type,
+			Data:  gap,
+		})
+	}
+	// Send one batch; returns false if the stream should end
+	sendBatch := func(w io.Writer) (int, bool) {
+		events, err := s.DB.GetEvents(ctx, since, EVENT_BATCH_SIZE)
+		if err == nil && since > 0 && (len(events) == 0 || events[0].Seq > since+1) {
+			// Sequence numbers have no holes, so anything missing after since was trimmed
+			nextSeq := uint64(0)
+			if len(events) > 0 {
+				nextSeq = events[0].Seq
+			} else {
+				nextSeq, err = s.DB.FirstEventSeq(ctx)
+			}
+			if err == nil && nextSeq > since+1 {
+				writeGap(w, nextSeq)
+				since = nextSeq - 1
+			}
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":   err.Error(),
+				"since": since,
+			}).Error("Could not read event log")
+			return 0, false
+		}
+		for _, e := range events {
+			write(w, e)
+			since = e.Seq
+		}
+		return len(events), true
+	}
+
+	if c.Query("follow") == "false" {
+		c.Status(http.StatusOK)
+		for {
+			n, ok := sendBatch(c.Writer)
+			if !ok || n < EVENT_BATCH_SIZE {
+				return
+			}
+		}
+	}
+
+	defer trackStream("events")()
+
+	// Database changes notify these hubs; the poll catches anything that doesn't
+	taskWake := s.TaskEvents.Subscribe()
+	defer s.TaskEvents.Unsubscribe(taskWake)
+	workerWake := s.WorkerEvents.Subscribe()
+	defer s.WorkerEvents.Unsubscribe(workerWake)
+
+	poll := time.Duration(EVENT_POLL_INTERVAL_SECONDS*1000*s.TimeMultiplier) * time.Millisecond
+	lastSent := time.Now()
+	c.Stream(func(w io.Writer) bool {
+		n, ok := sendBatch(w)
+		if !ok {
+			return false
+		}
+		if n > 0 {
+			lastSent = time.Now()
+		}
+		if n == EVENT_BATCH_SIZE {
+			return true
+		}
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-taskWake:
+		case <-workerWake:
+		case <-time.After(poll):
+		}
+		if !ndjson && time.Since(lastSent) > EVENT_KEEPALIVE_SECONDS*time.Second {
+			fmt.Fprintf(w, ": keepalive\n\n")
+			lastSent = time.Now()
+		}
+		return true
+	})
+}
+
+// Sequence number to resume after
+// The header wins since browsers send it on reconnect while keeping the original url
+func eventsSince(c *gin.Context) (uint64, error) {
+	raw := c.GetHeader("Last-Event-ID")
+	if raw == "" {
+		raw = c.Query("since")
+	}
+	if raw == "" {
+		return 0, nil
+	}
+	since, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid event id '%s'; must be a non-negative integer", raw)
+	}
+	return since, nil
+}
@@ -0,0 +1,145 @@
+// Covered:
+//   - GET /events as SSE and NDJSON, resuming with ?since= and Last-Event-ID: TestEvents_Resume
+//   - following the stream as new changes come in: TestEvents_Follow
+//   - trimming the log in GC and the gap sent to clients that fell behind it: TestEvents_Gap
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/tasks"
+)
+
+func TestEvents_Resume(t *testing.T) {
+	cleanup := setupTestTaskType(t)
+	defer cleanup()
+
+	s, scleanup := NewTestServer()
+	defer scleanup()
+	r := s.GetRouter()
+
+	var task tasks.Task
+	json.Unmarshal(postTask(r, "echo_task").Body.Bytes(), &task)
+	req, _ := http.NewRequest("PUT", fmt.Sprintf("/task/%s/cancel", task.Id.Hex()), nil)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	// SSE by default, with the sequence number as the event id
+	w := getUI(r, "/events?follow=false")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	assert.Contains(t, body, "id:1\nevent:task.created\n")
+	assert.Contains(t, body, "id:2\nevent:task.updated\n")
+	assert.Contains(t, body, `"oldState":"WAITING","newState":"STOPPED"`)
+
+	// NDJSON, resuming after the first event
+	w = getUI(r, "/events?follow=false&format=ndjson&since=1")
+	assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if assert.Len(t, lines, 1) {
+		var e database.Event
+		assert.NoError(t, json.Unmarshal([]byte(lines[0]), &e))
+		assert.Equal(t, uint64(2), e.Seq)
+		assert.Equal(t, task.Id, e.EntityId)
+		assert.Equal(t, "STOPPED", e.NewState)
+	}
+
+	// The header wins over the query string
+	req, _ = http.NewRequest("GET", "/events?follow=false&since=0", nil)
+	req.Header.Set("Last-Event-ID", "2")
+	req.Header.Set("Accept", "application/x-ndjson")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, "", w.Body.String())
+
+	assert.Equal(t, http.StatusBadRequest, getUI(r, "/events?since=abc").Code)
+}
+
+func TestEvents_Follow(t *testing.T) {
+	cleanup := setupTestTaskType(t)
+	defer cleanup()
+
+	s, scleanup := NewTestServer()
+	defer scleanup()
+	s.TimeMultiplier = 1
+	r := s.GetRouter()
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	postTask(r, "echo_task")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL+"/events?format=ndjson", nil)
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+
+	lines := bufio.NewScanner(res.Body)
+	var e database.Event
+	assert.True(t, lines.Scan())
+	json.Unmarshal(lines.Bytes(), &e)
+	assert.Equal(t, database.EVENT_TASK_CREATED, e.Type)
+
+	// Changes made after connecting show up on the open stream
+	postTask(r, "echo_task")
+	assert.True(t, lines.Scan())
+	json.Unmarshal(lines.Bytes(), &e)
+	assert.Equal(t, uint64(2), e.Seq)
+}
+
+func TestEvents_Gap(t *testing.T) {
+	ctx := context.Background()
+	cleanup := setupTestTaskType(t)
+	defer cleanup()
+	viper.Set("events.maxAgeDays", 1)
+	defer viper.Set("events.maxAgeDays", nil)
+
+	s, scleanup := NewTestServer()
+	defer scleanup()
+	r := s.GetRouter()
+
+	for i := 0; i < 3; i++ {
+		postTask(r, "echo_task")
+	}
+
+	// A collection two days from now finds every event too old
+	report, err := s.CollectGarbage(ctx, time.Now().Unix()+2*24*60*60, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, report.EventsRemoved)
+	postTask(r, "echo_task")
+
+	lines := strings.Split(strings.TrimSpace(getUI(r, "/events?follow=false&format=ndjson&since=1").Body.String()), "\n")
+	if assert.Len(t, lines, 2) {
+		var gap EventGap
+		assert.NoError(t, json.Unmarshal([]byte(lines[0]), &gap))
+		assert.Equal(t, EventGap{Type: "gap", Since: 1, NextSeq: 4}, gap)
+		var e database.Event
+		assert.NoError(t, json.Unmarshal([]byte(lines[1]), &e))
+		assert.Equal(t, uint64(4), e.Seq)
+	}
+
+	// SSE clients resume after the gap when they reconnect
+	body := getUI(r, "/events?follow=false&since=3").Body.String()
+	assert.NotContains(t, body, "event:gap")
+	body = getUI(r, "/events?follow=false&since=2").Body.String()
+	assert.True(t, strings.HasPrefix(body, "id:3\nevent:gap\n"), body)
+
+	// Starting from the beginning means the oldest event kept
+	body = getUI(r, "/events?follow=false&format=ndjson").Body.String()
+	assert.NotContains(t, body, `"gap"`)
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"net/http"
+	"time"
+)
+
+// Stream a snapshot of the database as JSON Lines
+func (s *ServerConfig) exportDatabase(c *gin.Context) {
+	ctx := c.Request.Context()
+	exporter, ok := s.DB.(database.Exporter)
+	if !ok {
+		c.String(http.StatusNotImplemented, MakeErrorString("This database backend does not support export"))
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=blanket-export-%d.jsonl", time.Now().Unix()))
+	c.Status(http.StatusOK)
+	if err := exporter.Export(ctx, c.Writer); err != nil {
+		// Headers are already sent, so all we can do is log and cut the stream short
+		log.WithFields(log.Fields{
+			"err": err.Error(),
+		}).Error("Export failed part way through")
+	}
+}
+
+// Load an export from the request body
+// `?mode=merge|replace` (default merge); `?remapIds=true` gives items whose id is taken a new id instead of skipping them
+func (s *ServerConfig) importDatabase(c *gin.Context) {
+	ctx := c.Request.Context()
+	c.Header("Content-Type", "application/json")
+
+	exporter, ok := s.DB.(database.Exporter)
+	if !ok {
+		c.String(http.StatusNotImplemented, MakeErrorString("This database backend does not support import"))
+		return
+	}
+
+	opts := database.ImportOptions{
+		Mode:     c.DefaultQuery("mode", database.IMPORT_MERGE),
+		RemapIds: c.Query("remapIds") == "true",
+	}
+	report, err := exporter.Import(ctx, c.Request.Body, opts)
+	if err != nil {
+		c.String(http.StatusBadRequest, MakeErrorString(err.Error()))
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"mode":     report.Mode,
+		"imported": report.Imported,
+		"skipped":  report.Skipped,
+		"remapped": report.Remapped,
+	}).Info("Imported database export")
+	s.TaskEvents.Notify()
+	s.WorkerEvents.Notify()
+	c.JSON(http.StatusOK, report)
+}
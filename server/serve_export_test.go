@@ -0,0 +1,57 @@
+// Covered:
+//   - GET /ops/export into POST /ops/import on another server, and bad imports: TestExportImport
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/turtlemonvh/blanket/lib/database"
+)
+
+func TestExportImport(t *testing.T) {
+	cleanup := setupTestTaskType(t)
+	defer cleanup()
+
+	s, scleanup := NewTestServer()
+	defer scleanup()
+	r := s.GetRouter()
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, http.StatusCreated, postTask(r, "echo_task").Code)
+	}
+
+	w := getUI(r, "/ops/export")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+	export := w.Body.Bytes()
+
+	other, ocleanup := NewTestServer()
+	defer ocleanup()
+	or := other.GetRouter()
+
+	importExport := func(query string, body []byte) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/ops/import"+query, bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		or.ServeHTTP(w, req)
+		return w
+	}
+
+	w = importExport("?mode=replace", export)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var report database.ImportReport
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	// Test servers keep the queue in its own file, so queue entries aren't part of the export here
+	assert.Equal(t, map[string]int{"task": 2}, report.Imported)
+
+	req, _ := http.NewRequest("GET", "/task/", nil)
+	assertResponseLength(t, or, req, 2)
+
+	assert.Equal(t, http.StatusBadRequest, importExport("?mode=overwrite", export).Code)
+	assert.Equal(t, http.StatusBadRequest, importExport("", []byte(`{"kind":"task","data":{}}`)).Code)
+	assertResponseLength(t, or, req, 2)
+}
@@ -0,0 +1,357 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/tasks"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// How often the collector runs unless `tasks.retention.intervalSeconds` is set
+	DEFAULT_GC_INTERVAL_SECONDS = 3600
+)
+
+var (
+	// Updated after each collection
+	gcRuns          = expvar.NewInt("gcRuns")
+	gcTasksRemoved  = expvar.NewInt("gcTasksRemoved")
+	gcTasksArchived = expvar.NewInt("gcTasksArchived")
+	gcBytesFreed    = expvar.NewInt("gcBytesFreed")
+	gcErrors        = expvar.NewInt("gcErrors")
+	gcLastRunTs     = expvar.NewInt("gcLastRunTs")
+)
+
+// Keeps one collection running at a time, and the report of the last one
+type gcState struct {
+	running sync.Mutex
+	mu      sync.Mutex
+	last    *GCReport
+}
+
+// A task the collector removed, or would remove in a dry run
+type GCRemoval struct {
+	Id      string `json:"id"`
+	Type    string `json:"type"`
+	State   string `json:"state"`
+	Reason  string `json:"reason"`  // "maxAge" or "maxTasks"
+	Archive string `json:"archive"` // path of the archive written first, if archiving is on
+}
+
+// What one collection did
+type GCReport struct {
+	StartedTs     int64       `json:"startedTs"`
+	FinishedTs    int64       `json:"finishedTs"`
+	DryRun        bool        `json:"dryRun"`
+	Scanned       int         `json:"scanned"` // finished tasks looked at
+	Removed       []GCRemoval `json:"removed"`
+	Archived      int         `json:"archived"`
+	BytesFreed    int64       `json:"bytesFreed"`    // size of the result directories removed
+	EventsRemoved int         `json:"eventsRemoved"` // entries older than `events.maxAgeDays` trimmed from the event log
+	Errors        []string    `json:"errors"`
+}
+
+// Report of the last collection; `{}` if none has run yet
+func (s *ServerConfig) getGC(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	s.gc.mu.Lock()
+	last := s.gc.last
+	s.gc.mu.Unlock()
+	if last == nil {
+		c.String(http.StatusOK, "{}")
+		return
+	}
+	c.JSON(http.StatusOK, last)
+}
+
+// Run a collection now
+// `?dryRun=true` reports what would be removed without removing it
+func (s *ServerConfig) runGC(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	report, err := s.CollectGarbage(c.Request.Context(), time.Now().Unix(), c.Query("dryRun") == "true")
+	if err != nil {
+		c.String(http.StatusConflict, MakeErrorString(err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// Remove finished tasks that fall outside the retention rules every `tasks.retention.intervalSeconds`
+// Runs in the background until stop is closed
+func (s *ServerConfig) RunGarbageCollector(stop <-chan struct{}) {
+	interval := viper.GetFloat64("tasks.retention.intervalSeconds")
+	if interval <= 0 {
+		interval = DEFAULT_GC_INTERVAL_SECONDS
+	}
+	ticker := time.NewTicker(time.Duration(interval*1000*s.TimeMultiplier) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if _, err := s.CollectGarbage(context.Background(), time.Now().Unix(), false); err != nil {
+				log.WithFields(log.Fields{
+					"err": err.Error(),
+				}).Warn("Skipped garbage collection")
+			}
+		}
+	}
+}
+
+// Remove, and archive first if `tasks.retention.archivePath` is set, every finished task outside the retention rules
+// Only fails if another collection is already running; problems with single tasks are listed in the report
+// Stops early, listing why, if ctx is done
+func (s *ServerConfig) CollectGarbage(ctx context.Context, now int64, dryRun bool) (*GCReport, error) {
+	if !s.gc.running.TryLock() {
+		return nil, fmt.Errorf("A garbage collection is already running")
+	}
+	defer s.gc.running.Unlock()
+
+	report := &GCReport{
+		StartedTs: now,
+		DryRun:    dryRun,
+		Removed:   []GCRemoval{},
+		Errors:    []string{},
+	}
+
+	tc := &database.TaskSearchConf{
+		Limit:             math.MaxInt32,
+		SmallestId:        objectid.NewObjectIdWithTime(time.Unix(0, 0)),
+		LargestId:         objectid.NewObjectIdWithTime(time.Unix(database.FAR_FUTURE_SECONDS, 0)),
+		AllowedTaskStates: make(map[string]bool),
+	}
+	for _, state := range tasks.ValidTerminalTaskStates {
+		tc.AllowedTaskStates[state] = true
+	}
+	finished, _, err := s.DB.GetTasks(ctx, tc)
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("Could not list finished tasks :: %s", err.Error()))
+		return s.finishGC(report), nil
+	}
+	report.Scanned = len(finished)
+
+	for _, removal := range expiredTasks(finished, now) {
+		if err = database.CheckContext(ctx); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("Stopped before the collection finished :: %s", err.Error()))
+			break
+		}
+		t := removal.task
+		r := GCRemoval{Id: t.Id.Hex(), Type: t.TypeId, State: t.State, Reason: removal.reason}
+		if dryRun {
+			report.Removed = append(report.Removed, r)
+			continue
+		}
+
+		if archivePath := viper.GetString("tasks.retention.archivePath"); archivePath != "" {
+			r.Archive, err = archiveTask(&t, archivePath)
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("Could not archive task %s; keeping it :: %s", r.Id, err.Error()))
+				continue
+			}
+			report.Archived++
+		}
+
+		size := dirSize(t.ResultDir)
+		if err = s.DB.DeleteTask(ctx, t.Id); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("Could not delete task %s :: %s", r.Id, err.Error()))
+			continue
+		}
+		if t.ResultDir != "" {
+			if err = os.RemoveAll(t.ResultDir); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("Could not remove result directory of task %s :: %s", r.Id, err.Error()))
+			}
+		}
+		report.BytesFreed += size
+		report.Removed = append(report.Removed, r)
+	}
+
+	if !dryRun && len(report.Removed) > 0 {
+		s.TaskEvents.Notify()
+	}
+
+	if days := viper.GetFloat64("events.maxAgeDays"); days > 0 && !dryRun {
+		report.EventsRemoved, err = s.DB.TrimEvents(ctx, now-int64(days*24*60*60))
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("Could not trim the event log :: %s", err.Error()))
+		}
+	}
+	return s.finishGC(report), nil
+}
+
+func (s *ServerConfig) finishGC(report *GCReport) *GCReport {
+	report.FinishedTs = time.Now().Unix()
+	if report.DryRun {
+		return report
+	}
+
+	gcRuns.Add(1)
+	gcTasksRemoved.Add(int64(len(report.Removed)))
+	gcTasksArchived.Add(int64(report.Archived))
+	gcBytesFreed.Add(report.BytesFreed)
+	gcErrors.Add(int64(len(report.Errors)))
+	gcLastRunTs.Set(report.FinishedTs)
+	gcRunsTotal.Inc()
+	gcTasksRemovedTotal.Add(float64(len(report.Removed)))
+	gcTasksArchivedTotal.Add(float64(report.Archived))
+	gcBytesFreedTotal.Add(float64(report.BytesFreed))
+	gcErrorsTotal.Add(float64(len(report.Errors)))
+	gcLastRun.Set(float64(report.FinishedTs))
+
+	s.gc.mu.Lock()
+	s.gc.last = report
+	s.gc.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"scanned":    report.Scanned,
+		"removed":    len(report.Removed),
+		"archived":   report.Archived,
+		"bytesFreed": report.BytesFreed,
+		"events":     report.EventsRemoved,
+		"errors":     len(report.Errors),
+	}).Info("Finished garbage collection")
+	return report
+}
+
+type expiredTask struct {
+	task   tasks.Task
+	reason string
+}
+
+// Apply each type's retention policy to its finished tasks, newest first
+func expiredTasks(finished []tasks.Task, now int64) []expiredTask {
+	byType := make(map[string][]tasks.Task)
+	for _, t := range finished {
+		byType[t.TypeId] = append(byType[t.TypeId], t)
+	}
+
+	defaults := tasks.DefaultRetentionPolicy()
+	var expired []expiredTask
+	for typeId, ts := range byType {
+		policy := defaults
+		if tt, err := tasks.FetchTaskType(typeId); err == nil {
+			policy = tt.RetentionPolicy(defaults)
+		}
+		if policy.IsEmpty() {
+			continue
+		}
+
+		sort.Slice(ts, func(i, j int) bool {
+			return ts[i].Id.Hex() > ts[j].Id.Hex()
+		})
+		kept := 0
+		for _, t := range ts {
+			days, hasMaxAge := policy.MaxAgeDays[t.State]
+			switch {
+			case hasMaxAge && float64(t.FinishedTs())+days*24*60*60 < float64(now):
+				expired = append(expired, expiredTask{t, "maxAge"})
+			case policy.MaxTasks > 0 && kept >= policy.MaxTasks:
+				expired = append(expired, expiredTask{t, "maxTasks"})
+			default:
+				kept++
+			}
+		}
+	}
+	return expired
+}
+
+// Write the task's record and result directory to `<archivePath>/<task id>.tar.gz`
+func archiveTask(t *tasks.Task, archivePath string) (string, error) {
+	err := os.MkdirAll(archivePath, os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+	archiveFile := path.Join(archivePath, t.Id.Hex()+".tar.gz")
+	f, err := os.Create(archiveFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	bts, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	err = tw.WriteHeader(&tar.Header{Name: "task.json", Mode: 0644, Size: int64(len(bts)), ModTime: time.Now()})
+	if err == nil {
+		_, err = tw.Write(bts)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if _, statErr := os.Stat(t.ResultDir); t.ResultDir != "" && statErr == nil {
+		err = filepath.Walk(t.ResultDir, func(p string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(t.ResultDir, p)
+			if err != nil {
+				return err
+			}
+			hdr, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			hdr.Name = path.Join("results", filepath.ToSlash(rel))
+			if err = tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			src, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer src.Close()
+			_, err = io.Copy(tw, src)
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		return "", err
+	}
+	if err = gz.Close(); err != nil {
+		return "", err
+	}
+	return archiveFile, f.Close()
+}
+
+// Total size of the files under dir; 0 if it doesn't exist
+func dirSize(dir string) int64 {
+	var size int64
+	if dir == "" {
+		return 0
+	}
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,139 @@
+// Covered:
+//   - POST /ops/gc as a dry run and for real, with archiving, GET /ops/gc and
+//     the gc expvars and Prometheus counters: TestGarbageCollection
+
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/turtlemonvh/blanket/tasks"
+)
+
+func TestGarbageCollection(t *testing.T) {
+	ctx := context.Background()
+	cleanup := setupTestTaskType(t)
+	defer cleanup()
+
+	archiveDir, err := os.MkdirTemp("", "blanket-test-archive-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(archiveDir)
+
+	viper.Set("tasks.retention.maxAgeDays", map[string]interface{}{"success": 14})
+	viper.Set("tasks.retention.maxTasksPerType", 3)
+	defer func() {
+		viper.Set("tasks.retention.maxAgeDays", nil)
+		viper.Set("tasks.retention.maxTasksPerType", 0)
+		viper.Set("tasks.retention.archivePath", "")
+	}()
+
+	s, scleanup := NewTestServer()
+	defer scleanup()
+	r := s.GetRouter()
+
+	tt, err := tasks.FetchTaskType("echo_task")
+	assert.NoError(t, err)
+	now := time.Now().Unix()
+	monthAgo := now - 30*24*60*60
+	// Ages count from when the task finished, not from later edits like retagging
+	save := func(state string, finishedTs int64) tasks.Task {
+		tsk, err := tt.NewTask(map[string]string{})
+		assert.NoError(t, err)
+		tsk.Transition(state, tasks.ACTOR_SYSTEM, "", finishedTs)
+		tsk.LastUpdatedTs = now
+		assert.NoError(t, s.DB.SaveTask(ctx, &tsk))
+		return tsk
+	}
+
+	oldSuccess := save("SUCCESS", monthAgo)
+	oldError := save("ERROR", monthAgo) // ERROR has no max age, but is the 4th newest
+	for i := 0; i < 3; i++ {
+		save("ERROR", now)
+	}
+	save("WAITING", monthAgo) // never collected
+
+	assert.NoError(t, os.MkdirAll(oldError.ResultDir, os.ModePerm))
+	assert.NoError(t, os.WriteFile(filepath.Join(oldError.ResultDir, "blanket.stdout.log"), []byte("output"), 0644))
+
+	w := getUI(r, "/ops/gc")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "{}", w.Body.String())
+
+	removedBefore := expvar.Get("gcTasksRemoved").(*expvar.Int).Value()
+	scraped := func() (runs, removed, archived float64) {
+		body := getUI(r, "/metrics").Body.String()
+		return max(metricValue(body, "blanket_gc_runs_total"), 0),
+			max(metricValue(body, "blanket_gc_tasks_removed_total"), 0),
+			max(metricValue(body, "blanket_gc_tasks_archived_total"), 0)
+	}
+	runsBefore, removedScrapedBefore, archivedBefore := scraped()
+
+	var report GCReport
+	w = postJSON(r, "/ops/gc?dryRun=true", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.True(t, report.DryRun)
+	assert.Equal(t, 5, report.Scanned)
+	reasons := make(map[string]string)
+	for _, removal := range report.Removed {
+		reasons[removal.Id] = removal.Reason
+	}
+	assert.Equal(t, map[string]string{oldSuccess.Id.Hex(): "maxAge", oldError.Id.Hex(): "maxTasks"}, reasons)
+	_, err = s.DB.GetTask(ctx, oldSuccess.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, "{}", getUI(r, "/ops/gc").Body.String())
+
+	viper.Set("tasks.retention.archivePath", archiveDir)
+	w = postJSON(r, "/ops/gc", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Len(t, report.Removed, 2)
+	assert.Equal(t, 2, report.Archived)
+	assert.Equal(t, int64(len("output")), report.BytesFreed)
+	assert.Empty(t, report.Errors)
+	assert.Equal(t, removedBefore+2, expvar.Get("gcTasksRemoved").(*expvar.Int).Value())
+	// The dry run isn't counted
+	runs, removed, archived := scraped()
+	assert.Equal(t, []float64{1, 2, 2}, []float64{runs - runsBefore, removed - removedScrapedBefore, archived - archivedBefore})
+
+	_, err = s.DB.GetTask(ctx, oldError.Id)
+	assert.Error(t, err)
+	_, err = os.Stat(oldError.ResultDir)
+	assert.True(t, os.IsNotExist(err))
+
+	// The archive holds the task record and its results
+	f, err := os.Open(filepath.Join(archiveDir, oldError.Id.Hex()+".tar.gz"))
+	if assert.NoError(t, err) {
+		defer f.Close()
+		gz, err := gzip.NewReader(f)
+		assert.NoError(t, err)
+		tr := tar.NewReader(gz)
+		var names []string
+		for hdr, err := tr.Next(); err == nil; hdr, err = tr.Next() {
+			names = append(names, hdr.Name)
+		}
+		assert.Equal(t, []string{"task.json", "results/blanket.stdout.log"}, names)
+	}
+
+	var last GCReport
+	assert.NoError(t, json.Unmarshal(getUI(r, "/ops/gc").Body.Bytes(), &last))
+	assert.Equal(t, report.StartedTs, last.StartedTs)
+	assert.Len(t, last.Removed, 2)
+
+	// Nothing left to remove
+	w = postJSON(r, "/ops/gc", "")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Empty(t, report.Removed)
+	assert.Equal(t, 3, report.Scanned)
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/manucorporat/sse"
 	"github.com/turtlemonvh/blanket/lib/tailed_file"
+	"github.com/turtlemonvh/blanket/tasks"
 )
 
 const (
@@ -26,6 +27,8 @@ const (
 // - task stopped when in terminal state
 // - worker stopped when no longer heartbeating
 func (s *ServerConfig) streamLog(c *gin.Context, sub *tailed_file.TailedFileSubscriber, isComplete func() bool) {
+	defer trackStream("logs")()
+
 	loglineChannelIsEmpty := false
 	lineno := 1
 	c.Stream(func(w io.Writer) bool {
@@ -86,11 +89,12 @@ func tailLines(filepath string, n int) (string, error) {
 }
 
 func (s *ServerConfig) tailTaskLog(c *gin.Context) {
+	ctx := c.Request.Context()
 	taskId, err := s.getTaskId(c)
 	if err != nil {
 		return
 	}
-	task, err := s.DB.GetTask(taskId)
+	task, err := s.DB.GetTask(ctx, taskId)
 	if err != nil {
 		c.String(http.StatusNotFound, err.Error())
 		return
@@ -102,6 +106,19 @@ func (s *ServerConfig) tailTaskLog(c *gin.Context) {
 		}
 	}
 	stdoutPath := path.Join(task.ResultDir, fmt.Sprintf("blanket.stdout.log"))
+	// `?step=` reads the log of one step of a multi-step task
+	if q := c.Query("step"); q != "" {
+		step, err := strconv.Atoi(q)
+		if err != nil || step < 0 || step >= len(task.Steps) {
+			c.String(http.StatusBadRequest, fmt.Sprintf("Task has %d steps; '%s' is not a valid step index", len(task.Steps), q))
+			return
+		}
+		stream := "stdout"
+		if c.Query("stream") == "stderr" {
+			stream = "stderr"
+		}
+		stdoutPath = tasks.StepLogPath(task.ResultDir, step, stream)
+	}
 	content, err := tailLines(stdoutPath, n)
 	if err != nil {
 		c.String(http.StatusOK, "")
@@ -112,12 +129,13 @@ func (s *ServerConfig) tailTaskLog(c *gin.Context) {
 }
 
 func (s *ServerConfig) tailWorkerLog(c *gin.Context) {
+	ctx := c.Request.Context()
 	workerId, err := SafeObjectId(c.Param("id"))
 	if err != nil {
 		c.String(http.StatusBadRequest, err.Error())
 		return
 	}
-	w, err := s.DB.GetWorker(workerId)
+	w, err := s.DB.GetWorker(ctx, workerId)
 	if err != nil {
 		c.String(http.StatusNotFound, err.Error())
 		return
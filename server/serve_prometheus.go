@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/turtlemonvh/blanket/lib/metrics"
+	"github.com/turtlemonvh/blanket/tasks"
+)
+
+// Upper bounds for task wait and run times, in seconds
+var taskSecondsBuckets = []float64{1, 5, 10, 30, 60, 300, 600, 1800, 3600, 7200, 21600, 86400}
+
+var (
+	// Kept up to date by handlers and the queue
+	tasksSubmitted    = metrics.NewCounter("blanket_tasks_submitted_total", "Tasks added to the queue.", "type")
+	tasksFinished     = metrics.NewCounter("blanket_tasks_finished_total", "Tasks that reached a terminal state.", "type", "state")
+	taskClaimLatency  = metrics.NewHistogram("blanket_task_claim_latency_seconds", "Seconds from submitting a task to a worker claiming it.", taskSecondsBuckets, "type")
+	taskDuration      = metrics.NewHistogram("blanket_task_duration_seconds", "Seconds from claiming a task to it finishing.", taskSecondsBuckets, "type")
+	httpDuration      = metrics.NewHistogram("blanket_http_request_duration_seconds", "Seconds taken to answer requests; streams are not included.", metrics.DefaultBuckets, "method", "route", "status")
+	streamSubscribers = metrics.NewGauge("blanket_sse_subscribers", "Open event and log streams.", "stream")
+
+	// Kept up to date by the garbage collector; dry runs are not counted
+	gcRunsTotal          = metrics.NewCounter("blanket_gc_runs_total", "Garbage collections run.")
+	gcTasksRemovedTotal  = metrics.NewCounter("blanket_gc_tasks_removed_total", "Finished tasks removed by garbage collection.")
+	gcTasksArchivedTotal = metrics.NewCounter("blanket_gc_tasks_archived_total", "Finished tasks archived before being removed.")
+	gcBytesFreedTotal    = metrics.NewCounter("blanket_gc_bytes_freed_total", "Size of the result directories garbage collection removed.")
+	gcErrorsTotal        = metrics.NewCounter("blanket_gc_errors_total", "Problems garbage collection reported.")
+	gcLastRun            = metrics.NewGauge("blanket_gc_last_run_timestamp_seconds", "When the last garbage collection finished.")
+
+	// Read on each scrape
+	queueDepth    = metrics.NewGauge("blanket_queue_depth", "Queued tasks not yet handed to a worker.", "type")
+	tasksByState  = metrics.NewGauge("blanket_tasks", "Tasks in the database.", "state")
+	activeWorkers = metrics.NewGauge("blanket_workers_active", "Workers that are not stopped.")
+	goroutines    = metrics.NewGauge("blanket_goroutines", "Goroutines in the server process.")
+
+	// Scrapes reset the scraped gauges, so they take turns
+	scrapeLock sync.Mutex
+)
+
+// Metrics in the Prometheus text format
+// Counters and histograms cover requests since the server started; gauges are read from the database and queue on each scrape
+func (s *ServerConfig) getPrometheusMetrics(c *gin.Context) {
+	scrapeLock.Lock()
+	defer scrapeLock.Unlock()
+
+	if err := s.collectGauges(c.Request.Context()); err != nil {
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
+		return
+	}
+	c.Header("Content-Type", metrics.CONTENT_TYPE)
+	c.Status(http.StatusOK)
+	metrics.Default.Write(c.Writer)
+}
+
+func (s *ServerConfig) collectGauges(ctx context.Context) error {
+	depth, err := s.Q.CountTasks(ctx)
+	if err != nil {
+		return fmt.Errorf("Could not count queued tasks :: %s", err.Error())
+	}
+	byType := make(map[string]float64)
+	for typeId, n := range depth {
+		byType[typeId] = float64(n)
+	}
+	queueDepth.SetAll(byType)
+
+	// Kept by the database as tasks change, so this doesn't read them
+	counts, err := s.DB.CountTasksByState(ctx)
+	if err != nil {
+		return fmt.Errorf("Could not count tasks :: %s", err.Error())
+	}
+	byState := make(map[string]float64)
+	for _, state := range tasks.ValidTaskStates {
+		byState[state] = 0
+	}
+	for state, n := range counts {
+		byState[state] = float64(n)
+	}
+	tasksByState.SetAll(byState)
+
+	workers, err := s.DB.GetWorkers(ctx)
+	if err != nil {
+		return fmt.Errorf("Could not list workers :: %s", err.Error())
+	}
+	active := 0
+	for _, w := range workers {
+		if !w.Stopped {
+			active++
+		}
+	}
+	activeWorkers.Set(float64(active))
+
+	goroutines.Set(float64(runtime.NumGoroutine()))
+	return nil
+}
+
+// Middleware timing every request by route, except event and log streams
+func instrumentRequests(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	contentType, _, _ := strings.Cut(c.Writer.Header().Get("Content-Type"), ";")
+	if contentType == "text/event-stream" || contentType == "application/x-ndjson" {
+		return
+	}
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	httpDuration.Observe(time.Since(start).Seconds(), c.Request.Method, route, strconv.Itoa(c.Writer.Status()))
+}
+
+// Count an open stream; call the returned function when it closes
+func trackStream(stream string) func() {
+	streamSubscribers.Add(1, stream)
+	return func() {
+		streamSubscribers.Add(-1, stream)
+	}
+}
+
+// Record task transitions as they are published
+func observeTaskEvent(name string, t *tasks.Task) {
+	switch name {
+	case "task.claimed":
+		if t.CreatedTs != 0 {
+			taskClaimLatency.Observe(float64(t.StartedTs-t.CreatedTs), t.TypeId)
+		}
+	case "task.finished":
+		tasksFinished.Inc(t.TypeId, t.State)
+		if t.StartedTs != 0 && t.LastUpdatedTs >= t.StartedTs {
+			taskDuration.Observe(float64(t.LastUpdatedTs-t.StartedTs), t.TypeId)
+		}
+	}
+}
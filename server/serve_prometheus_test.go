@@ -0,0 +1,97 @@
+// Covered:
+//   - GET /metrics gauges read from the queue and database, and counters and
+//     histograms kept by the submit, claim and finish handlers: TestPrometheusMetrics
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/tasks"
+	"github.com/turtlemonvh/blanket/worker"
+)
+
+// The value of one series in a scrape, or -1 if it is missing
+func metricValue(body string, series string) float64 {
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		if rest, ok := strings.CutPrefix(scanner.Text(), series+" "); ok {
+			v, _ := strconv.ParseFloat(rest, 64)
+			return v
+		}
+	}
+	return -1
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	ctx := context.Background()
+	cleanup := setupTestTaskType(t)
+	defer cleanup()
+
+	s, scleanup := NewTestServer()
+	defer scleanup()
+	r := s.GetRouter()
+
+	// Counters are shared by every server in the process, so compare with where they started
+	w := getUI(r, "/metrics")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	before := w.Body.String()
+	submitted := `blanket_tasks_submitted_total{type="echo_task"}`
+	finished := `blanket_tasks_finished_total{type="echo_task",state="SUCCESS"}`
+	claims := `blanket_task_claim_latency_seconds_count{type="echo_task"}`
+	durations := `blanket_task_duration_seconds_count{type="echo_task"}`
+	counts := func(body string) []float64 {
+		var vs []float64
+		for _, series := range []string{submitted, finished, claims, durations} {
+			vs = append(vs, max(metricValue(body, series), 0))
+		}
+		return vs
+	}
+	start := counts(before)
+
+	var first tasks.Task
+	assert.NoError(t, json.Unmarshal(postTask(r, "echo_task").Body.Bytes(), &first))
+	postTask(r, "echo_task")
+
+	wconf := worker.WorkerConf{Id: objectid.NewObjectId(), Tags: []string{"bash", "unix"}}
+	assert.NoError(t, s.DB.UpdateWorker(ctx, &wconf))
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/task/claim/%s", wconf.Id.Hex()), nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var claimed tasks.Task
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &claimed))
+	req, _ = http.NewRequest("PUT", fmt.Sprintf("/task/%s/finish?state=SUCCESS", claimed.Id.Hex()), nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = getUI(r, "/metrics")
+	assert.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	end := counts(body)
+	assert.Equal(t, []float64{2, 1, 1, 1}, []float64{end[0] - start[0], end[1] - start[1], end[2] - start[2], end[3] - start[3]})
+
+	// Gauges only describe this server
+	assert.Equal(t, 1.0, metricValue(body, `blanket_queue_depth{type="echo_task"}`))
+	assert.Equal(t, 1.0, metricValue(body, `blanket_tasks{state="WAITING"}`))
+	assert.Equal(t, 1.0, metricValue(body, `blanket_tasks{state="SUCCESS"}`))
+	assert.Equal(t, 0.0, metricValue(body, `blanket_tasks{state="RUNNING"}`))
+	assert.Equal(t, 1.0, metricValue(body, `blanket_workers_active`))
+
+	// Requests are timed by route, not by path
+	assert.Contains(t, body, `blanket_http_request_duration_seconds_count{method="PUT",route="/task/:id/finish",status="200"}`)
+	assert.NotContains(t, body, first.Id.Hex())
+	assert.Contains(t, body, "# TYPE blanket_task_duration_seconds histogram")
+}
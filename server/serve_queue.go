@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/lib/queue"
+	"github.com/turtlemonvh/blanket/tasks"
+	"github.com/turtlemonvh/blanket/worker"
+	"net/http"
+	"time"
+)
+
+const (
+	// Longest a worker can wait on `POST /task/claim/:workerid`, in seconds
+	MAX_CLAIM_WAIT_SECONDS = 60
+)
+
+// The server's queue; counts the tasks added to it, and notifies `queued` whenever a task may have become claimable
+type instrumentedQueue struct {
+	queue.BlanketQueue
+	queued *EventHub
+}
+
+func (q *instrumentedQueue) AddTask(ctx context.Context, t *tasks.Task) error {
+	err := q.BlanketQueue.AddTask(ctx, t)
+	if err == nil {
+		tasksSubmitted.Inc(t.TypeId)
+		q.queued.Notify()
+	}
+	return err
+}
+
+// New tags may let a waiting worker take the task
+func (q *instrumentedQueue) UpdateTaskTags(ctx context.Context, taskId objectid.ObjectId, tags []string) error {
+	err := q.BlanketQueue.UpdateTaskTags(ctx, taskId, tags)
+	if err == nil {
+		q.queued.Notify()
+	}
+	return err
+}
+
+// A task handed back with the nack callback can be claimed again
+func (q *instrumentedQueue) ClaimTask(ctx context.Context, w *worker.WorkerConf) (tasks.Task, func() error, func() error, error) {
+	t, ackCb, nackCb, err := q.BlanketQueue.ClaimTask(ctx, w)
+	if err != nil {
+		return t, ackCb, nackCb, err
+	}
+	notifyingNackCb := func() error {
+		err := nackCb()
+		if err == nil {
+			q.queued.Notify()
+		}
+		return err
+	}
+	return t, ackCb, notifyingNackCb, nil
+}
+
+// Claim a task for the worker, waiting up to wait for one it can take to be queued
+// Returns queue.ErrQueueEmpty if none came in time, or as soon as the worker is stopped
+// Paused claims and draining workers wait too, and claim as soon as they are resumed
+func (s *ServerConfig) claimOrWait(ctx context.Context, w worker.WorkerConf, wait time.Duration) (tasks.Task, func() error, func() error, error) {
+	// Subscribe before the first claim so a task queued in between isn't missed
+	queued := s.QueueEvents.Subscribe()
+	defer s.QueueEvents.Unsubscribe(queued)
+	workerChanged := s.WorkerEvents.Subscribe()
+	defer s.WorkerEvents.Unsubscribe(workerChanged)
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+
+	for {
+		t, ackCb, nackCb, err := s.Q.ClaimTask(ctx, &w)
+		if !errors.Is(err, queue.ErrQueueEmpty) || w.Stopped {
+			return t, ackCb, nackCb, err
+		}
+
+		select {
+		case <-queued:
+		case <-workerChanged:
+			// Pick up new tags and draining, and let a stopped worker go
+			if w, err = s.DB.GetWorker(ctx, w.Id); err != nil {
+				return tasks.Task{}, nil, nil, err
+			}
+			if w.Stopped {
+				return tasks.Task{}, nil, nil, queue.ErrQueueEmpty
+			}
+		case <-timeout.C:
+			return tasks.Task{}, nil, nil, queue.ErrQueueEmpty
+		case <-ctx.Done():
+			return tasks.Task{}, nil, nil, database.CheckContext(ctx)
+		}
+	}
+}
+
+// Whether claims are paused
+func (s *ServerConfig) getQueuePause(c *gin.Context) {
+	ctx := c.Request.Context()
+	p, err := s.DB.GetQueuePause(ctx)
+	if err != nil {
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+// Hold every claim until `PUT /ops/resume`, e.g. while upgrading the server; `?reason=` is shown in the UI
+// Tasks can still be submitted, and tasks already claimed carry on
+func (s *ServerConfig) pauseQueue(c *gin.Context) {
+	s.setQueuePause(c, database.QueuePause{Paused: true, Reason: c.Query("reason")})
+}
+
+func (s *ServerConfig) resumeQueue(c *gin.Context) {
+	s.setQueuePause(c, database.QueuePause{})
+}
+
+func (s *ServerConfig) setQueuePause(c *gin.Context, p database.QueuePause) {
+	ctx := c.Request.Context()
+	c.Header("Content-Type", "application/json")
+	p.ChangedTs = time.Now().Unix()
+	if err := s.DB.SaveQueuePause(ctx, &p); err != nil {
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"paused": p.Paused,
+		"reason": p.Reason,
+	}).Info("Changed claim pause")
+	// Waiting claims try again, and open pages refresh
+	s.QueueEvents.Notify()
+	s.TaskEvents.Notify()
+	s.WorkerEvents.Notify()
+	c.JSON(http.StatusOK, p)
+}
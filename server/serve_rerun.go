@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cast"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/tasks"
+	"io"
+	"net/http"
+	"os"
+	"path"
+)
+
+// Submit a new task with the type, environment, tags and uploaded files of a finished one
+// Body may contain `{"environment": {...}}` to override some of the original environment
+// The new task runs the type definition snapshotted with the original, and points back at it with `rerunOf`
+func (s *ServerConfig) rerunTask(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	taskId, err := s.getTaskId(c)
+	if err != nil {
+		return
+	}
+
+	// The body is optional
+	var req map[string]interface{}
+	err = json.NewDecoder(c.Request.Body).Decode(&req)
+	if err != nil && err != io.EOF {
+		c.String(http.StatusBadRequest, MakeErrorString("Error decoding JSON in request body."))
+		return
+	}
+
+	var overrides map[string]string
+	if req["environment"] != nil {
+		overrides = cast.ToStringMapString(req["environment"])
+		if len(overrides) == 0 {
+			c.String(http.StatusBadRequest, MakeErrorString("The 'environment' parameter must be a map of string keys to string values."))
+			return
+		}
+	}
+
+	status, t, err := s.rerunTaskById(c.Request.Context(), taskId, overrides)
+	if err != nil {
+		c.String(status, MakeErrorString(err.Error()))
+		return
+	}
+	c.JSON(status, t)
+}
+
+// Create and queue the copy of a finished task
+// Returns the status code to report along with the new task
+func (s *ServerConfig) rerunTaskById(ctx context.Context, taskId objectid.ObjectId, overrides map[string]string) (int, *tasks.Task, error) {
+	original, err := s.DB.GetTask(ctx, taskId)
+	if err != nil {
+		if _, ok := err.(database.ItemNotFoundError); ok {
+			return http.StatusNotFound, nil, err
+		}
+		return errorStatus(err), nil, err
+	}
+
+	finished := false
+	for _, state := range tasks.ValidTerminalTaskStates {
+		if original.State == state {
+			finished = true
+		}
+	}
+	if !finished {
+		return http.StatusConflict, nil, fmt.Errorf("Only finished tasks can be rerun; task is in state '%s'", original.State)
+	}
+
+	envVars := make(map[string]string)
+	for k, v := range original.ExecEnv {
+		envVars[k] = v
+	}
+	for k, v := range overrides {
+		envVars[k] = v
+	}
+
+	// Tasks submitted before snapshots were stored fall back to the current definition
+	tt, err := original.GetTaskType()
+	if err != nil {
+		return http.StatusConflict, nil, fmt.Errorf("Task has no stored type definition and type '%s' can't be loaded :: %s", original.TypeId, err.Error())
+	}
+
+	// Overrides can blank out a variable the type requires
+	var missingVars []string
+	for varName, _ := range tt.RequiredEnv() {
+		if envVars[varName] == "" {
+			missingVars = append(missingVars, varName)
+		}
+	}
+	if len(missingVars) > 0 {
+		return http.StatusBadRequest, nil, fmt.Errorf("Missing environment variables required for this task type: %s", missingVars)
+	}
+
+	t, err := tt.NewTask(envVars)
+	if err != nil {
+		return http.StatusBadRequest, nil, err
+	}
+	t.Tags = original.Tags
+	t.RerunOf = original.Id.Hex()
+
+	// Copy uploaded files from the copies kept at submission, since the run may have changed the originals
+	for _, filename := range original.Inputs {
+		// Stored before names were checked; copying it could write outside the result directory
+		if !tasks.ValidPlainFileName(filename) {
+			log.WithFields(log.Fields{
+				"taskId":   original.Id.Hex(),
+				"filename": filename,
+			}).Warn("Not copying uploaded file with an invalid name to rerun")
+			continue
+		}
+		src, err := os.Open(path.Join(original.ResultDir, TASK_INPUTS_DIR, filename))
+		if os.IsNotExist(err) {
+			return http.StatusConflict, nil, fmt.Errorf("The uploaded file '%s' of task %s is no longer available", filename, original.Id.Hex())
+		} else if err != nil {
+			return http.StatusInternalServerError, nil, err
+		}
+		err = saveTaskInput(&t, filename, src)
+		src.Close()
+		if err != nil {
+			return http.StatusInternalServerError, nil, fmt.Errorf("Error copying input file '%s' :: %s", filename, err.Error())
+		}
+	}
+
+	err = s.DB.SaveTask(ctx, &t)
+	if err != nil {
+		return errorStatus(err), nil, fmt.Errorf("Error saving to database :: %s", err.Error())
+	}
+
+	err = s.Q.AddTask(ctx, &t)
+	if err != nil {
+		return errorStatus(err), nil, err
+	}
+
+	s.TaskEvents.Notify()
+	return http.StatusCreated, &t, nil
+}
+
+// Uploaded files are kept here, untouched by the task, so reruns get the same inputs
+const TASK_INPUTS_DIR = ".blanket-inputs"
+
+// Write an uploaded file into the task's directory, keeping a pristine copy under TASK_INPUTS_DIR
+func saveTaskInput(t *tasks.Task, filename string, src io.Reader) error {
+	inputsDir := path.Join(t.ResultDir, TASK_INPUTS_DIR)
+	err := os.MkdirAll(inputsDir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	pristine := path.Join(inputsDir, filename)
+	if err = writeTaskFile(pristine, src); err != nil {
+		return err
+	}
+	in, err := os.Open(pristine)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err = writeTaskFile(path.Join(t.ResultDir, filename), in); err != nil {
+		return err
+	}
+	t.Inputs = append(t.Inputs, filename)
+	return nil
+}
+
+func writeTaskFile(dst string, src io.Reader) error {
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, src); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
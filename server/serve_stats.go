@@ -0,0 +1,26 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"net/http"
+)
+
+// Counts, wait times, run times and success ratios of tasks over a range of time
+// `?from=&to=` (default the last day), `?bucket=hour|day`, `?types=` and `?tag=` narrow it down
+func (s *ServerConfig) getTaskStats(c *gin.Context) {
+	ctx := c.Request.Context()
+	c.Header("Content-Type", "application/json")
+
+	sq, err := database.TaskStatsQueryFromContext(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, MakeErrorString(err.Error()))
+		return
+	}
+	report, err := database.GetTaskStatsReport(ctx, s.DB, sq)
+	if err != nil {
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
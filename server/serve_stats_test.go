@@ -0,0 +1,63 @@
+// Covered:
+//   - GET /stats/tasks totals and buckets, narrowed by type, and rejecting
+//     bad buckets and ranges: TestTaskStats
+//   - GET /ui/stats renders the totals: TestTaskStats
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/tasks"
+)
+
+func TestTaskStats(t *testing.T) {
+	ctx := context.Background()
+	cleanup := setupTestTaskType(t)
+	defer cleanup()
+
+	s, scleanup := NewTestServer()
+	defer scleanup()
+	r := s.GetRouter()
+
+	tt, err := tasks.FetchTaskType("echo_task")
+	assert.NoError(t, err)
+	for _, state := range []string{"SUCCESS", "ERROR", ""} {
+		tsk, err := tt.NewTask(map[string]string{})
+		assert.NoError(t, err)
+		assert.NoError(t, s.DB.SaveTask(ctx, &tsk))
+		if state != "" {
+			assert.NoError(t, s.DB.FinishTask(ctx, tsk.Id, state, "", "", nil))
+		}
+	}
+
+	w := getUI(r, "/stats/tasks?bucket=day")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var report database.TaskStatsReport
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, 3, report.Totals.Submitted)
+	assert.Equal(t, map[string]int{"SUCCESS": 1, "ERROR": 1}, report.Totals.Finished)
+	assert.Equal(t, 0.5, report.Totals.SuccessRatio)
+	assert.Equal(t, 3, report.ByType["echo_task"].Submitted)
+	assert.NotEmpty(t, report.Buckets)
+
+	w = getUI(r, "/stats/tasks?types=other_task")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, 0, report.Totals.Submitted)
+
+	for _, bad := range []string{"bucket=week", "from=-1h&to=-2h", "from=yesterday", "from=-365d"} {
+		w = getUI(r, "/stats/tasks?"+bad)
+		assert.Equal(t, http.StatusBadRequest, w.Code, bad)
+	}
+
+	w = getUI(r, "/ui/stats")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Submitted <strong>3</strong>")
+	assert.Contains(t, w.Body.String(), "50%")
+}
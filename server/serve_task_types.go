@@ -1,16 +1,23 @@
 package server
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 	"github.com/turtlemonvh/blanket/tasks"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"strings"
 )
 
+// List loaded task types
+// With `?withErrors=true` the list is wrapped in an object that also reports per-file load errors
 func (s *ServerConfig) getTaskTypes(c *gin.Context) {
 	c.Header("Content-Type", "application/json")
 
-	// Read from disk
+	// Read from the in-memory registry
 	tts, err := tasks.ReadTypes()
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -19,6 +26,14 @@ func (s *ServerConfig) getTaskTypes(c *gin.Context) {
 		c.String(http.StatusInternalServerError, MakeErrorString(err.Error()))
 		return
 	}
+
+	if c.Query("withErrors") == "true" {
+		c.JSON(http.StatusOK, gin.H{
+			"types":  tts,
+			"errors": tasks.DefaultRegistry().LoadErrors(),
+		})
+		return
+	}
 	c.JSON(http.StatusOK, tts)
 }
 
@@ -28,10 +43,155 @@ func (s *ServerConfig) getTaskType(c *gin.Context) {
 
 	tt, err := tasks.FetchTaskType(name)
 	if err != nil {
-		// FIXME: Handle not found errors differently
-		c.String(http.StatusInternalServerError, MakeErrorString(err.Error()))
+		c.String(taskTypeErrorStatus(err), MakeErrorString(err.Error()))
 		return
 	}
 	c.JSON(http.StatusOK, tt)
 	return
 }
+
+// Map errors from the task type store to status codes
+func taskTypeErrorStatus(err error) int {
+	switch err.(type) {
+	case tasks.TaskTypeNotFoundError:
+		return http.StatusNotFound
+	case tasks.TaskTypeExistsError, tasks.TaskTypeNotWritableError:
+		return http.StatusConflict
+	case tasks.TaskTypeValidationError:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Read a task type definition and any supporting files from a request
+// Accepts the TOML as the raw body, or as a form with the definition in the `config` field
+// Multipart forms can also carry supporting files in any other file field
+func readTaskTypeUpload(c *gin.Context) ([]byte, map[string]io.Reader, error) {
+	files := make(map[string]io.Reader)
+
+	contentType := c.Request.Header.Get("Content-Type")
+	if strings.Contains(contentType, "application/x-www-form-urlencoded") {
+		return []byte(c.PostForm("config")), files, nil
+	}
+	if !strings.Contains(contentType, "multipart/form-data") {
+		contents, err := ioutil.ReadAll(c.Request.Body)
+		return contents, files, err
+	}
+
+	var contents []byte
+	configFile, _, err := c.Request.FormFile("config")
+	if err == nil {
+		defer configFile.Close()
+		contents, err = ioutil.ReadAll(configFile)
+		if err != nil {
+			return contents, files, err
+		}
+	} else {
+		contents = []byte(c.Request.FormValue("config"))
+	}
+
+	for field, headers := range c.Request.MultipartForm.File {
+		if field == "config" {
+			continue
+		}
+		for _, header := range headers {
+			// Browsers send an empty part when no file was chosen
+			if header.Filename == "" {
+				continue
+			}
+			f, err := header.Open()
+			if err != nil {
+				return contents, files, err
+			}
+			data, err := ioutil.ReadAll(f)
+			f.Close()
+			if err != nil {
+				return contents, files, err
+			}
+			files[header.Filename] = bytes.NewReader(data)
+		}
+	}
+	return contents, files, nil
+}
+
+// Shared by create and update
+// With `?dryRun=true` the definition is only validated
+func (s *ServerConfig) saveTaskType(c *gin.Context, create bool) {
+	c.Header("Content-Type", "application/json")
+	name := c.Param("name")
+
+	contents, files, err := readTaskTypeUpload(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, MakeErrorString(fmt.Sprintf("Error reading task type definition :: %s", err.Error())))
+		return
+	}
+
+	if c.Query("dryRun") == "true" {
+		bundledNames := make([]string, 0, len(files))
+		for f := range files {
+			bundledNames = append(bundledNames, f)
+		}
+		problems := tasks.ValidateTaskType(name, contents, bundledNames)
+		status := http.StatusOK
+		if len(problems) > 0 {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"valid": len(problems) == 0, "problems": problems})
+		return
+	}
+
+	tt, err := tasks.SaveTaskTypeFile(name, contents, files, create)
+	if err != nil {
+		if problems, ok := err.(tasks.TaskTypeValidationError); ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "problems": []string(problems)})
+			return
+		}
+		c.String(taskTypeErrorStatus(err), MakeErrorString(err.Error()))
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"name":        name,
+		"versionHash": tt.ConfigVersionHash,
+		"created":     create,
+	}).Info("Saved task type through the API")
+
+	status := http.StatusOK
+	if create {
+		status = http.StatusCreated
+	}
+	c.JSON(status, tt)
+}
+
+func (s *ServerConfig) postTaskType(c *gin.Context) {
+	s.saveTaskType(c, true)
+}
+
+func (s *ServerConfig) putTaskType(c *gin.Context) {
+	s.saveTaskType(c, false)
+}
+
+// Remove a task type written through the API
+// Previous revisions are kept
+func (s *ServerConfig) deleteTaskType(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+	name := c.Param("name")
+
+	if err := tasks.DeleteTaskTypeFile(name); err != nil {
+		c.String(taskTypeErrorStatus(err), MakeErrorString(err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"name": name})
+}
+
+func (s *ServerConfig) getTaskTypeRevisions(c *gin.Context) {
+	c.Header("Content-Type", "application/json")
+
+	revisions, err := tasks.ListTaskTypeRevisions(c.Param("name"))
+	if err != nil {
+		c.String(http.StatusInternalServerError, MakeErrorString(err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, revisions)
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -46,12 +47,22 @@ func (s *ServerConfig) getTaskId(c *gin.Context) (objectid.ObjectId, error) {
  * Request handlers
  */
 
-// Get all tasks
+// Get a page of tasks
 // Only looks in the database
+// Responds with a database.TaskPage; pass its nextCursor back as `cursor` for the next page
 func (s *ServerConfig) getTasks(c *gin.Context) {
+	ctx := c.Request.Context()
 	c.Header("Content-Type", "application/json")
 
 	tc := database.TaskSearchConfFromContext(c)
+	if err := database.TaskPageConfFromContext(c, tc); err != nil {
+		c.String(http.StatusBadRequest, MakeErrorString(err.Error()))
+		return
+	}
+	if err := database.TaskQueryFromContext(c, tc); err != nil {
+		c.String(http.StatusBadRequest, MakeErrorString(err.Error()))
+		return
+	}
 	log.WithFields(log.Fields{
 		"requiredTaskTags": tc.RequiredTags,
 		"maxTaskTags":      tc.MaxTags,
@@ -61,22 +72,31 @@ func (s *ServerConfig) getTasks(c *gin.Context) {
 		"smallestId":       tc.SmallestId.Hex(),
 		"largestId":        tc.LargestId.Hex(),
 		"justCounts":       tc.JustCounts,
+		"sort":             tc.Sort,
+		"query":            c.Query("q"),
 	}).Debug("Task request params")
 
-	result, nfounddb, err := s.DB.GetTasks(tc)
-	if err != nil {
-		c.String(http.StatusInternalServerError, MakeErrorString(err.Error()))
+	if tc.JustCounts {
+		tc.CountAll = false
+		_, nfounddb, err := s.DB.GetTasks(ctx, tc)
+		if err != nil {
+			c.String(errorStatus(err), MakeErrorString(err.Error()))
+			return
+		}
+		c.String(http.StatusOK, cast.ToString(nfounddb))
 		return
 	}
 
-	if tc.JustCounts {
-		c.String(http.StatusOK, cast.ToString(nfounddb))
-	} else {
-		c.JSON(http.StatusOK, result)
+	page, err := database.GetTaskPage(ctx, s.DB, tc)
+	if err != nil {
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
+		return
 	}
+	c.JSON(http.StatusOK, page)
 }
 
 func (s *ServerConfig) getTask(c *gin.Context) {
+	ctx := c.Request.Context()
 	c.Header("Content-Type", "application/json")
 
 	var err error
@@ -88,29 +108,95 @@ func (s *ServerConfig) getTask(c *gin.Context) {
 	}
 
 	var task tasks.Task
-	task, err = s.DB.GetTask(taskId)
+	task, err = s.DB.GetTask(ctx, taskId)
 	if err != nil {
-		c.String(http.StatusInternalServerError, MakeErrorString(err.Error()))
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
 		return
 	}
 
 	c.JSON(http.StatusOK, task)
 }
 
+// Get the task type definition captured when the task was submitted
+func (s *ServerConfig) getTaskTypeSnapshot(c *gin.Context) {
+	ctx := c.Request.Context()
+	c.Header("Content-Type", "application/json")
+
+	taskId, err := s.getTaskId(c)
+	if err != nil {
+		return
+	}
+
+	task, err := s.DB.GetTask(ctx, taskId)
+	if err != nil {
+		if _, ok := err.(database.ItemNotFoundError); ok {
+			c.String(http.StatusNotFound, MakeErrorString(err.Error()))
+			return
+		}
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
+		return
+	}
+
+	if task.TypeSnapshot == nil {
+		errMsg := fmt.Sprintf("Task '%s' was submitted before task type snapshots were stored", taskId.Hex())
+		c.String(http.StatusNotFound, MakeErrorString(errMsg))
+		return
+	}
+	c.JSON(http.StatusOK, task.TypeSnapshot)
+}
+
+// Get every change of state of a task, oldest first
+func (s *ServerConfig) getTaskHistory(c *gin.Context) {
+	ctx := c.Request.Context()
+	c.Header("Content-Type", "application/json")
+
+	taskId, err := s.getTaskId(c)
+	if err != nil {
+		return
+	}
+
+	task, err := s.DB.GetTask(ctx, taskId)
+	if err != nil {
+		if _, ok := err.(database.ItemNotFoundError); ok {
+			c.String(http.StatusNotFound, MakeErrorString(err.Error()))
+			return
+		}
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
+		return
+	}
+
+	history := task.History
+	if history == nil {
+		// Submitted before history was recorded
+		history = []tasks.TaskTransition{}
+	}
+	c.JSON(http.StatusOK, history)
+}
+
 // Fetch from queue, moves to database, sets fields
+// `?wait=` holds the request until a task the worker can take is queued, up to MAX_CLAIM_WAIT_SECONDS
 // FIXME: Add logging
 func (s *ServerConfig) claimTask(c *gin.Context) {
+	ctx := c.Request.Context()
 	c.Header("Content-Type", "application/json")
 	errMsg := ""
 
 	workerId, err := SafeObjectId(c.Param("workerid"))
 	if err != nil {
-		c.String(http.StatusInternalServerError, MakeErrorString(err.Error()))
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
 		return
 	}
+	wait, err := waitParam(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, MakeErrorString(err.Error()))
+		return
+	}
+	if wait > MAX_CLAIM_WAIT_SECONDS*time.Second {
+		wait = MAX_CLAIM_WAIT_SECONDS * time.Second
+	}
 
 	// Fetch worker config from DB
-	w, err := s.DB.GetWorker(workerId)
+	w, err := s.DB.GetWorker(ctx, workerId)
 	if err != nil {
 		errMsg = "Error fetching worker config from database; possible registration error or corrupt worker configuration"
 		log.WithFields(log.Fields{
@@ -118,7 +204,7 @@ func (s *ServerConfig) claimTask(c *gin.Context) {
 			"workerId": workerId,
 		}).Debug(errMsg)
 		errMsg = MakeErrorString(fmt.Sprintf("%s :: %s", errMsg, err.Error()))
-		c.String(http.StatusInternalServerError, errMsg)
+		c.String(errorStatus(err), errMsg)
 		return
 	}
 
@@ -126,20 +212,24 @@ func (s *ServerConfig) claimTask(c *gin.Context) {
 	var t tasks.Task
 	var ackCb func() error
 	var nackCb func() error
-	t, ackCb, nackCb, err = s.Q.ClaimTask(&w)
+	t, ackCb, nackCb, err = s.claimOrWait(ctx, w, wait)
 	if err != nil {
 		if errors.Is(err, queue.ErrQueueEmpty) {
 			// Normal polling state — no task for this worker right now.
 			c.Status(http.StatusNoContent)
 			return
 		}
+		status := http.StatusNotFound
+		if _, ok := err.(database.CanceledError); ok {
+			status = errorStatus(err)
+		}
 		errMsg = fmt.Sprintf("Problem claiming task :: %s", err.Error())
-		c.String(http.StatusNotFound, MakeErrorString(errMsg))
+		c.String(status, MakeErrorString(errMsg))
 		return
 	}
 
 	// Fetch from database to make sure it wasn't STOPPED
-	dbt, err := s.DB.GetTask(t.Id)
+	dbt, err := s.DB.GetTask(ctx, t.Id)
 	if err != nil {
 		if _, ok := err.(database.ItemNotFoundError); ok {
 			status := http.StatusNotFound
@@ -152,8 +242,12 @@ func (s *ServerConfig) claimTask(c *gin.Context) {
 			return
 		}
 
+		// Hand the task back so another claim can pick it up
 		errMsg = fmt.Sprintf("Could not fetch task from database to ensure it was not stopped :: %s", err.Error())
-		c.String(http.StatusInternalServerError, MakeErrorString(errMsg))
+		if nackErr := nackCb(); nackErr != nil {
+			errMsg += fmt.Sprintf("; Subsequent error returning to queue :: %s", nackErr.Error())
+		}
+		c.String(errorStatus(err), MakeErrorString(errMsg))
 		return
 	}
 
@@ -172,9 +266,9 @@ func (s *ServerConfig) claimTask(c *gin.Context) {
 	}
 
 	// Add fields
-	t.State = "CLAIMED"
 	t.Progress = 0
 	t.LastUpdatedTs = time.Now().Unix()
+	t.Transition("CLAIMED", tasks.WorkerActor(workerId), "", t.LastUpdatedTs)
 	t.StartedTs = time.Now().Unix()
 	t.WorkerId = workerId
 	// Just nil values for these
@@ -183,15 +277,21 @@ func (s *ServerConfig) claimTask(c *gin.Context) {
 	t.Pid = 0
 	t.Timeout = 0
 
-	// Save to database
-	err = s.DB.SaveTask(&t)
+	// Save to database, as long as nothing (like a cancel) has changed the task since it was checked above
+	t.Revision = dbt.Revision
+	err = s.DB.SaveTask(ctx, &t)
 	if err != nil {
+		status := errorStatus(err)
+		if _, ok := err.(database.RevisionConflictError); ok {
+			// The worker will try again
+			status = http.StatusConflict
+		}
 		errMsg = fmt.Sprintf("Error saving to database :: %s", err.Error())
 		err = nackCb()
 		if err != nil {
 			errMsg += fmt.Sprintf("; Subsequent error returning to queue :: %s", err.Error())
 		}
-		c.String(http.StatusInternalServerError, MakeErrorString(errMsg))
+		c.String(status, MakeErrorString(errMsg))
 	} else {
 		err = ackCb()
 		if err != nil {
@@ -200,6 +300,7 @@ func (s *ServerConfig) claimTask(c *gin.Context) {
 		} else {
 			// Everything is fine
 			s.TaskEvents.Notify()
+			s.taskTransitioned("task.claimed", &t)
 			c.JSON(http.StatusOK, t)
 		}
 	}
@@ -211,6 +312,7 @@ func (s *ServerConfig) claimTask(c *gin.Context) {
 // - tags should already be set at creation time
 // - execEnv should be more dynamic than it is now
 func (s *ServerConfig) markTaskAsRunning(c *gin.Context) {
+	ctx := c.Request.Context()
 	c.Header("Content-Type", "application/json")
 
 	var err error
@@ -233,55 +335,22 @@ func (s *ServerConfig) markTaskAsRunning(c *gin.Context) {
 		Pid:           cast.ToInt(c.Query("pid")),
 		TypeDigest:    c.Query("typeDigest"),
 	}
-	err = s.DB.RunTask(taskId, tc)
+	err = s.DB.RunTask(ctx, taskId, tc)
 	if err != nil {
-		c.String(http.StatusInternalServerError, MakeErrorString(err.Error()))
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
 		return
 	}
 
 	s.TaskEvents.Notify()
+	// Send the task.running deliveries queued with the transition
+	s.WebhookEvents.Notify()
 	c.JSON(http.StatusOK, "{}")
 }
 
-// Called for stopping
-func (s *ServerConfig) cancelTask(c *gin.Context) {
-	// Upsert in database, setting any item that has that Id to STOPPED state
-	c.Header("Content-Type", "application/json")
-
-	var err error
-	var taskId objectid.ObjectId
-	taskId, err = s.getTaskId(c)
-	if err != nil {
-		c.String(http.StatusBadRequest, MakeErrorString(err.Error()))
-		return
-	}
-
-	var task tasks.Task
-	task, err = s.DB.GetTask(taskId)
-	if err != nil {
-		// Should already be there since we will write to db first before adding to queue
-		c.String(http.StatusNotFound, MakeErrorString(err.Error()))
-		return
-	}
-
-	if task.State == "RUNNING" || task.State == "WAITING" {
-		err = s.DB.FinishTask(taskId, "STOPPED")
-		if err != nil {
-			c.String(http.StatusInternalServerError, MakeErrorString(err.Error()))
-			return
-		} else {
-			s.TaskEvents.Notify()
-			c.String(http.StatusOK, `{}`)
-			return
-		}
-	} else {
-		// If it doesn't exist in the database, the 'tombstone' will just have the taskId and state=STOPPED
-		c.JSON(http.StatusNotImplemented, `{"error": "Functionality not implemented"}`)
-	}
-}
-
 // Set the task to a terminal state like: STOPPING,
+// `?reason=` is recorded in the task's history
 func (s *ServerConfig) markTaskAsFinished(c *gin.Context) {
+	ctx := c.Request.Context()
 	c.Header("Content-Type", "application/json")
 
 	var err error
@@ -306,17 +375,31 @@ func (s *ServerConfig) markTaskAsFinished(c *gin.Context) {
 		return
 	}
 
-	err = s.DB.FinishTask(taskId, newState)
+	// Optional; the exit code of the command or of the step that ended the task
+	var exitCode *int
+	if raw := c.Query("exitCode"); raw != "" {
+		code, err := cast.ToIntE(raw)
+		if err != nil {
+			c.String(http.StatusBadRequest, MakeErrorString("The parameter 'exitCode' must be an integer."))
+			return
+		}
+		exitCode = &code
+	}
+
+	// Called by the worker that claimed the task
+	err = s.DB.FinishTask(ctx, taskId, newState, "", c.Query("reason"), exitCode)
 	if err != nil {
 		c.String(http.StatusBadRequest, MakeErrorString(err.Error()))
 		return
 	}
 
 	s.TaskEvents.Notify()
+	s.taskFinished(taskId)
 	c.JSON(http.StatusOK, "{}")
 }
 
 func (s *ServerConfig) updateTaskProgress(c *gin.Context) {
+	ctx := c.Request.Context()
 	c.Header("Content-Type", "application/json")
 
 	var err error
@@ -334,17 +417,78 @@ func (s *ServerConfig) updateTaskProgress(c *gin.Context) {
 		return
 	}
 
-	err = s.DB.UpdateTaskProgress(taskId, progress)
+	err = s.DB.UpdateTaskProgress(ctx, taskId, progress)
+	if err != nil {
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
+		return
+	}
+	c.String(http.StatusOK, "{}")
+}
+
+// Record the state of one step of a multi-step task
+func (s *ServerConfig) updateTaskStep(c *gin.Context) {
+	ctx := c.Request.Context()
+	c.Header("Content-Type", "application/json")
+
+	var err error
+	var taskId objectid.ObjectId
+	taskId, err = s.getTaskId(c)
+	if err != nil {
+		return
+	}
+
+	step, err := cast.ToIntE(c.Param("step"))
+	if err != nil {
+		c.String(http.StatusBadRequest, MakeErrorString("The step must be an integer index into the task's steps."))
+		return
+	}
+	exitCode := cast.ToInt(c.Query("exitCode"))
+
+	err = s.DB.UpdateTaskStep(ctx, taskId, step, c.Query("state"), exitCode)
+	if err != nil {
+		if _, ok := err.(database.ItemNotFoundError); ok {
+			c.String(http.StatusNotFound, MakeErrorString(err.Error()))
+			return
+		}
+		c.String(http.StatusBadRequest, MakeErrorString(err.Error()))
+		return
+	}
+
+	s.TaskEvents.Notify()
+	c.String(http.StatusOK, "{}")
+}
+
+// Record the state of one hook of a task
+func (s *ServerConfig) updateTaskHook(c *gin.Context) {
+	ctx := c.Request.Context()
+	c.Header("Content-Type", "application/json")
+
+	var err error
+	var taskId objectid.ObjectId
+	taskId, err = s.getTaskId(c)
+	if err != nil {
+		return
+	}
+
+	exitCode := cast.ToInt(c.Query("exitCode"))
+	err = s.DB.UpdateTaskHook(ctx, taskId, c.Param("hook"), c.Query("state"), exitCode, c.Query("followUpTaskId"))
 	if err != nil {
-		c.String(http.StatusInternalServerError, MakeErrorString(err.Error()))
+		if _, ok := err.(database.ItemNotFoundError); ok {
+			c.String(http.StatusNotFound, MakeErrorString(err.Error()))
+			return
+		}
+		c.String(http.StatusBadRequest, MakeErrorString(err.Error()))
 		return
 	}
+
+	s.TaskEvents.Notify()
 	c.String(http.StatusOK, "{}")
 }
 
 // TESTME
 // FIXME: Also grab extra tags, e.g. machine specific tag
 func (s *ServerConfig) postTask(c *gin.Context) {
+	ctx := c.Request.Context()
 	c.Header("Content-Type", "application/json")
 
 	var req map[string]interface{}
@@ -431,9 +575,19 @@ func (s *ServerConfig) postTask(c *gin.Context) {
 		c.String(http.StatusBadRequest, MakeErrorString(err.Error()))
 		return
 	}
+	// Set when a hook of another task submits this one as a follow-up
+	t.ParentId = cast.ToString(req["parentId"])
 
 	// Read any uploaded files
 	if c.Request.MultipartForm != nil {
+		// The field name is the file name in the task's directory, so it can't point anywhere else
+		for filename, _ := range c.Request.MultipartForm.File {
+			if filename != "data" && !tasks.ValidPlainFileName(filename) {
+				c.String(http.StatusBadRequest, MakeErrorString(fmt.Sprintf("Invalid name for uploaded file '%s'; must not be empty or contain path separators or '..'", filename)))
+				return
+			}
+		}
+
 		// Create output dir to put files in
 		err = os.MkdirAll(t.ResultDir, os.ModePerm)
 		if err != nil {
@@ -453,23 +607,26 @@ func (s *ServerConfig) postTask(c *gin.Context) {
 			}
 			defer uploadedFile.Close()
 
-			writtenUploadedFile, err := os.Create(path.Join(t.ResultDir, filename))
-			defer writtenUploadedFile.Close()
-			io.Copy(writtenUploadedFile, uploadedFile)
+			err = saveTaskInput(&t, filename, uploadedFile)
+			if err != nil {
+				c.String(http.StatusInternalServerError, MakeErrorString(fmt.Sprintf("Error saving uploaded file '%s' :: %s", filename, err.Error())))
+				return
+			}
 		}
 	}
 
 	// Add to database
-	err = s.DB.SaveTask(&t)
+	err = s.DB.SaveTask(ctx, &t)
 	if err != nil {
 		errMsg := fmt.Sprintf("Error saving to database :: %s", err.Error())
-		c.String(http.StatusInternalServerError, MakeErrorString(errMsg))
+		c.String(errorStatus(err), MakeErrorString(errMsg))
+		return
 	}
 
 	// Add to queue
-	err = s.Q.AddTask(&t)
+	err = s.Q.AddTask(ctx, &t)
 	if err != nil {
-		c.String(http.StatusInternalServerError, MakeErrorString(err.Error()))
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
 		return
 	}
 
@@ -490,28 +647,36 @@ func (s *ServerConfig) removeTask(c *gin.Context) {
 		return
 	}
 
-	err = s.DB.DeleteTask(taskId)
+	err = s.deleteTaskById(c.Request.Context(), taskId)
 	if err != nil {
-		errMsg := fmt.Sprintf(`{"error": "%s"}`, err.Error())
-		c.String(http.StatusInternalServerError, errMsg)
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
 		return
 	}
 
+	c.String(http.StatusOK, fmt.Sprintf(`{"id": "%s"}`, taskId.Hex()))
+}
+
+// Remove a task from the database along with its result directory
+func (s *ServerConfig) deleteTaskById(ctx context.Context, taskId objectid.ObjectId) error {
+	err := s.DB.DeleteTask(ctx, taskId)
+	if err != nil {
+		return err
+	}
+
 	// Remove result directory
 	// FIXME: Grab from json instead
 	err = os.RemoveAll(path.Join(s.ResultsPath, taskId.Hex()))
 	if err != nil {
-		errMsg := fmt.Sprintf(`{"error": "%s"}`, err.Error())
-		c.String(http.StatusInternalServerError, errMsg)
-		return
+		return err
 	}
 
 	s.TaskEvents.Notify()
-	c.String(http.StatusOK, fmt.Sprintf(`{"id": "%s"}`, taskId.Hex()))
+	return nil
 }
 
 // Stream out task log
 func (s *ServerConfig) streamTaskLog(c *gin.Context) {
+	ctx := c.Request.Context()
 	var err error
 	var taskId objectid.ObjectId
 
@@ -521,7 +686,7 @@ func (s *ServerConfig) streamTaskLog(c *gin.Context) {
 	}
 
 	var task tasks.Task
-	task, err = s.DB.GetTask(taskId)
+	task, err = s.DB.GetTask(ctx, taskId)
 	if err != nil {
 		c.String(http.StatusInternalServerError, "Error fetching information about task while preparing to open logfile stream")
 		return
@@ -537,7 +702,7 @@ func (s *ServerConfig) streamTaskLog(c *gin.Context) {
 
 	// Task is stopped when it is in a terminal state or we get an error fetching its information
 	isComplete := func() bool {
-		task, err = s.DB.GetTask(taskId)
+		task, err = s.DB.GetTask(ctx, taskId)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"taskId":         taskId,
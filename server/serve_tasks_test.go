@@ -4,23 +4,43 @@
 //   - POST /task/ with JSON body: TestPostTask_Valid, TestPostTask_MissingTypeField,
 //     TestPostTask_UnknownType
 //   - GET /task/:id:            TestGetTask_InvalidId, TestGetTask_Exists
+//   - GET /task_type/:name with extends: TestTaskType_ByName_ShowsProvenance
+//   - POST/PUT/DELETE /task_type/:name, dryRun, revisions:
+//     TestTaskType_CreateUpdateDelete, TestTaskType_CreateWithBundledFiles
+//   - GET /task/:id/type:       TestGetTaskTypeSnapshot_IgnoresLaterEdits,
+//     TestGetTaskTypeSnapshot_MissingTask
 //   - GET /task/ + state filter: TestTaskList_FilterByState
+//   - GET /task/ pages, cursors, sorts and totals: TestTaskList_Pages
+//   - GET /task/?q= queries, and exit codes from PUT /task/:id/finish: TestTaskList_Query
 //   - DELETE /task/:id:         TestDeleteTask
 //   - PUT /task/:id/cancel from WAITING: TestCancelTask_Waiting
+//   - PUT /task/:id/cancel from RUNNING, GET /task/:id/cancel, PUT /task/:id/cancel/ack
+//     and unacknowledged requests: TestCancelTask_Running
+//   - GET /task/:id/history with worker and API actors: TestTaskHistory
+//   - POST /task/:id/rerun with overrides and uploaded inputs: TestRerunTask
+//   - uploaded file names that would leave the task's directory: TestUploadedFileNames
 //   - PUT /task/:id/progress (valid + out-of-range): TestUpdateProgress_Valid,
 //     TestUpdateProgress_InvalidValue
 //   - PUT /task/:id/progress (missing task): TestUpdateProgress_MissingTask
+//   - PUT /task/:id/step/:step: TestUpdateTaskStep
+//   - PUT /task/:id/hook/:hook: TestUpdateTaskHook
 //   - PUT /task/:id/finish: TestFinishTask_Valid, TestFinishTask_MissingTask,
 //     TestFinishTask_WrongState, TestFinishTask_InvalidState
 //   - POST /task/claim/:workerid edges: TestClaim_MissingWorker,
 //     TestClaim_NoMatchingTask, TestClaim_DeletedTaskDoesNotPanic
+//   - POST /task/claim/:workerid?wait= held until a task is queued or the worker stops:
+//     TestClaim_WaitsForTask
+//   - PUT /ops/pause, /ops/resume and PUT /worker/:id/drain, /worker/:id/resume holding claims:
+//     TestClaim_PausedAndDraining
+//   - 504 past `server.requestTimeoutSeconds` and 499 once the client goes away:
+//     TestRequestDeadlines
 //   - claim-task happy path: covered by worker integration test TestProcessOne
 //
 // Not yet covered:
 //   - POST /task/ with multipart form + file uploads (data=@file, extra files
 //     placed at the task's working dir root)
 //   - GET /task/ with the full filter flag set (not just state): type, tags,
-//     created-before/after, limit, offset, sort order, etc.
+//     created-before/after, etc.
 //   - PUT /task/:id/stop (distinct from cancel: stop applies to a RUNNING task
 //     and should signal the worker)
 //   - cancel-then-still-try-to-run: ensure the worker observes the tombstone
@@ -32,11 +52,13 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -44,6 +66,8 @@ import (
 	"time"
 
 	"github.com/spf13/viper"
+	"github.com/turtlemonvh/blanket/lib/bolt"
+	"github.com/turtlemonvh/blanket/lib/database"
 	"github.com/stretchr/testify/assert"
 	"github.com/turtlemonvh/blanket/lib/objectid"
 	"github.com/turtlemonvh/blanket/tasks"
@@ -163,6 +187,44 @@ func TestTaskTypes_Listed(t *testing.T) {
 	assert.Len(t, tts, 1)
 }
 
+func TestTaskTypes_ReportsLoadErrors(t *testing.T) {
+	cleanup := setupTestTaskType(t)
+	defer cleanup()
+
+	typesDir := viper.GetStringSlice("tasks.typesPaths")[0]
+	err := os.WriteFile(filepath.Join(typesDir, "broken_task.toml"), []byte(`tags = ["bash"]`), 0644)
+	assert.NoError(t, err)
+
+	s, scleanup := NewTestServer()
+	defer scleanup()
+	r := s.GetRouter()
+
+	// The plain listing is unaffected by the broken file
+	req, _ := http.NewRequest("GET", "/task_type/", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var tts []interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &tts))
+	assert.Len(t, tts, 1)
+
+	req, _ = http.NewRequest("GET", "/task_type/?withErrors=true", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Types  []map[string]interface{} `json:"types"`
+		Errors []tasks.TaskTypeLoadError `json:"errors"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Len(t, resp.Types, 1)
+	if assert.Len(t, resp.Errors, 1) {
+		assert.Equal(t, "broken_task", resp.Errors[0].Name)
+		assert.Contains(t, resp.Errors[0].Error, "command")
+	}
+}
+
 func TestTaskType_ByName(t *testing.T) {
 	cleanup := setupTestTaskType(t)
 	defer cleanup()
@@ -183,6 +245,128 @@ func TestTaskType_ByName(t *testing.T) {
 	assert.Equal(t, "echo_task", tt["name"])
 }
 
+// --- POST/PUT/DELETE /task_type/:name ---
+
+func TestTaskType_CreateUpdateDelete(t *testing.T) {
+	cleanup := setupTestTaskType(t)
+	defer cleanup()
+
+	s, scleanup := NewTestServer()
+	defer scleanup()
+	r := s.GetRouter()
+
+	send := func(method string, path string, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// Dry run reports problems without writing anything
+	w := send("POST", "/task_type/new_task?dryRun=true", `tags = ["bash"]`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "command")
+	w = send("GET", "/task_type/new_task", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = send("POST", "/task_type/new_task", minimalTaskTypeToml)
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	w = send("POST", "/task_type/new_task", minimalTaskTypeToml)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// The new type can be used right away
+	w = postTask(r, "new_task")
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	w = send("PUT", "/task_type/new_task", `command = "echo 'v2'"`)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var tt map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &tt))
+	assert.Equal(t, "echo 'v2'", tt["command"])
+
+	w = send("PUT", "/task_type/missing_task", minimalTaskTypeToml)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = send("DELETE", "/task_type/new_task", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = send("GET", "/task_type/new_task", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = send("GET", "/task_type/new_task/revisions", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var revisions []tasks.TaskTypeRevision
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &revisions))
+	if assert.Len(t, revisions, 3) {
+		assert.Equal(t, tt["versionHash"], revisions[1].VersionHash)
+		assert.True(t, revisions[2].Deleted)
+	}
+}
+
+func TestTaskType_CreateWithBundledFiles(t *testing.T) {
+	cleanup := setupTestTaskType(t)
+	defer cleanup()
+
+	s, scleanup := NewTestServer()
+	defer scleanup()
+	r := s.GetRouter()
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	mw.WriteField("config", `
+command = "bash run.sh"
+files_to_include = [["script_task.files/run.sh", "run.sh"]]
+`)
+	fw, _ := mw.CreateFormFile("files", "run.sh")
+	fw.Write([]byte("echo bundled"))
+	mw.Close()
+
+	req, _ := http.NewRequest("POST", "/task_type/script_task", body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	typesDir := viper.GetStringSlice("tasks.typesPaths")[0]
+	bundled, err := os.ReadFile(filepath.Join(typesDir, "script_task.files", "run.sh"))
+	assert.NoError(t, err)
+	assert.Equal(t, "echo bundled", string(bundled))
+}
+
+func TestTaskType_ByName_ShowsProvenance(t *testing.T) {
+	cleanup := setupTestTaskType(t)
+	defer cleanup()
+
+	s, scleanup := NewTestServer()
+	defer scleanup()
+	r := s.GetRouter()
+
+	req, _ := http.NewRequest("POST", "/task_type/child_task", strings.NewReader(`
+extends = "echo_task"
+tags = ["child"]
+`))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	req, _ = http.NewRequest("GET", "/task_type/child_task", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var tt struct {
+		Command    string            `json:"command"`
+		Tags       []string          `json:"tags"`
+		Provenance map[string]string `json:"provenance"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &tt))
+	assert.Equal(t, "echo 'hello from blanket'", tt.Command)
+	assert.Equal(t, []string{"bash", "unix", "child"}, tt.Tags)
+
+	typesDir := viper.GetStringSlice("tasks.typesPaths")[0]
+	assert.Equal(t, filepath.Join(typesDir, "echo_task.toml"), tt.Provenance["command"])
+	assert.Equal(t, filepath.Join(typesDir, "child_task.toml"), tt.Provenance["tags.child"])
+}
+
 // --- POST /task/ ---
 
 func TestPostTask_MissingTypeField(t *testing.T) {
@@ -270,6 +454,49 @@ func TestGetTask_Exists(t *testing.T) {
 	assert.Equal(t, "echo_task", fetched.TypeId)
 }
 
+// --- GET /task/:id/type ---
+
+func TestGetTaskTypeSnapshot_IgnoresLaterEdits(t *testing.T) {
+	cleanup := setupTestTaskType(t)
+	defer cleanup()
+
+	s, scleanup := NewTestServer()
+	defer scleanup()
+	r := s.GetRouter()
+
+	created := postTask(r, "echo_task")
+	assert.Equal(t, http.StatusCreated, created.Code)
+	var createdTask tasks.Task
+	json.Unmarshal(created.Body.Bytes(), &createdTask)
+
+	// Edit the type on disk after submission
+	typesDir := viper.GetStringSlice("tasks.typesPaths")[0]
+	err := os.WriteFile(filepath.Join(typesDir, "echo_task.toml"), []byte(`command = "echo edited"`), 0644)
+	assert.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/task/%s/type", createdTask.Id.Hex()), nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var tt map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &tt))
+	assert.Equal(t, "echo_task", tt["name"])
+	assert.Equal(t, "echo 'hello from blanket'", tt["command"])
+	assert.Equal(t, createdTask.TypeDigest, tt["versionHash"])
+}
+
+func TestGetTaskTypeSnapshot_MissingTask(t *testing.T) {
+	s, cleanup := NewTestServer()
+	defer cleanup()
+	r := s.GetRouter()
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/task/%s/type", objectid.NewObjectId().Hex()), nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
 // --- DELETE /task/:id ---
 
 func TestDeleteTask(t *testing.T) {
@@ -335,6 +562,140 @@ func TestCancelTask_Waiting(t *testing.T) {
 	assert.Equal(t, "STOPPED", stopped.State)
 }
 
+func TestCancelTask_Running(t *testing.T) {
+	ctx := context.Background()
+	s, cleanup := NewTestServer()
+	defer cleanup()
+	r := s.GetRouter()
+
+	put := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("PUT", path, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	newRunningTask := func() tasks.Task {
+		task := tasks.Task{Id: objectid.NewObjectId(), State: "RUNNING", WorkerId: objectid.NewObjectId()}
+		assert.NoError(t, s.DB.SaveTask(ctx, &task))
+		return task
+	}
+
+	// Nothing to report yet
+	acked := newRunningTask()
+	assert.Equal(t, http.StatusNoContent, getUI(r, fmt.Sprintf("/task/%s/cancel?wait=0", acked.Id.Hex())).Code)
+	assert.Equal(t, http.StatusBadRequest, put(fmt.Sprintf("/task/%s/cancel/ack", acked.Id.Hex())).Code)
+
+	// The request is recorded but the task keeps running until its worker answers
+	w := put(fmt.Sprintf("/task/%s/cancel?reason=wrong+input", acked.Id.Hex()))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	w = getUI(r, fmt.Sprintf("/task/%s/cancel?wait=5", acked.Id.Hex()))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var cancellation tasks.TaskCancellation
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &cancellation))
+	assert.Equal(t, "wrong input", cancellation.Reason)
+	assert.False(t, cancellation.Force)
+	stored, _ := s.DB.GetTask(ctx, acked.Id)
+	assert.Equal(t, "RUNNING", stored.State)
+
+	// A second request can add force
+	assert.Equal(t, http.StatusAccepted, put(fmt.Sprintf("/task/%s/cancel?force=true", acked.Id.Hex())).Code)
+	assert.Equal(t, http.StatusOK, put(fmt.Sprintf("/task/%s/cancel/ack", acked.Id.Hex())).Code)
+	assert.Equal(t, http.StatusBadRequest, put(fmt.Sprintf("/task/%s/cancel/ack?outcome=MAYBE", acked.Id.Hex())).Code)
+	assert.Equal(t, http.StatusOK, put(fmt.Sprintf("/task/%s/cancel/ack?outcome=KILLED", acked.Id.Hex())).Code)
+	stored, _ = s.DB.GetTask(ctx, acked.Id)
+	assert.Equal(t, "STOPPED", stored.State)
+	assert.True(t, stored.Cancellation.Force)
+	assert.Equal(t, tasks.CANCEL_KILLED, stored.Cancellation.Outcome)
+	assert.Equal(t, "wrong input", stored.History[len(stored.History)-1].Reason)
+
+	// Finished tasks can't be cancelled
+	assert.Equal(t, http.StatusConflict, put(fmt.Sprintf("/task/%s/cancel", acked.Id.Hex())).Code)
+
+	// The server stops tasks whose worker never answers
+	viper.Set("tasks.cancelAckTimeoutSeconds", 60)
+	defer viper.Set("tasks.cancelAckTimeoutSeconds", nil)
+	ignored := newRunningTask()
+	assert.Equal(t, http.StatusAccepted, put(fmt.Sprintf("/task/%s/cancel", ignored.Id.Hex())).Code)
+	s.stopUnacknowledgedCancels(time.Now().Unix())
+	stored, _ = s.DB.GetTask(ctx, ignored.Id)
+	assert.Equal(t, "RUNNING", stored.State)
+	s.stopUnacknowledgedCancels(time.Now().Unix() + 61)
+	stored, _ = s.DB.GetTask(ctx, ignored.Id)
+	assert.Equal(t, "STOPPED", stored.State)
+	assert.Equal(t, tasks.CANCEL_UNACKNOWLEDGED, stored.Cancellation.Outcome)
+	assert.Zero(t, stored.Cancellation.AcknowledgedTs)
+	assert.Equal(t, tasks.ACTOR_SYSTEM, stored.History[len(stored.History)-1].Actor)
+}
+
+func TestTaskHistory(t *testing.T) {
+	ctx := context.Background()
+	cleanup := setupTestTaskType(t)
+	defer cleanup()
+
+	s, scleanup := NewTestServer()
+	defer scleanup()
+	r := s.GetRouter()
+
+	wconf := worker.WorkerConf{
+		Id:   objectid.NewObjectId(),
+		Tags: []string{"bash", "unix"},
+	}
+	assert.NoError(t, s.DB.UpdateWorker(ctx, &wconf))
+
+	put := func(path string) int {
+		req, _ := http.NewRequest("PUT", path, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	getHistory := func(taskId objectid.ObjectId) []tasks.TaskTransition {
+		w := getUI(r, fmt.Sprintf("/task/%s/history", taskId.Hex()))
+		assert.Equal(t, http.StatusOK, w.Code)
+		var history []tasks.TaskTransition
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &history))
+		return history
+	}
+
+	// Run by a worker, which reports why it failed
+	var ran tasks.Task
+	json.Unmarshal(postTask(r, "echo_task").Body.Bytes(), &ran)
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/task/claim/%s", wconf.Id.Hex()), nil)
+	claimed := httptest.NewRecorder()
+	r.ServeHTTP(claimed, req)
+	assert.Equal(t, http.StatusOK, claimed.Code)
+	assert.Equal(t, http.StatusOK, put(fmt.Sprintf("/task/%s/run", ran.Id.Hex())))
+	assert.Equal(t, http.StatusOK, put(fmt.Sprintf("/task/%s/finish?state=ERROR&reason=exit+status+2", ran.Id.Hex())))
+
+	history := getHistory(ran.Id)
+	workerActor := tasks.WorkerActor(wconf.Id)
+	expected := []tasks.TaskTransition{
+		{Actor: tasks.ACTOR_API, OldState: "", NewState: "WAITING"},
+		{Actor: workerActor, OldState: "WAITING", NewState: "CLAIMED"},
+		{Actor: workerActor, OldState: "CLAIMED", NewState: "RUNNING"},
+		{Actor: workerActor, OldState: "RUNNING", NewState: "ERROR", Reason: "exit status 2"},
+	}
+	if assert.Len(t, history, len(expected)) {
+		for i := range history {
+			assert.NotZero(t, history[i].Ts)
+			history[i].Ts = 0
+		}
+		assert.Equal(t, expected, history)
+	}
+
+	// Cancelled through the API
+	var cancelled tasks.Task
+	json.Unmarshal(postTask(r, "echo_task").Body.Bytes(), &cancelled)
+	assert.Equal(t, http.StatusOK, put(fmt.Sprintf("/task/%s/cancel?reason=no+longer+needed", cancelled.Id.Hex())))
+	history = getHistory(cancelled.Id)
+	if assert.Len(t, history, 2) {
+		assert.Equal(t, tasks.ACTOR_API, history[1].Actor)
+		assert.Equal(t, "STOPPED", history[1].NewState)
+		assert.Equal(t, "no longer needed", history[1].Reason)
+	}
+
+	assert.Equal(t, http.StatusNotFound, getUI(r, fmt.Sprintf("/task/%s/history", objectid.NewObjectId().Hex())).Code)
+}
+
 // --- PUT /task/:id/progress ---
 
 func TestUpdateProgress_InvalidValue(t *testing.T) {
@@ -374,6 +735,103 @@ func TestUpdateProgress_Valid(t *testing.T) {
 	assert.Equal(t, http.StatusOK, w.Code)
 }
 
+// --- PUT /task/:id/step/:step ---
+
+func TestUpdateTaskStep(t *testing.T) {
+	ctx := context.Background()
+	s, cleanup := NewTestServer()
+	defer cleanup()
+	r := s.GetRouter()
+
+	tt, err := tasks.ReadTaskType(strings.NewReader(`
+[[steps]]
+name = "fetch"
+command = "echo fetch"
+
+[[steps]]
+name = "process"
+command = "echo process"
+`))
+	assert.NoError(t, err)
+	task, err := tt.NewTask(nil)
+	assert.NoError(t, err)
+	assert.NoError(t, s.DB.SaveTask(ctx, &task))
+
+	put := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("PUT", fmt.Sprintf("/task/%s%s", task.Id.Hex(), path), nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// Steps only change while the task is running
+	assert.Equal(t, http.StatusBadRequest, put("/step/0?state=RUNNING").Code)
+
+	task.State = "RUNNING"
+	assert.NoError(t, s.DB.SaveTask(ctx, &task))
+	assert.Equal(t, http.StatusOK, put("/step/0?state=SUCCESS&exitCode=0").Code)
+	assert.Equal(t, http.StatusOK, put("/step/1?state=ERROR&exitCode=2").Code)
+	assert.Equal(t, http.StatusBadRequest, put("/step/2?state=SUCCESS").Code)
+	assert.Equal(t, http.StatusBadRequest, put("/step/1?state=DONE").Code)
+
+	stored, err := s.DB.GetTask(ctx, task.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, stored.Progress)
+	assert.Equal(t, "process", stored.FailedStep)
+	assert.Equal(t, 2, stored.Steps[1].ExitCode)
+
+	// Each step has its own log
+	assert.Equal(t, http.StatusBadRequest, getUI(r, fmt.Sprintf("/task/%s/log/tail?step=5", task.Id.Hex())).Code)
+}
+
+func TestUpdateTaskHook(t *testing.T) {
+	ctx := context.Background()
+	s, cleanup := NewTestServer()
+	defer cleanup()
+	r := s.GetRouter()
+
+	tt, err := tasks.ReadTaskType(strings.NewReader(`
+command = "echo main"
+after = "echo cleanup"
+
+[on_success]
+command = "echo done"
+`))
+	assert.NoError(t, err)
+	task, err := tt.NewTask(nil)
+	assert.NoError(t, err)
+	assert.NoError(t, s.DB.SaveTask(ctx, &task))
+
+	put := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("PUT", fmt.Sprintf("/task/%s%s", task.Id.Hex(), path), nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// Hooks only change once a worker has the task
+	assert.Equal(t, http.StatusBadRequest, put("/hook/after?state=RUNNING").Code)
+
+	// ...but still change after it has finished
+	task.State = "SUCCESS"
+	assert.NoError(t, s.DB.SaveTask(ctx, &task))
+	followUpId := objectid.NewObjectId().Hex()
+	assert.Equal(t, http.StatusOK, put("/hook/on_success?state=SUCCESS&followUpTaskId="+followUpId).Code)
+	assert.Equal(t, http.StatusOK, put("/hook/after?state=ERROR&exitCode=3").Code)
+	assert.Equal(t, http.StatusBadRequest, put("/hook/before?state=SUCCESS").Code)
+	assert.Equal(t, http.StatusBadRequest, put("/hook/after?state=DONE").Code)
+
+	stored, err := s.DB.GetTask(ctx, task.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, "SUCCESS", stored.State)
+	if assert.Len(t, stored.Hooks, 2) {
+		assert.Equal(t, "on_success", stored.Hooks[0].Name)
+		assert.Equal(t, followUpId, stored.Hooks[0].FollowUpTaskId)
+		assert.Equal(t, "ERROR", stored.Hooks[1].State)
+		assert.Equal(t, 3, stored.Hooks[1].ExitCode)
+	}
+}
+
 // --- GET /task/ with filters ---
 
 func TestTaskList_FilterByState(t *testing.T) {
@@ -400,9 +858,117 @@ func TestTaskList_FilterByState(t *testing.T) {
 	assertResponseLength(t, r, req, 3)
 }
 
+func TestTaskList_Pages(t *testing.T) {
+	cleanup := setupTestTaskType(t)
+	defer cleanup()
+
+	s, scleanup := NewTestServer()
+	defer scleanup()
+	r := s.GetRouter()
+
+	var created []string
+	for i := 0; i < 5; i++ {
+		w := postTask(r, "echo_task")
+		assert.Equal(t, http.StatusCreated, w.Code)
+		var tsk tasks.Task
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &tsk))
+		created = append(created, tsk.Id.Hex())
+	}
+
+	getPage := func(query string) (int, database.TaskPage) {
+		req, _ := http.NewRequest("GET", "/task/?"+query, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var page database.TaskPage
+		if w.Code == http.StatusOK {
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+		}
+		return w.Code, page
+	}
+
+	// Follow cursors to the end, newest first
+	var seen []string
+	query := "limit=2&reverseSort=true&total=true"
+	for i := 0; i < 5; i++ {
+		code, page := getPage(query)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, 5, page.Total)
+		for _, tsk := range page.Items {
+			seen = append(seen, tsk.Id.Hex())
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query = "limit=2&reverseSort=true&total=true&cursor=" + page.NextCursor
+	}
+	assert.Equal(t, []string{created[4], created[3], created[2], created[1], created[0]}, seen)
+
+	// Totals are only counted when asked for
+	code, page := getPage("limit=2&sort=updated")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, -1, page.Total)
+	assert.Len(t, page.Items, 2)
+
+	// A cursor only continues the sort it came from
+	code, _ = getPage("limit=2&cursor=" + page.NextCursor)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = getPage("cursor=nope")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = getPage("sort=priority")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestTaskList_Query(t *testing.T) {
+	cleanup := setupTestTaskType(t)
+	defer cleanup()
+
+	s, scleanup := NewTestServer()
+	defer scleanup()
+	r := s.GetRouter()
+
+	var ids []string
+	for _, dataset := range []string{"foo", "foo", "bar"} {
+		w := postJSON(r, "/task/", fmt.Sprintf(`{"type": "echo_task", "environment": {"DATASET": %q}}`, dataset))
+		assert.Equal(t, http.StatusCreated, w.Code)
+		var tsk tasks.Task
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &tsk))
+		ids = append(ids, tsk.Id.Hex())
+	}
+
+	// One foo run fails with an exit code
+	req, _ := http.NewRequest("PUT", fmt.Sprintf("/task/%s/finish?state=ERROR&exitCode=3", ids[0]), nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	req, _ = http.NewRequest("PUT", fmt.Sprintf("/task/%s/finish?state=ERROR&exitCode=three", ids[1]), nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	query := func(q string) *http.Request {
+		req, _ := http.NewRequest("GET", "/task/?q="+url.QueryEscape(q), nil)
+		return req
+	}
+	assertResponseLength(t, r, query("env.DATASET=foo"), 2)
+	assertResponseLength(t, r, query("env.DATASET=foo exitCode!=0"), 1)
+	assertResponseLength(t, r, query("exitCode=none"), 2)
+	assertResponseLength(t, r, query("bar OR finished>-1h"), 2)
+	assertResponseLength(t, r, query("-env.DATASET=foo"), 1)
+
+	// The query combines with the other filters
+	req, _ = http.NewRequest("GET", "/task/?states=WAITING&q="+url.QueryEscape("env.DATASET=foo"), nil)
+	assertResponseLength(t, r, req, 1)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, query("color=red"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Unknown field")
+}
+
 // --- PUT /task/:id/finish ---
 
 func TestFinishTask_Valid(t *testing.T) {
+	ctx := context.Background()
 	cleanup := setupTestTaskType(t)
 	defer cleanup()
 
@@ -422,7 +988,7 @@ func TestFinishTask_Valid(t *testing.T) {
 	assert.Equal(t, http.StatusOK, w.Code)
 
 	// Confirm state is now SUCCESS and progress was bumped to 100.
-	got, err := s.DB.GetTask(createdTask.Id)
+	got, err := s.DB.GetTask(ctx, createdTask.Id)
 	assert.NoError(t, err)
 	assert.Equal(t, "SUCCESS", got.State)
 	assert.Equal(t, 100, got.Progress)
@@ -534,6 +1100,7 @@ func TestClaim_MissingWorker(t *testing.T) {
 }
 
 func TestClaim_NoMatchingTask(t *testing.T) {
+	ctx := context.Background()
 	cleanup := setupTestTaskType(t)
 	defer cleanup()
 
@@ -548,7 +1115,7 @@ func TestClaim_NoMatchingTask(t *testing.T) {
 		Tags:    []string{"bash", "unix"},
 		Stopped: false,
 	}
-	assert.NoError(t, s.DB.UpdateWorker(&wconf))
+	assert.NoError(t, s.DB.UpdateWorker(ctx, &wconf))
 
 	url := fmt.Sprintf("/task/claim/%s", wconf.Id.Hex())
 	req, _ := http.NewRequest("POST", url, nil)
@@ -560,7 +1127,162 @@ func TestClaim_NoMatchingTask(t *testing.T) {
 	assert.Equal(t, http.StatusNoContent, w.Code)
 }
 
+func TestClaim_WaitsForTask(t *testing.T) {
+	ctx := context.Background()
+	cleanup := setupTestTaskType(t)
+	defer cleanup()
+
+	s, scleanup := NewTestServer()
+	defer scleanup()
+	r := s.GetRouter()
+
+	wconf := worker.WorkerConf{
+		Id:   objectid.NewObjectId(),
+		Tags: []string{"bash", "unix"},
+	}
+	assert.NoError(t, s.DB.UpdateWorker(ctx, &wconf))
+	claim := func(wait string) (*httptest.ResponseRecorder, time.Duration) {
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/task/claim/%s?wait=%s", wconf.Id.Hex(), wait), nil)
+		w := httptest.NewRecorder()
+		start := time.Now()
+		r.ServeHTTP(w, req)
+		return w, time.Since(start)
+	}
+
+	// Nothing queued: held for the whole wait
+	w, took := claim("200ms")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.GreaterOrEqual(t, took, 200*time.Millisecond)
+
+	w, _ = claim("soon")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// A task submitted while the claim waits is handed out right away
+	claimed := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w, _ := claim("10")
+		claimed <- w
+	}()
+	time.Sleep(100 * time.Millisecond)
+	created := postTask(r, "echo_task")
+	assert.Equal(t, http.StatusCreated, created.Code)
+	select {
+	case w = <-claimed:
+		assert.Equal(t, http.StatusOK, w.Code)
+		var task tasks.Task
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &task))
+		assert.Equal(t, "CLAIMED", task.State)
+	case <-time.After(5 * time.Second):
+		t.Fatal("claim was not woken by the new task")
+	}
+
+	// Stopping the worker lets its claim go
+	go func() {
+		w, _ := claim("10")
+		claimed <- w
+	}()
+	time.Sleep(100 * time.Millisecond)
+	req, _ := http.NewRequest("PUT", fmt.Sprintf("/worker/%s/stop", wconf.Id.Hex()), nil)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	select {
+	case w = <-claimed:
+		assert.Equal(t, http.StatusNoContent, w.Code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("claim was not let go when the worker stopped")
+	}
+}
+
+func TestClaim_PausedAndDraining(t *testing.T) {
+	ctx := context.Background()
+	cleanup := setupTestTaskType(t)
+	defer cleanup()
+
+	// The queue reads the pause from its own storage, so it must share the database's file
+	s, scleanup := NewTestServer()
+	defer scleanup()
+	DB, Q, closer := bolt.NewTestBackend()
+	defer closer()
+	s.DB, s.Q = DB, Q
+	r := s.GetRouter()
+
+	wconf := worker.WorkerConf{
+		Id:   objectid.NewObjectId(),
+		Tags: []string{"bash", "unix"},
+	}
+	assert.NoError(t, s.DB.UpdateWorker(ctx, &wconf))
+	put := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("PUT", path, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	claimed := make(chan *httptest.ResponseRecorder)
+	claimInBackground := func() {
+		go func() {
+			req, _ := http.NewRequest("POST", fmt.Sprintf("/task/claim/%s?wait=10", wconf.Id.Hex()), nil)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			claimed <- w
+		}()
+		time.Sleep(100 * time.Millisecond)
+	}
+	assertClaimed := func(msg string) {
+		select {
+		case w := <-claimed:
+			assert.Equal(t, http.StatusOK, w.Code)
+		case <-time.After(5 * time.Second):
+			t.Fatal(msg)
+		}
+	}
+
+	// Paused: submissions are accepted, but claims get nothing
+	w := put("/ops/pause?reason=upgrade")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var p database.QueuePause
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+	assert.True(t, p.Paused)
+	assert.Equal(t, "upgrade", p.Reason)
+	assert.Equal(t, http.StatusCreated, postTask(r, "echo_task").Code)
+
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/task/claim/%s?wait=100ms", wconf.Id.Hex()), nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	req, _ = http.NewRequest("GET", "/ops/pause", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"paused":true`)
+
+	// Resuming hands the queued task to the waiting claim
+	claimInBackground()
+	assert.Equal(t, http.StatusOK, put("/ops/resume").Code)
+	assertClaimed("claim was not woken when claims resumed")
+
+	// A draining worker stays registered but gets nothing until it is resumed
+	w = put(fmt.Sprintf("/worker/%s/drain", wconf.Id.Hex()))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var drained worker.WorkerConf
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &drained))
+	assert.True(t, drained.Draining)
+	assert.False(t, drained.Stopped)
+	assert.Equal(t, http.StatusCreated, postTask(r, "echo_task").Code)
+
+	req, _ = http.NewRequest("POST", fmt.Sprintf("/task/claim/%s?wait=100ms", wconf.Id.Hex()), nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	claimInBackground()
+	assert.Equal(t, http.StatusOK, put(fmt.Sprintf("/worker/%s/resume", wconf.Id.Hex())).Code)
+	assertClaimed("claim was not woken when the worker resumed")
+
+	assert.Equal(t, http.StatusNotFound, put(fmt.Sprintf("/worker/%s/drain", objectid.NewObjectId().Hex())).Code)
+}
+
 func TestClaim_DeletedTaskDoesNotPanic(t *testing.T) {
+	ctx := context.Background()
 	cleanup := setupTestTaskType(t)
 	defer cleanup()
 
@@ -572,7 +1294,7 @@ func TestClaim_DeletedTaskDoesNotPanic(t *testing.T) {
 		Id:   objectid.NewObjectId(),
 		Tags: []string{"bash", "unix"},
 	}
-	assert.NoError(t, s.DB.UpdateWorker(&wconf))
+	assert.NoError(t, s.DB.UpdateWorker(ctx, &wconf))
 
 	created := postTask(r, "echo_task")
 	assert.Equal(t, http.StatusCreated, created.Code)
@@ -582,7 +1304,7 @@ func TestClaim_DeletedTaskDoesNotPanic(t *testing.T) {
 	json.NewDecoder(created.Body).Decode(&body)
 
 	taskId := objectid.ObjectIdHex(body.ID)
-	assert.NoError(t, s.DB.DeleteTask(taskId))
+	assert.NoError(t, s.DB.DeleteTask(ctx, taskId))
 
 	url := fmt.Sprintf("/task/claim/%s", wconf.Id.Hex())
 	req, _ := http.NewRequest("POST", url, nil)
@@ -594,6 +1316,34 @@ func TestClaim_DeletedTaskDoesNotPanic(t *testing.T) {
 	assert.Equal(t, http.StatusNotFound, w.Code)
 }
 
+func TestRequestDeadlines(t *testing.T) {
+	cleanup := setupTestTaskType(t)
+	defer cleanup()
+
+	s, scleanup := NewTestServer()
+	defer scleanup()
+	r := s.GetRouter()
+
+	// The client hung up before the database was read
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", "/task/", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, STATUS_CLIENT_CLOSED_REQUEST, w.Code)
+
+	// Out of time before the task could be saved; nothing is written
+	viper.Set("server.requestTimeoutSeconds", 0.000001)
+	defer viper.Set("server.requestTimeoutSeconds", 0)
+	w = postTask(r, "echo_task")
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.Contains(t, w.Body.String(), "Request abandoned")
+
+	viper.Set("server.requestTimeoutSeconds", 0)
+	req, _ = http.NewRequest("GET", "/task/", nil)
+	assertResponseLength(t, r, req, 0)
+}
+
 // --- GET /task/ with additional filters ---
 
 // taggedTaskTypeToml returns a task type TOML with a caller-supplied tag.
@@ -830,3 +1580,126 @@ func TestPostTask_MultipartUpload(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "hello attachment", string(got))
 }
+
+func TestRerunTask(t *testing.T) {
+	ctx := context.Background()
+	cleanup := setupTestTaskType(t)
+	defer cleanup()
+
+	s, scleanup := NewTestServer()
+	defer scleanup()
+	r := s.GetRouter()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	assert.NoError(t, writer.WriteField("data", `{"type": "echo_task", "environment": {"GREETING": "hi", "NAME": "world"}}`))
+	part, err := writer.CreateFormFile("input.txt", "input.txt")
+	assert.NoError(t, err)
+	part.Write([]byte("original input"))
+	writer.Close()
+
+	req, _ := http.NewRequest("POST", "/task/", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var original tasks.Task
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &original))
+	assert.Equal(t, []string{"input.txt"}, original.Inputs)
+
+	// Not finished yet
+	w = postJSON(r, fmt.Sprintf("/task/%s/rerun", original.Id.Hex()), "")
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	req, _ = http.NewRequest("PUT", fmt.Sprintf("/task/%s/cancel", original.Id.Hex()), nil)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	// The run changed its input and the type was deleted since; the rerun uses what was submitted
+	assert.NoError(t, os.WriteFile(filepath.Join(original.ResultDir, "input.txt"), []byte("changed by the task"), 0644))
+	assert.NoError(t, tasks.DeleteTaskTypeFile("echo_task"))
+
+	w = postJSON(r, fmt.Sprintf("/task/%s/rerun", original.Id.Hex()), `{"environment": {"NAME": "again"}}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var rerun tasks.Task
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &rerun))
+	assert.NotEqual(t, original.Id, rerun.Id)
+	assert.Equal(t, original.Id.Hex(), rerun.RerunOf)
+	assert.Empty(t, rerun.ParentId)
+	assert.Equal(t, original.TypeDigest, rerun.TypeDigest)
+	assert.Equal(t, "WAITING", rerun.State)
+	assert.Equal(t, original.Tags, rerun.Tags)
+	assert.Equal(t, "hi", rerun.ExecEnv["GREETING"])
+	assert.Equal(t, "again", rerun.ExecEnv["NAME"])
+	assert.Equal(t, []string{"input.txt"}, rerun.Inputs)
+	got, err := os.ReadFile(filepath.Join(rerun.ResultDir, "input.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "original input", string(got))
+
+	// Queued like any other new task
+	stored, err := s.DB.GetTask(ctx, rerun.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, original.Id.Hex(), stored.RerunOf)
+
+	// Without a body the environment is copied as is
+	w = postJSON(r, fmt.Sprintf("/task/%s/rerun", original.Id.Hex()), "")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &rerun))
+	assert.Equal(t, "world", rerun.ExecEnv["NAME"])
+
+	// Without the copies kept at submission there is nothing safe to rerun with
+	assert.NoError(t, os.RemoveAll(filepath.Join(original.ResultDir, TASK_INPUTS_DIR)))
+	w = postJSON(r, fmt.Sprintf("/task/%s/rerun", original.Id.Hex()), "")
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = postJSON(r, fmt.Sprintf("/task/%s/rerun", objectid.NewObjectId().Hex()), "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestUploadedFileNames(t *testing.T) {
+	ctx := context.Background()
+	cleanup := setupTestTaskType(t)
+	defer cleanup()
+
+	s, scleanup := NewTestServer()
+	defer scleanup()
+	r := s.GetRouter()
+
+	escaped := fmt.Sprintf("escape-%s.txt", objectid.NewObjectId().Hex())
+	for _, name := range []string{"../" + escaped, "sub/" + escaped, ".."} {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		assert.NoError(t, writer.WriteField("data", `{"type": "echo_task", "environment": {"GREETING": "hi", "NAME": "world"}}`))
+		part, err := writer.CreateFormFile(name, "input.txt")
+		assert.NoError(t, err)
+		part.Write([]byte("input"))
+		writer.Close()
+
+		req, _ := http.NewRequest("POST", "/task/", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, name)
+	}
+	req, _ := http.NewRequest("GET", "/task/", nil)
+	assertResponseLength(t, r, req, 0)
+
+	// Names stored before they were checked are left out of reruns
+	var original tasks.Task
+	assert.NoError(t, json.Unmarshal(postTask(r, "echo_task").Body.Bytes(), &original))
+	stored, err := s.DB.GetTask(ctx, original.Id)
+	assert.NoError(t, err)
+	stored.Inputs = []string{"../" + escaped}
+	assert.NoError(t, s.DB.SaveTask(ctx, &stored))
+	assert.NoError(t, os.MkdirAll(filepath.Join(original.ResultDir, TASK_INPUTS_DIR), os.ModePerm))
+	assert.NoError(t, os.WriteFile(filepath.Join(original.ResultDir, escaped), []byte("input"), 0644))
+	req, _ = http.NewRequest("PUT", fmt.Sprintf("/task/%s/cancel", original.Id.Hex()), nil)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	w := postJSON(r, fmt.Sprintf("/task/%s/rerun", original.Id.Hex()), "")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var rerun tasks.Task
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &rerun))
+	assert.Empty(t, rerun.Inputs)
+	_, err = os.Stat(filepath.Join(filepath.Dir(rerun.ResultDir), escaped))
+	assert.True(t, os.IsNotExist(err))
+}
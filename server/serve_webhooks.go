@@ -0,0 +1,331 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/lib/webhooks"
+	"github.com/turtlemonvh/blanket/tasks"
+	"github.com/turtlemonvh/blanket/worker"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	// Max deliveries sent per pass of the dispatcher
+	WEBHOOK_BATCH_SIZE = 100
+)
+
+// Webhooks from the config file followed by those created through the API
+func (s *ServerConfig) allWebhooks(ctx context.Context) ([]webhooks.Webhook, error) {
+	stored, err := s.DB.GetWebhooks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return append(webhooks.ConfigWebhooks(), stored...), nil
+}
+
+func (s *ServerConfig) findWebhook(ctx context.Context, webhookId objectid.ObjectId) (webhooks.Webhook, error) {
+	for _, w := range webhooks.ConfigWebhooks() {
+		if w.Id == webhookId {
+			return w, nil
+		}
+	}
+	return s.DB.GetWebhook(ctx, webhookId)
+}
+
+// EVENTS
+
+// Count a task's transition and wake the dispatcher
+// The database queues the webhook deliveries in the transaction that made the change; see webhooks.TaskEventName
+func (s *ServerConfig) taskTransitioned(name string, t *tasks.Task) {
+	observeTaskEvent(name, t)
+	s.WebhookEvents.Notify()
+}
+
+// Like taskTransitioned, for a task that was just finished by id
+func (s *ServerConfig) taskFinished(taskId objectid.ObjectId) {
+	t, err := s.DB.GetTask(context.Background(), taskId)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":    err.Error(),
+			"taskId": taskId.Hex(),
+		}).Warn("Could not load finished task to count it")
+		s.WebhookEvents.Notify()
+		return
+	}
+	s.taskTransitioned("task.finished", &t)
+}
+
+// Queue an event about a worker for every matching webhook
+func (s *ServerConfig) publishWorkerEvent(name string, w worker.WorkerConf) {
+	s.publishEvent(webhooks.Event{Name: name, Ts: time.Now().Unix(), Worker: &w})
+}
+
+func (s *ServerConfig) publishEvent(e webhooks.Event) {
+	ctx := context.Background()
+	hooks, err := s.allWebhooks(ctx)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":   err.Error(),
+			"event": e.Name,
+		}).Error("Could not list webhooks to publish event")
+		return
+	}
+
+	queued := 0
+	for _, w := range hooks {
+		if !w.Matches(&e) {
+			continue
+		}
+		d, err := webhooks.NewDelivery(&w, e)
+		if err == nil {
+			err = s.DB.SaveWebhookDelivery(ctx, &d)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":       err.Error(),
+				"event":     e.Name,
+				"webhookId": w.Id.Hex(),
+			}).Error("Could not queue webhook delivery")
+			continue
+		}
+		queued++
+	}
+	if queued > 0 {
+		s.WebhookEvents.Notify()
+	}
+}
+
+// DELIVERY
+
+// Send pending deliveries in the background until stop is closed
+// Wakes up when new deliveries are queued, and every `webhooks.pollIntervalSeconds` for retries
+func (s *ServerConfig) RunWebhookDispatcher(stop <-chan struct{}) {
+	wake := s.WebhookEvents.Subscribe()
+	defer s.WebhookEvents.Unsubscribe(wake)
+
+	interval := time.Duration(viper.GetFloat64("webhooks.pollIntervalSeconds")*1000*viper.GetFloat64("timeMultiplier")) * time.Millisecond
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.deliverDueWebhooks()
+		select {
+		case <-stop:
+			return
+		case <-wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Make one attempt at every delivery that is due
+func (s *ServerConfig) deliverDueWebhooks() {
+	ctx := context.Background()
+	due, err := s.DB.GetDueWebhookDeliveries(ctx, time.Now().Unix(), WEBHOOK_BATCH_SIZE)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err.Error(),
+		}).Error("Could not read webhook outbox")
+		return
+	}
+
+	client := &http.Client{
+		Timeout: time.Duration(viper.GetFloat64("webhooks.timeoutSeconds")*1000) * time.Millisecond,
+	}
+	for _, d := range due {
+		attempt := webhooks.Attempt{Ts: time.Now().Unix()}
+		w, err := s.findWebhook(ctx, d.WebhookId)
+		if err != nil {
+			// Removed since the event was queued
+			attempt.Error = fmt.Sprintf("Webhook is no longer available :: %s", err.Error())
+			d.Attempts = append(d.Attempts, attempt)
+			d.State = webhooks.DELIVERY_FAILED
+			d.NextAttemptTs = 0
+		} else {
+			attempt = sendWebhook(client, &w, &d)
+			d.RecordAttempt(attempt, viper.GetInt("webhooks.maxAttempts"), viper.GetFloat64("webhooks.retryDelaySeconds"))
+		}
+
+		log.WithFields(log.Fields{
+			"deliveryId": d.Id.Hex(),
+			"webhookId":  d.WebhookId.Hex(),
+			"event":      d.Event,
+			"statusCode": attempt.StatusCode,
+			"error":      attempt.Error,
+			"state":      d.State,
+			"attempts":   len(d.Attempts),
+		}).Info("Attempted webhook delivery")
+
+		if err := s.DB.SaveWebhookDelivery(ctx, &d); err != nil {
+			log.WithFields(log.Fields{
+				"err":        err.Error(),
+				"deliveryId": d.Id.Hex(),
+			}).Error("Could not save webhook delivery result")
+		}
+	}
+}
+
+// POST the payload of a delivery to the webhook's url
+func sendWebhook(client *http.Client, w *webhooks.Webhook, d *webhooks.Delivery) (attempt webhooks.Attempt) {
+	attempt.Ts = time.Now().Unix()
+	start := time.Now()
+	defer func() {
+		attempt.DurationMs = time.Since(start).Nanoseconds() / int64(time.Millisecond)
+	}()
+
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhooks.EVENT_HEADER, d.Event)
+	req.Header.Set(webhooks.DELIVERY_HEADER, d.Id.Hex())
+	req.Header.Set(webhooks.SIGNATURE_HEADER, webhooks.Sign(w.Secret, d.Payload))
+
+	res, err := client.Do(req)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	attempt.StatusCode = res.StatusCode
+	return attempt
+}
+
+// API
+
+func (s *ServerConfig) getWebhookId(c *gin.Context) (objectid.ObjectId, error) {
+	webhookId, err := SafeObjectId(c.Param("id"))
+	if err != nil {
+		c.String(http.StatusBadRequest, MakeErrorString("Invalid webhook id"))
+	}
+	return webhookId, err
+}
+
+// List webhooks; secrets are not included
+func (s *ServerConfig) getWebhooks(c *gin.Context) {
+	ctx := c.Request.Context()
+	c.Header("Content-Type", "application/json")
+
+	hooks, err := s.allWebhooks(ctx)
+	if err != nil {
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
+		return
+	}
+	redacted := make([]webhooks.Webhook, 0, len(hooks))
+	for _, w := range hooks {
+		redacted = append(redacted, w.Redacted())
+	}
+	c.JSON(http.StatusOK, redacted)
+}
+
+func (s *ServerConfig) getWebhook(c *gin.Context) {
+	ctx := c.Request.Context()
+	c.Header("Content-Type", "application/json")
+
+	webhookId, err := s.getWebhookId(c)
+	if err != nil {
+		return
+	}
+	w, err := s.findWebhook(ctx, webhookId)
+	if err != nil {
+		if _, ok := err.(database.ItemNotFoundError); ok {
+			c.String(http.StatusNotFound, MakeErrorString(err.Error()))
+			return
+		}
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, w.Redacted())
+}
+
+// Create a webhook
+// A secret is generated if none is sent; it is only returned in this response
+func (s *ServerConfig) postWebhook(c *gin.Context) {
+	ctx := c.Request.Context()
+	c.Header("Content-Type", "application/json")
+
+	w := webhooks.Webhook{}
+	if err := c.BindJSON(&w); err != nil {
+		c.String(http.StatusBadRequest, MakeErrorString(fmt.Sprintf("Error decoding JSON in request body :: %s", err.Error())))
+		return
+	}
+	if err := w.Validate(); err != nil {
+		c.String(http.StatusBadRequest, MakeErrorString(err.Error()))
+		return
+	}
+	w.Id = objectid.NewObjectId()
+	w.FromConfig = false
+	w.CreatedTs = time.Now().Unix()
+	if w.Secret == "" {
+		w.Secret = webhooks.NewSecret()
+	}
+
+	if err := s.DB.SaveWebhook(ctx, &w); err != nil {
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
+		return
+	}
+	c.JSON(http.StatusCreated, w)
+}
+
+// Remove a webhook created through the API
+// Deliveries already queued for it are marked FAILED when they come up
+func (s *ServerConfig) deleteWebhook(c *gin.Context) {
+	ctx := c.Request.Context()
+	c.Header("Content-Type", "application/json")
+
+	webhookId, err := s.getWebhookId(c)
+	if err != nil {
+		return
+	}
+	for _, w := range webhooks.ConfigWebhooks() {
+		if w.Id == webhookId {
+			c.String(http.StatusConflict, MakeErrorString("Webhook is defined in the config file and can't be removed through the API"))
+			return
+		}
+	}
+
+	if err := s.DB.DeleteWebhook(ctx, webhookId); err != nil {
+		if _, ok := err.(database.ItemNotFoundError); ok {
+			c.String(http.StatusNotFound, MakeErrorString(err.Error()))
+			return
+		}
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
+		return
+	}
+	c.String(http.StatusOK, fmt.Sprintf(`{"id": "%s"}`, webhookId.Hex()))
+}
+
+// Delivery history for a webhook, newest first
+// `?limit=` defaults to 50
+func (s *ServerConfig) getWebhookDeliveries(c *gin.Context) {
+	ctx := c.Request.Context()
+	c.Header("Content-Type", "application/json")
+
+	webhookId, err := s.getWebhookId(c)
+	if err != nil {
+		return
+	}
+	limit := cast.ToInt(c.Query("limit"))
+	if limit < 1 {
+		limit = 50
+	}
+
+	deliveries, err := s.DB.GetWebhookDeliveries(ctx, webhookId, limit)
+	if err != nil {
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, deliveries)
+}
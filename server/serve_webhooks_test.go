@@ -0,0 +1,208 @@
+// Covered:
+//   - POST/GET/DELETE /webhook/, GET /webhook/:id/deliveries, signed delivery
+//     of task.finished and retry scheduling: TestWebhooks_DeliverTaskEvents
+//   - worker events and filters: TestWebhooks_WorkerEvents
+//   - worker.registered when PUT /worker/:id registers or re-registers a worker, not for
+//     updates that send a revision: TestWebhooks_WorkerRegistered
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/lib/webhooks"
+	"github.com/turtlemonvh/blanket/tasks"
+	"github.com/turtlemonvh/blanket/worker"
+)
+
+// webhookReceiver records requests and answers with a fixed status code
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newWebhookReceiver(status int) *webhookReceiver {
+	wr := &webhookReceiver{}
+	wr.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		wr.mu.Lock()
+		wr.requests = append(wr.requests, r)
+		wr.bodies = append(wr.bodies, body)
+		wr.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	return wr
+}
+
+func getWebhookDeliveries(t *testing.T, r http.Handler, id string) []webhooks.Delivery {
+	t.Helper()
+	w := getUI(r, fmt.Sprintf("/webhook/%s/deliveries", id))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var deliveries []webhooks.Delivery
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &deliveries))
+	return deliveries
+}
+
+func TestWebhooks_DeliverTaskEvents(t *testing.T) {
+	cleanup := setupTestTaskType(t)
+	defer cleanup()
+
+	s, scleanup := NewTestServer()
+	defer scleanup()
+	r := s.GetRouter()
+
+	viper.Set("webhooks.maxAttempts", 3)
+	viper.Set("webhooks.retryDelaySeconds", 30)
+	viper.Set("webhooks.timeoutSeconds", 5)
+	defer viper.Set("webhooks.maxAttempts", nil)
+
+	ok := newWebhookReceiver(http.StatusOK)
+	defer ok.Close()
+	failing := newWebhookReceiver(http.StatusServiceUnavailable)
+	defer failing.Close()
+
+	// One subscription from config, one through the API
+	viper.Set("webhooks.subscriptions", []interface{}{
+		map[string]interface{}{"url": failing.URL, "secret": "from-config"},
+	})
+	defer viper.Set("webhooks.subscriptions", nil)
+
+	assert.Equal(t, http.StatusBadRequest, postJSON(r, "/webhook/", `{"url": "ftp://example.com"}`).Code)
+	created := postJSON(r, "/webhook/", fmt.Sprintf(`{"url": %q, "types": ["echo_task"], "states": ["STOPPED"]}`, ok.URL))
+	assert.Equal(t, http.StatusCreated, created.Code)
+	var hook webhooks.Webhook
+	json.Unmarshal(created.Body.Bytes(), &hook)
+	assert.NotEmpty(t, hook.Secret)
+
+	// Secrets aren't listed
+	var listed []webhooks.Webhook
+	json.Unmarshal(getUI(r, "/webhook/").Body.Bytes(), &listed)
+	if assert.Len(t, listed, 2) {
+		assert.True(t, listed[0].FromConfig)
+		assert.Empty(t, listed[0].Secret)
+		assert.Empty(t, listed[1].Secret)
+	}
+
+	// Cancelling a waiting task goes through FinishTask
+	var task tasks.Task
+	json.Unmarshal(postTask(r, "echo_task").Body.Bytes(), &task)
+	req, _ := http.NewRequest("PUT", fmt.Sprintf("/task/%s/cancel", task.Id.Hex()), nil)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	s.deliverDueWebhooks()
+
+	if assert.Len(t, ok.requests, 1) {
+		received := ok.requests[0]
+		assert.Equal(t, "task.finished", received.Header.Get(webhooks.EVENT_HEADER))
+		assert.Equal(t, webhooks.Sign(hook.Secret, ok.bodies[0]), received.Header.Get(webhooks.SIGNATURE_HEADER))
+		var event webhooks.Event
+		assert.NoError(t, json.Unmarshal(ok.bodies[0], &event))
+		assert.Equal(t, task.Id, event.Task.Id)
+		assert.Equal(t, "STOPPED", event.Task.State)
+	}
+	delivered := getWebhookDeliveries(t, r, hook.Id.Hex())
+	if assert.Len(t, delivered, 1) {
+		assert.Equal(t, webhooks.DELIVERY_DELIVERED, delivered[0].State)
+		assert.Equal(t, http.StatusOK, delivered[0].Attempts[0].StatusCode)
+	}
+
+	// The failing receiver is retried later instead of right away
+	assert.Len(t, failing.requests, 1)
+	s.deliverDueWebhooks()
+	assert.Len(t, failing.requests, 1)
+	configHookId := listed[0].Id.Hex()
+	retrying := getWebhookDeliveries(t, r, configHookId)
+	if assert.Len(t, retrying, 1) {
+		assert.Equal(t, webhooks.DELIVERY_PENDING, retrying[0].State)
+		assert.Len(t, retrying[0].Attempts, 1)
+		assert.True(t, retrying[0].NextAttemptTs >= time.Now().Unix()+29)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/webhook/"+configHookId, nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	req, _ = http.NewRequest("DELETE", "/webhook/"+hook.Id.Hex(), nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusNotFound, getUI(r, "/webhook/"+hook.Id.Hex()).Code)
+}
+
+func TestWebhooks_WorkerEvents(t *testing.T) {
+	ctx := context.Background()
+	s, cleanup := NewTestServer()
+	defer cleanup()
+	r := s.GetRouter()
+
+	ok := newWebhookReceiver(http.StatusNoContent)
+	defer ok.Close()
+	created := postJSON(r, "/webhook/", fmt.Sprintf(`{"url": %q, "events": ["worker.stopped"], "tags": ["gpu"]}`, ok.URL))
+	assert.Equal(t, http.StatusCreated, created.Code)
+
+	for _, tags := range [][]string{{"bash"}, {"bash", "gpu"}} {
+		w := worker.WorkerConf{Id: objectid.NewObjectId(), Tags: tags}
+		assert.NoError(t, s.DB.UpdateWorker(ctx, &w))
+		req, _ := http.NewRequest("PUT", fmt.Sprintf("/worker/%s/stop", w.Id.Hex()), nil)
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	s.deliverDueWebhooks()
+	if assert.Len(t, ok.bodies, 1) {
+		var event webhooks.Event
+		assert.NoError(t, json.Unmarshal(ok.bodies[0], &event))
+		assert.Equal(t, "worker.stopped", event.Name)
+		assert.Equal(t, []string{"bash", "gpu"}, event.Worker.Tags)
+		assert.True(t, event.Worker.Stopped)
+	}
+}
+
+func TestWebhooks_WorkerRegistered(t *testing.T) {
+	s, cleanup := NewTestServer()
+	defer cleanup()
+	r := s.GetRouter()
+
+	ok := newWebhookReceiver(http.StatusNoContent)
+	defer ok.Close()
+	created := postJSON(r, "/webhook/", fmt.Sprintf(`{"url": %q, "events": ["worker.registered"]}`, ok.URL))
+	assert.Equal(t, http.StatusCreated, created.Code)
+
+	// Registering, a status update at the current revision, then registering again under the same id
+	w := worker.WorkerConf{Id: objectid.NewObjectId(), Tags: []string{"bash"}}
+	for i, revision := range []int64{0, 1, 0} {
+		w.Pid = 100 + i
+		w.Revision = revision
+		body, _ := json.Marshal(w)
+		req, _ := http.NewRequest("PUT", fmt.Sprintf("/worker/%s", w.Id.Hex()), bytes.NewReader(body))
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusOK, resp.Code)
+	}
+
+	s.deliverDueWebhooks()
+	if assert.Len(t, ok.bodies, 2) {
+		pids := []int{}
+		for _, body := range ok.bodies {
+			var event webhooks.Event
+			assert.NoError(t, json.Unmarshal(body, &event))
+			assert.Equal(t, "worker.registered", event.Name)
+			pids = append(pids, event.Worker.Pid)
+		}
+		assert.ElementsMatch(t, []int{100, 102}, pids)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
+	"github.com/turtlemonvh/blanket/lib/database"
 	"github.com/turtlemonvh/blanket/lib/objectid"
 	"github.com/turtlemonvh/blanket/lib/tailed_file"
 	"github.com/turtlemonvh/blanket/worker"
@@ -14,10 +15,11 @@ import (
 // Search in the database for all items
 // For each item in the db, check that a process exists that has the right name
 func (s *ServerConfig) getWorkers(c *gin.Context) {
+	ctx := c.Request.Context()
 	c.Header("Content-Type", "application/json")
-	ws, err := s.DB.GetWorkers()
+	ws, err := s.DB.GetWorkers(ctx)
 	if err != nil {
-		c.String(http.StatusInternalServerError, MakeErrorString(err.Error()))
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
 		return
 	}
 	c.JSON(http.StatusOK, ws)
@@ -25,36 +27,40 @@ func (s *ServerConfig) getWorkers(c *gin.Context) {
 
 // Get just the configuration for this worker as json
 func (s *ServerConfig) getWorker(c *gin.Context) {
+	ctx := c.Request.Context()
 	c.Header("Content-Type", "application/json")
 	workerId, err := SafeObjectId(c.Param("id"))
 	if err != nil {
-		c.String(http.StatusInternalServerError, MakeErrorString(err.Error()))
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
 		return
 	}
 
-	worker, err := s.DB.GetWorker(workerId)
+	worker, err := s.DB.GetWorker(ctx, workerId)
 	if err != nil {
-		c.String(http.StatusInternalServerError, MakeErrorString(err.Error()))
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
 		return
 	}
+	setRevisionETag(c, worker.Revision)
 	c.JSON(http.StatusOK, worker)
 }
 
 // Register with Id
 // Continue to write to old log via append
+// The write is refused if `If-Match`, or else a non-zero `revision` in the body, doesn't match the stored revision
 func (s *ServerConfig) updateWorker(c *gin.Context) {
+	ctx := c.Request.Context()
 	c.Header("Content-Type", "application/json")
 
 	workerId, err := SafeObjectId(c.Param("id"))
 	if err != nil {
-		c.String(http.StatusInternalServerError, MakeErrorString(err.Error()))
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
 		return
 	}
 
 	w := worker.WorkerConf{}
 	err = c.BindJSON(&w)
 	if err != nil {
-		c.String(http.StatusInternalServerError, MakeErrorString(err.Error()))
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
 		return
 	}
 
@@ -65,59 +71,135 @@ func (s *ServerConfig) updateWorker(c *gin.Context) {
 		return
 	}
 
-	err = s.DB.UpdateWorker(&w)
+	revision, hasIfMatch, err := ifMatchRevision(c)
 	if err != nil {
-		c.String(http.StatusInternalServerError, MakeErrorString(err.Error()))
+		c.String(http.StatusBadRequest, MakeErrorString(err.Error()))
 		return
 	}
+	if hasIfMatch {
+		w.Revision = revision
+	}
+	// Without a revision the record is replaced outright, which is how a worker registers (again)
+	registering := w.Revision == 0
+
+	err = s.DB.UpdateWorker(ctx, &w)
+	if _, ok := err.(database.RevisionConflictError); ok {
+		status := http.StatusConflict
+		if hasIfMatch {
+			status = http.StatusPreconditionFailed
+		}
+		c.String(status, MakeErrorString(err.Error()))
+		return
+	} else if err != nil {
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
+		return
+	}
+	if registering {
+		s.publishWorkerEvent("worker.registered", w)
+	}
+	setRevisionETag(c, w.Revision)
 	c.String(http.StatusOK, "{}")
 }
 
+// Record that the worker is alive and send back its record, so it can see whether it has been stopped
+// Only lastHeardTs is written, so this can't undo a stop
+func (s *ServerConfig) heartbeatWorker(c *gin.Context) {
+	ctx := c.Request.Context()
+	c.Header("Content-Type", "application/json")
+
+	workerId, err := SafeObjectId(c.Param("id"))
+	if err != nil {
+		c.String(http.StatusBadRequest, MakeErrorString(err.Error()))
+		return
+	}
+
+	w, err := s.DB.HeartbeatWorker(ctx, workerId, time.Now().Unix())
+	if _, ok := err.(database.ItemNotFoundError); ok {
+		c.String(http.StatusNotFound, MakeErrorString(err.Error()))
+		return
+	} else if err != nil {
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
+		return
+	}
+	setRevisionETag(c, w.Revision)
+	c.JSON(http.StatusOK, w)
+}
+
 // Put the worker in the "stopped" state
-// The worker will poll for this state
-// FIXME: Make this worker update atomic
-// FIXME: Update lastHeardTs too
+// The worker will see this at its next heartbeat
 // FIXME: Allow force option that sends signals (on platforms That support that)
 func (s *ServerConfig) stopWorker(c *gin.Context) {
+	ctx := c.Request.Context()
 	c.Header("Content-Type", "application/json")
 
 	workerId, err := SafeObjectId(c.Param("id"))
 	if err != nil {
-		c.String(http.StatusInternalServerError, MakeErrorString(err.Error()))
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
 		return
 	}
 
-	w, err := s.DB.GetWorker(workerId)
+	w, err := s.DB.StopWorker(ctx, workerId)
 	if err != nil {
-		c.String(http.StatusInternalServerError, MakeErrorString(err.Error()))
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
 		return
 	}
 
-	w.Stopped = true
-	err = s.DB.UpdateWorker(&w)
+	s.WorkerEvents.Notify()
+	s.publishWorkerEvent("worker.stopped", w)
+	c.String(http.StatusOK, `{}`)
+}
+
+// Let the worker finish its current task but claim nothing new; unlike stopping, it stays running and registered
+func (s *ServerConfig) drainWorker(c *gin.Context) {
+	s.setWorkerDraining(c, true, "worker.draining")
+}
+
+// Let a draining worker claim tasks again
+func (s *ServerConfig) resumeWorker(c *gin.Context) {
+	s.setWorkerDraining(c, false, "worker.resumed")
+}
+
+func (s *ServerConfig) setWorkerDraining(c *gin.Context, draining bool, eventName string) {
+	ctx := c.Request.Context()
+	c.Header("Content-Type", "application/json")
+
+	workerId, err := SafeObjectId(c.Param("id"))
 	if err != nil {
-		c.String(http.StatusInternalServerError, MakeErrorString(err.Error()))
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
+		return
+	}
+
+	w, err := s.DB.DrainWorker(ctx, workerId, draining)
+	if _, ok := err.(database.ItemNotFoundError); ok {
+		c.String(http.StatusNotFound, MakeErrorString(err.Error()))
+		return
+	} else if err != nil {
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
 		return
 	}
 
+	// Also wakes the worker's claim if it is waiting on one
 	s.WorkerEvents.Notify()
-	c.String(http.StatusOK, `{}`)
+	s.publishWorkerEvent(eventName, w)
+	setRevisionETag(c, w.Revision)
+	c.JSON(http.StatusOK, w)
 }
 
 // Find an existing worker in the database and change its status
 // Start it on the command line
 func (s *ServerConfig) restartWorker(c *gin.Context) {
+	ctx := c.Request.Context()
 	c.Header("Content-Type", "application/json")
 
 	workerId, err := SafeObjectId(c.Param("id"))
 	if err != nil {
-		c.String(http.StatusInternalServerError, MakeErrorString(err.Error()))
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
 		return
 	}
 
-	w, err := s.DB.GetWorker(workerId)
+	w, err := s.DB.GetWorker(ctx, workerId)
 	if err != nil {
-		c.String(http.StatusInternalServerError, MakeErrorString(err.Error()))
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
 		return
 	}
 
@@ -127,10 +209,11 @@ func (s *ServerConfig) restartWorker(c *gin.Context) {
 // Remove the worker's record from the db if it exists
 // Should only be called by the worker itself as it is shutting down
 func (s *ServerConfig) deleteWorker(c *gin.Context) {
+	ctx := c.Request.Context()
 	c.Header("Content-Type", "application/json")
 	workerId, err := SafeObjectId(c.Param("id"))
 	if err != nil {
-		c.String(http.StatusInternalServerError, MakeErrorString(err.Error()))
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
 		return
 	}
 
@@ -141,12 +224,18 @@ func (s *ServerConfig) deleteWorker(c *gin.Context) {
 		c.String(http.StatusBadRequest, `{"error": "Cannot delete a worker that has not been stopped"}`)
 	}
 
-	err = s.DB.DeleteWorker(workerId)
+	// Kept for the webhook payload
+	existing, getErr := s.DB.GetWorker(ctx, workerId)
+
+	err = s.DB.DeleteWorker(ctx, workerId)
 	if err != nil {
-		c.String(http.StatusInternalServerError, MakeErrorString(err.Error()))
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
 		return
 	}
 	s.WorkerEvents.Notify()
+	if getErr == nil {
+		s.publishWorkerEvent("worker.deleted", existing)
+	}
 	c.String(http.StatusOK, fmt.Sprintf(`{"id": "%s"}`, workerId.Hex()))
 }
 
@@ -155,13 +244,14 @@ func (s *ServerConfig) launchNewWorker(c *gin.Context) {
 	w := worker.WorkerConf{}
 	err = c.BindJSON(&w)
 	if err != nil {
-		c.String(http.StatusInternalServerError, MakeErrorString(err.Error()))
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
 	}
 	s.launchWorker(c, &w)
 }
 
 // Called by other request handlers
 func (s *ServerConfig) launchWorker(c *gin.Context, w *worker.WorkerConf) {
+	ctx := c.Request.Context()
 	c.Header("Content-Type", "application/json")
 
 	var err error
@@ -178,7 +268,7 @@ func (s *ServerConfig) launchWorker(c *gin.Context, w *worker.WorkerConf) {
 
 	err = w.Run()
 	if err != nil {
-		c.String(http.StatusInternalServerError, MakeErrorString(err.Error()))
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
 		return
 	}
 
@@ -186,7 +276,7 @@ func (s *ServerConfig) launchWorker(c *gin.Context, w *worker.WorkerConf) {
 	maxRequestTime := time.NewTimer(time.Duration(MAX_REQUEST_TIME_SECONDS*s.TimeMultiplier) * time.Second)
 	loopWaitTime := time.Duration(500*s.TimeMultiplier) * time.Millisecond
 	for {
-		w, _ := s.DB.GetWorker(w.Id)
+		w, _ := s.DB.GetWorker(ctx, w.Id)
 		if w.Pid != 0 {
 			s.WorkerEvents.Notify()
 			c.JSON(http.StatusOK, w)
@@ -202,6 +292,9 @@ func (s *ServerConfig) launchWorker(c *gin.Context, w *worker.WorkerConf) {
 			err = fmt.Errorf("Worker was not found after %d seconds", MAX_REQUEST_TIME_SECONDS)
 			c.String(http.StatusRequestTimeout, MakeErrorString(err.Error()))
 			return
+		case <-ctx.Done():
+			c.String(errorStatus(ctx.Err()), MakeErrorString(ctx.Err().Error()))
+			return
 		case <-time.After(loopWaitTime):
 			continue
 		}
@@ -210,16 +303,17 @@ func (s *ServerConfig) launchWorker(c *gin.Context, w *worker.WorkerConf) {
 
 // FIXME: Stream file contents
 func (s *ServerConfig) getWorkerLogfile(c *gin.Context) {
+	ctx := c.Request.Context()
 	c.Header("Content-Type", "text/plain")
 
 	workerId, err := SafeObjectId(c.Param("id"))
 	if err != nil {
-		c.String(http.StatusInternalServerError, MakeErrorString(err.Error()))
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
 		return
 	}
 
 	// FIXME: Return bytes or string?
-	w, err := s.DB.GetWorker(workerId)
+	w, err := s.DB.GetWorker(ctx, workerId)
 	if err != nil {
 		c.String(http.StatusInternalServerError, fmt.Sprintf(`Error: "%s"`, err.Error()))
 		return
@@ -237,17 +331,18 @@ func (s *ServerConfig) getWorkerLogfile(c *gin.Context) {
 
 // Stream out worker log
 func (s *ServerConfig) streamWorkerLog(c *gin.Context) {
+	ctx := c.Request.Context()
 	var err error
 	var workerId objectid.ObjectId
 
 	workerId, err = SafeObjectId(c.Param("id"))
 	if err != nil {
-		c.String(http.StatusInternalServerError, MakeErrorString(err.Error()))
+		c.String(errorStatus(err), MakeErrorString(err.Error()))
 		return
 	}
 
 	// FIXME: Return bytes or string?
-	w, err := s.DB.GetWorker(workerId)
+	w, err := s.DB.GetWorker(ctx, workerId)
 	if err != nil {
 		c.String(http.StatusInternalServerError, fmt.Sprintf(`Error: "%s"`, err.Error()))
 		return
@@ -262,7 +357,7 @@ func (s *ServerConfig) streamWorkerLog(c *gin.Context) {
 	defer sub.Stop()
 
 	isComplete := func() bool {
-		w, err = s.DB.GetWorker(workerId)
+		w, err = s.DB.GetWorker(ctx, workerId)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"workerId":       workerId,
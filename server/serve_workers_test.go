@@ -0,0 +1,68 @@
+// Covered:
+//   - ETag on GET /worker/:id, If-Match on PUT /worker/:id, and a stop that a stale
+//     write can't undo: TestWorkerRevisions
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/worker"
+)
+
+func TestWorkerRevisions(t *testing.T) {
+	s, scleanup := NewTestServer()
+	defer scleanup()
+	r := s.GetRouter()
+
+	w := worker.WorkerConf{Id: objectid.NewObjectId(), Tags: []string{"bash"}}
+	workerPath := fmt.Sprintf("/worker/%s", w.Id.Hex())
+	put := func(path string, conf worker.WorkerConf, ifMatch string) *httptest.ResponseRecorder {
+		bts, _ := json.Marshal(conf)
+		req, _ := http.NewRequest("PUT", path, bytes.NewReader(bts))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := put(workerPath, w, "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, `"1"`, resp.Header().Get("ETag"))
+	assert.Equal(t, `"1"`, getUI(r, workerPath).Header().Get("ETag"))
+
+	// An operator stops the worker while it still holds revision 1
+	assert.Equal(t, http.StatusOK, put(workerPath+"/stop", worker.WorkerConf{}, "").Code)
+
+	w.Pid = 100
+	assert.Equal(t, http.StatusPreconditionFailed, put(workerPath, w, `"1"`).Code)
+	w.Revision = 1
+	assert.Equal(t, http.StatusConflict, put(workerPath, w, "").Code)
+	assert.Equal(t, http.StatusBadRequest, put(workerPath, w, "latest").Code)
+
+	// The heartbeat only sets lastHeardTs, and shows the worker it was stopped
+	resp = put(workerPath+"/heartbeat", worker.WorkerConf{}, "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var heard worker.WorkerConf
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &heard))
+	assert.True(t, heard.Stopped)
+	assert.Equal(t, 0, heard.Pid)
+	assert.NotZero(t, heard.LastHeardTs)
+	assert.Equal(t, `"3"`, resp.Header().Get("ETag"))
+
+	heard.Pid = 100
+	resp = put(workerPath, heard, resp.Header().Get("ETag"))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, `"4"`, resp.Header().Get("ETag"))
+
+	assert.Equal(t, http.StatusNotFound, put(fmt.Sprintf("/worker/%s/heartbeat", objectid.NewObjectId().Hex()), worker.WorkerConf{}, "").Code)
+}
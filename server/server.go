@@ -19,6 +19,7 @@ import (
 	"github.com/turtlemonvh/blanket/lib/database"
 	"github.com/turtlemonvh/blanket/lib/queue"
 	"github.com/turtlemonvh/blanket/lib/tailed_file"
+	"github.com/turtlemonvh/blanket/tasks"
 	"gopkg.in/tylerb/graceful.v1"
 	"net/http"
 	"time"
@@ -60,6 +61,10 @@ type ServerConfig struct {
 	Version        string
 	TaskEvents     *EventHub
 	WorkerEvents   *EventHub
+	TaskTypeEvents *EventHub
+	WebhookEvents  *EventHub // notified when webhook deliveries are queued
+	QueueEvents    *EventHub // notified when a task may have become claimable
+	gc             gcState
 }
 
 func (s *ServerConfig) GetRouter() *gin.Engine {
@@ -69,6 +74,21 @@ func (s *ServerConfig) GetRouter() *gin.Engine {
 	if s.WorkerEvents == nil {
 		s.WorkerEvents = NewEventHub()
 	}
+	if s.WebhookEvents == nil {
+		s.WebhookEvents = NewEventHub()
+	}
+	if s.QueueEvents == nil {
+		s.QueueEvents = NewEventHub()
+	}
+	if _, ok := s.Q.(*instrumentedQueue); !ok && s.Q != nil {
+		s.Q = &instrumentedQueue{BlanketQueue: s.Q, queued: s.QueueEvents}
+	}
+	if s.TaskTypeEvents == nil {
+		s.TaskTypeEvents = NewEventHub()
+		tasks.DefaultRegistry().OnChange(func(change tasks.TaskTypeChange) {
+			s.TaskTypeEvents.Notify()
+		})
+	}
 
 	// https://godoc.org/github.com/rs/cors
 	c := cors.New(cors.Options{
@@ -95,6 +115,8 @@ func (s *ServerConfig) GetRouter() *gin.Engine {
 	r := gin.New()
 	r.Use(ginLogger(log.StandardLogger(), time.RFC3339, true))
 	r.Use(gin.Recovery())
+	r.Use(instrumentRequests)
+	r.Use(requestDeadline)
 	r.Use(gin.WrapF(makeCorsHandler(c)))
 
 	// Make the result dir browseable
@@ -108,8 +130,11 @@ func (s *ServerConfig) GetRouter() *gin.Engine {
 	r.GET("/ui/workers/:id", s.uiNextWorkerDetailPage)
 	r.GET("/ui/task-types", s.uiNextTaskTypesPage)
 	r.GET("/ui/about", s.uiNextAboutPage)
+	r.GET("/ui/stats", s.uiNextStatsPage)
 	r.POST("/ui/tasks", s.uiNextSubmitTask)
+	r.POST("/ui/tasks/bulk", s.uiNextBulkTasks)
 	r.POST("/ui/workers", s.uiNextSubmitWorker)
+	r.POST("/ui/task-types", s.uiNextSaveTaskType)
 	r.GET("/ui/partials/tasks-rows", s.uiNextTasksRowsPartial)
 	r.GET("/ui/partials/workers-rows", s.uiNextWorkersRowsPartial)
 	r.GET("/ui/partials/task-types-rows", s.uiNextTaskTypesRowsPartial)
@@ -117,9 +142,13 @@ func (s *ServerConfig) GetRouter() *gin.Engine {
 	r.GET("/ui/partials/task-type-env", s.uiNextTaskTypeEnvPartial)
 	r.GET("/ui/partials/custom-env-row", s.uiNextCustomEnvRowPartial)
 	r.GET("/ui/partials/new-worker", s.uiNextNewWorkerPartial)
+	r.GET("/ui/partials/task-type-editor", s.uiNextTaskTypeEditorPartial)
+	r.POST("/ui/partials/task-type-validate", s.uiNextValidateTaskType)
 	r.GET("/ui/partials/blank", s.uiNextBlankPartial)
+	r.GET("/ui/partials/pause-banner", s.uiNextPauseBannerPartial)
 	r.GET("/ui/sse/tasks", s.sseTaskEvents)
 	r.GET("/ui/sse/workers", s.sseWorkerEvents)
+	r.GET("/ui/sse/task-types", s.sseTaskTypeEvents)
 
 	// Redirect to ui
 	r.GET("/", func(c *gin.Context) {
@@ -134,36 +163,69 @@ func (s *ServerConfig) GetRouter() *gin.Engine {
 	})
 
 	r.GET("/ops/status/", MetricsHandler)
+	r.GET("/metrics", s.getPrometheusMetrics) // Prometheus text format
+	r.GET("/ops/gc", s.getGC)                 // report of the last garbage collection
+	r.POST("/ops/gc", s.runGC)                // remove tasks outside the retention rules now; ?dryRun=true only reports
+	r.GET("/ops/export", s.exportDatabase)    // JSON Lines snapshot of workers, tasks, queue entries and webhooks
+	r.POST("/ops/import", s.importDatabase)   // load an export; ?mode=merge|replace&remapIds=true
+	r.GET("/ops/pause", s.getQueuePause)      // whether claims are paused
+	r.PUT("/ops/pause", s.pauseQueue)         // hold all claims; submissions are still accepted; ?reason=
+	r.PUT("/ops/resume", s.resumeQueue)       // let workers claim again
 	r.GET("/config/", s.getConfigProcessed)
 
 	r.GET("/task_type/", s.getTaskTypes)
 	r.GET("/task_type/:name", s.getTaskType)
+	r.POST("/task_type/:name", s.postTaskType)                  // create from TOML body or multipart form
+	r.PUT("/task_type/:name", s.putTaskType)                    // replace a type created through the API
+	r.DELETE("/task_type/:name", s.deleteTaskType)              // remove a type created through the API
+	r.GET("/task_type/:name/revisions", s.getTaskTypeRevisions) // versions written through the API
 
 	// Called by user
-	r.GET("/task/", s.getTasks)                // list tasks in db
-	r.GET("/task/:id", s.getTask)              // fetch just 1 by id
-	r.POST("/task/", s.postTask)               // add a new task to the queue
-	r.DELETE("/task/:id", s.removeTask)        // delete all information from db, including killing if running
-	r.GET("/task/:id/log", s.streamTaskLog)    // stream stdout log
-	r.GET("/task/:id/log/tail", s.tailTaskLog) // last N lines of stdout
-	r.PUT("/task/:id/cancel", s.cancelTask)    // stop execution of a task; will be moved to state STOPPED
+	r.GET("/task/", s.getTasks)                    // list tasks in db
+	r.GET("/task/:id", s.getTask)                  // fetch just 1 by id
+	r.POST("/task/", s.postTask)                   // add a new task to the queue
+	r.DELETE("/task/:id", s.removeTask)            // delete all information from db, including killing if running
+	r.GET("/task/:id/log", s.streamTaskLog)        // stream stdout log
+	r.GET("/task/:id/log/tail", s.tailTaskLog)     // last N lines of stdout
+	r.GET("/task/:id/type", s.getTaskTypeSnapshot) // task type as it was when the task was submitted
+	r.GET("/task/:id/history", s.getTaskHistory)   // every change of state, with who made it and why
+	r.PUT("/task/:id/cancel", s.cancelTask)        // stop a task; WAITING tasks stop now, others once their worker answers
+	r.POST("/task/:id/rerun", s.rerunTask)         // submit a copy of a finished task, with optional environment overrides
+	r.POST("/task/bulk/:op", s.bulkTasks)          // cancel, delete, rerun or retag tasks by id list or filter
 
 	// Called by worker
-	r.POST("/task/claim/:workerid", s.claimTask)      // claim a task
+	r.POST("/task/claim/:workerid", s.claimTask)      // claim a task; ?wait= holds the request until one is queued
 	r.PUT("/task/:id/run", s.markTaskAsRunning)       // mark a task as running
 	r.PUT("/task/:id/progress", s.updateTaskProgress) // update progress
+	r.PUT("/task/:id/step/:step", s.updateTaskStep)   // update the state of one step
+	r.PUT("/task/:id/hook/:hook", s.updateTaskHook)   // update the state of one hook
 	r.PUT("/task/:id/finish", s.markTaskAsFinished)   // update state
+	r.GET("/task/:id/cancel", s.waitForTaskCancel)    // wait for a cancel request
+	r.PUT("/task/:id/cancel/ack", s.updateTaskCancel) // acknowledge a cancel request, or report its outcome
 
 	r.GET("/worker/:id", s.getWorker)
 	r.GET("/worker/", s.getWorkers)
-	r.POST("/worker/", s.launchNewWorker)          // called from front end, doesn't actually hit database
-	r.PUT("/worker/:id/stop", s.stopWorker)        // stop/pause worker; will stop after current task stops
-	r.PUT("/worker/:id/restart", s.restartWorker)  // re-start an existing worker
-	r.PUT("/worker/:id", s.updateWorker)           // used for initial creation + status updates
-	r.DELETE("/worker/:id", s.deleteWorker)        // remove from database; can only be called on a stopped worker
-	r.GET("/worker/:id/logs", s.getWorkerLogfile)  // full logfile download
-	r.GET("/worker/:id/log", s.streamWorkerLog)    // SSE stream of worker log
-	r.GET("/worker/:id/log/tail", s.tailWorkerLog) // last N lines of worker log
+	r.POST("/worker/", s.launchNewWorker)             // called from front end, doesn't actually hit database
+	r.PUT("/worker/:id/stop", s.stopWorker)           // stop/pause worker; will stop after current task stops
+	r.PUT("/worker/:id/drain", s.drainWorker)         // finish the current task and claim no more, but stay registered
+	r.PUT("/worker/:id/resume", s.resumeWorker)       // let a draining worker claim again
+	r.PUT("/worker/:id/restart", s.restartWorker)     // re-start an existing worker
+	r.PUT("/worker/:id/heartbeat", s.heartbeatWorker) // worker is alive; returns its record
+	r.PUT("/worker/:id", s.updateWorker)              // used for initial creation + status updates
+	r.DELETE("/worker/:id", s.deleteWorker)           // remove from database; can only be called on a stopped worker
+	r.GET("/worker/:id/logs", s.getWorkerLogfile)     // full logfile download
+	r.GET("/worker/:id/log", s.streamWorkerLog)       // SSE stream of worker log
+	r.GET("/worker/:id/log/tail", s.tailWorkerLog)    // last N lines of worker log
+
+	r.GET("/events", s.getEvents) // task and worker changes; SSE or NDJSON
+
+	r.GET("/stats/tasks", s.getTaskStats) // counts, wait and run times by hour or day; ?from=&to=&bucket=&types=&tag=
+
+	r.GET("/webhook/", s.getWebhooks)
+	r.POST("/webhook/", s.postWebhook)
+	r.GET("/webhook/:id", s.getWebhook)
+	r.DELETE("/webhook/:id", s.deleteWebhook)                // only for webhooks created through the API
+	r.GET("/webhook/:id/deliveries", s.getWebhookDeliveries) // delivery history, newest first
 
 	return r
 }
@@ -179,17 +241,24 @@ func (s *ServerConfig) Serve() *graceful.Server {
 	// - cleaning db
 	// - cleaning workers
 
+	router := s.GetRouter()
+	stopDispatcher := make(chan struct{})
+	go s.RunWebhookDispatcher(stopDispatcher)
+	go s.RunCancelMonitor(stopDispatcher)
+	go s.RunGarbageCollector(stopDispatcher)
+
 	// Graceful shutdown, leaving up to 2 seconds for requests to complete
 	return &graceful.Server{
 		Timeout: 2 * time.Second,
 		Server: &http.Server{
 			Addr:    fmt.Sprintf(":%d", s.Port),
-			Handler: s.GetRouter(),
+			Handler: router,
 		},
 		BeforeShutdown: func() bool {
 			// Called first
 			log.Warn("Called BeforeShutdown")
 			tailed_file.StopAll()
+			close(stopDispatcher)
 			return true
 		},
 		ShutdownInitiated: func() {
@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/gin-gonic/gin"
@@ -68,7 +69,8 @@ func NewTestServer() (*ServerConfig, func()) {
 		}
 }
 
-// Assert that the request object passed generated an empty list json response
+// Assert that a listing request returned this many items
+// Task listings are pages with the items under `items`; other listings are plain lists
 func assertResponseLength(t *testing.T, r *gin.Engine, req *http.Request, nitems int) {
 	var body []byte
 	var err error
@@ -82,7 +84,15 @@ func assertResponseLength(t *testing.T, r *gin.Engine, req *http.Request, nitems
 
 	// Read in body as json
 	var results []interface{}
-	err = json.Unmarshal(body, &results)
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+		var page struct {
+			Items []interface{} `json:"items"`
+		}
+		err = json.Unmarshal(body, &page)
+		results = page.Items
+	} else {
+		err = json.Unmarshal(body, &results)
+	}
 	assert.Equal(t, nil, err)
 
 	// Check # records
@@ -91,6 +101,7 @@ func assertResponseLength(t *testing.T, r *gin.Engine, req *http.Request, nitems
 
 // Requires turning off firewall on mac
 func TestGetTasks(t *testing.T) {
+	ctx := context.Background()
 	var err error
 
 	// Run server
@@ -119,10 +130,10 @@ func TestGetTasks(t *testing.T) {
 		assert.Equal(t, nil, err)
 		//tsks = append(tsks, &tsk)
 
-		err = s.DB.SaveTask(&tsk)
+		err = s.DB.SaveTask(ctx, &tsk)
 		assert.Equal(t, nil, err)
 
-		err = s.Q.AddTask(&tsk)
+		err = s.Q.AddTask(ctx, &tsk)
 		assert.Equal(t, nil, err)
 	}
 
@@ -140,7 +151,7 @@ func TestGetTasks(t *testing.T) {
 		Tags:    []string{},
 		Stopped: false,
 	}
-	err = s.DB.UpdateWorker(&wconf)
+	err = s.DB.UpdateWorker(ctx, &wconf)
 	assert.Equal(t, nil, err)
 
 	// List workers
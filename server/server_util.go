@@ -1,16 +1,88 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
 	"github.com/turtlemonvh/blanket/lib/objectid"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
 	MAX_REQUEST_TIME_SECONDS = 5
+	// Not in net/http; the status nginx logs when the client hangs up first
+	STATUS_CLIENT_CLOSED_REQUEST = 499
 )
 
+// Routes that stay open for as long as the client wants, so they get no deadline
+// Bulk operations and garbage collection are here too, so a deadline can't leave them half done
+var untimedRoutes = map[string]bool{
+	"/task/:id/log":        true,
+	"/worker/:id/log":      true,
+	"/events":              true,
+	"/ui/sse/tasks":        true,
+	"/ui/sse/workers":      true,
+	"/ui/sse/task-types":   true,
+	"/ops/export":          true,
+	"/ops/import":          true,
+	"/ops/gc":              true,
+	"/task/bulk/:op":       true,
+	"/ui/tasks/bulk":       true,
+	"/results/*filepath":   true,
+	"/ui/static/*filepath": true,
+}
+
 // Utility functions
 
+// Give each request `server.requestTimeoutSeconds` to finish, plus however long it asks to `?wait=`
+// Handlers pass the request's context to the database and queue, which give up once it is done
+func requestDeadline(c *gin.Context) {
+	timeout := viper.GetFloat64("server.requestTimeoutSeconds")
+	if timeout <= 0 || untimedRoutes[c.FullPath()] {
+		c.Next()
+		return
+	}
+	wait, _ := waitParam(c)
+	timeout += wait.Seconds()
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), time.Duration(timeout*1000)*time.Millisecond)
+	defer cancel()
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+}
+
+// `?wait=` as seconds (`30`, `0.5`) or a duration (`30s`, `500ms`); 0 if not set
+func waitParam(c *gin.Context) (time.Duration, error) {
+	v := c.Query("wait")
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if secs, floatErr := strconv.ParseFloat(v, 64); floatErr == nil {
+		d, err = time.Duration(secs*1000)*time.Millisecond, nil
+	}
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("Invalid wait '%s'; expected seconds or a duration like 30s", v)
+	}
+	return d, nil
+}
+
+// Status for a failed call: 504 if the request ran out of time, 499 if the client went away, else 500
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled):
+		return STATUS_CLIENT_CLOSED_REQUEST
+	}
+	return http.StatusInternalServerError
+}
+
 func MakeErrorString(errmsg string) string {
 	return fmt.Sprintf(`{"error": "%s"}`, errmsg)
 }
@@ -33,4 +105,22 @@ func SafeObjectId(workerIdStr string) (objectid.ObjectId, error) {
 	return objectid.ObjectIdHex(workerIdStr), nil
 }
 
+// Record revisions are sent as the ETag
+func setRevisionETag(c *gin.Context, revision int64) {
+	c.Header("ETag", fmt.Sprintf(`"%d"`, revision))
+}
+
+// The revision in the request's If-Match header; false if there isn't one
+func ifMatchRevision(c *gin.Context) (int64, bool, error) {
+	h := strings.TrimSpace(c.GetHeader("If-Match"))
+	if h == "" || h == "*" {
+		return 0, false, nil
+	}
+	rev, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(h, "W/"), `"`), 10, 64)
+	if err != nil || rev < 1 {
+		return 0, false, fmt.Errorf("Invalid If-Match header; expected an ETag from this server")
+	}
+	return rev, true, nil
+}
+
 // Error types
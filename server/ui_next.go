@@ -7,6 +7,7 @@ import (
 	"io"
 	"io/fs"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sort"
@@ -49,12 +50,17 @@ var uiNextFuncs = template.FuncMap{
 		return h
 	},
 	"hex": func(id objectid.ObjectId) string { return id.Hex() },
+	"secs": func(v float64) string {
+		return time.Duration(v * float64(time.Second)).Round(time.Second).String()
+	},
+	"pct": func(v float64) string { return fmt.Sprintf("%.0f%%", 100*v) },
 	"fmtTs": func(ts int64) string {
 		if ts == 0 {
 			return ""
 		}
 		return time.Unix(ts, 0).UTC().Format("2006/01/02 15:04:05")
 	},
+	"workerState": func(w worker.WorkerConf) string { return database.WorkerState(&w) },
 	"isCancelable": func(state string) bool {
 		return state == "WAITING" || state == "CLAIMED" || state == "RUNNING"
 	},
@@ -79,7 +85,7 @@ func mustParseUINextPage(name string, files ...string) *template.Template {
 	if t, ok := uiNextTemplates[name]; ok {
 		return t
 	}
-	paths := append([]string{"ui_next/templates/_layout.html"}, files...)
+	paths := append([]string{"ui_next/templates/_layout.html", "ui_next/templates/pause_banner.html"}, files...)
 	t, err := template.New(name).Funcs(uiNextFuncs).ParseFS(uiNextFS, paths...)
 	if err != nil {
 		panic(fmt.Errorf("ui-next: parse %s: %w", name, err))
@@ -113,6 +119,9 @@ type TaskTypeView struct {
 	LoadedTs    int64
 	ConfigFile  string
 	VersionHash string
+	LoadError   string
+	Writable    bool
+	Abstract    bool
 }
 
 // SettingView is one row on the About page.
@@ -137,17 +146,51 @@ func readTaskTypeViews() []TaskTypeView {
 			LoadedTs:    tt.LoadedTs,
 			ConfigFile:  tt.ConfigFile,
 			VersionHash: tt.ConfigVersionHash,
+			LoadError:   tt.LoadError,
+			Writable:    tasks.TaskTypeIsWritable(tt.GetName()),
+			Abstract:    tt.IsAbstract(),
 		})
 	}
 	sort.Slice(views, func(i, j int) bool { return views[i].Name < views[j].Name })
 	return views
 }
 
+// uiTaskPageSize is how many task rows are shown before "Load more".
+const uiTaskPageSize = 100
+
+// uiNextTaskRows fetches one page of task rows for the list and its partial.
+// `row` is the number of rows already shown, so numbering carries on across pages.
+func (s *ServerConfig) uiNextTaskRows(c *gin.Context) (gin.H, int, error) {
+	ctx := c.Request.Context()
+	tc := database.TaskSearchConfFromContext(c)
+	if c.Query("limit") == "" {
+		tc.Limit = uiTaskPageSize
+	}
+	if err := database.TaskPageConfFromContext(c, tc); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if err := database.TaskQueryFromContext(c, tc); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	tc.CountAll = false
+	page, err := database.GetTaskPage(ctx, s.DB, tc)
+	if err != nil {
+		return nil, errorStatus(err), err
+	}
+	row := cast.ToInt(c.Query("row"))
+	return gin.H{
+		"Tasks":      page.Items,
+		"RowStart":   row + 1,
+		"NextRow":    row + len(page.Items),
+		"NextCursor": page.NextCursor,
+	}, http.StatusOK, nil
+}
+
 // uiNextTasksPage renders the tasks list page.
 func (s *ServerConfig) uiNextTasksPage(c *gin.Context) {
-	tks, _, err := s.DB.GetTasks(database.TaskSearchConfFromContext(c))
+	data, status, err := s.uiNextTaskRows(c)
 	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+		c.String(status, err.Error())
 		return
 	}
 	views := readTaskTypeViews()
@@ -156,22 +199,22 @@ func (s *ServerConfig) uiNextTasksPage(c *gin.Context) {
 		typeNames = append(typeNames, v.Name)
 	}
 	t := mustParseUINextPage("tasks", "ui_next/templates/tasks.html", "ui_next/templates/tasks_rows.html")
-	s.renderUINext(c, t, gin.H{
-		"Title":         "Tasks",
-		"Tasks":         tks,
-		"TaskStates":    tasks.ValidTaskStates,
-		"TaskTypeNames": typeNames,
-	})
+	data["Title"] = "Tasks"
+	data["TaskStates"] = tasks.ValidTaskStates
+	data["TaskTypeNames"] = typeNames
+	data["TaskSorts"] = database.ValidTaskSorts
+	s.renderUINext(c, t, data)
 }
 
 // uiNextTaskDetailPage renders one task's metadata, env vars, and log stream.
 func (s *ServerConfig) uiNextTaskDetailPage(c *gin.Context) {
+	ctx := c.Request.Context()
 	taskId, err := SafeObjectId(c.Param("id"))
 	if err != nil {
 		c.String(http.StatusBadRequest, err.Error())
 		return
 	}
-	task, err := s.DB.GetTask(taskId)
+	task, err := s.DB.GetTask(ctx, taskId)
 	if err != nil {
 		c.String(http.StatusNotFound, err.Error())
 		return
@@ -182,22 +225,23 @@ func (s *ServerConfig) uiNextTaskDetailPage(c *gin.Context) {
 
 // uiNextTasksRowsPartial renders just the tbody for htmx swaps.
 func (s *ServerConfig) uiNextTasksRowsPartial(c *gin.Context) {
-	tks, _, err := s.DB.GetTasks(database.TaskSearchConfFromContext(c))
+	data, status, err := s.uiNextTaskRows(c)
 	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+		c.String(status, err.Error())
 		return
 	}
 	t := mustParsePartial("tasks-rows", "tasks_rows.html")
 	c.Header("Content-Type", "text/html; charset=utf-8")
-	if err := t.ExecuteTemplate(c.Writer, "tasks-rows", gin.H{"Tasks": tks}); err != nil {
+	if err := t.ExecuteTemplate(c.Writer, "tasks-rows", data); err != nil {
 		log.WithField("err", err).Warn("ui-next: render tasks-rows")
 	}
 }
 
 func (s *ServerConfig) uiNextWorkersPage(c *gin.Context) {
-	ws, err := s.DB.GetWorkers()
+	ctx := c.Request.Context()
+	ws, err := s.DB.GetWorkers(ctx)
 	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+		c.String(errorStatus(err), err.Error())
 		return
 	}
 	t := mustParseUINextPage("workers", "ui_next/templates/workers.html", "ui_next/templates/workers_rows.html")
@@ -206,12 +250,13 @@ func (s *ServerConfig) uiNextWorkersPage(c *gin.Context) {
 
 // uiNextWorkerDetailPage renders one worker's metadata and log stream.
 func (s *ServerConfig) uiNextWorkerDetailPage(c *gin.Context) {
+	ctx := c.Request.Context()
 	workerId, err := SafeObjectId(c.Param("id"))
 	if err != nil {
 		c.String(http.StatusBadRequest, err.Error())
 		return
 	}
-	w, err := s.DB.GetWorker(workerId)
+	w, err := s.DB.GetWorker(ctx, workerId)
 	if err != nil {
 		c.String(http.StatusNotFound, err.Error())
 		return
@@ -233,6 +278,7 @@ func (s *ServerConfig) uiNextNewWorkerPartial(c *gin.Context) {
 // the refreshed rows partial. Mirrors server.launchWorker without the JSON
 // response shape.
 func (s *ServerConfig) uiNextSubmitWorker(c *gin.Context) {
+	ctx := c.Request.Context()
 	rawTags := strings.TrimSpace(c.PostForm("tags"))
 	tags := []string{}
 	if rawTags != "" {
@@ -258,7 +304,7 @@ func (s *ServerConfig) uiNextSubmitWorker(c *gin.Context) {
 		CheckInterval: interval,
 	}
 	if err := w.Run(); err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+		c.String(errorStatus(err), err.Error())
 		return
 	}
 
@@ -266,7 +312,7 @@ func (s *ServerConfig) uiNextSubmitWorker(c *gin.Context) {
 	// refreshed rows include it. Mirrors the API handler's wait loop.
 	deadline := time.Now().Add(time.Duration(float64(MAX_REQUEST_TIME_SECONDS)*s.TimeMultiplier) * time.Second)
 	for time.Now().Before(deadline) {
-		found, _ := s.DB.GetWorker(w.Id)
+		found, _ := s.DB.GetWorker(ctx, w.Id)
 		if found.Pid != 0 {
 			break
 		}
@@ -277,9 +323,10 @@ func (s *ServerConfig) uiNextSubmitWorker(c *gin.Context) {
 }
 
 func (s *ServerConfig) uiNextWorkersRowsPartial(c *gin.Context) {
-	ws, err := s.DB.GetWorkers()
+	ctx := c.Request.Context()
+	ws, err := s.DB.GetWorkers(ctx)
 	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+		c.String(errorStatus(err), err.Error())
 		return
 	}
 	t := mustParsePartial("workers-rows", "workers_rows.html")
@@ -293,17 +340,105 @@ func (s *ServerConfig) uiNextTaskTypesPage(c *gin.Context) {
 	t := mustParseUINextPage("task-types",
 		"ui_next/templates/task_types.html",
 		"ui_next/templates/task_types_rows.html")
-	s.renderUINext(c, t, gin.H{"Title": "Task Types", "TaskTypes": readTaskTypeViews()})
+	s.renderUINext(c, t, gin.H{
+		"Title":      "Task Types",
+		"TaskTypes":  readTaskTypeViews(),
+		"LoadErrors": tasks.DefaultRegistry().LoadErrors(),
+	})
 }
 
 func (s *ServerConfig) uiNextTaskTypesRowsPartial(c *gin.Context) {
 	t := mustParsePartial("task-types-rows", "task_types_rows.html")
 	c.Header("Content-Type", "text/html; charset=utf-8")
-	if err := t.ExecuteTemplate(c.Writer, "task-types-rows", gin.H{"TaskTypes": readTaskTypeViews()}); err != nil {
+	data := gin.H{
+		"TaskTypes":  readTaskTypeViews(),
+		"LoadErrors": tasks.DefaultRegistry().LoadErrors(),
+	}
+	if err := t.ExecuteTemplate(c.Writer, "task-types-rows", data); err != nil {
 		log.WithField("err", err).Warn("ui-next: render task-types-rows")
 	}
 }
 
+// uiNextTaskTypeEditorPartial renders the create/edit form for a task type.
+// With `?name=` the form is prefilled from that type's file in the writable directory.
+func (s *ServerConfig) uiNextTaskTypeEditorPartial(c *gin.Context) {
+	data := gin.H{}
+	if name := c.Query("name"); name != "" {
+		if !tasks.TaskTypeIsWritable(name) {
+			c.String(http.StatusConflict, tasks.TaskTypeNotWritableError(name).Error())
+			return
+		}
+		tt, err := tasks.FetchTaskType(name)
+		if err != nil {
+			c.String(http.StatusNotFound, err.Error())
+			return
+		}
+		contents, err := os.ReadFile(tt.ConfigFile)
+		if err != nil {
+			c.String(errorStatus(err), err.Error())
+			return
+		}
+		data["Name"] = name
+		data["Existing"] = true
+		data["Config"] = string(contents)
+	}
+	t := mustParsePartial("task-type-editor", "task_type_editor.html")
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	if err := t.ExecuteTemplate(c.Writer, "task-type-editor", data); err != nil {
+		log.WithField("err", err).Warn("ui-next: render task-type-editor")
+	}
+}
+
+func (s *ServerConfig) renderTaskTypeValidation(c *gin.Context, data gin.H) {
+	t := mustParsePartial("task-type-validation", "task_type_validation.html")
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	if err := t.ExecuteTemplate(c.Writer, "task-type-validation", data); err != nil {
+		log.WithField("err", err).Warn("ui-next: render task-type-validation")
+	}
+}
+
+// uiNextValidateTaskType checks the editor contents without saving.
+// Always returns 200 so htmx swaps the problem list into the form.
+func (s *ServerConfig) uiNextValidateTaskType(c *gin.Context) {
+	contents, files, err := readTaskTypeUpload(c)
+	if err != nil {
+		s.renderTaskTypeValidation(c, gin.H{"Error": err.Error()})
+		return
+	}
+	bundledNames := make([]string, 0, len(files))
+	for f := range files {
+		bundledNames = append(bundledNames, f)
+	}
+	s.renderTaskTypeValidation(c, gin.H{
+		"Problems": tasks.ValidateTaskType(c.PostForm("name"), contents, bundledNames),
+	})
+}
+
+// uiNextSaveTaskType handles the editor's Save button.
+// The rows refresh themselves from the task-types SSE stream once the registry picks up the file.
+func (s *ServerConfig) uiNextSaveTaskType(c *gin.Context) {
+	contents, files, err := readTaskTypeUpload(c)
+	if err != nil {
+		s.renderTaskTypeValidation(c, gin.H{"Saved": true, "Error": err.Error()})
+		return
+	}
+	name := c.PostForm("name")
+	create := c.PostForm("existing") == ""
+	tt, err := tasks.SaveTaskTypeFile(name, contents, files, create)
+	if problems, ok := err.(tasks.TaskTypeValidationError); ok {
+		s.renderTaskTypeValidation(c, gin.H{"Saved": true, "Problems": []string(problems)})
+		return
+	} else if err != nil {
+		s.renderTaskTypeValidation(c, gin.H{"Saved": true, "Error": err.Error()})
+		return
+	}
+	s.renderTaskTypeValidation(c, gin.H{
+		"Saved":       true,
+		"Name":        name,
+		"VersionHash": tt.ConfigVersionHash,
+	})
+}
+
 // Settings keys hidden from the About page — internal/test-only knobs.
 var aboutHiddenKeys = map[string]bool{
 	"timemultiplier":  true, // test-time speedup
@@ -313,9 +448,11 @@ var aboutHiddenKeys = map[string]bool{
 // Settings keys whose values should be rendered as absolute paths (or a
 // list of absolute paths for slice-valued keys).
 var aboutPathKeys = map[string]bool{
-	"database":          true,
-	"tasks.typespaths":  true,
-	"tasks.resultspath": true,
+	"database":              true, // the bolt file, in older configs
+	"database.path":         true,
+	"database.snapshotpath": true,
+	"tasks.typespaths":      true,
+	"tasks.resultspath":     true,
 }
 
 // Settings keys whose values are slices.
@@ -335,6 +472,99 @@ func absPath(p string) string {
 	return abs
 }
 
+// StatsBarView is one bucket of the charts on the Stats page; heights are percent of the tallest bucket.
+type StatsBarView struct {
+	Label          string
+	Succeeded      int
+	Failed         int
+	SucceededPct   float64
+	FailedPct      float64
+	P95Duration    float64
+	P95DurationPct float64
+	P95Wait        float64
+	P95WaitPct     float64
+}
+
+// uiNextStatsPage charts task statistics; it takes the same query string as GET /stats/tasks.
+func (s *ServerConfig) uiNextStatsPage(c *gin.Context) {
+	ctx := c.Request.Context()
+	sq, err := database.TaskStatsQueryFromContext(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	report, err := database.GetTaskStatsReport(ctx, s.DB, sq)
+	if err != nil {
+		c.String(errorStatus(err), err.Error())
+		return
+	}
+
+	var maxFinished int
+	var maxDuration, maxWait float64
+	for _, b := range report.Buckets {
+		finished := 0
+		for _, n := range b.Finished {
+			finished += n
+		}
+		maxFinished = max(maxFinished, finished)
+		maxDuration = max(maxDuration, b.Duration.P95)
+		maxWait = max(maxWait, b.Wait.P95)
+	}
+	pct := func(v float64, top float64) float64 {
+		if top == 0 {
+			return 0
+		}
+		return 100 * v / top
+	}
+	layout := "01/02 15:00"
+	if sq.Bucket == database.STATS_BUCKET_DAY {
+		layout = "01/02"
+	}
+	bars := make([]StatsBarView, 0, len(report.Buckets))
+	for _, b := range report.Buckets {
+		bar := StatsBarView{
+			Label:       time.Unix(b.Ts, 0).UTC().Format(layout),
+			Succeeded:   b.Finished["SUCCESS"],
+			P95Duration: b.Duration.P95,
+			P95Wait:     b.Wait.P95,
+		}
+		for state, n := range b.Finished {
+			if state != "SUCCESS" {
+				bar.Failed += n
+			}
+		}
+		bar.SucceededPct = pct(float64(bar.Succeeded), float64(maxFinished))
+		bar.FailedPct = pct(float64(bar.Failed), float64(maxFinished))
+		bar.P95DurationPct = pct(bar.P95Duration, maxDuration)
+		bar.P95WaitPct = pct(bar.P95Wait, maxWait)
+		bars = append(bars, bar)
+	}
+
+	typeNames := make([]string, 0, len(report.ByType))
+	for name := range report.ByType {
+		typeNames = append(typeNames, name)
+	}
+	sort.Strings(typeNames)
+	tagNames := make([]string, 0, len(report.ByTag))
+	for name := range report.ByTag {
+		tagNames = append(tagNames, name)
+	}
+	sort.Strings(tagNames)
+
+	t := mustParseUINextPage("stats", "ui_next/templates/stats.html")
+	s.renderUINext(c, t, gin.H{
+		"Title":    "Stats",
+		"Report":   report,
+		"Bars":     bars,
+		"Types":    typeNames,
+		"Tags":     tagNames,
+		"From":     c.DefaultQuery("from", "-24h"),
+		"Bucket":   sq.Bucket,
+		"TypeName": c.Query("types"),
+		"Tag":      sq.Tag,
+	})
+}
+
 func (s *ServerConfig) uiNextAboutPage(c *gin.Context) {
 	keys := viper.AllKeys()
 	sort.Strings(keys)
@@ -482,6 +712,7 @@ func (s *ServerConfig) uiNextCustomEnvRowPartial(c *gin.Context) {
 // uiNextSubmitTask handles the New Task form submit and returns fresh rows.
 // Form fields named `env.<NAME>` are collected into the task's ExecEnv.
 func (s *ServerConfig) uiNextSubmitTask(c *gin.Context) {
+	ctx := c.Request.Context()
 	taskType := c.PostForm("type")
 	if taskType == "" {
 		c.String(http.StatusBadRequest, "type is required")
@@ -538,32 +769,109 @@ func (s *ServerConfig) uiNextSubmitTask(c *gin.Context) {
 
 	t, err := tt.NewTask(childEnv)
 	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+		c.String(errorStatus(err), err.Error())
 		return
 	}
-	if err := s.DB.SaveTask(&t); err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+	if err := s.DB.SaveTask(ctx, &t); err != nil {
+		c.String(errorStatus(err), err.Error())
 		return
 	}
-	if err := s.Q.AddTask(&t); err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+	if err := s.Q.AddTask(ctx, &t); err != nil {
+		c.String(errorStatus(err), err.Error())
 		return
 	}
 	s.TaskEvents.Notify()
 	s.uiNextTasksRowsPartial(c)
 }
 
+// uiNextBulkTasks runs a bulk operation from the task list and renders a
+// summary. With scope=filter the filter form's fields select the tasks,
+// otherwise the checked rows do. The rows refresh themselves over SSE.
+func (s *ServerConfig) uiNextBulkTasks(c *gin.Context) {
+	if err := c.Request.ParseForm(); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	form := c.Request.PostForm
+
+	req := &tasks.BulkTaskRequest{
+		Reason:     form.Get("reason"),
+		AddTags:    splitCSV(form.Get("addTags")),
+		RemoveTags: splitCSV(form.Get("removeTags")),
+	}
+	if form.Get("scope") == "filter" {
+		// selectBulkTasks reads filters from the query string, same as GET /task/
+		q := url.Values{}
+		for _, p := range bulkFilterParams {
+			for _, v := range form[p] {
+				if v != "" {
+					q.Add(p, v)
+				}
+			}
+		}
+		c.Request.URL.RawQuery = q.Encode()
+	} else {
+		req.Ids = form["ids"]
+		if len(req.Ids) == 0 {
+			c.String(http.StatusBadRequest, "no tasks selected")
+			return
+		}
+	}
+
+	status, resp, err := s.runBulkTaskOp(c, form.Get("op"), req, form.Get("dryRun") == "true")
+	if err != nil {
+		c.String(status, err.Error())
+		return
+	}
+	t := mustParsePartial("bulk-result", "bulk_result.html")
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	if err := t.ExecuteTemplate(c.Writer, "bulk-result", resp); err != nil {
+		log.WithField("err", err).Warn("ui-next: render bulk-result")
+	}
+}
+
+func splitCSV(raw string) []string {
+	out := []string{}
+	for _, v := range strings.Split(raw, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
 // renderUINext executes the layout with the page's content block bound.
+// Every page gets the claim pause for the banner in the layout.
 func (s *ServerConfig) renderUINext(c *gin.Context, t *template.Template, data gin.H) {
+	data["Pause"] = s.uiNextQueuePause(c)
 	c.Header("Content-Type", "text/html; charset=utf-8")
 	if err := t.ExecuteTemplate(c.Writer, "layout", data); err != nil {
 		log.WithField("err", err).Warn("ui-next: render page")
 	}
 }
 
+// uiNextQueuePause reads the claim pause; a failed read shows no banner rather than failing the page.
+func (s *ServerConfig) uiNextQueuePause(c *gin.Context) database.QueuePause {
+	p, err := s.DB.GetQueuePause(c.Request.Context())
+	if err != nil {
+		log.WithField("err", err).Warn("ui-next: read claim pause")
+	}
+	return p
+}
+
+// uiNextPauseBannerPartial re-renders the banner so open pages notice a pause.
+func (s *ServerConfig) uiNextPauseBannerPartial(c *gin.Context) {
+	t := mustParsePartial("pause-banner", "pause_banner.html")
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	if err := t.ExecuteTemplate(c.Writer, "pause-banner", s.uiNextQueuePause(c)); err != nil {
+		log.WithField("err", err).Warn("ui-next: render pause-banner")
+	}
+}
+
 func (s *ServerConfig) sseStream(c *gin.Context, hub *EventHub, eventName string) {
 	ch := hub.Subscribe()
 	defer hub.Unsubscribe(ch)
+	defer trackStream("ui")()
 
 	seq := 0
 	send := func(w io.Writer) {
@@ -598,3 +906,7 @@ func (s *ServerConfig) sseTaskEvents(c *gin.Context) {
 func (s *ServerConfig) sseWorkerEvents(c *gin.Context) {
 	s.sseStream(c, s.WorkerEvents, "workers-changed")
 }
+
+func (s *ServerConfig) sseTaskTypeEvents(c *gin.Context) {
+	s.sseStream(c, s.TaskTypeEvents, "task-types-changed")
+}
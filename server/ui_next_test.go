@@ -5,10 +5,16 @@
 //     and date-string createdAfter (datetime-local / RFC3339)
 //   - custom-env-row partial renders the name/value inputs
 //   - POST /ui/tasks zips customEnvName/customEnvValue pairs into ExecEnv
+//   - POST /ui/tasks/bulk acts on checked rows or on the filter form's matches
+//   - task type editor validates and saves through /ui/partials/task-type-validate
+//     and POST /ui/task-types
+//   - every page shows the pause banner while claims are paused, and workers
+//     show their DRAINING state
 
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
@@ -17,6 +23,9 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/turtlemonvh/blanket/lib/database"
+	"github.com/turtlemonvh/blanket/lib/objectid"
+	"github.com/turtlemonvh/blanket/worker"
 )
 
 func getUI(r http.Handler, path string) *httptest.ResponseRecorder {
@@ -68,6 +77,37 @@ func TestUI_RootRedirectsToUI(t *testing.T) {
 	assert.Equal(t, "/ui/", w.Header().Get("Location"))
 }
 
+func TestUI_PauseBannerAndDrainingWorkers(t *testing.T) {
+	s, cleanup := NewTestServer()
+	defer cleanup()
+	r := s.GetRouter()
+	ctx := context.Background()
+
+	wconf := worker.WorkerConf{Id: objectid.NewObjectId(), Tags: []string{"bash"}}
+	assert.NoError(t, s.DB.UpdateWorker(ctx, &wconf))
+
+	w := getUI(r, "/ui/workers")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "Claims are paused")
+	assert.Contains(t, w.Body.String(), "Pause Claims")
+
+	assert.NoError(t, s.DB.SaveQueuePause(ctx, &database.QueuePause{Paused: true, Reason: "upgrading to v2"}))
+	_, err := s.DB.DrainWorker(ctx, wconf.Id, true)
+	assert.NoError(t, err)
+
+	for _, path := range []string{"/ui/", "/ui/workers", "/ui/about", "/ui/partials/pause-banner"} {
+		w = getUI(r, path)
+		assert.Equal(t, http.StatusOK, w.Code, path)
+		assert.Contains(t, w.Body.String(), "Claims are paused", path)
+		assert.Contains(t, w.Body.String(), "upgrading to v2", path)
+	}
+
+	w = getUI(r, "/ui/partials/workers-rows")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "DRAINING")
+	assert.Contains(t, w.Body.String(), "/resume")
+}
+
 // --- /ui/partials/tasks-rows with filters ---
 
 func TestUI_TasksRows_MultiValueStates(t *testing.T) {
@@ -165,12 +205,15 @@ func TestUI_SubmitTask_MergesCustomEnv(t *testing.T) {
 	r.ServeHTTP(rec, req)
 	assert.Equal(t, http.StatusOK, rec.Code)
 
-	var list []struct {
-		DefaultEnv map[string]string `json:"defaultEnv"`
+	var page struct {
+		Items []struct {
+			DefaultEnv map[string]string `json:"defaultEnv"`
+		} `json:"items"`
 	}
-	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
 		t.Fatalf("decode /task/: %v; body=%s", err, rec.Body.String())
 	}
+	list := page.Items
 	if assert.Len(t, list, 1) {
 		env := list[0].DefaultEnv
 		assert.Equal(t, "orange", env["COLOR"])
@@ -180,6 +223,80 @@ func TestUI_SubmitTask_MergesCustomEnv(t *testing.T) {
 	}
 }
 
+func TestUI_BulkTasks(t *testing.T) {
+	cleanup := setupTestTaskType(t)
+	defer cleanup()
+
+	s, scleanup := NewTestServer()
+	defer scleanup()
+	r := s.GetRouter()
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		var created struct {
+			Id string `json:"id"`
+		}
+		json.Unmarshal(postTask(r, "echo_task").Body.Bytes(), &created)
+		ids = append(ids, created.Id)
+	}
+
+	// Checked rows
+	form := url.Values{}
+	form.Set("op", "cancel")
+	form.Set("scope", "selected")
+	form.Add("ids", ids[0])
+	w := postForm(r, "/ui/tasks/bulk", form)
+	assert.Equal(t, http.StatusOK, w.Code, "body: %s", w.Body.String())
+	assert.Contains(t, w.Body.String(), "1 succeeded, 0 failed")
+
+	// Everything the filter form matches, as a dry run
+	form = url.Values{}
+	form.Set("op", "delete")
+	form.Set("scope", "filter")
+	form.Add("states", "WAITING")
+	form.Set("dryRun", "true")
+	w = postForm(r, "/ui/tasks/bulk", form)
+	assert.Equal(t, http.StatusOK, w.Code, "body: %s", w.Body.String())
+	assert.Contains(t, w.Body.String(), "would apply to 2 task(s)")
+
+	form.Del("scope")
+	w = postForm(r, "/ui/tasks/bulk", form)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// --- task type editor ---
+
+func TestUI_TaskTypeEditor_ValidateAndSave(t *testing.T) {
+	cleanup := setupTestTaskType(t)
+	defer cleanup()
+
+	s, scleanup := NewTestServer()
+	defer scleanup()
+	r := s.GetRouter()
+
+	form := url.Values{}
+	form.Set("name", "ui_task")
+	form.Set("config", `tags = ["bash"]`)
+
+	// Problems are rendered with a 200 so htmx swaps them into the form
+	w := postForm(r, "/ui/partials/task-type-validate", form)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "command")
+	w = postForm(r, "/ui/task-types", form)
+	assert.Contains(t, w.Body.String(), "Not saved")
+
+	form.Set("config", `command = "echo 'from the ui'"`)
+	w = postForm(r, "/ui/task-types", form)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Saved")
+
+	// Editing prefills the form from the stored file
+	w = getUI(r, "/ui/partials/task-type-editor?name=ui_task")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "from the ui")
+	assert.Contains(t, w.Body.String(), `name="existing"`)
+}
+
 // --- POST /ui/workers ---
 
 // TestUI_SubmitWorker_RejectsLowCheckInterval is the UI side of the
@@ -0,0 +1,42 @@
+package tasks
+
+// Operations for `POST /task/bulk/:op`
+const (
+	BULK_CANCEL = "cancel"
+	BULK_DELETE = "delete"
+	BULK_RERUN  = "rerun"
+	BULK_RETAG  = "retag"
+)
+
+var ValidBulkOps = []string{BULK_CANCEL, BULK_DELETE, BULK_RERUN, BULK_RETAG}
+
+// Body of a bulk operation
+// Only the fields for the chosen operation are used
+type BulkTaskRequest struct {
+	Ids         []string          `json:"ids"`         // act on these tasks instead of the ones matching the query string
+	Force       bool              `json:"force"`       // cancel: kill running commands
+	Reason      string            `json:"reason"`      // cancel: kept in each task's history
+	Environment map[string]string `json:"environment"` // rerun: overrides for each copy
+	Tags        []string          `json:"tags"`        // retag: replace the tags
+	AddTags     []string          `json:"addTags"`     // retag: add these tags
+	RemoveTags  []string          `json:"removeTags"`  // retag: then remove these
+}
+
+// What happened to one task in a bulk operation
+type BulkTaskResult struct {
+	Id        string `json:"id"`
+	Status    int    `json:"status"` // same code the single-task endpoint would return
+	Error     string `json:"error"`
+	NewTaskId string `json:"newTaskId"` // rerun: id of the copy
+}
+
+type BulkTaskResponse struct {
+	Op        string           `json:"op"`
+	DryRun    bool             `json:"dryRun"`
+	Matched   int              `json:"matched"`
+	ByState   map[string]int   `json:"byState"` // matched tasks, counted by state before the operation
+	Missing   []string         `json:"missing"` // requested ids that don't exist
+	Succeeded int              `json:"succeeded"`
+	Failed    int              `json:"failed"`
+	Results   []BulkTaskResult `json:"results"` // one per matched or missing task; empty for a dry run
+}
@@ -0,0 +1,31 @@
+package tasks
+
+/*
+
+Cancelling a task that a worker already has.
+
+- The API records a cancel request on the task; its state doesn't change yet
+- The worker waits on `GET /task/:id/cancel` while the task runs, so it hears about the request right away
+- It acknowledges the request, then either stops the command gracefully or, with `force`, kills it
+- Once the command is gone it reports the outcome and the task moves to STOPPED
+- If the worker doesn't acknowledge in time the server moves the task to STOPPED itself
+
+*/
+
+// How a cancel request ended
+const (
+	CANCEL_GRACEFUL       = "GRACEFUL"       // the command exited after being asked to stop
+	CANCEL_KILLED         = "KILLED"         // the command was killed, because of `force` or because it ignored the request
+	CANCEL_UNACKNOWLEDGED = "UNACKNOWLEDGED" // the worker never answered; the server stopped the task without it
+)
+
+var ValidCancelOutcomes = []string{CANCEL_GRACEFUL, CANCEL_KILLED, CANCEL_UNACKNOWLEDGED}
+
+// A request to cancel a CLAIMED or RUNNING task
+type TaskCancellation struct {
+	RequestedTs    int64  `json:"requestedTs"`
+	Force          bool   `json:"force"` // kill the command instead of asking it to exit
+	Reason         string `json:"reason"`
+	AcknowledgedTs int64  `json:"acknowledgedTs"` // when the worker picked up the request
+	Outcome        string `json:"outcome"`        // see ValidCancelOutcomes; empty until the task is stopped
+}
@@ -1,6 +1,8 @@
 package tasks
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	log "github.com/sirupsen/logrus"
@@ -8,15 +10,21 @@ import (
 	"github.com/turtlemonvh/blanket/lib/objectid"
 	"net/http"
 	"net/url"
+	"strconv"
 )
 
 // FIXME: Move to client package
 // Functions that work over http to transition task state
+// Each request is abandoned once its ctx is done
 
 // Refresh information about this task by pulling from the blanket server
-func (t *Task) Refresh() error {
+func (t *Task) Refresh(ctx context.Context) error {
 	reqURL := fmt.Sprintf("http://localhost:%d/task/%s", viper.GetInt("port"), t.Id.Hex())
-	res, err := http.Get(reqURL)
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -27,7 +35,7 @@ func (t *Task) Refresh() error {
 
 // FIXME: Should operate on a task object and set the property on it
 // Should only be called by worker
-func MarkAsRunning(t *Task, extraVars map[string]string) error {
+func MarkAsRunning(ctx context.Context, t *Task, extraVars map[string]string) error {
 	urlParams := url.Values{}
 	urlParams.Set("state", "RUNNING")
 	for k, v := range extraVars {
@@ -35,7 +43,7 @@ func MarkAsRunning(t *Task, extraVars map[string]string) error {
 	}
 	paramsString := urlParams.Encode()
 	reqURL := fmt.Sprintf("http://localhost:%d/task/%s/run", viper.GetInt("port"), t.Id.Hex()) + "?" + paramsString
-	req, err := http.NewRequest("PUT", reqURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "PUT", reqURL, nil)
 	if err != nil {
 		return err
 	}
@@ -49,12 +57,111 @@ func MarkAsRunning(t *Task, extraVars map[string]string) error {
 
 // Should only be called by worker
 // Set task to one of the following states: ERROR/SUCCESS/TIMEDOUT/STOPPED
-func MarkAsFinished(t *Task, state string) error {
+// reason is recorded in the task's history and may be ""
+// exitCode is nil if the command never ran or its exit code is unknown
+func MarkAsFinished(ctx context.Context, t *Task, state string, reason string, exitCode *int) error {
 	urlParams := url.Values{}
 	urlParams.Set("state", state)
+	if reason != "" {
+		urlParams.Set("reason", reason)
+	}
+	if exitCode != nil {
+		urlParams.Set("exitCode", strconv.Itoa(*exitCode))
+	}
 	paramsString := urlParams.Encode()
 	reqURL := fmt.Sprintf("http://localhost:%d/task/%s/finish", viper.GetInt("port"), t.Id.Hex()) + "?" + paramsString
-	req, err := http.NewRequest("PUT", reqURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "PUT", reqURL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return nil
+}
+
+// Should only be called by worker
+// Wait up to waitSeconds for the task to be cancelled; returns nil if it wasn't
+func WaitForCancel(ctx context.Context, t *Task, waitSeconds float64) (*TaskCancellation, error) {
+	reqURL := fmt.Sprintf("http://localhost:%d/task/%s/cancel?wait=%g", viper.GetInt("port"), t.Id.Hex(), waitSeconds)
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusOK:
+		cancellation := &TaskCancellation{}
+		return cancellation, json.NewDecoder(res.Body).Decode(cancellation)
+	default:
+		return nil, fmt.Errorf("Problem waiting for cancel request; status code :: %s", res.Status)
+	}
+}
+
+// Should only be called by worker
+// Acknowledge a cancel request with an empty outcome, or report how it ended; see ValidCancelOutcomes
+func UpdateCancel(ctx context.Context, t *Task, outcome string) error {
+	urlParams := url.Values{}
+	if outcome != "" {
+		urlParams.Set("outcome", outcome)
+	}
+	reqURL := fmt.Sprintf("http://localhost:%d/task/%s/cancel/ack", viper.GetInt("port"), t.Id.Hex()) + "?" + urlParams.Encode()
+	req, err := http.NewRequestWithContext(ctx, "PUT", reqURL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Problem updating cancel request; status code :: %s", res.Status)
+	}
+	return nil
+}
+
+// Should only be called by worker
+// Report the state of one step of a multi-step task
+func MarkStep(ctx context.Context, t *Task, step int, state string, exitCode int) error {
+	urlParams := url.Values{}
+	urlParams.Set("state", state)
+	urlParams.Set("exitCode", fmt.Sprintf("%d", exitCode))
+	reqURL := fmt.Sprintf("http://localhost:%d/task/%s/step/%d", viper.GetInt("port"), t.Id.Hex(), step) + "?" + urlParams.Encode()
+	req, err := http.NewRequestWithContext(ctx, "PUT", reqURL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Problem updating step %d; status code :: %s", step, res.Status)
+	}
+	return nil
+}
+
+// Should only be called by worker
+// Report the state of one hook of a task
+func MarkHook(ctx context.Context, t *Task, hook string, state string, exitCode int, followUpTaskId string) error {
+	urlParams := url.Values{}
+	urlParams.Set("state", state)
+	urlParams.Set("exitCode", fmt.Sprintf("%d", exitCode))
+	if followUpTaskId != "" {
+		urlParams.Set("followUpTaskId", followUpTaskId)
+	}
+	reqURL := fmt.Sprintf("http://localhost:%d/task/%s/hook/%s", viper.GetInt("port"), t.Id.Hex(), url.PathEscape(hook)) + "?" + urlParams.Encode()
+	req, err := http.NewRequestWithContext(ctx, "PUT", reqURL, nil)
 	if err != nil {
 		return err
 	}
@@ -63,15 +170,57 @@ func MarkAsFinished(t *Task, state string) error {
 		return err
 	}
 	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Problem updating hook %s; status code :: %s", hook, res.Status)
+	}
 	return nil
 }
 
+// Submit a new task, e.g. a follow-up from a hook
+// parentId is the id of the task that submitted it, or "" for none
+func SubmitTask(ctx context.Context, taskType string, env map[string]string, parentId string) (Task, error) {
+	bts, err := json.Marshal(map[string]interface{}{
+		"type":        taskType,
+		"environment": env,
+		"parentId":    parentId,
+	})
+	if err != nil {
+		return Task{}, err
+	}
+	reqURL := fmt.Sprintf("http://localhost:%d/task/", viper.GetInt("port"))
+	req, err := http.NewRequestWithContext(ctx, "POST", reqURL, bytes.NewReader(bts))
+	if err != nil {
+		return Task{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return Task{}, err
+	}
+	defer res.Body.Close()
+	dec := json.NewDecoder(res.Body)
+
+	if res.StatusCode != http.StatusCreated {
+		errMsg := make(map[string]interface{})
+		dec.Decode(&errMsg)
+		return Task{}, fmt.Errorf("Problem submitting task of type '%s'; status code :: %s :: %v", taskType, res.Status, errMsg["error"])
+	}
+	var t Task
+	err = dec.Decode(&t)
+	return t, err
+}
+
 // Find the oldest task we are eligible to run
-func MarkAsClaimed(workerId objectid.ObjectId) (Task, error) {
+// The server holds the request for up to waitSeconds until one is queued; returns an empty task if none came
+func MarkAsClaimed(ctx context.Context, workerId objectid.ObjectId, waitSeconds float64) (Task, error) {
 	// Call the REST api and get a task with the required tags
 	// The worker needs to make sure it has all the tags of whatever task it requests
-	reqURL := fmt.Sprintf("http://localhost:%d/task/claim/%s", viper.GetInt("port"), workerId.Hex())
-	res, err := http.Post(reqURL, "application/json", nil)
+	reqURL := fmt.Sprintf("http://localhost:%d/task/claim/%s?wait=%g", viper.GetInt("port"), workerId.Hex(), waitSeconds)
+	req, err := http.NewRequestWithContext(ctx, "POST", reqURL, nil)
+	if err != nil {
+		return Task{}, err
+	}
+	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return Task{}, err
 	}
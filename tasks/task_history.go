@@ -0,0 +1,57 @@
+package tasks
+
+import (
+	"github.com/turtlemonvh/blanket/lib/objectid"
+)
+
+const (
+	// Actors that can change the state of a task, besides workers
+	ACTOR_API    = "api"    // a client of the REST API or the UI
+	ACTOR_SYSTEM = "system" // the server itself, e.g. when cleaning up stalled tasks
+)
+
+// One change in the state of a task
+type TaskTransition struct {
+	Ts       int64  `json:"ts"`
+	Actor    string `json:"actor"`    // ACTOR_API, ACTOR_SYSTEM, or see WorkerActor
+	OldState string `json:"oldState"` // empty when the task was created
+	NewState string `json:"newState"`
+	Reason   string `json:"reason"`
+}
+
+// Actor for changes made by a worker
+func WorkerActor(workerId objectid.ObjectId) string {
+	return "worker:" + workerId.Hex()
+}
+
+// Move the task to a new state, recording who did it and why
+func (t *Task) Transition(state string, actor string, reason string, ts int64) {
+	t.History = append(t.History, TaskTransition{
+		Ts:       ts,
+		Actor:    actor,
+		OldState: t.State,
+		NewState: state,
+		Reason:   reason,
+	})
+	t.State = state
+}
+
+// When the task reached the state it finished in; 0 if it hasn't
+// Falls back to the last update for tasks stored without a history
+func (t *Task) FinishedTs() int64 {
+	isFinished := false
+	for _, s := range ValidTerminalTaskStates {
+		if t.State == s {
+			isFinished = true
+		}
+	}
+	if !isFinished {
+		return 0
+	}
+	for i := len(t.History) - 1; i >= 0; i-- {
+		if t.History[i].NewState == t.State {
+			return t.History[i].Ts
+		}
+	}
+	return t.LastUpdatedTs
+}
@@ -0,0 +1,227 @@
+package tasks
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/spf13/cast"
+	"os/exec"
+	"path"
+	"text/template"
+)
+
+/*
+
+Task types can run hook commands around the main command or steps.
+
+- `before` runs first; if it fails the main command is skipped and the task ends in ERROR
+- `on_success` runs when the task ends in SUCCESS
+- `on_failure` runs when the task ends in ERROR or TIMEDOUT
+- `after` always runs last, whatever the outcome, as long as the worker got as far as running `before`
+
+A hook is either a command string or a table with `command`, `executor`, `timeout` and, for
+`on_success` and `on_failure`, a `submit` table naming a follow-up task to create.
+
+The task's own state only reflects the main command. Hooks report their state separately in the
+task's `hooks` field and write to their own log files.
+
+*/
+
+const (
+	DEFAULT_HOOK_TIMEOUT = 300 // hooks get 5 minutes unless they set their own timeout
+)
+
+// Hooks in the order they run
+var HookNames = []string{"before", "on_success", "on_failure", "after"}
+
+// Hooks that can submit a follow-up task
+var followUpHookNames = map[string]bool{
+	"on_success": true,
+	"on_failure": true,
+}
+
+// One of the hooks of a task type
+type TaskTypeHook struct {
+	Name     string
+	Command  string
+	Executor string
+	Timeout  int64 // seconds
+	Submit   *TaskTypeFollowUp
+}
+
+// A task to submit when a hook runs
+type TaskTypeFollowUp struct {
+	Type        string
+	Environment map[string]string // values are templated against the parent's environment and BLANKET_PARENT_* fields
+}
+
+// Status of one hook of a task
+type TaskHook struct {
+	Name           string `json:"name"`
+	State          string `json:"state"` // See ValidTaskStepStates
+	StartedTs      int64  `json:"startedTs"`
+	FinishedTs     int64  `json:"finishedTs"`
+	ExitCode       int    `json:"exitCode"`
+	FollowUpTaskId string `json:"followUpTaskId"` // id of the task submitted by this hook, if any
+}
+
+// The hooks defined by a task type, keyed by name
+func (t *TaskType) Hooks() map[string]TaskTypeHook {
+	hooks := make(map[string]TaskTypeHook)
+	for _, name := range HookNames {
+		value := t.Config.Get(name)
+		if value == nil {
+			continue
+		}
+		hook := TaskTypeHook{Name: name}
+		if command, ok := value.(string); ok {
+			hook.Command = command
+		} else {
+			hookConfig := cast.ToStringMap(value)
+			hook.Command = cast.ToString(hookConfig["command"])
+			hook.Executor = cast.ToString(hookConfig["executor"])
+			hook.Timeout = cast.ToInt64(hookConfig["timeout"])
+			if submit, ok := hookConfig["submit"]; ok {
+				submitConfig := cast.ToStringMap(submit)
+				hook.Submit = &TaskTypeFollowUp{
+					Type:        cast.ToString(submitConfig["type"]),
+					Environment: make(map[string]string),
+				}
+				// A list of name/value tables like `environment.default`, since viper lowercases map keys
+				for _, envVar := range cast.ToSlice(submitConfig["environment"]) {
+					ev := cast.ToStringMap(envVar)
+					hook.Submit.Environment[cast.ToString(ev["name"])] = cast.ToString(ev["value"])
+				}
+			}
+		}
+		if hook.Executor == "" {
+			hook.Executor = t.Config.GetString("executor")
+		}
+		if hook.Timeout == 0 {
+			hook.Timeout = DEFAULT_HOOK_TIMEOUT
+		}
+		hooks[name] = hook
+	}
+	return hooks
+}
+
+// Check the hooks of a task type definition and return a list of problems
+func validateHooks(hooks map[string]TaskTypeHook) []string {
+	problems := []string{}
+	for _, name := range HookNames {
+		hook, ok := hooks[name]
+		if !ok {
+			continue
+		}
+		if hook.Command == "" && hook.Submit == nil {
+			problems = append(problems, fmt.Sprintf("Hook '%s' must set 'command' or 'submit'", name))
+		} else if err := parseCommandTemplate(hook.Command); err != nil {
+			problems = append(problems, fmt.Sprintf("Hook '%s' field 'command' is not a valid template :: %s", name, err.Error()))
+		}
+		if hook.Timeout < 0 {
+			problems = append(problems, fmt.Sprintf("Hook '%s' field 'timeout' must be a positive number of seconds", name))
+		}
+		if hook.Submit == nil {
+			continue
+		}
+		if !followUpHookNames[name] {
+			problems = append(problems, fmt.Sprintf("Hook '%s' can't submit a follow-up task; only on_success and on_failure can", name))
+		} else if !ValidTaskTypeName(hook.Submit.Type) {
+			problems = append(problems, fmt.Sprintf("Hook '%s' field 'submit.type' must name a task type", name))
+		}
+		for k, v := range hook.Submit.Environment {
+			if k == "" {
+				problems = append(problems, fmt.Sprintf("Hook '%s' has a follow-up variable with no 'name'", name))
+			} else if err := parseCommandTemplate(v); err != nil {
+				problems = append(problems, fmt.Sprintf("Hook '%s' follow-up variable '%s' is not a valid template :: %s", name, k, err.Error()))
+			}
+		}
+	}
+	return problems
+}
+
+// Initial status of each hook for a new task
+func newTaskHooks(hooks map[string]TaskTypeHook) []TaskHook {
+	var taskHooks []TaskHook
+	for _, name := range HookNames {
+		if _, ok := hooks[name]; ok {
+			taskHooks = append(taskHooks, TaskHook{Name: name, State: "WAITING"})
+		}
+	}
+	return taskHooks
+}
+
+// Log file for one hook; stream is "stdout" or "stderr"
+func HookLogPath(resultDir string, hook string, stream string) string {
+	return path.Join(resultDir, fmt.Sprintf("blanket.hook-%s.%s.log", hook, stream))
+}
+
+// Get the command object used to run one hook of this task
+func (t *Task) GetHookCmd(hook TaskTypeHook) (*exec.Cmd, error) {
+	return t.buildCmd(hook.Command, hook.Executor)
+}
+
+// Environment for a follow-up task submitted by a hook
+// The parent's id, type, final state and result directory are always passed along
+func (t *Task) FollowUpEnv(followUp *TaskTypeFollowUp, state string) (map[string]string, error) {
+	env := map[string]string{
+		"BLANKET_PARENT_TASK_ID":    t.Id.Hex(),
+		"BLANKET_PARENT_TASK_TYPE":  t.TypeId,
+		"BLANKET_PARENT_TASK_STATE": state,
+		"BLANKET_PARENT_RESULT_DIR": t.ResultDir,
+	}
+	templateData := make(map[string]string)
+	for k, v := range t.ExecEnv {
+		templateData[k] = v
+	}
+	for k, v := range env {
+		templateData[k] = v
+	}
+
+	for k, v := range followUp.Environment {
+		tmpl, err := template.New("followUp").Parse(v)
+		if err != nil {
+			return nil, err
+		}
+		var value bytes.Buffer
+		if err := tmpl.Execute(&value, templateData); err != nil {
+			return nil, fmt.Errorf("Problem evaluating follow-up variable '%s' :: %s", k, err.Error())
+		}
+		env[k] = value.String()
+	}
+	return env, nil
+}
+
+// Record a change in the state of one hook
+func (t *Task) UpdateHook(name string, state string, exitCode int, followUpTaskId string, ts int64) error {
+	isValid := false
+	for _, s := range ValidTaskStepStates {
+		if state == s {
+			isValid = true
+			break
+		}
+	}
+	if !isValid {
+		return fmt.Errorf("Invalid hook state '%s'; must be one of: %v", state, ValidTaskStepStates)
+	}
+
+	for i := range t.Hooks {
+		h := &t.Hooks[i]
+		if h.Name != name {
+			continue
+		}
+		h.State = state
+		h.ExitCode = exitCode
+		if followUpTaskId != "" {
+			h.FollowUpTaskId = followUpTaskId
+		}
+		switch state {
+		case "RUNNING":
+			h.StartedTs = ts
+		case "WAITING":
+		default:
+			h.FinishedTs = ts
+		}
+		return nil
+	}
+	return fmt.Errorf("Task has no hook named '%s'", name)
+}
@@ -0,0 +1,535 @@
+package tasks
+
+import (
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+
+In-memory cache of task types, kept up to date by watching the types directories.
+
+- Each file is loaded independently; a bad file or missing directory does not affect the others
+- When an edit breaks a file that previously loaded, the last good version keeps being served
+- Listeners registered with OnChange are called whenever a type is added, updated or removed
+- Types that extend or include another file are reloaded when that file changes
+
+*/
+
+// Actions reported to registry listeners
+const (
+	TASK_TYPE_ADDED   = "added"
+	TASK_TYPE_UPDATED = "updated"
+	TASK_TYPE_REMOVED = "removed"
+	TASK_TYPE_ERROR   = "error"
+)
+
+// A problem loading one file or directory of task types
+type TaskTypeLoadError struct {
+	ConfigFile string `json:"configFile"`
+	Name       string `json:"name"`
+	Error      string `json:"error"`
+	Ts         int64  `json:"ts"`
+}
+
+// Returned when no task type with a given name is loaded
+type TaskTypeNotFoundError string
+
+func (e TaskTypeNotFoundError) Error() string {
+	return fmt.Sprintf("No task of type '%s' could be located", string(e))
+}
+
+// Sent to registry listeners when a task type changes
+type TaskTypeChange struct {
+	Name       string `json:"name"`
+	ConfigFile string `json:"configFile"`
+	Action     string `json:"action"`
+}
+
+type TaskTypeRegistry struct {
+	mu         sync.RWMutex
+	dirs       []string
+	byFile     map[string]*TaskType         // last good version of each file
+	loadErrors map[string]TaskTypeLoadError // latest error for each file or directory
+	listeners  []func(TaskTypeChange)
+	watcher    *fsnotify.Watcher
+	stopPoll   chan struct{} // set while polling instead of watching
+}
+
+func NewTaskTypeRegistry(dirs []string) *TaskTypeRegistry {
+	return &TaskTypeRegistry{
+		dirs:       append([]string{}, dirs...),
+		byFile:     make(map[string]*TaskType),
+		loadErrors: make(map[string]TaskTypeLoadError),
+	}
+}
+
+var (
+	defaultRegistryMu sync.Mutex
+	defaultRegistry   *TaskTypeRegistry
+
+	// How often the default registry reads its directories again if they can't be watched
+	registryPollInterval = 10 * time.Second
+	// Replaced in tests to make watching fail
+	newWatcher = fsnotify.NewWatcher
+)
+
+// Directories task types are loaded from
+// Includes the writable types directory even if it is not listed in `tasks.typesPaths`
+func TypesDirs() []string {
+	dirs := append([]string{}, viper.GetStringSlice("tasks.typesPaths")...)
+	writableDir := WritableTypesDir()
+	if writableDir == "" {
+		return dirs
+	}
+	for _, d := range dirs {
+		if path.Clean(d) == path.Clean(writableDir) {
+			return dirs
+		}
+	}
+	return append(dirs, writableDir)
+}
+
+// Get the registry for the directories returned by TypesDirs
+// The registry is rebuilt if the configured directories change
+func DefaultRegistry() *TaskTypeRegistry {
+	dirs := TypesDirs()
+
+	defaultRegistryMu.Lock()
+	defer defaultRegistryMu.Unlock()
+
+	if defaultRegistry != nil && sameStrings(defaultRegistry.dirs, dirs) {
+		return defaultRegistry
+	}
+
+	r := NewTaskTypeRegistry(dirs)
+	if defaultRegistry != nil {
+		defaultRegistry.mu.RLock()
+		r.listeners = append(r.listeners, defaultRegistry.listeners...)
+		defaultRegistry.mu.RUnlock()
+		defaultRegistry.Close()
+	}
+	r.Reload()
+	if err := r.Watch(); err != nil {
+		// Lookups only read what is loaded, so without this nothing new would be seen until a restart
+		log.WithFields(log.Fields{
+			"error":    err.Error(),
+			"dirs":     dirs,
+			"interval": registryPollInterval.String(),
+		}).Warn("Problem watching task types directories; reading them again on an interval instead")
+		r.Poll(registryPollInterval)
+	}
+	defaultRegistry = r
+	return r
+}
+
+func sameStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Register a function to call whenever a task type changes
+func (r *TaskTypeRegistry) OnChange(f func(TaskTypeChange)) {
+	r.mu.Lock()
+	r.listeners = append(r.listeners, f)
+	r.mu.Unlock()
+}
+
+func (r *TaskTypeRegistry) notify(change TaskTypeChange) {
+	r.mu.RLock()
+	listeners := append([]func(TaskTypeChange){}, r.listeners...)
+	r.mu.RUnlock()
+	for _, f := range listeners {
+		f(change)
+	}
+}
+
+// Re-read every file in every directory
+// Files that disappeared since the last read are dropped
+func (r *TaskTypeRegistry) Reload() {
+	seen := make(map[string]bool)
+	for _, typesDir := range r.dirs {
+		dirEntries, err := os.ReadDir(typesDir)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":    err.Error(),
+				"filepath": typesDir,
+			}).Error("Problem reading task types directory location")
+			r.setLoadError(typesDir, "", err)
+			continue
+		}
+		r.clearLoadError(typesDir)
+
+		for _, dirEntry := range dirEntries {
+			filepath := path.Join(typesDir, dirEntry.Name())
+			if dirEntry.IsDir() || !validConfigfileName.MatchString(filepath) {
+				continue
+			}
+			seen[filepath] = true
+			r.LoadFile(filepath)
+		}
+	}
+
+	r.mu.RLock()
+	var removed []string
+	for filepath := range r.byFile {
+		if !seen[filepath] {
+			removed = append(removed, filepath)
+		}
+	}
+	r.mu.RUnlock()
+	for _, filepath := range removed {
+		r.RemoveFile(filepath)
+	}
+}
+
+// Load or reload a single file
+// On error the previously loaded version of the file is kept
+func (r *TaskTypeRegistry) LoadFile(filepath string) {
+	r.loadFile(filepath, map[string]bool{})
+}
+
+// visited holds files already reloaded by this change, so dependents are only reloaded once
+func (r *TaskTypeRegistry) loadFile(filepath string, visited map[string]bool) {
+	visited[filepath] = true
+	tt, err := ReadTaskTypeFromFilepath(filepath)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":    err.Error(),
+			"filepath": filepath,
+		}).Error("Problem loading toml file")
+		r.setLoadError(filepath, typeNameFromFilepath(filepath), err)
+		r.notify(TaskTypeChange{
+			Name:       typeNameFromFilepath(filepath),
+			ConfigFile: filepath,
+			Action:     TASK_TYPE_ERROR,
+		})
+		r.reloadDependents(filepath, visited)
+		return
+	}
+
+	r.mu.Lock()
+	existing, found := r.byFile[filepath]
+	unchanged := found && existing.ConfigVersionHash == tt.ConfigVersionHash
+	if !unchanged {
+		r.byFile[filepath] = &tt
+	}
+	_, hadError := r.loadErrors[filepath]
+	delete(r.loadErrors, filepath)
+	r.mu.Unlock()
+
+	if unchanged && !hadError {
+		return
+	}
+	r.watchSources(tt.sources)
+	action := TASK_TYPE_ADDED
+	if found {
+		action = TASK_TYPE_UPDATED
+	}
+	r.notify(TaskTypeChange{
+		Name:       tt.GetName(),
+		ConfigFile: filepath,
+		Action:     action,
+	})
+	r.reloadDependents(filepath, visited)
+	if action == TASK_TYPE_ADDED {
+		// Types that failed because this one was missing may load now
+		r.retryFailed(visited)
+	}
+}
+
+// Reload loaded types resolved from filepath, e.g. when a parent or fragment changes
+func (r *TaskTypeRegistry) reloadDependents(filepath string, visited map[string]bool) {
+	r.mu.RLock()
+	var dependents []string
+	for f, tt := range r.byFile {
+		if visited[f] {
+			continue
+		}
+		for _, source := range tt.sources {
+			if source == filepath {
+				dependents = append(dependents, f)
+				break
+			}
+		}
+	}
+	r.mu.RUnlock()
+	sort.Strings(dependents)
+	for _, f := range dependents {
+		if !visited[f] {
+			r.loadFile(f, visited)
+		}
+	}
+}
+
+func (r *TaskTypeRegistry) retryFailed(visited map[string]bool) {
+	r.mu.RLock()
+	var failed []string
+	for f := range r.loadErrors {
+		if !visited[f] && validConfigfileName.MatchString(f) && r.isTypeFile(f) {
+			failed = append(failed, f)
+		}
+	}
+	r.mu.RUnlock()
+	sort.Strings(failed)
+	for _, f := range failed {
+		if !visited[f] {
+			r.loadFile(f, visited)
+		}
+	}
+}
+
+// Whether a file sits at the top level of one of the types directories
+func (r *TaskTypeRegistry) isTypeFile(filepath string) bool {
+	for _, d := range r.dirs {
+		if path.Clean(d) == path.Dir(filepath) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch directories holding parents or fragments outside the types directories
+func (r *TaskTypeRegistry) watchSources(sources []string) {
+	r.mu.RLock()
+	watcher := r.watcher
+	r.mu.RUnlock()
+	if watcher == nil {
+		return
+	}
+	for _, source := range sources {
+		if r.isTypeFile(source) {
+			continue
+		}
+		// Adding a directory that is already watched is a no-op
+		if err := watcher.Add(path.Dir(source)); err != nil {
+			log.WithFields(log.Fields{
+				"error":    err.Error(),
+				"filepath": path.Dir(source),
+			}).Warn("Problem watching task type fragments directory")
+		}
+	}
+}
+
+// Drop a file that no longer exists
+func (r *TaskTypeRegistry) RemoveFile(filepath string) {
+	r.mu.Lock()
+	tt, found := r.byFile[filepath]
+	delete(r.byFile, filepath)
+	delete(r.loadErrors, filepath)
+	r.mu.Unlock()
+
+	if found {
+		r.notify(TaskTypeChange{
+			Name:       tt.GetName(),
+			ConfigFile: filepath,
+			Action:     TASK_TYPE_REMOVED,
+		})
+	}
+	r.reloadDependents(filepath, map[string]bool{filepath: true})
+}
+
+func (r *TaskTypeRegistry) setLoadError(filepath string, name string, err error) {
+	r.mu.Lock()
+	r.loadErrors[filepath] = TaskTypeLoadError{
+		ConfigFile: filepath,
+		Name:       name,
+		Error:      err.Error(),
+		Ts:         time.Now().Unix(),
+	}
+	r.mu.Unlock()
+}
+
+func (r *TaskTypeRegistry) clearLoadError(filepath string) {
+	r.mu.Lock()
+	delete(r.loadErrors, filepath)
+	r.mu.Unlock()
+}
+
+func typeNameFromFilepath(filepath string) string {
+	return strings.Split(path.Base(filepath), ".toml")[0]
+}
+
+// Files ordered the same way a directory scan would find them
+// Earlier directories in `tasks.typesPaths` win when names collide
+func (r *TaskTypeRegistry) orderedFiles() []string {
+	dirIndex := make(map[string]int)
+	for i, d := range r.dirs {
+		if _, ok := dirIndex[path.Clean(d)]; !ok {
+			dirIndex[path.Clean(d)] = i
+		}
+	}
+	files := make([]string, 0, len(r.byFile))
+	for f := range r.byFile {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		di, dj := dirIndex[path.Dir(files[i])], dirIndex[path.Dir(files[j])]
+		if di != dj {
+			return di < dj
+		}
+		return files[i] < files[j]
+	})
+	return files
+}
+
+func (r *TaskTypeRegistry) find(typeName string) *TaskType {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, f := range r.orderedFiles() {
+		if tt := r.byFile[f]; tt.GetName() == typeName {
+			return tt
+		}
+	}
+	return nil
+}
+
+// Get a loaded task type by name
+// Only reads what is loaded; the watcher picks up new files, so a miss doesn't rescan the directories
+func (r *TaskTypeRegistry) Get(typeName string) (*TaskType, error) {
+	if tt := r.find(typeName); tt != nil {
+		return tt, nil
+	}
+	return &TaskType{}, TaskTypeNotFoundError(typeName)
+}
+
+// All loaded task types
+// Types whose latest edit failed to load are returned with LoadError set
+func (r *TaskTypeRegistry) List() []TaskType {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	taskTypes := []TaskType{}
+	for _, f := range r.orderedFiles() {
+		tt := *r.byFile[f]
+		if loadErr, ok := r.loadErrors[f]; ok {
+			tt.LoadError = loadErr.Error
+		}
+		taskTypes = append(taskTypes, tt)
+	}
+	return taskTypes
+}
+
+// Problems from the most recent load of each file and directory
+func (r *TaskTypeRegistry) LoadErrors() []TaskTypeLoadError {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	loadErrors := []TaskTypeLoadError{}
+	for _, loadErr := range r.loadErrors {
+		loadErrors = append(loadErrors, loadErr)
+	}
+	sort.Slice(loadErrors, func(i, j int) bool {
+		return loadErrors[i].ConfigFile < loadErrors[j].ConfigFile
+	})
+	return loadErrors
+}
+
+// Start watching the types directories for changes
+func (r *TaskTypeRegistry) Watch() error {
+	watcher, err := newWatcher()
+	if err != nil {
+		return err
+	}
+	for _, typesDir := range r.dirs {
+		if err := watcher.Add(typesDir); err != nil {
+			log.WithFields(log.Fields{
+				"error":    err.Error(),
+				"filepath": typesDir,
+			}).Warn("Problem watching task types directory")
+		}
+	}
+
+	r.mu.Lock()
+	r.watcher = watcher
+	r.mu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				r.handleEvent(event)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.WithFields(log.Fields{
+					"error": err.Error(),
+				}).Warn("Error watching task types directories")
+			}
+		}
+	}()
+	return nil
+}
+
+func (r *TaskTypeRegistry) handleEvent(event fsnotify.Event) {
+	// Normalize to the form used by Reload
+	filepath := path.Join(path.Dir(event.Name), path.Base(event.Name))
+	if !validConfigfileName.MatchString(filepath) {
+		return
+	}
+	// Fragments and parents outside the types directories only affect the types built from them
+	if !r.isTypeFile(filepath) {
+		r.reloadDependents(filepath, map[string]bool{filepath: true})
+		return
+	}
+	// Events can arrive after the file is gone, e.g. a write followed quickly by a delete
+	if _, err := os.Stat(filepath); os.IsNotExist(err) {
+		r.RemoveFile(filepath)
+		return
+	}
+	if event.Has(fsnotify.Create) || event.Has(fsnotify.Write) || event.Has(fsnotify.Rename) {
+		r.LoadFile(filepath)
+	}
+}
+
+// Stop watching for changes
+func (r *TaskTypeRegistry) Close() {
+	r.mu.Lock()
+	watcher, stopPoll := r.watcher, r.stopPoll
+	r.watcher, r.stopPoll = nil, nil
+	r.mu.Unlock()
+	if watcher != nil {
+		watcher.Close()
+	}
+	if stopPoll != nil {
+		close(stopPoll)
+	}
+}
+
+// Reload every interval until closed; for directories that can't be watched
+func (r *TaskTypeRegistry) Poll(interval time.Duration) {
+	stop := make(chan struct{})
+	r.mu.Lock()
+	r.stopPoll = stop
+	r.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				r.Reload()
+			}
+		}
+	}()
+}
@@ -0,0 +1,146 @@
+package tasks
+
+import (
+	"errors"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const registryTestToml = `
+tags = ["bash"]
+timeout = 10
+command = "echo 'v1'"
+`
+
+func writeRegistryTestFile(t *testing.T, dir string, name string, contents string) string {
+	t.Helper()
+	p := filepath.Join(dir, name+".toml")
+	if err := os.WriteFile(p, []byte(contents), 0644); err != nil {
+		t.Fatalf("write %s: %v", p, err)
+	}
+	return p
+}
+
+func TestRegistry_KeepsLastGoodVersion(t *testing.T) {
+	dir := t.TempDir()
+	p := writeRegistryTestFile(t, dir, "echo_task", registryTestToml)
+
+	r := NewTaskTypeRegistry([]string{dir, filepath.Join(dir, "does-not-exist")})
+	r.Reload()
+
+	tt, err := r.Get("echo_task")
+	assert.NoError(t, err)
+	assert.Equal(t, "echo 'v1'", tt.Config.GetString("command"))
+
+	// A missing directory is reported but doesn't fail the read
+	loadErrors := r.LoadErrors()
+	assert.Len(t, loadErrors, 1)
+	assert.Equal(t, filepath.Join(dir, "does-not-exist"), loadErrors[0].ConfigFile)
+
+	// Break the file; the last good version is still served
+	writeRegistryTestFile(t, dir, "echo_task", `tags = ["bash"]`)
+	r.LoadFile(p)
+
+	tt, err = r.Get("echo_task")
+	assert.NoError(t, err)
+	assert.Equal(t, "echo 'v1'", tt.Config.GetString("command"))
+
+	listed := r.List()
+	assert.Len(t, listed, 1)
+	assert.NotEmpty(t, listed[0].LoadError)
+	assert.Len(t, r.LoadErrors(), 2)
+
+	// Fixing the file clears the error
+	writeRegistryTestFile(t, dir, "echo_task", `command = "echo 'v2'"`)
+	r.LoadFile(p)
+	tt, err = r.Get("echo_task")
+	assert.NoError(t, err)
+	assert.Equal(t, "echo 'v2'", tt.Config.GetString("command"))
+	assert.Empty(t, r.List()[0].LoadError)
+	assert.Len(t, r.LoadErrors(), 1)
+}
+
+func TestRegistry_MissIsServedFromCache(t *testing.T) {
+	dir := t.TempDir()
+	r := NewTaskTypeRegistry([]string{dir})
+	r.Reload()
+
+	_, err := r.Get("echo_task")
+	assert.IsType(t, TaskTypeNotFoundError(""), err)
+
+	// Files only show up once the watcher or a reload loads them
+	writeRegistryTestFile(t, dir, "echo_task", registryTestToml)
+	_, err = r.Get("echo_task")
+	assert.IsType(t, TaskTypeNotFoundError(""), err)
+	r.Reload()
+	_, err = r.Get("echo_task")
+	assert.NoError(t, err)
+}
+
+func TestDefaultRegistry_PollsWithoutWatcher(t *testing.T) {
+	newWatcher = func() (*fsnotify.Watcher, error) { return nil, errors.New("too many open files") }
+	registryPollInterval = 20 * time.Millisecond
+	defer func() {
+		newWatcher = fsnotify.NewWatcher
+		registryPollInterval = 10 * time.Second
+	}()
+	dir := t.TempDir()
+	viper.Set("tasks.typesPaths", []string{dir})
+	defer viper.Set("tasks.typesPaths", nil)
+
+	r := DefaultRegistry()
+	defer r.Close()
+	_, err := r.Get("echo_task")
+	assert.IsType(t, TaskTypeNotFoundError(""), err)
+
+	writeRegistryTestFile(t, dir, "echo_task", registryTestToml)
+	assert.Eventually(t, func() bool {
+		_, err := r.Get("echo_task")
+		return err == nil
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestRegistry_WatchEmitsChanges(t *testing.T) {
+	dir := t.TempDir()
+	r := NewTaskTypeRegistry([]string{dir})
+	r.Reload()
+	assert.NoError(t, r.Watch())
+	defer r.Close()
+
+	var mu sync.Mutex
+	changes := []TaskTypeChange{}
+	r.OnChange(func(change TaskTypeChange) {
+		mu.Lock()
+		changes = append(changes, change)
+		mu.Unlock()
+	})
+	waitFor := func(action string) bool {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			mu.Lock()
+			for _, c := range changes {
+				if c.Name == "echo_task" && c.Action == action {
+					mu.Unlock()
+					return true
+				}
+			}
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+		}
+		return false
+	}
+
+	p := writeRegistryTestFile(t, dir, "echo_task", registryTestToml)
+	assert.True(t, waitFor(TASK_TYPE_ADDED), "expected an 'added' change")
+	assert.Len(t, r.List(), 1)
+
+	os.Remove(p)
+	assert.True(t, waitFor(TASK_TYPE_REMOVED), "expected a 'removed' change")
+	assert.Len(t, r.List(), 0)
+}
@@ -0,0 +1,66 @@
+package tasks
+
+import (
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"strings"
+)
+
+/*
+
+Finished tasks are removed once they fall outside the retention rules.
+
+The rules come from the `tasks.retention` config section, and a task type can override them in its own
+`[retention]` section:
+
+    [retention]
+    maxAgeDays = { SUCCESS = 14, ERROR = 90 }   # by state, measured from when the task finished
+    maxTasks = 10000                             # finished tasks of this type to keep, newest first
+
+States without an age are kept until `maxTasks` pushes them out. WAITING, CLAIMED and RUNNING tasks are never removed.
+
+*/
+
+// How long finished tasks are kept
+type RetentionPolicy struct {
+	MaxAgeDays map[string]float64 `json:"maxAgeDays"` // by terminal state
+	MaxTasks   int                `json:"maxTasks"`   // per task type; 0 for no limit
+}
+
+// The rules from the `tasks.retention` config section
+func DefaultRetentionPolicy() RetentionPolicy {
+	p := RetentionPolicy{
+		MaxAgeDays: make(map[string]float64),
+		MaxTasks:   viper.GetInt("tasks.retention.maxTasksPerType"),
+	}
+	p.mergeMaxAgeDays(viper.Get("tasks.retention.maxAgeDays"))
+	return p
+}
+
+// The rules for tasks of this type: its `[retention]` section on top of the defaults
+func (t *TaskType) RetentionPolicy(defaults RetentionPolicy) RetentionPolicy {
+	p := RetentionPolicy{
+		MaxAgeDays: make(map[string]float64),
+		MaxTasks:   defaults.MaxTasks,
+	}
+	for state, days := range defaults.MaxAgeDays {
+		p.MaxAgeDays[state] = days
+	}
+	p.mergeMaxAgeDays(t.Config.Get("retention.maxAgeDays"))
+	if t.Config.IsSet("retention.maxTasks") {
+		p.MaxTasks = t.Config.GetInt("retention.maxTasks")
+	}
+	return p
+}
+
+// True if the policy never removes anything
+func (p RetentionPolicy) IsEmpty() bool {
+	return len(p.MaxAgeDays) == 0 && p.MaxTasks <= 0
+}
+
+// Config keys come back lowercased, so states are matched without case
+func (p *RetentionPolicy) mergeMaxAgeDays(value interface{}) {
+	for state, days := range cast.ToStringMap(value) {
+		p.MaxAgeDays[strings.ToUpper(state)] = cast.ToFloat64(days)
+	}
+}
@@ -0,0 +1,138 @@
+package tasks
+
+import (
+	"fmt"
+	"github.com/spf13/cast"
+	"path"
+)
+
+/*
+
+Task types can split their work into a `[[steps]]` array instead of a single `command`.
+
+- Steps run in order in the same result directory
+- Each step can set its own `executor` and `timeout`; `executor` defaults to the type's executor
+- A failing step stops the task unless it sets `continue_on_error = true`; later steps are marked SKIPPED
+- Each step writes to its own log files as well as the task's combined logs
+
+*/
+
+// States a step can be in besides the terminal task states
+var ValidTaskStepStates = []string{"WAITING", "RUNNING", "SKIPPED", "ERROR", "SUCCESS", "STOPPED", "TIMEDOUT"}
+
+// One entry in a task type's `[[steps]]` array
+type TaskTypeStep struct {
+	Name            string
+	Command         string
+	Executor        string
+	Timeout         int64 // seconds; 0 means only the task's timeout applies
+	ContinueOnError bool
+}
+
+// Status of one step of a task
+type TaskStep struct {
+	Name            string `json:"name"`
+	State           string `json:"state"` // See ValidTaskStepStates
+	StartedTs       int64  `json:"startedTs"`
+	FinishedTs      int64  `json:"finishedTs"`
+	ExitCode        int    `json:"exitCode"`
+	ContinueOnError bool   `json:"continueOnError"`
+}
+
+// The steps defined by a task type, or nil if it runs a single command
+func (t *TaskType) Steps() []TaskTypeStep {
+	var steps []TaskTypeStep
+	for i, s := range cast.ToSlice(t.Config.Get("steps")) {
+		stepConfig := cast.ToStringMap(s)
+		step := TaskTypeStep{
+			Name:            cast.ToString(stepConfig["name"]),
+			Command:         cast.ToString(stepConfig["command"]),
+			Executor:        cast.ToString(stepConfig["executor"]),
+			Timeout:         cast.ToInt64(stepConfig["timeout"]),
+			ContinueOnError: cast.ToBool(stepConfig["continue_on_error"]),
+		}
+		if step.Name == "" {
+			step.Name = fmt.Sprintf("step-%d", i+1)
+		}
+		if step.Executor == "" {
+			step.Executor = t.Config.GetString("executor")
+		}
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+// Check the `[[steps]]` array of a task type definition and return a list of problems
+func validateSteps(steps []TaskTypeStep) []string {
+	problems := []string{}
+	for i, step := range steps {
+		if step.Command == "" {
+			problems = append(problems, fmt.Sprintf("Step %d (%s) is missing required field 'command'", i+1, step.Name))
+		} else if err := parseCommandTemplate(step.Command); err != nil {
+			problems = append(problems, fmt.Sprintf("Step %d (%s) field 'command' is not a valid template :: %s", i+1, step.Name, err.Error()))
+		}
+		if step.Timeout < 0 {
+			problems = append(problems, fmt.Sprintf("Step %d (%s) field 'timeout' must be a positive number of seconds", i+1, step.Name))
+		}
+	}
+	return problems
+}
+
+// Initial status of each step for a new task
+func newTaskSteps(steps []TaskTypeStep) []TaskStep {
+	var taskSteps []TaskStep
+	for _, step := range steps {
+		taskSteps = append(taskSteps, TaskStep{
+			Name:            step.Name,
+			State:           "WAITING",
+			ContinueOnError: step.ContinueOnError,
+		})
+	}
+	return taskSteps
+}
+
+// Log file for one step; step is the index into the steps array and stream is "stdout" or "stderr"
+func StepLogPath(resultDir string, step int, stream string) string {
+	return path.Join(resultDir, fmt.Sprintf("blanket.step-%d.%s.log", step+1, stream))
+}
+
+// Record a change in the state of one step
+// Progress is updated to the fraction of steps that have finished
+func (t *Task) UpdateStep(step int, state string, exitCode int, ts int64) error {
+	if step < 0 || step >= len(t.Steps) {
+		return fmt.Errorf("Task has %d steps; step %d does not exist", len(t.Steps), step)
+	}
+	isValid := false
+	for _, s := range ValidTaskStepStates {
+		if state == s {
+			isValid = true
+			break
+		}
+	}
+	if !isValid {
+		return fmt.Errorf("Invalid step state '%s'; must be one of: %v", state, ValidTaskStepStates)
+	}
+
+	s := &t.Steps[step]
+	s.State = state
+	s.ExitCode = exitCode
+	switch state {
+	case "RUNNING":
+		s.StartedTs = ts
+	case "WAITING":
+	default:
+		s.FinishedTs = ts
+	}
+	if (state == "ERROR" || state == "TIMEDOUT") && !s.ContinueOnError && t.FailedStep == "" {
+		t.FailedStep = s.Name
+	}
+
+	finished := 0
+	for _, s := range t.Steps {
+		if s.State != "WAITING" && s.State != "RUNNING" {
+			finished++
+		}
+	}
+	t.Progress = finished * 100 / len(t.Steps)
+	return nil
+}
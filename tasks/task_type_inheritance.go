@@ -0,0 +1,269 @@
+package tasks
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"github.com/turtlemonvh/blanket/lib"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+/*
+
+Resolve task types that build on other files.
+
+- `extends = "base_python"` starts from the fully resolved `base_python` type
+- `include = ["fragments/python_env.toml"]` merges in fragment files, in order, after the parent
+- The file's own fields are merged last
+
+Merge rules, applied from the parent down to the file itself:
+
+- `tags` are combined, keeping the first occurrence of each
+- `environment.default` and `environment.required` entries are merged by name; later entries replace earlier ones
+- `files_to_include` entries are appended; relative paths keep pointing at the directory of the file that declared them
+- `abstract`, `extends` and `include` are not inherited
+- Any other field is replaced
+
+Parents are looked up next to the extending file first, then in each directory returned by TypesDirs.
+Fragments are resolved relative to the including file. Keep them out of the top level of the types
+directories (e.g. in a `fragments/` subdirectory) so they are not loaded as task types themselves.
+
+*/
+
+const (
+	EXTENDS_KEY  = "extends"
+	INCLUDE_KEY  = "include"
+	ABSTRACT_KEY = "abstract"
+)
+
+// Fields a file only sets for itself
+var nonInheritedKeys = map[string]bool{
+	"name":       true,
+	EXTENDS_KEY:  true,
+	INCLUDE_KEY:  true,
+	ABSTRACT_KEY: true,
+}
+
+// Settings merged from a chain of files, with the file each field came from
+type resolvedTaskType struct {
+	settings   map[string]interface{}
+	provenance map[string]string
+	sources    []string // every file that contributed, parents first
+}
+
+func newResolvedTaskType() *resolvedTaskType {
+	return &resolvedTaskType{
+		settings:   make(map[string]interface{}),
+		provenance: make(map[string]string),
+	}
+}
+
+// Read a TOML file into a settings map
+func readTaskTypeSettings(filepath string) (map[string]interface{}, error) {
+	contents, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+	return parseTaskTypeSettings(contents)
+}
+
+func parseTaskTypeSettings(contents []byte) (map[string]interface{}, error) {
+	config := viper.New()
+	config.SetConfigType("toml")
+	if err := config.ReadConfig(bytes.NewReader(contents)); err != nil {
+		return nil, err
+	}
+	return config.AllSettings(), nil
+}
+
+// Resolve the file at filepath, whose contents have already been parsed into settings
+// chain holds the files currently being resolved, to catch cycles
+func resolveTaskTypeSettings(filepath string, settings map[string]interface{}, chain []string) (*resolvedTaskType, error) {
+	for _, f := range chain {
+		if f == filepath {
+			return nil, fmt.Errorf("Cycle in task type inheritance: %s", strings.Join(append(chain, filepath), " -> "))
+		}
+	}
+	chain = append(chain, filepath)
+
+	resolved := newResolvedTaskType()
+	dir := path.Dir(filepath)
+
+	if parentName := cast.ToString(settings[EXTENDS_KEY]); parentName != "" {
+		parentPath, err := findParentTaskTypeFile(parentName, dir)
+		if err != nil {
+			return nil, err
+		}
+		parent, err := resolveTaskTypeFile(parentPath, chain)
+		if err != nil {
+			return nil, fmt.Errorf("Problem resolving parent '%s' of %s :: %s", parentName, filepath, err.Error())
+		}
+		resolved.merge(parent.settings, parent.provenanceOf, dir)
+		resolved.addSources(parent.sources)
+	}
+
+	for _, fragment := range cast.ToStringSlice(settings[INCLUDE_KEY]) {
+		fragmentPath := fragment
+		if !path.IsAbs(fragmentPath) {
+			fragmentPath = path.Join(dir, fragment)
+		}
+		included, err := resolveTaskTypeFile(fragmentPath, chain)
+		if err != nil {
+			return nil, fmt.Errorf("Problem resolving fragment '%s' included by %s :: %s", fragment, filepath, err.Error())
+		}
+		resolved.merge(included.settings, included.provenanceOf, dir)
+		resolved.addSources(included.sources)
+	}
+
+	own := func(string) string { return filepath }
+	resolved.merge(settings, own, dir)
+	for _, key := range []string{EXTENDS_KEY, INCLUDE_KEY, ABSTRACT_KEY} {
+		if v, ok := settings[key]; ok {
+			resolved.settings[key] = v
+			resolved.provenance[key] = filepath
+		}
+	}
+	resolved.addSources([]string{filepath})
+	return resolved, nil
+}
+
+func resolveTaskTypeFile(filepath string, chain []string) (*resolvedTaskType, error) {
+	settings, err := readTaskTypeSettings(filepath)
+	if err != nil {
+		return nil, err
+	}
+	return resolveTaskTypeSettings(filepath, settings, chain)
+}
+
+func findParentTaskTypeFile(name string, fromDir string) (string, error) {
+	if !ValidTaskTypeName(name) {
+		return "", fmt.Errorf("Invalid task type name '%s' in '%s'", name, EXTENDS_KEY)
+	}
+	for _, dir := range append([]string{fromDir}, TypesDirs()...) {
+		candidate := path.Join(dir, name+".toml")
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("Could not find task type '%s' to extend", name)
+}
+
+func (r *resolvedTaskType) provenanceOf(key string) string {
+	return r.provenance[key]
+}
+
+func (r *resolvedTaskType) addSources(sources []string) {
+	for _, s := range sources {
+		found := false
+		for _, existing := range r.sources {
+			if existing == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			r.sources = append(r.sources, s)
+		}
+	}
+}
+
+// Merge settings from a later layer over the current ones
+// from looks up the file a field of the layer came from; targetDir is the directory of the file being resolved
+func (r *resolvedTaskType) merge(settings map[string]interface{}, from func(string) string, targetDir string) {
+	for key, value := range settings {
+		if nonInheritedKeys[key] {
+			continue
+		}
+		switch key {
+		case "tags":
+			tags := cast.ToStringSlice(r.settings["tags"])
+			for _, tag := range cast.ToStringSlice(value) {
+				if _, ok := r.provenance["tags."+tag]; ok {
+					continue
+				}
+				tags = append(tags, tag)
+				r.provenance["tags."+tag] = from("tags." + tag)
+			}
+			r.settings["tags"] = tags
+		case "environment":
+			r.mergeEnvironment(cast.ToStringMap(value), from)
+		case "files_to_include":
+			r.mergeFilesToInclude(value, from, targetDir)
+		default:
+			r.settings[key] = value
+			r.provenance[key] = from(key)
+		}
+	}
+}
+
+func (r *resolvedTaskType) mergeEnvironment(env map[string]interface{}, from func(string) string) {
+	merged := cast.ToStringMap(r.settings["environment"])
+	for section, entries := range env {
+		if section != "default" && section != "required" {
+			merged[section] = entries
+			r.provenance["environment."+section] = from("environment." + section)
+			continue
+		}
+		existing := cast.ToSlice(merged[section])
+		for _, entry := range cast.ToSlice(entries) {
+			name := cast.ToString(cast.ToStringMap(entry)["name"])
+			key := fmt.Sprintf("environment.%s.%s", section, name)
+			replaced := false
+			for i, e := range existing {
+				if cast.ToString(cast.ToStringMap(e)["name"]) == name {
+					existing[i] = entry
+					replaced = true
+					break
+				}
+			}
+			if !replaced {
+				existing = append(existing, entry)
+			}
+			r.provenance[key] = from(key)
+		}
+		merged[section] = existing
+	}
+	r.settings["environment"] = merged
+}
+
+func (r *resolvedTaskType) mergeFilesToInclude(value interface{}, from func(string) string, targetDir string) {
+	existing := cast.ToSlice(r.settings["files_to_include"])
+	for _, fileSpec := range lib.ToSliceStringSlice(value) {
+		if len(fileSpec) < 1 {
+			continue
+		}
+		declaredIn := from("files_to_include." + fileSpec[0])
+		src := fileSpec[0]
+		// Keep relative paths pointing at the directory of the file that declared them
+		if declaredIn != "" && path.Dir(declaredIn) != targetDir && !filepath.IsAbs(src) && !strings.HasPrefix(src, "~") {
+			src = path.Join(path.Dir(declaredIn), src)
+		}
+		spec := []interface{}{src}
+		for _, part := range fileSpec[1:] {
+			spec = append(spec, part)
+		}
+		existing = append(existing, spec)
+		r.provenance["files_to_include."+src] = declaredIn
+	}
+	r.settings["files_to_include"] = existing
+}
+
+// Hash identifying the resolved version of a task type
+// Matches the file checksum when the type is a single file, so revisions still line up with typeDigest
+func resolvedVersionHash(sources []string) string {
+	if len(sources) == 1 {
+		cs, _ := lib.Checksum(sources[0])
+		return cs
+	}
+	var checksums []string
+	for _, s := range sources {
+		cs, _ := lib.Checksum(s)
+		checksums = append(checksums, s+":"+cs)
+	}
+	return fmt.Sprintf("%x", md5.Sum([]byte(strings.Join(checksums, "\n"))))
+}
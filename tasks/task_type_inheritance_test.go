@@ -0,0 +1,140 @@
+package tasks
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+	"github.com/turtlemonvh/blanket/lib"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const baseTypeToml = `
+abstract = true
+tags = ["python"]
+timeout = 120
+files_to_include = [["common.py"]]
+
+    [[environment.default]]
+    name = "PYTHON"
+    value = "python3"
+
+    [[environment.default]]
+    name = "LEVEL"
+    value = "info"
+`
+
+const fragmentToml = `
+tags = ["gpu", "python"]
+files_to_include = [["requirements.txt"]]
+
+    [[environment.default]]
+    name = "CUDA"
+    value = "1"
+`
+
+const childTypeToml = `
+extends = "base_python"
+include = ["fragments/gpu.toml"]
+tags = ["train"]
+command = "$PYTHON train.py"
+
+    [[environment.default]]
+    name = "LEVEL"
+    value = "debug"
+`
+
+func writeInheritanceTestFiles(t *testing.T, dir string) {
+	t.Helper()
+	writeRegistryTestFile(t, dir, "base_python", baseTypeToml)
+	writeRegistryTestFile(t, dir, "train", childTypeToml)
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "fragments"), os.ModePerm))
+	writeRegistryTestFile(t, filepath.Join(dir, "fragments"), "gpu", fragmentToml)
+}
+
+func TestReadTaskTypeFromFilepath_ResolvesInheritance(t *testing.T) {
+	dir := setupWritableTypesDir(t)
+	writeInheritanceTestFiles(t, dir)
+
+	tt, err := ReadTaskTypeFromFilepath(filepath.Join(dir, "train.toml"))
+	assert.NoError(t, err)
+	assert.False(t, tt.IsAbstract())
+	assert.Equal(t, 120, tt.Config.GetInt("timeout"))
+	assert.Equal(t, []string{"python", "gpu", "train"}, tt.Config.GetStringSlice("tags"))
+	assert.Equal(t, map[string]string{"PYTHON": "python3", "LEVEL": "debug", "CUDA": "1"}, tt.DefaultEnv())
+
+	// Inherited relative paths keep pointing at the directory of the file that declared them
+	assert.Equal(t, [][]string{
+		{"common.py"},
+		{filepath.Join(dir, "fragments", "requirements.txt")},
+	}, lib.ToSliceStringSlice(tt.Config.Get("files_to_include")))
+
+	assert.Equal(t, filepath.Join(dir, "base_python.toml"), tt.Provenance["timeout"])
+	assert.Equal(t, filepath.Join(dir, "fragments", "gpu.toml"), tt.Provenance["tags.gpu"])
+	assert.Equal(t, filepath.Join(dir, "train.toml"), tt.Provenance["environment.default.LEVEL"])
+	assert.Equal(t, filepath.Join(dir, "train.toml"), tt.Provenance["command"])
+
+	// The base type loads but can't be used for tasks
+	base, err := ReadTaskTypeFromFilepath(filepath.Join(dir, "base_python.toml"))
+	assert.NoError(t, err)
+	assert.True(t, base.IsAbstract())
+	_, err = base.NewTask(nil)
+	assert.Error(t, err)
+
+	// Provenance survives the snapshot taken at submission
+	snapshot, err := tt.Snapshot()
+	assert.NoError(t, err)
+	assert.Equal(t, tt.Provenance, snapshot.Provenance)
+	assert.Equal(t, tt.Config.GetStringSlice("tags"), snapshot.Config.GetStringSlice("tags"))
+}
+
+func TestReadTaskTypeFromFilepath_InheritanceErrors(t *testing.T) {
+	dir := setupWritableTypesDir(t)
+
+	writeRegistryTestFile(t, dir, "orphan", `extends = "missing"`+"\ncommand = \"echo\"")
+	_, err := ReadTaskTypeFromFilepath(filepath.Join(dir, "orphan.toml"))
+	assert.ErrorContains(t, err, "missing")
+
+	writeRegistryTestFile(t, dir, "first", `extends = "second"`+"\ncommand = \"echo\"")
+	writeRegistryTestFile(t, dir, "second", `extends = "first"`+"\ncommand = \"echo\"")
+	_, err = ReadTaskTypeFromFilepath(filepath.Join(dir, "first.toml"))
+	assert.ErrorContains(t, err, "Cycle")
+}
+
+func TestRegistry_ReloadsDependents(t *testing.T) {
+	dir := setupWritableTypesDir(t)
+	writeInheritanceTestFiles(t, dir)
+
+	r := NewTaskTypeRegistry([]string{dir})
+	r.Reload()
+	tt, err := r.Get("train")
+	assert.NoError(t, err)
+	originalHash := tt.ConfigVersionHash
+
+	// Editing the parent or a fragment reloads the child
+	writeRegistryTestFile(t, dir, "base_python", "executor = \"python3\"\n"+baseTypeToml)
+	r.LoadFile(filepath.Join(dir, "base_python.toml"))
+	tt, err = r.Get("train")
+	assert.NoError(t, err)
+	assert.Equal(t, "python3", tt.Config.GetString("executor"))
+	assert.NotEqual(t, originalHash, tt.ConfigVersionHash)
+
+	writeRegistryTestFile(t, filepath.Join(dir, "fragments"), "gpu", `tags = ["tpu"]`)
+	r.handleEvent(fsnotify.Event{Name: filepath.Join(dir, "fragments", "gpu.toml"), Op: fsnotify.Write})
+	tt, err = r.Get("train")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"python", "tpu", "train"}, tt.Config.GetStringSlice("tags"))
+
+	// Removing the parent breaks the child; the last good version is kept
+	assert.NoError(t, os.Remove(filepath.Join(dir, "base_python.toml")))
+	r.RemoveFile(filepath.Join(dir, "base_python.toml"))
+	tt, err = r.Get("train")
+	assert.NoError(t, err)
+	assert.Equal(t, "python3", tt.Config.GetString("executor"))
+	assert.Len(t, r.LoadErrors(), 1)
+
+	// Restoring it clears the error
+	writeRegistryTestFile(t, dir, "base_python", baseTypeToml)
+	r.LoadFile(filepath.Join(dir, "base_python.toml"))
+	assert.Len(t, r.LoadErrors(), 0)
+}
@@ -0,0 +1,374 @@
+package tasks
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"github.com/turtlemonvh/blanket/lib"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+
+Manage task type files written through the API.
+
+- Files are written to `tasks.writableTypesPath`, or the first entry of `tasks.typesPaths` if that is not set
+- Every version written is also kept under `.revisions/<name>/` so earlier versions can be inspected
+- Supporting files are stored in `<name>.files/` next to the TOML file, so they can be referenced
+  from `files_to_include` with a path like `<name>.files/script.py`
+
+*/
+
+const (
+	REVISIONS_DIR_NAME   = ".revisions"
+	BUNDLED_FILES_SUFFIX = ".files"
+	TEMP_UPLOAD_PATTERN  = ".upload-*"
+)
+
+var validTaskTypeName = regexp.MustCompile(`^\w+$`)
+
+// Returned when a task type is not stored in the writable directory
+type TaskTypeNotWritableError string
+
+func (e TaskTypeNotWritableError) Error() string {
+	return fmt.Sprintf("Task type '%s' is not stored in the writable types directory and cannot be changed through the API", string(e))
+}
+
+// Returned when creating a task type whose name is already taken
+type TaskTypeExistsError string
+
+func (e TaskTypeExistsError) Error() string {
+	return fmt.Sprintf("Task type '%s' already exists", string(e))
+}
+
+// Returned when a task type definition fails validation
+type TaskTypeValidationError []string
+
+func (e TaskTypeValidationError) Error() string {
+	return fmt.Sprintf("Invalid task type definition: %s", strings.Join(e, "; "))
+}
+
+// One stored version of a task type file
+type TaskTypeRevision struct {
+	Name        string `json:"name"`
+	VersionHash string `json:"versionHash"`
+	SavedTs     int64  `json:"savedTs"`
+	File        string `json:"file"`
+	Deleted     bool   `json:"deleted"`
+}
+
+// Directory task types created through the API are written to
+func WritableTypesDir() string {
+	if dir := viper.GetString("tasks.writableTypesPath"); dir != "" {
+		return dir
+	}
+	typesDirs := viper.GetStringSlice("tasks.typesPaths")
+	if len(typesDirs) == 0 {
+		return ""
+	}
+	return typesDirs[0]
+}
+
+func ValidTaskTypeName(name string) bool {
+	return validTaskTypeName.MatchString(name)
+}
+
+// Check a TOML task type definition and return a list of problems
+// bundledFiles are the names of supporting files that will be stored alongside the definition
+func ValidateTaskType(name string, contents []byte, bundledFiles []string) []string {
+	problems := []string{}
+	if !ValidTaskTypeName(name) {
+		problems = append(problems, fmt.Sprintf("Name '%s' must only contain letters, numbers and underscores", name))
+	}
+
+	settings, err := parseTaskTypeSettings(contents)
+	if err != nil {
+		return append(problems, fmt.Sprintf("Could not parse TOML :: %s", err.Error()))
+	}
+
+	// Check the definition as it will be resolved once written
+	resolved, err := resolveTaskTypeSettings(taskTypeFilepath(name), settings, nil)
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	config := viper.New()
+	if err := config.MergeConfigMap(resolved.settings); err != nil {
+		return append(problems, err.Error())
+	}
+
+	tt := &TaskType{Config: config}
+	steps := tt.Steps()
+	command := config.GetString("command")
+	if command == "" {
+		if !config.GetBool(ABSTRACT_KEY) && len(steps) == 0 {
+			problems = append(problems, "Missing required field 'command'")
+		}
+	} else if err := parseCommandTemplate(command); err != nil {
+		problems = append(problems, fmt.Sprintf("Field 'command' is not a valid template :: %s", err.Error()))
+	}
+	problems = append(problems, validateSteps(steps)...)
+	problems = append(problems, validateHooks(tt.Hooks())...)
+
+	if config.IsSet("timeout") {
+		if timeout, err := cast.ToIntE(config.Get("timeout")); err != nil || timeout <= 0 {
+			problems = append(problems, "Field 'timeout' must be a positive number of seconds")
+		}
+	}
+
+	// Relative paths are resolved against the directory the file will be written to
+	// Bundled files are written under exactly these names, so they can't point outside their directory
+	bundled := make(map[string]bool)
+	for _, f := range bundledFiles {
+		if !ValidPlainFileName(f) {
+			problems = append(problems, fmt.Sprintf("Bundled file name '%s' must not be empty or contain path separators or '..'", f))
+			continue
+		}
+		bundled[name+BUNDLED_FILES_SUFFIX+"/"+f] = true
+	}
+	fileCopier := lib.FileCopier{BasePath: WritableTypesDir()}
+	for i, fileSpec := range lib.ToSliceStringSlice(config.Get("files_to_include")) {
+		if len(fileSpec) < 1 || fileSpec[0] == "" {
+			problems = append(problems, fmt.Sprintf("Item %d in 'files_to_include' must have at least 1 component", i))
+			continue
+		}
+		if bundled[path.Clean(fileSpec[0])] {
+			continue
+		}
+		matches, err := fileCopier.GetMatchingFiles(fileSpec[0])
+		if err != nil || len(matches) == 0 {
+			problems = append(problems, fmt.Sprintf("No files match '%s' in 'files_to_include'", fileSpec[0]))
+		}
+	}
+	return problems
+}
+
+// Whether f names a file directly inside a directory: not empty, "." or "..", and without path separators
+// For names that come from clients, like bundled and uploaded files
+func ValidPlainFileName(f string) bool {
+	return f != "" && f != "." && !strings.ContainsAny(f, `/\`) && !strings.Contains(f, "..")
+}
+
+func taskTypeFilepath(name string) string {
+	return path.Join(WritableTypesDir(), name+".toml")
+}
+
+func revisionsDir(name string) string {
+	return path.Join(WritableTypesDir(), REVISIONS_DIR_NAME, name)
+}
+
+// Path of the bundled files directory for a task type
+func BundledFilesDir(name string) string {
+	return path.Join(WritableTypesDir(), name+BUNDLED_FILES_SUFFIX)
+}
+
+// Whether a task type is stored in the writable directory
+func TaskTypeIsWritable(name string) bool {
+	_, err := os.Stat(taskTypeFilepath(name))
+	return err == nil
+}
+
+// Write a task type definition and any supporting files
+// If create is true the type must not already exist; otherwise it must exist in the writable directory
+func SaveTaskTypeFile(name string, contents []byte, files map[string]io.Reader, create bool) (*TaskType, error) {
+	if WritableTypesDir() == "" {
+		return nil, fmt.Errorf("No writable task types directory is configured")
+	}
+
+	bundledNames := make([]string, 0, len(files))
+	for f := range files {
+		bundledNames = append(bundledNames, f)
+	}
+	if problems := ValidateTaskType(name, contents, bundledNames); len(problems) > 0 {
+		return nil, TaskTypeValidationError(problems)
+	}
+
+	_, fetchErr := FetchTaskType(name)
+	if create && fetchErr == nil {
+		return nil, TaskTypeExistsError(name)
+	}
+	if !create && !TaskTypeIsWritable(name) {
+		if fetchErr == nil {
+			return nil, TaskTypeNotWritableError(name)
+		}
+		return nil, TaskTypeNotFoundError(name)
+	}
+
+	if err := os.MkdirAll(WritableTypesDir(), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	// Keep the version that was on disk before the first API edit
+	if !create {
+		if revisions, err := ListTaskTypeRevisions(name); err == nil && len(revisions) == 0 {
+			if existing, err := os.ReadFile(taskTypeFilepath(name)); err == nil {
+				if err := saveRevision(name, existing); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if create {
+		// The check above can race with another create, so the name is only ours once this succeeds
+		// That comes before the supporting files, so a losing create can't overwrite the winner's
+		err := createFileExclusive(taskTypeFilepath(name), bytes.NewReader(contents))
+		if os.IsExist(err) {
+			return nil, TaskTypeExistsError(name)
+		} else if err != nil {
+			return nil, err
+		}
+		if err := writeBundledFiles(name, files); err != nil {
+			os.Remove(taskTypeFilepath(name))
+			return nil, err
+		}
+	} else {
+		// Supporting files first, so the type never references files that aren't there yet
+		if err := writeBundledFiles(name, files); err != nil {
+			return nil, err
+		}
+		if err := writeFileAtomic(taskTypeFilepath(name), bytes.NewReader(contents)); err != nil {
+			return nil, err
+		}
+	}
+	if err := saveRevision(name, contents); err != nil {
+		return nil, err
+	}
+
+	DefaultRegistry().LoadFile(taskTypeFilepath(name))
+	return FetchTaskType(name)
+}
+
+// Names have been checked by ValidateTaskType, so each file lands directly in the bundled files directory
+func writeBundledFiles(name string, files map[string]io.Reader) error {
+	if len(files) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(BundledFilesDir(name), os.ModePerm); err != nil {
+		return err
+	}
+	for filename, r := range files {
+		if err := writeFileAtomic(path.Join(BundledFilesDir(name), filename), r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove a task type and its supporting files
+// Earlier revisions are kept
+func DeleteTaskTypeFile(name string) error {
+	if !TaskTypeIsWritable(name) {
+		if _, err := FetchTaskType(name); err == nil {
+			return TaskTypeNotWritableError(name)
+		}
+		return TaskTypeNotFoundError(name)
+	}
+
+	// Record the deletion so the revision history shows it
+	if err := os.MkdirAll(revisionsDir(name), os.ModePerm); err != nil {
+		return err
+	}
+	marker := path.Join(revisionsDir(name), fmt.Sprintf("%d.deleted", time.Now().UnixNano()))
+	if err := os.WriteFile(marker, []byte{}, 0644); err != nil {
+		return err
+	}
+
+	if err := os.Remove(taskTypeFilepath(name)); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(BundledFilesDir(name)); err != nil {
+		return err
+	}
+	DefaultRegistry().RemoveFile(taskTypeFilepath(name))
+	return nil
+}
+
+// List every version of a task type written through the API, oldest first
+func ListTaskTypeRevisions(name string) ([]TaskTypeRevision, error) {
+	revisions := []TaskTypeRevision{}
+	dirEntries, err := os.ReadDir(revisionsDir(name))
+	if os.IsNotExist(err) {
+		return revisions, nil
+	} else if err != nil {
+		return revisions, err
+	}
+
+	for _, dirEntry := range dirEntries {
+		filename := dirEntry.Name()
+		ext := path.Ext(filename)
+		savedNs, err := cast.ToInt64E(strings.TrimSuffix(filename, ext))
+		if err != nil {
+			continue
+		}
+		revision := TaskTypeRevision{
+			Name:    name,
+			SavedTs: savedNs / int64(time.Second),
+			File:    path.Join(revisionsDir(name), filename),
+			Deleted: ext == ".deleted",
+		}
+		if !revision.Deleted {
+			// Same hash as TaskType.ConfigVersionHash, so a task's typeDigest can be matched to a revision
+			revision.VersionHash, _ = lib.Checksum(revision.File)
+		}
+		revisions = append(revisions, revision)
+	}
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].File < revisions[j].File
+	})
+	return revisions, nil
+}
+
+func saveRevision(name string, contents []byte) error {
+	if err := os.MkdirAll(revisionsDir(name), os.ModePerm); err != nil {
+		return err
+	}
+	revisionPath := path.Join(revisionsDir(name), fmt.Sprintf("%d.toml", time.Now().UnixNano()))
+	return os.WriteFile(revisionPath, contents, 0644)
+}
+
+// Write to a temporary file then rename, so readers never see a partial file
+func writeFileAtomic(filepath string, r io.Reader) error {
+	// The temporary name must not look like a TOML file or the registry would try to load it
+	f, err := os.CreateTemp(path.Dir(filepath), TEMP_UPLOAD_PATTERN)
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, filepath)
+}
+
+// Like writeFileAtomic, but fails with an error satisfying os.IsExist if filepath is already there
+// A hard link, unlike a rename, never replaces its target, so this is as exclusive as an O_EXCL create
+// while readers still only ever see the whole file
+func createFileExclusive(filepath string, r io.Reader) error {
+	f, err := os.CreateTemp(path.Dir(filepath), TEMP_UPLOAD_PATTERN)
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	defer os.Remove(tmpPath)
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Link(tmpPath, filepath)
+}
@@ -0,0 +1,147 @@
+package tasks
+
+import (
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func setupWritableTypesDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	viper.Set("tasks.typesPaths", []string{dir})
+	t.Cleanup(func() {
+		viper.Set("tasks.typesPaths", nil)
+	})
+	return dir
+}
+
+func TestValidateTaskType(t *testing.T) {
+	setupWritableTypesDir(t)
+
+	assert.Empty(t, ValidateTaskType("echo_task", []byte(registryTestToml), nil))
+
+	problems := ValidateTaskType("bad name", []byte(`
+timeout = -1
+command = "echo {{.X"
+files_to_include = [["missing.py"]]
+`), nil)
+	assert.Len(t, problems, 4)
+	assert.Contains(t, problems[0], "Name")
+	assert.Contains(t, problems[1], "template")
+	assert.Contains(t, problems[2], "timeout")
+	assert.Contains(t, problems[3], "missing.py")
+
+	// Bundled files are resolved relative to `<name>.files/`
+	problems = ValidateTaskType("echo_task", []byte(`
+command = "bash run.sh"
+files_to_include = [["echo_task.files/run.sh"]]
+`), []string{"run.sh"})
+	assert.Empty(t, problems)
+
+	// Hooks need a command or a follow-up, and only outcome hooks can submit one
+	problems = ValidateTaskType("echo_task", []byte(`
+command = "echo hi"
+before = "echo {{.X"
+
+    [after.submit]
+    type = "cleanup"
+
+    [on_failure]
+    timeout = 5
+`), nil)
+	if assert.Len(t, problems, 3) {
+		assert.Contains(t, problems[0], "'before' field 'command' is not a valid template")
+		assert.Contains(t, problems[1], "'on_failure' must set 'command' or 'submit'")
+		assert.Contains(t, problems[2], "'after' can't submit")
+	}
+
+	problems = ValidateTaskType("echo_task", []byte(`command = [`), nil)
+	if assert.Len(t, problems, 1) {
+		assert.Contains(t, problems[0], "TOML")
+	}
+}
+
+func TestSaveTaskTypeFile_Lifecycle(t *testing.T) {
+	dir := setupWritableTypesDir(t)
+
+	// Types that were placed on disk by hand can still be edited
+	writeRegistryTestFile(t, dir, "echo_task", registryTestToml)
+
+	_, err := SaveTaskTypeFile("echo_task", []byte(registryTestToml), nil, true)
+	assert.IsType(t, TaskTypeExistsError(""), err)
+
+	_, err = SaveTaskTypeFile("other_task", []byte(registryTestToml), nil, false)
+	assert.IsType(t, TaskTypeNotFoundError(""), err)
+
+	_, err = SaveTaskTypeFile("echo_task", []byte(`tags = ["bash"]`), nil, false)
+	assert.IsType(t, TaskTypeValidationError{}, err)
+
+	// Update with a bundled file
+	tt, err := SaveTaskTypeFile("echo_task", []byte(`
+command = "bash run.sh"
+files_to_include = [["echo_task.files/run.sh", "run.sh"]]
+`), map[string]io.Reader{"run.sh": strings.NewReader("echo v2")}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "bash run.sh", tt.Config.GetString("command"))
+	bundled, err := os.ReadFile(filepath.Join(dir, "echo_task.files", "run.sh"))
+	assert.NoError(t, err)
+	assert.Equal(t, "echo v2", string(bundled))
+
+	// The hand-written version was kept before the first edit
+	revisions, err := ListTaskTypeRevisions("echo_task")
+	assert.NoError(t, err)
+	if assert.Len(t, revisions, 2) {
+		assert.Equal(t, tt.ConfigVersionHash, revisions[1].VersionHash)
+		assert.NotEqual(t, revisions[0].VersionHash, revisions[1].VersionHash)
+	}
+
+	assert.NoError(t, DeleteTaskTypeFile("echo_task"))
+	_, err = FetchTaskType("echo_task")
+	assert.Error(t, err)
+	_, err = os.Stat(filepath.Join(dir, "echo_task.files"))
+	assert.True(t, os.IsNotExist(err))
+
+	revisions, err = ListTaskTypeRevisions("echo_task")
+	assert.NoError(t, err)
+	if assert.Len(t, revisions, 3) {
+		assert.True(t, revisions[2].Deleted)
+	}
+
+	assert.IsType(t, TaskTypeNotFoundError(""), DeleteTaskTypeFile("echo_task"))
+}
+
+func TestSaveTaskTypeFile_BundledFileNames(t *testing.T) {
+	dir := setupWritableTypesDir(t)
+
+	for _, name := range []string{"../run.sh", "sub/run.sh", `sub\run.sh`, "..", ""} {
+		_, err := SaveTaskTypeFile("echo_task", []byte(registryTestToml), map[string]io.Reader{name: strings.NewReader("echo")}, true)
+		if assert.IsType(t, TaskTypeValidationError{}, err, name) {
+			assert.Contains(t, err.Error(), "Bundled file name", name)
+		}
+	}
+	_, err := os.Stat(filepath.Join(dir, "run.sh"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "echo_task.toml"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCreateFileExclusive(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "echo_task.toml")
+
+	assert.NoError(t, createFileExclusive(target, strings.NewReader("first")))
+	err := createFileExclusive(target, strings.NewReader("second"))
+	assert.True(t, os.IsExist(err))
+
+	contents, err := os.ReadFile(target)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(contents))
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
@@ -1,6 +1,9 @@
 package tasks
 
 import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	log "github.com/sirupsen/logrus"
@@ -9,10 +12,10 @@ import (
 	"github.com/turtlemonvh/blanket/lib"
 	"github.com/turtlemonvh/blanket/lib/objectid"
 	"io"
-	"io/ioutil"
 	"os"
 	"path"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 )
@@ -25,67 +28,27 @@ var validConfigfileName = regexp.MustCompile(`(\w*).toml`)
 
 // Task types are just a load of configuration loaded with viper with a few extra methods
 type TaskType struct {
-	ConfigFile        string // path to TOML config file on disk
-	LoadedTs          int64  // time loaded from disk
-	ConfigVersionHash string // md5 hash of the config file
+	ConfigFile        string            // path to TOML config file on disk
+	LoadedTs          int64             // time loaded from disk
+	ConfigVersionHash string            // md5 hash of the config file and any files it extends or includes
+	LoadError         string            // set when the latest edit of the file failed to load and this is the last good version
+	Provenance        map[string]string // file each field was resolved from, see task_type_inheritance.go
 	Config            *viper.Viper
+	sources           []string // files this type was resolved from, parents first
 }
 
+// Find a loaded task type by name
 func FetchTaskType(typeName string) (*TaskType, error) {
-	var foundType TaskType
-
-	tts, err := ReadTypes()
-	if err != nil {
-		return &foundType, err
-	}
-
-	for _, tt := range tts {
-		if tt.GetName() == typeName {
-			return &tt, nil
-		}
-	}
-
-	return &foundType, fmt.Errorf("No task of type '%s' could be located", typeName)
+	return DefaultRegistry().Get(typeName)
 }
 
-// Read types from config directory
+// List the task types loaded from the config directories
+// Problems with individual files are reported by DefaultRegistry().LoadErrors()
 func ReadTypes() ([]TaskType, error) {
-	typesDirs := viper.GetStringSlice("tasks.typesPaths")
-
-	// Grab entries out of directories
-	var taskTypes []TaskType
-	for _, typesDir := range typesDirs {
-		dirEntries, err := ioutil.ReadDir(typesDir)
-		if err != nil {
-			// FIXME: Handle this more elegantly
-			log.WithFields(log.Fields{
-				"error":    err.Error(),
-				"filepath": typesDir,
-			}).Error("Problem reading task types directory location")
-			return taskTypes, err
-		}
-
-		for _, dirEntry := range dirEntries {
-			filepath := path.Join(typesDir, dirEntry.Name())
-			if !validConfigfileName.MatchString(filepath) {
-				continue
-			}
-
-			tt, err := ReadTaskTypeFromFilepath(filepath)
-			if err != nil {
-				log.WithFields(log.Fields{
-					"error":    err.Error(),
-					"filepath": filepath,
-				}).Error("Problem loading toml file")
-				continue
-			}
-			taskTypes = append(taskTypes, tt)
-		}
-	}
-
-	return taskTypes, nil
+	return DefaultRegistry().List(), nil
 }
 
+// Read a task type file, resolving any parent it extends and fragments it includes
 func ReadTaskTypeFromFilepath(filepath string) (TaskType, error) {
 	// Check that the file exists and is a TOML file
 	fi, err := os.Stat(filepath)
@@ -97,25 +60,43 @@ func ReadTaskTypeFromFilepath(filepath string) (TaskType, error) {
 		return TaskType{}, fmt.Errorf("Path points to a directory")
 	}
 
-	configFile, err := os.Open(filepath)
+	resolved, err := resolveTaskTypeFile(filepath, nil)
 	if err != nil {
-		// FIXME: Handle this more elegantly
 		return TaskType{}, err
 	}
-	defer configFile.Close()
 
-	tt, err := ReadTaskType(configFile)
+	tt, err := newTaskTypeFromSettings(resolved.settings)
 	if err != nil {
-		// FIXME: Handle this more elegantly
 		return TaskType{}, err
 	}
 	tt.ConfigFile = filepath
 	tt.Config.Set("name", strings.Split(path.Base(filepath), ".toml")[0])
+	tt.Provenance = resolved.provenance
+	tt.Provenance["name"] = filepath
+	tt.sources = resolved.sources
+	tt.ConfigVersionHash = resolvedVersionHash(resolved.sources)
+	return tt, nil
+}
 
-	// Ignore errors in finding checksum for now
-	cs, err := lib.Checksum(filepath)
-	if err == nil {
-		tt.ConfigVersionHash = cs
+// Build a task type from already merged settings
+func newTaskTypeFromSettings(settings map[string]interface{}) (TaskType, error) {
+	tt := TaskType{}
+	tt.Config = viper.New()
+	tt.Config.SetDefault("timeout", DEFAULT_TIMEOUT)
+	if err := tt.Config.MergeConfigMap(settings); err != nil {
+		return tt, err
+	}
+	tt.LoadedTs = time.Now().Unix()
+
+	// Abstract types only exist to be extended, so they don't need a command
+	if tt.Config.GetString("command") == "" && len(tt.Steps()) == 0 && !tt.IsAbstract() {
+		return tt, fmt.Errorf("TaskType config file is missing required field 'command'.")
+	}
+	if problems := validateSteps(tt.Steps()); len(problems) > 0 {
+		return tt, fmt.Errorf("TaskType config file has invalid steps :: %s", strings.Join(problems, "; "))
+	}
+	if problems := validateHooks(tt.Hooks()); len(problems) > 0 {
+		return tt, fmt.Errorf("TaskType config file has invalid hooks :: %s", strings.Join(problems, "; "))
 	}
 	return tt, nil
 }
@@ -134,7 +115,7 @@ func ReadTaskType(configFile io.Reader) (TaskType, error) {
 	tt.LoadedTs = time.Now().Unix()
 
 	// Check that required fields are set
-	if tt.Config.GetString("command") == "" {
+	if tt.Config.GetString("command") == "" && len(tt.Steps()) == 0 {
 		return tt, fmt.Errorf("TaskType config file is missing required field 'command'.")
 	}
 
@@ -149,15 +130,97 @@ func (t *TaskType) GetName() string {
 	return t.Config.GetString("name")
 }
 
+// Abstract types can be extended but tasks can't be created from them
+func (t *TaskType) IsAbstract() bool {
+	return t.Config.GetBool(ABSTRACT_KEY)
+}
+
 // Implement Marshaler
 func (t *TaskType) MarshalJSON() ([]byte, error) {
 	ttSettings := t.Config.AllSettings()
 	ttSettings["loadedTs"] = t.LoadedTs
 	ttSettings["configFile"] = t.ConfigFile
 	ttSettings["versionHash"] = t.ConfigVersionHash
+	if t.LoadError != "" {
+		ttSettings["loadError"] = t.LoadError
+	}
+	if len(t.Provenance) > 0 {
+		ttSettings["provenance"] = t.Provenance
+	}
 	return json.Marshal(ttSettings)
 }
 
+// Implement Unmarshaler
+// Reverses MarshalJSON so a task type stored alongside a task can be used to run it
+func (t *TaskType) UnmarshalJSON(bts []byte) error {
+	ttSettings := make(map[string]interface{})
+	if err := json.Unmarshal(bts, &ttSettings); err != nil {
+		return err
+	}
+	t.LoadedTs = cast.ToInt64(ttSettings["loadedTs"])
+	t.ConfigFile = cast.ToString(ttSettings["configFile"])
+	t.ConfigVersionHash = cast.ToString(ttSettings["versionHash"])
+	if provenance, ok := ttSettings["provenance"]; ok {
+		t.Provenance = cast.ToStringMapString(provenance)
+	}
+	delete(ttSettings, "loadedTs")
+	delete(ttSettings, "configFile")
+	delete(ttSettings, "versionHash")
+	delete(ttSettings, "loadError")
+	delete(ttSettings, "provenance")
+
+	settingsBts, err := json.Marshal(ttSettings)
+	if err != nil {
+		return err
+	}
+	t.Config = viper.New()
+	t.Config.SetConfigType("json")
+	return t.Config.ReadConfig(bytes.NewReader(settingsBts))
+}
+
+// Snapshot returns a copy of the task type that shares no state with the original
+// Later edits to the TOML file on disk do not affect the copy
+// Files in `files_to_include` are not part of it; they are still read from disk when the task runs,
+// which is why tasks also record IncludedFilesDigest
+func (t *TaskType) Snapshot() (*TaskType, error) {
+	bts, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &TaskType{}
+	err = json.Unmarshal(bts, snapshot)
+	return snapshot, err
+}
+
+// Hash of the name and contents of every file `files_to_include` matches right now
+// Empty if the type includes no files
+func (t *TaskType) IncludedFilesDigest() (string, error) {
+	fileSpecs := lib.ToSliceStringSlice(t.Config.Get("files_to_include"))
+	if len(fileSpecs) == 0 {
+		return "", nil
+	}
+	fileCopier := lib.FileCopier{BasePath: path.Dir(t.ConfigFile)}
+	hash := md5.New()
+	for _, fileSpec := range fileSpecs {
+		if len(fileSpec) < 1 {
+			continue
+		}
+		matches, err := fileCopier.GetMatchingFiles(fileSpec[0])
+		if err != nil {
+			return "", err
+		}
+		sort.Strings(matches)
+		for _, match := range matches {
+			checksum, err := lib.Checksum(match)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(hash, "%s\t%s\n", match, checksum)
+		}
+	}
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
 // Return a map of default values, {name => value}
 func (t *TaskType) DefaultEnv() map[string]string {
 	defaultEnv := cast.ToSlice(t.Config.Get("environment.default"))
@@ -194,6 +257,21 @@ func (t *TaskType) NewTask(childEnv map[string]string) (Task, error) {
 	taskType := t.Config.GetString("name")
 	taskId := objectid.NewObjectId()
 
+	if t.IsAbstract() {
+		return Task{}, fmt.Errorf("Task type '%s' is abstract and can only be extended", taskType)
+	}
+
+	// Freeze the type definition so the task runs what the submitter saw
+	snapshot, err := t.Snapshot()
+	if err != nil {
+		return Task{}, err
+	}
+	// The snapshot doesn't hold included files, so the worker checks them against this before running
+	includedFilesDigest, err := t.IncludedFilesDigest()
+	if err != nil {
+		return Task{}, fmt.Errorf("Could not read the files task type '%s' includes :: %s", taskType, err.Error())
+	}
+
 	// Merge environment variables
 	// FIXME: Take any files and copy them into directory
 	// FIXME: This should happen at execution time
@@ -215,16 +293,22 @@ func (t *TaskType) NewTask(childEnv map[string]string) (Task, error) {
 		"tags":     t.Config.GetStringSlice("tags"),
 	}).Info("Tag mixing results for task")
 
-	return Task{
-		Id:            taskId,
-		CreatedTs:     time.Now().Unix(),
-		LastUpdatedTs: time.Now().Unix(),
-		TypeId:        t.Config.GetString("name"),
-		TypeDigest:    "",
-		ResultDir:     path.Join(viper.GetString("tasks.resultsPath"), taskId.Hex()),
-		State:         "WAITING",
-		Progress:      0,
-		ExecEnv:       mixedEnv,
-		Tags:          t.Config.GetStringSlice("tags"),
-	}, nil
+	// Tasks are only created through the API
+	task := Task{
+		Id:                  taskId,
+		CreatedTs:           time.Now().Unix(),
+		LastUpdatedTs:       time.Now().Unix(),
+		TypeId:              t.Config.GetString("name"),
+		TypeDigest:          t.ConfigVersionHash,
+		TypeSnapshot:        snapshot,
+		IncludedFilesDigest: includedFilesDigest,
+		Steps:               newTaskSteps(t.Steps()),
+		Hooks:               newTaskHooks(t.Hooks()),
+		ResultDir:           path.Join(viper.GetString("tasks.resultsPath"), taskId.Hex()),
+		Progress:            0,
+		ExecEnv:             mixedEnv,
+		Tags:                t.Config.GetStringSlice("tags"),
+	}
+	task.Transition("WAITING", ACTOR_API, "", task.CreatedTs)
+	return task, nil
 }
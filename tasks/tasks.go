@@ -15,22 +15,33 @@ var (
 	ValidTerminalTaskStates = []string{"ERROR", "SUCCESS", "STOPPED", "TIMEDOUT"}
 )
 
-// FIXME: Reason field for why a task was stopped? audit trail of actions?
 type Task struct {
-	Id            objectid.ObjectId `json:"id"`            // time sortable id
-	Pid           int               `json:"pid"`           // the process id used to run the task on disk
-	CreatedTs     int64             `json:"createdTs"`     // when it was first added to the queue
-	StartedTs     int64             `json:"startedTs"`     // when it was pulled from the queue
-	LastUpdatedTs int64             `json:"lastUpdatedTs"` // last time any information changed
-	TypeId        string            `json:"type"`          // String name
-	ResultDir     string            `json:"resultDir"`     // Full path
-	TypeDigest    string            `json:"typeDigest"`    // version hash of config file
-	Timeout       int64             `json:"timeout"`       // The max time the task is allowed to run
-	State         string            `json:"state"`         // See ValidTaskStates
-	WorkerId      objectid.ObjectId `json:"workerId"`      // Id of the worker that processed this task; set when CLAIMED
-	Progress      int               `json:"progress"`      // 0-100
-	ExecEnv       map[string]string `json:"defaultEnv"`    // Combined with default env
-	Tags          []string          `json:"tags"`          // tags for capabilities of workers
+	Id                  objectid.ObjectId `json:"id"`                  // time sortable id
+	Pid                 int               `json:"pid"`                 // the process id used to run the task on disk
+	CreatedTs           int64             `json:"createdTs"`           // when it was first added to the queue
+	StartedTs           int64             `json:"startedTs"`           // when it was pulled from the queue
+	LastUpdatedTs       int64             `json:"lastUpdatedTs"`       // last time any information changed
+	TypeId              string            `json:"type"`                // String name
+	ResultDir           string            `json:"resultDir"`           // Full path
+	TypeDigest          string            `json:"typeDigest"`          // version hash of config file
+	Timeout             int64             `json:"timeout"`             // The max time the task is allowed to run
+	State               string            `json:"state"`               // See ValidTaskStates
+	WorkerId            objectid.ObjectId `json:"workerId"`            // Id of the worker that processed this task; set when CLAIMED
+	Progress            int               `json:"progress"`            // 0-100
+	ExecEnv             map[string]string `json:"defaultEnv"`          // Combined with default env
+	Tags                []string          `json:"tags"`                // tags for capabilities of workers
+	TypeSnapshot        *TaskType         `json:"typeSnapshot"`        // copy of the task type taken at submission time
+	IncludedFilesDigest string            `json:"includedFilesDigest"` // of the type's files_to_include at submission time
+	Steps               []TaskStep        `json:"steps"`               // status of each step, for task types with `[[steps]]`
+	FailedStep          string            `json:"failedStep"`          // name of the step that stopped the task, if any
+	Hooks               []TaskHook        `json:"hooks"`               // status of each hook the task type defines
+	ParentId            string            `json:"parentId"`            // id of the task whose hook submitted this one, if any
+	History             []TaskTransition  `json:"history"`             // every change of state, oldest first
+	Cancellation        *TaskCancellation `json:"cancellation"`        // set when a CLAIMED or RUNNING task is cancelled
+	Inputs              []string          `json:"inputs"`              // names of files uploaded with the task, kept in ResultDir
+	RerunOf             string            `json:"rerunOf"`             // id of the task this one is a rerun of, if any
+	Revision            int64             `json:"revision"`            // bumped on every write; see database.RevisionConflictError
+	ExitCode            *int              `json:"exitCode"`            // exit code of the command, or of the step that ended the task; nil if none was reported
 }
 
 func (t *Task) String() string {
@@ -39,13 +50,26 @@ func (t *Task) String() string {
 
 // Get the command object used to run this task
 // Task type is passed in so the same config is used for every step
-// Maybe task type TOML should be copied when task is added so that it is saved
 func (t *Task) GetCmd(tt *TaskType) (*exec.Cmd, error) {
+	return t.buildCmd(tt.Config.GetString("command"), tt.Config.GetString("executor"))
+}
+
+// Get the command object used to run one step of this task
+func (t *Task) GetStepCmd(step TaskTypeStep) (*exec.Cmd, error) {
+	return t.buildCmd(step.Command, step.Executor)
+}
+
+func parseCommandTemplate(command string) error {
+	_, err := template.New("tasks").Parse(command)
+	return err
+}
+
+func (t *Task) buildCmd(command string, executor string) (*exec.Cmd, error) {
 	var cmd *exec.Cmd
 	var err error
 
 	// Evaluate template
-	tmpl, err := template.New("tasks").Parse(tt.Config.GetString("command"))
+	tmpl, err := template.New("tasks").Parse(command)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err.Error(),
@@ -62,7 +86,6 @@ func (t *Task) GetCmd(tt *TaskType) (*exec.Cmd, error) {
 		return cmd, err
 	}
 
-	executor := tt.Config.GetString("executor")
 	if executor == "" {
 		executor = "bash"
 	}
@@ -86,6 +109,12 @@ func (t *Task) GetCmd(tt *TaskType) (*exec.Cmd, error) {
 	return cmd, nil
 }
 
+// Get the task type this task should run with
+// Uses the snapshot taken at submission time, falling back to the current definition on disk
+// for tasks submitted before snapshots were stored
 func (t *Task) GetTaskType() (*TaskType, error) {
+	if t.TypeSnapshot != nil {
+		return t.TypeSnapshot, nil
+	}
 	return FetchTaskType(t.TypeId)
 }
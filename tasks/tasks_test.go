@@ -1,7 +1,9 @@
 package tasks
 
 import (
+	"encoding/json"
 	"github.com/stretchr/testify/assert"
+	"github.com/turtlemonvh/blanket/lib"
 	"strings"
 	"testing"
 )
@@ -50,3 +52,75 @@ executor="bash"
 	assert.True(t, len(cmd.Args) > 1)
 
 }
+
+func TestTaskTypeSnapshot(t *testing.T) {
+	tt, err := ReadTaskType(strings.NewReader(`
+tags = ["bash", "unix"]
+timeout = 200
+command = "echo {{.ANIMAL}}"
+executor = "bash"
+files_to_include = [["data/*.csv", "inputs"]]
+
+    [[environment.default]]
+    name = "ANIMAL"
+    value = "giraffe"
+`))
+	assert.NoError(t, err)
+	tt.Config.Set("name", "snapshot_task")
+	tt.ConfigFile = "/types/snapshot_task.toml"
+	tt.ConfigVersionHash = "abc123"
+
+	nt, err := tt.NewTask(map[string]string{})
+	assert.NoError(t, err)
+	assert.Equal(t, "abc123", nt.TypeDigest)
+	assert.NotNil(t, nt.TypeSnapshot)
+
+	// Changes to the original type after submission must not leak into the task
+	tt.Config.Set("command", "echo changed")
+
+	// Snapshot should survive being stored as json
+	bts, err := json.Marshal(nt)
+	assert.NoError(t, err)
+	var stored Task
+	assert.NoError(t, json.Unmarshal(bts, &stored))
+
+	snapshot, err := stored.GetTaskType()
+	assert.NoError(t, err)
+	assert.Equal(t, "snapshot_task", snapshot.GetName())
+	assert.Equal(t, "echo {{.ANIMAL}}", snapshot.Config.GetString("command"))
+	assert.Equal(t, "bash", snapshot.Config.GetString("executor"))
+	assert.Equal(t, 200, snapshot.Config.GetInt("timeout"))
+	assert.Equal(t, "/types/snapshot_task.toml", snapshot.ConfigFile)
+	assert.Equal(t, "abc123", snapshot.ConfigVersionHash)
+	assert.Equal(t, [][]string{{"data/*.csv", "inputs"}}, lib.ToSliceStringSlice(snapshot.Config.Get("files_to_include")))
+	assert.Equal(t, map[string]string{"ANIMAL": "giraffe"}, snapshot.DefaultEnv())
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	defaults := RetentionPolicy{
+		MaxAgeDays: map[string]float64{"SUCCESS": 14, "ERROR": 90},
+		MaxTasks:   10000,
+	}
+
+	plain, err := ReadTaskType(strings.NewReader(`
+command = "echo hi"
+executor = "bash"
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, defaults, plain.RetentionPolicy(defaults))
+
+	tt, err := ReadTaskType(strings.NewReader(`
+command = "echo hi"
+executor = "bash"
+
+[retention]
+maxAgeDays = { SUCCESS = 1, TIMEDOUT = 7.5 }
+maxTasks = 0
+`))
+	assert.NoError(t, err)
+	p := tt.RetentionPolicy(defaults)
+	assert.Equal(t, map[string]float64{"SUCCESS": 1, "ERROR": 90, "TIMEDOUT": 7.5}, p.MaxAgeDays)
+	assert.Equal(t, 0, p.MaxTasks)
+	assert.False(t, p.IsEmpty())
+	assert.True(t, RetentionPolicy{}.IsEmpty())
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package worker
+
+import (
+	"os"
+	"syscall"
+)
+
+// terminate asks a task's process to exit with SIGTERM so it can clean
+// up. The windows build has no equivalent and always returns an error,
+// so callers fall back to killing the process.
+func terminate(p *os.Process) error {
+	return p.Signal(syscall.SIGTERM)
+}
@@ -0,0 +1,14 @@
+//go:build windows
+
+package worker
+
+import (
+	"errors"
+	"os"
+)
+
+// terminate is not supported on windows: processes can't be sent
+// SIGTERM, so callers kill the process instead.
+func terminate(p *os.Process) error {
+	return errors.New("graceful termination is not supported on windows")
+}
@@ -2,7 +2,9 @@ package worker
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/kardianos/osext"
 	log "github.com/sirupsen/logrus"
@@ -11,6 +13,7 @@ import (
 	"github.com/turtlemonvh/blanket/lib"
 	"github.com/turtlemonvh/blanket/lib/objectid"
 	"github.com/turtlemonvh/blanket/tasks"
+	"io"
 	"net/http"
 	"os"
 	"os/exec"
@@ -28,6 +31,12 @@ const (
 	// be configured with. Below this, the claim/refresh loop hammers the
 	// server with no useful work — see ProcessTasks.
 	MIN_CHECK_INTERVAL_SECONDS = 0.5
+	// How long each request waiting for a cancel request stays open, in seconds
+	CANCEL_WAIT_SECONDS = 30
+	// How long each claim waits for a task to be queued, in seconds
+	CLAIM_WAIT_SECONDS = 30
+	// How long any other call to the server may take, so a hung server can't stall the worker
+	REQUEST_TIMEOUT_SECONDS = 30
 )
 
 // ErrCheckIntervalTooLow is returned by Run when CheckInterval is set to
@@ -46,8 +55,11 @@ type WorkerConf struct {
 	Daemon        bool              `json:"daemon"`
 	Pid           int               `json:"pid"`
 	Stopped       bool              `json:"stopped"`
+	Draining      bool              `json:"draining"`      // finishes its current task, but claims no more until resumed
 	CheckInterval float64           `json:"checkInterval"` // seconds
 	StartedTs     int64             `json:"startedTs"`
+	LastHeardTs   int64             `json:"lastHeardTs"` // last heartbeat
+	Revision      int64             `json:"revision"`    // bumped on every write; see database.RevisionConflictError
 }
 
 // FIXME: Ensure this works ok on windows: https://golang.org/pkg/os/#Signal
@@ -126,7 +138,9 @@ func (c *WorkerConf) Run() error {
 			maxShutdownRetries := 10
 			nShutdownRetries := 0
 			log.Warn("Received shutdown signal; attempting to set worker to 'stopped'")
-			err = c.Stop()
+			ctx, cancel := requestContext()
+			err = c.Stop(ctx)
+			cancel()
 			for err != nil && nShutdownRetries < maxShutdownRetries {
 				log.WithFields(log.Fields{
 					"err":        err.Error(),
@@ -221,8 +235,19 @@ func (c *WorkerConf) SetLogfileName() error {
 // Also register with time running
 func (c *WorkerConf) MustRegister() {
 	c.Stopped = false
+	// Registering replaces whatever an earlier run of this worker left behind
+	c.Revision = 0
 
-	err := c.UpdateInDatabase()
+	ctx, cancel := requestContext()
+	defer cancel()
+
+	// A worker restarted under the same id stays draining until it is resumed
+	stored := WorkerConf{Id: c.Id}
+	if err := stored.Refetch(ctx); err == nil {
+		c.Draining = stored.Draining
+	}
+
+	err := c.UpdateInDatabase(ctx)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err.Error(),
@@ -230,11 +255,11 @@ func (c *WorkerConf) MustRegister() {
 	}
 }
 
-func (c *WorkerConf) Stop() error {
+func (c *WorkerConf) Stop(ctx context.Context) error {
 	var err error
 
 	reqURL := fmt.Sprintf("http://localhost:%d/worker/%s/stop", viper.GetInt("port"), c.Id.Hex())
-	req, err := http.NewRequest("PUT", reqURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "PUT", reqURL, nil)
 	if err != nil {
 		return err
 	}
@@ -248,7 +273,7 @@ func (c *WorkerConf) Stop() error {
 	return err
 }
 
-func (c *WorkerConf) UpdateInDatabase() error {
+func (c *WorkerConf) UpdateInDatabase(ctx context.Context) error {
 	var err error
 	var bts []byte
 
@@ -258,7 +283,7 @@ func (c *WorkerConf) UpdateInDatabase() error {
 	}
 
 	reqURL := fmt.Sprintf("http://localhost:%d/worker/%s", viper.GetInt("port"), c.Id.Hex())
-	req, err := http.NewRequest("PUT", reqURL, bytes.NewReader(bts))
+	req, err := http.NewRequestWithContext(ctx, "PUT", reqURL, bytes.NewReader(bts))
 	if err != nil {
 		return err
 	}
@@ -269,12 +294,20 @@ func (c *WorkerConf) UpdateInDatabase() error {
 	}
 	defer res.Body.Close()
 
-	return err
+	// A stale revision gets a 409 or 412 and nothing is written
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Problem updating worker; status code :: %s", res.Status)
+	}
+	return nil
 }
 
-func (c *WorkerConf) Refetch() error {
+func (c *WorkerConf) Refetch(ctx context.Context) error {
 	reqURL := fmt.Sprintf("http://localhost:%d/worker/%s", viper.GetInt("port"), c.Id.Hex())
-	res, err := http.Get(reqURL)
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -283,24 +316,54 @@ func (c *WorkerConf) Refetch() error {
 	return dec.Decode(c)
 }
 
+// Tell the server the worker is alive and pick up its record, including whether it has been stopped
+func (c *WorkerConf) Heartbeat(ctx context.Context) error {
+	reqURL := fmt.Sprintf("http://localhost:%d/worker/%s/heartbeat", viper.GetInt("port"), c.Id.Hex())
+	req, err := http.NewRequestWithContext(ctx, "PUT", reqURL, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Heartbeat failed with status %d", res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(c)
+}
+
+// A context for one call to the server
+func requestContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), REQUEST_TIMEOUT_SECONDS*time.Second)
+}
+
 func (c *WorkerConf) CheckIntervalMs() time.Duration {
 	return time.Duration(c.CheckInterval*1000*viper.GetFloat64("timeMultiplier")) * time.Millisecond
 }
 
-// ProcessTasks is the worker's main loop: refresh state, claim a task, run
+// ProcessTasks is the worker's main loop: heartbeat, claim a task, run
 // it, repeat — until the worker is marked Stopped (typically by the SIGTERM
-// handler updating the DB record). Sleeps c.CheckIntervalMs() whenever an
-// iteration ends without processing a task (empty queue, refresh error,
-// claim error). Returns the last error seen, or nil on clean shutdown.
+// handler updating the DB record). Claims wait on the server for up to
+// CLAIM_WAIT_SECONDS for a task to be queued, so new tasks start right away.
+// Sleeps c.CheckIntervalMs() after a refresh or claim error, and before
+// claiming again after an empty claim the server answered sooner than that.
+// Returns the last error seen, or nil on clean shutdown.
 //
 // FIXME: Once working on a task, send some logs of errors into that task's logfiles
 func (c *WorkerConf) ProcessTasks() error {
 	var lastErr error
 	var t tasks.Task
+	// Set when the last claim came back empty sooner than the check interval
+	answeredEarly := false
 
 	for !c.Stopped {
 		// Update the worker config
-		err := c.Refetch()
+		ctx, cancel := requestContext()
+		err := c.Heartbeat(ctx)
+		cancel()
 		if err != nil {
 			log.WithFields(log.Fields{
 				"id":    c.Id,
@@ -313,8 +376,20 @@ func (c *WorkerConf) ProcessTasks() error {
 		log.WithFields(log.Fields{
 			"id": c.Id,
 		}).Info("successfully refreshed worker state")
+		if c.Stopped {
+			// Don't hold a claim open on the way out
+			continue
+		}
+		if answeredEarly {
+			// Back off so a server that doesn't hold claims can't make the loop hot-spin
+			answeredEarly = false
+			time.Sleep(c.CheckIntervalMs())
+		}
 
-		t, err = tasks.MarkAsClaimed(c.Id)
+		claimStart := time.Now()
+		ctx, cancel = context.WithTimeout(context.Background(), (REQUEST_TIMEOUT_SECONDS+CLAIM_WAIT_SECONDS)*time.Second)
+		t, err = tasks.MarkAsClaimed(ctx, c.Id, CLAIM_WAIT_SECONDS)
+		cancel()
 		if err != nil {
 			log.WithFields(log.Fields{
 				"err":        err.Error(),
@@ -325,12 +400,13 @@ func (c *WorkerConf) ProcessTasks() error {
 			continue
 		}
 		if t.Id.IsZero() {
-			// Empty queue — back off before polling again. (Pre-fix this
-			// branch fell through with no sleep, hot-spinning the loop.)
+			// Empty queue — the server already waited, so claim again right
+			// away. An early answer usually means the worker was stopped,
+			// which the next heartbeat shows before any back off.
 			log.WithFields(log.Fields{
-				"retryDelay": c.CheckIntervalMs(),
+				"waited": time.Since(claimStart),
 			}).Debug("found no matching tasks")
-			time.Sleep(c.CheckIntervalMs())
+			answeredEarly = time.Since(claimStart) < c.CheckIntervalMs()
 			continue
 		}
 
@@ -376,68 +452,142 @@ func (c *WorkerConf) ProcessOne(t *tasks.Task) error {
 		return err
 	}
 
-	var cmd *exec.Cmd
-	cmd, err = t.GetCmd(tt)
-
-	// Add extra environment variables common for all tasks
-	extraEnv := map[string]string{
-		"BLANKET_APP_TASK_ID":                t.Id.Hex(),
-		"BLANKET_APP_RESULTS_DIRECTORY":      viper.GetString("tasks.resultsPath"),
-		"BLANKET_APP_TASK_RESULTS_DIRECTORY": path.Join(viper.GetString("tasks.resultsPath"), t.Id.Hex()),
-		"BLANKET_APP_WORKER_PID":             cast.ToString(c.Pid),
-		"BLANKET_APP_SERVER_PORT":            viper.GetString("port"),
-	}
-	for k, v := range extraEnv {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+	// Included files are copied from disk, not the snapshot, so they must still be what was submitted
+	if t.IncludedFilesDigest != "" {
+		digest, err := tt.IncludedFilesDigest()
+		if err == nil && digest != t.IncludedFilesDigest {
+			err = fmt.Errorf("Files included by task type '%s' changed after the task was submitted; submit it again to run with the current files", t.TypeId)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":    err.Error(),
+				"taskId": t.Id,
+			}).Error("included files do not match the task")
+			return c.finishTask(t, "ERROR", err)
+		}
 	}
 
-	var fileCloser func()
-	err, fileCloser = c.SetupExecutionDirectory(t, tt, cmd)
+	stdout, stderr, fileCloser, err := c.prepareExecutionDirectory(t, tt)
 	if err != nil {
 		return err
 	}
 	defer fileCloser()
 
+	hooks := tt.Hooks()
+
+	// The main command only runs if the `before` hook succeeds
+	var state string
+	var runErr error
+	if hookState := c.runHook(t, hooks, "before", ""); hookState != "" && hookState != "SUCCESS" {
+		state = "ERROR"
+		runErr = fmt.Errorf("'before' hook ended in state %s", hookState)
+	} else if hookState != "" && c.cancelledDuringHook(t) {
+		// The main command never starts
+		state = "STOPPED"
+	} else if steps := tt.Steps(); len(steps) > 0 {
+		state, runErr = c.processSteps(t, tt, steps, stdout, stderr)
+	} else {
+		state, runErr = c.processCommand(t, tt, stdout, stderr)
+	}
+	err = c.finishTask(t, state, runErr)
+
+	switch state {
+	case "SUCCESS":
+		c.runHook(t, hooks, "on_success", state)
+		c.skipHook(t, hooks, "on_failure")
+	case "ERROR", "TIMEDOUT":
+		c.runHook(t, hooks, "on_failure", state)
+		c.skipHook(t, hooks, "on_success")
+	default:
+		c.skipHook(t, hooks, "on_success")
+		c.skipHook(t, hooks, "on_failure")
+	}
+	c.runHook(t, hooks, "after", state)
+
+	return err
+}
+
+// Run the single command of a task and return the state it ended in
+func (c *WorkerConf) processCommand(t *tasks.Task, tt *tasks.TaskType, stdout *os.File, stderr *os.File) (string, error) {
+	cmd, err := t.GetCmd(tt)
+	if err != nil {
+		return "ERROR", err
+	}
+	cmd.Env = append(cmd.Env, c.taskEnv(t)...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Dir = t.ResultDir
+
 	err = cmd.Start()
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err":    err.Error(),
 			"taskId": t.Id,
 		}).Error("Error starting task execution")
-		terr := tasks.MarkAsFinished(t, "ERROR")
-		if terr != nil {
-			log.WithFields(log.Fields{
-				"err":    terr.Error(),
-				"taskId": t.Id,
-			}).Error("After failing to start task execution, failed to transition task to state ERROR")
-			return terr
-		}
-		return err
+		return "ERROR", err
 	}
 
 	// FIXME: Move more fields here
-	err = tasks.MarkAsRunning(t, map[string]string{
+	ctx, cancel := requestContext()
+	err = tasks.MarkAsRunning(ctx, t, map[string]string{
 		"timeout":    tt.Config.GetString("timeout"),
 		"pid":        cast.ToString(cmd.Process.Pid),
 		"typeDigest": tt.ConfigVersionHash,
 	})
 	if err != nil {
+		cancel()
 		log.WithFields(log.Fields{
 			"err":    err.Error(),
 			"taskId": t.Id,
 		}).Error("failed to transition task to state RUNNING")
-		return err
+		return "ERROR", err
 	}
-	t.Refresh()
+	t.Refresh(ctx)
+	cancel()
+
+	return c.monitorCmd(t, cmd, t.StartedTs+t.Timeout, true)
+}
+
+// Extra environment variables common for all tasks
+func (c *WorkerConf) taskEnv(t *tasks.Task) []string {
+	extraEnv := map[string]string{
+		"BLANKET_APP_TASK_ID":                t.Id.Hex(),
+		"BLANKET_APP_RESULTS_DIRECTORY":      viper.GetString("tasks.resultsPath"),
+		"BLANKET_APP_TASK_RESULTS_DIRECTORY": path.Join(viper.GetString("tasks.resultsPath"), t.Id.Hex()),
+		"BLANKET_APP_WORKER_PID":             cast.ToString(c.Pid),
+		"BLANKET_APP_SERVER_PORT":            viper.GetString("port"),
+	}
+	var env []string
+	for k, v := range extraEnv {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+	return env
+}
 
+// Wait for a started command to exit
+// The command is killed if it runs past deadline (unix seconds), or if stoppable is set and the task is stopped through the API
+// If stoppable is set and the task is cancelled, t.Cancellation is set with the outcome once the command is gone
+// Otherwise a cancel request is acknowledged right away and the command left to finish; the next stoppable command stops on it
+// Returns the state the command ended in and any error from waiting on it
+func (c *WorkerConf) monitorCmd(t *tasks.Task, cmd *exec.Cmd, deadline int64, stoppable bool) (string, error) {
+	killedWith := make(chan string, 1)
 	taskDone := make(chan struct{}, 1)
-	maxTime := t.StartedTs + t.Timeout
-	taskTimeout := time.NewTimer(time.Duration(float64(maxTime-time.Now().Unix())*1000*viper.GetFloat64("timeMultiplier")) * time.Millisecond)
+	monitorDone := make(chan struct{})
+	taskTimeout := time.NewTimer(time.Duration(float64(deadline-time.Now().Unix())*1000*viper.GetFloat64("timeMultiplier")) * time.Millisecond)
+
+	cancelRequested := make(chan *tasks.TaskCancellation, 1)
+	var cancelled *tasks.TaskCancellation
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	go c.watchForCancel(watchCtx, t.Id, cancelRequested)
+
 	go func() {
+		defer close(monitorDone)
+		defer taskTimeout.Stop()
 		for true {
 			log.WithFields(log.Fields{
 				"taskId":       t.Id,
-				"maxTime":      maxTime,
+				"maxTime":      deadline,
 				"processState": cmd.ProcessState,
 			}).Debug("looping in task process monitoring thread")
 
@@ -459,30 +609,26 @@ func (c *WorkerConf) ProcessOne(t *tasks.Task) error {
 				}
 			}
 
-			// Check if still running
-			if cmd.ProcessState != nil && cmd.ProcessState.Exited() {
+			// Check that we haven't stopped this task from another process
+			ctx, cancel := requestContext()
+			t.Refresh(ctx)
+			cancel()
+			if stoppable && t.State == "STOPPED" {
 				log.WithFields(log.Fields{
 					"taskId": t.Id,
-				}).Info("returning from task process monitoring thread because task has exited")
+					"pid":    cmd.Process.Pid,
+				}).Warn("killing task because state is STOPPED")
+				killedWith <- "STOPPED"
+				cmd.Process.Kill()
 				return
 			}
 
-			// Check that we haven't stopped this task from another process
-			t.Refresh()
-			if t.State == "STOPPED" {
-				if cmd.Process != nil {
-					log.WithFields(log.Fields{
-						"taskId": t.Id,
-						"pid":    cmd.Process.Pid,
-					}).Warn("killing task because state is STOPPED")
-					cmd.Process.Kill()
-					return
+			// Flush log files
+			for _, w := range []interface{}{cmd.Stdout, cmd.Stderr} {
+				if f, ok := w.(*os.File); ok {
+					f.Sync()
 				}
 			}
-
-			// Flush log files
-			cmd.Stdout.(*os.File).Sync()
-			cmd.Stderr.(*os.File).Sync()
 			log.WithFields(log.Fields{
 				"taskId": t.Id,
 			}).Debug("Flushing logfiles for task")
@@ -492,71 +638,457 @@ func (c *WorkerConf) ProcessOne(t *tasks.Task) error {
 			select {
 			case killTime := <-taskTimeout.C:
 				// Ran out of time
-				// Kill process and return with error
 				loopTimeout.Stop()
-				err = tasks.MarkAsFinished(t, "TIMEDOUT")
-				if err != nil {
+				log.WithFields(log.Fields{
+					"taskId":   t.Id,
+					"maxTime":  deadline,
+					"killTime": killTime,
+				}).Error("killing task because over max time allowed for execution")
+				killedWith <- "TIMEDOUT"
+				cmd.Process.Kill()
+				return
+			case cancellation := <-cancelRequested:
+				if !stoppable {
+					// Answer now so the server doesn't stop the task while this command still runs
 					log.WithFields(log.Fields{
-						"err":    err.Error(),
 						"taskId": t.Id,
-					}).Error("failed to transition task to state TIMEDOUT")
-				} else {
-					log.WithFields(log.Fields{
-						"taskId":   t.Id,
-						"maxTime":  maxTime,
-						"killTime": killTime,
-					}).Error("killing task because over max time allowed for execution")
-					if cmd.Process != nil {
-						cmd.Process.Kill()
-						return
-					}
+						"pid":    cmd.Process.Pid,
+					}).Warn("task was cancelled; stopping it once this command is done")
+					c.acknowledgeCancel(t)
+					loopTimeout.Stop()
+					continue
 				}
+				loopTimeout.Stop()
+				cancellation.Outcome = c.stopCancelledCmd(t, cmd, cancellation, taskDone)
+				cancelled = cancellation
+				killedWith <- "STOPPED"
+				return
 			case <-loopTimeout.C:
 				// Loop again
 				continue
 			case <-taskDone:
 				loopTimeout.Stop()
-				taskTimeout.Stop()
 				return
 			}
 		}
 	}()
-	defer func() {
-		// Ensure monitoring goroutine exits when the parent exits
-		taskDone <- struct{}{}
-	}()
 
-	err = cmd.Wait()
+	err := cmd.Wait()
+	// Ensure monitoring goroutine exits before returning, since it shares the task object
+	taskDone <- struct{}{}
+	<-monitorDone
+	stopWatching()
+	if cancelled != nil {
+		t.Cancellation = cancelled
+	}
+
+	select {
+	case state := <-killedWith:
+		return state, err
+	default:
+	}
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err":    err.Error(),
 			"taskId": t.Id,
 		}).Error("problems finishing task execution")
-		terr := tasks.MarkAsFinished(t, "ERROR")
-		if terr != nil {
+		return "ERROR", err
+	}
+	return "SUCCESS", nil
+}
+
+// Wait on the server for a cancel request for a task and send it on found
+// Stops when ctx is done
+func (c *WorkerConf) watchForCancel(ctx context.Context, taskId objectid.ObjectId, found chan<- *tasks.TaskCancellation) {
+	// Separate from the task being monitored, which is refreshed from another goroutine
+	ref := &tasks.Task{Id: taskId}
+	for ctx.Err() == nil {
+		cancellation, err := tasks.WaitForCancel(ctx, ref, CANCEL_WAIT_SECONDS)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
 			log.WithFields(log.Fields{
-				"err":    terr.Error(),
-				"taskId": t.Id,
-			}).Error("after failing to finish task execution, failed to transition task to state ERROR")
-			return terr
+				"err":    err.Error(),
+				"taskId": taskId.Hex(),
+			}).Warn("problem waiting for cancel request; retrying")
+			select {
+			case <-ctx.Done():
+			case <-time.After(c.CheckIntervalMs()):
+			}
+			continue
+		}
+		if cancellation != nil {
+			found <- cancellation
+			return
+		}
+	}
+}
+
+// True if the task was cancelled while a hook ran; t.Cancellation is set with the outcome
+func (c *WorkerConf) cancelledDuringHook(t *tasks.Task) bool {
+	ctx, cancel := requestContext()
+	defer cancel()
+	if err := t.Refresh(ctx); err != nil || t.Cancellation == nil {
+		return false
+	}
+	t.Cancellation.Outcome = tasks.CANCEL_GRACEFUL
+	return true
+}
+
+// Tell the server a cancel request was seen, so it doesn't stop the task itself
+func (c *WorkerConf) acknowledgeCancel(t *tasks.Task) {
+	ctx, cancel := requestContext()
+	defer cancel()
+	if err := tasks.UpdateCancel(ctx, t, ""); err != nil {
+		log.WithFields(log.Fields{
+			"err":    err.Error(),
+			"taskId": t.Id,
+		}).Error("failed to acknowledge cancel request")
+	}
+}
+
+// Stop a command after its task was cancelled and return how it went; see tasks.ValidCancelOutcomes
+// Unless the request is forced the command gets `tasks.cancelGracePeriodSeconds` to exit before it is killed
+// exited receives once the command has exited
+func (c *WorkerConf) stopCancelledCmd(t *tasks.Task, cmd *exec.Cmd, cancellation *tasks.TaskCancellation, exited <-chan struct{}) string {
+	log.WithFields(log.Fields{
+		"taskId": t.Id,
+		"pid":    cmd.Process.Pid,
+		"force":  cancellation.Force,
+		"reason": cancellation.Reason,
+	}).Warn("stopping task because it was cancelled")
+	c.acknowledgeCancel(t)
+
+	if !cancellation.Force {
+		if err := terminate(cmd.Process); err == nil {
+			grace := time.NewTimer(time.Duration(viper.GetFloat64("tasks.cancelGracePeriodSeconds")*1000*viper.GetFloat64("timeMultiplier")) * time.Millisecond)
+			defer grace.Stop()
+			select {
+			case <-exited:
+				return tasks.CANCEL_GRACEFUL
+			case <-grace.C:
+				log.WithFields(log.Fields{
+					"taskId": t.Id,
+					"pid":    cmd.Process.Pid,
+				}).Warn("killing cancelled task because it did not exit within the grace period")
+			}
 		}
+	}
+	cmd.Process.Kill()
+	return tasks.CANCEL_KILLED
+}
+
+// The exit code to report for a run: 0 on success, the command's code if it exited with an error,
+// and nil if nothing ran
+func runExitCode(state string, runErr error) *int {
+	var exitErr *exec.ExitError
+	switch {
+	case runErr == nil && state == "SUCCESS":
+		code := 0
+		return &code
+	case errors.As(runErr, &exitErr):
+		code := exitErr.ExitCode()
+		return &code
+	}
+	return nil
+}
+
+// Move a task to the state its run ended in
+// Cancelled tasks report how the cancellation went; tasks the server already stopped are left alone
+func (c *WorkerConf) finishTask(t *tasks.Task, state string, runErr error) error {
+	ctx, cancel := requestContext()
+	defer cancel()
+	if state == "STOPPED" {
+		// The last refresh shows STOPPED when the server stopped the task without us
+		if t.State != "STOPPED" && t.Cancellation != nil && t.Cancellation.Outcome != "" {
+			if err := tasks.UpdateCancel(ctx, t, t.Cancellation.Outcome); err != nil {
+				log.WithFields(log.Fields{
+					"err":     err.Error(),
+					"taskId":  t.Id,
+					"outcome": t.Cancellation.Outcome,
+				}).Error("failed to report outcome of cancel request")
+				return err
+			}
+		}
+		return runErr
+	}
+	reason := ""
+	if runErr != nil {
+		reason = runErr.Error()
+	}
+	err := tasks.MarkAsFinished(ctx, t, state, reason, runExitCode(state, runErr))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":    err.Error(),
+			"taskId": t.Id,
+			"state":  state,
+		}).Error("failed to transition task to final state")
 		return err
 	}
+	return runErr
+}
+
+// Run each step of a multi-step task in order in the task's result directory
+// Returns the state the task ended in
+func (c *WorkerConf) processSteps(t *tasks.Task, tt *tasks.TaskType, steps []tasks.TaskTypeStep, stdout *os.File, stderr *os.File) (string, error) {
+	// FIXME: Pid is not set for multi-step tasks since each step runs as its own process
+	ctx, cancel := requestContext()
+	err := tasks.MarkAsRunning(ctx, t, map[string]string{
+		"timeout":    tt.Config.GetString("timeout"),
+		"typeDigest": tt.ConfigVersionHash,
+	})
+	if err != nil {
+		cancel()
+		log.WithFields(log.Fields{
+			"err":    err.Error(),
+			"taskId": t.Id,
+		}).Error("failed to transition task to state RUNNING")
+		return "ERROR", err
+	}
+	t.Refresh(ctx)
+	cancel()
+	taskDeadline := t.StartedTs + t.Timeout
+
+	finalState := "SUCCESS"
+	var runErr error
+	for i, step := range steps {
+		// A failed step stops the rest of the task
+		if finalState != "SUCCESS" {
+			c.markStep(t, i, "SKIPPED", 0)
+			continue
+		}
+
+		// Whichever is sooner of the step's own timeout and the task's timeout
+		deadline := taskDeadline
+		stepLimited := false
+		if step.Timeout > 0 && time.Now().Unix()+step.Timeout < taskDeadline {
+			deadline = time.Now().Unix() + step.Timeout
+			stepLimited = true
+		}
 
-	err = tasks.MarkAsFinished(t, "SUCCESS")
+		state, exitCode, err := c.runStep(t, i, len(steps), step, stdout, stderr, deadline)
+		c.markStep(t, i, state, exitCode)
+		switch {
+		case state == "SUCCESS":
+		case state == "STOPPED" || (state == "TIMEDOUT" && !stepLimited):
+			// The whole task was stopped or ran out of time
+			finalState = state
+			runErr = err
+		case step.ContinueOnError:
+			log.WithFields(log.Fields{
+				"taskId": t.Id,
+				"step":   step.Name,
+				"state":  state,
+			}).Warn("step failed; continuing because continue_on_error is set")
+		default:
+			finalState = state
+			runErr = err
+		}
+	}
+	return finalState, runErr
+}
+
+// Run one step and return the state it ended in and its exit code
+// Output goes to the step's own log files and to the task's combined logs
+func (c *WorkerConf) runStep(t *tasks.Task, index int, nsteps int, step tasks.TaskTypeStep, stdout *os.File, stderr *os.File, deadline int64) (string, int, error) {
+	cmd, err := t.GetStepCmd(step)
+	if err != nil {
+		return "ERROR", -1, err
+	}
+	cmd.Env = append(cmd.Env, c.taskEnv(t)...)
+	cmd.Env = append(cmd.Env,
+		fmt.Sprintf("BLANKET_APP_STEP_INDEX=%d", index),
+		fmt.Sprintf("BLANKET_APP_STEP_NAME=%s", step.Name),
+	)
+	cmd.Dir = t.ResultDir
+
+	stepStdout, err := os.Create(tasks.StepLogPath(t.ResultDir, index, "stdout"))
+	if err != nil {
+		return "ERROR", -1, err
+	}
+	defer stepStdout.Close()
+	stepStderr, err := os.Create(tasks.StepLogPath(t.ResultDir, index, "stderr"))
 	if err != nil {
+		return "ERROR", -1, err
+	}
+	defer stepStderr.Close()
+	cmd.Stdout = io.MultiWriter(stepStdout, stdout)
+	cmd.Stderr = io.MultiWriter(stepStderr, stderr)
+	// Output is copied through pipes, so don't wait forever on children that keep them open after a kill
+	cmd.WaitDelay = 5 * time.Second
+
+	fmt.Fprintf(stdout, "==> step %d/%d: %s\n", index+1, nsteps, step.Name)
+	c.markStep(t, index, "RUNNING", 0)
+
+	if err := cmd.Start(); err != nil {
 		log.WithFields(log.Fields{
 			"err":    err.Error(),
 			"taskId": t.Id,
-		}).Error("failed to transition task to state SUCCESS")
+			"step":   step.Name,
+		}).Error("Error starting step execution")
+		return "ERROR", -1, err
 	}
 
-	return err
+	state, err := c.monitorCmd(t, cmd, deadline, true)
+	exitCode := -1
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+	return state, exitCode, err
+}
+
+// Report the state of a step; failures are logged since the step has already run
+func (c *WorkerConf) markStep(t *tasks.Task, index int, state string, exitCode int) {
+	ctx, cancel := requestContext()
+	defer cancel()
+	if err := tasks.MarkStep(ctx, t, index, state, exitCode); err != nil {
+		log.WithFields(log.Fields{
+			"err":    err.Error(),
+			"taskId": t.Id,
+			"step":   index,
+			"state":  state,
+		}).Warn("failed to update step state")
+	}
+}
+
+// Run one of the task type's hooks, if it is defined, and report how it went
+// outcome is the state the task ended in, or "" before the main command runs
+// Returns the state the hook ended in, or "" if the type doesn't define it
+func (c *WorkerConf) runHook(t *tasks.Task, hooks map[string]tasks.TaskTypeHook, name string, outcome string) string {
+	hook, ok := hooks[name]
+	if !ok {
+		return ""
+	}
+	c.markHook(t, name, "RUNNING", 0, "")
+
+	state, exitCode := "SUCCESS", 0
+	if hook.Command != "" {
+		var err error
+		state, exitCode, err = c.runHookCommand(t, hook, outcome)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":    err.Error(),
+				"taskId": t.Id,
+				"hook":   name,
+				"state":  state,
+			}).Warn("hook command failed")
+		}
+	}
+
+	followUpTaskId := ""
+	if state == "SUCCESS" && hook.Submit != nil {
+		followUp, err := c.submitFollowUp(t, hook, outcome)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":    err.Error(),
+				"taskId": t.Id,
+				"hook":   name,
+				"type":   hook.Submit.Type,
+			}).Error("failed to submit follow-up task")
+			state = "ERROR"
+		} else {
+			followUpTaskId = followUp.Id.Hex()
+		}
+	}
+
+	c.markHook(t, name, state, exitCode, followUpTaskId)
+	return state
+}
+
+// Run the command of a hook and return the state it ended in and its exit code
+// Hooks write to their own log files and keep running if the task is stopped, so `after` can clean up
+func (c *WorkerConf) runHookCommand(t *tasks.Task, hook tasks.TaskTypeHook, outcome string) (string, int, error) {
+	cmd, err := t.GetHookCmd(hook)
+	if err != nil {
+		return "ERROR", -1, err
+	}
+	cmd.Env = append(cmd.Env, c.taskEnv(t)...)
+	cmd.Env = append(cmd.Env,
+		fmt.Sprintf("BLANKET_APP_HOOK_NAME=%s", hook.Name),
+		fmt.Sprintf("BLANKET_APP_TASK_STATE=%s", outcome),
+	)
+	cmd.Dir = t.ResultDir
+
+	hookStdout, err := os.Create(tasks.HookLogPath(t.ResultDir, hook.Name, "stdout"))
+	if err != nil {
+		return "ERROR", -1, err
+	}
+	defer hookStdout.Close()
+	hookStderr, err := os.Create(tasks.HookLogPath(t.ResultDir, hook.Name, "stderr"))
+	if err != nil {
+		return "ERROR", -1, err
+	}
+	defer hookStderr.Close()
+	cmd.Stdout = hookStdout
+	cmd.Stderr = hookStderr
+
+	if err := cmd.Start(); err != nil {
+		return "ERROR", -1, err
+	}
+	state, err := c.monitorCmd(t, cmd, time.Now().Unix()+hook.Timeout, false)
+	exitCode := -1
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+	return state, exitCode, err
+}
+
+// Submit the follow-up task of a hook, passing along fields of this task
+func (c *WorkerConf) submitFollowUp(t *tasks.Task, hook tasks.TaskTypeHook, outcome string) (tasks.Task, error) {
+	env, err := t.FollowUpEnv(hook.Submit, outcome)
+	if err != nil {
+		return tasks.Task{}, err
+	}
+	ctx, cancel := requestContext()
+	defer cancel()
+	followUp, err := tasks.SubmitTask(ctx, hook.Submit.Type, env, t.Id.Hex())
+	if err == nil {
+		log.WithFields(log.Fields{
+			"taskId":     t.Id,
+			"hook":       hook.Name,
+			"followUpId": followUp.Id,
+			"type":       hook.Submit.Type,
+		}).Info("submitted follow-up task")
+	}
+	return followUp, err
+}
+
+// Mark a hook that won't run for this outcome as SKIPPED
+func (c *WorkerConf) skipHook(t *tasks.Task, hooks map[string]tasks.TaskTypeHook, name string) {
+	if _, ok := hooks[name]; ok {
+		c.markHook(t, name, "SKIPPED", 0, "")
+	}
+}
+
+// Report the state of a hook; failures are logged since the hook has already run
+func (c *WorkerConf) markHook(t *tasks.Task, name string, state string, exitCode int, followUpTaskId string) {
+	ctx, cancel := requestContext()
+	defer cancel()
+	if err := tasks.MarkHook(ctx, t, name, state, exitCode, followUpTaskId); err != nil {
+		log.WithFields(log.Fields{
+			"err":    err.Error(),
+			"taskId": t.Id,
+			"hook":   name,
+			"state":  state,
+		}).Warn("failed to update hook state")
+	}
 }
 
 // Create the execution directory for a task
 // Includes attaching log files to the cmd object
 func (c *WorkerConf) SetupExecutionDirectory(t *tasks.Task, tt *tasks.TaskType, cmd *exec.Cmd) (error, func()) {
+	stdoutFile, stderrFile, fileCloser, err := c.prepareExecutionDirectory(t, tt)
+	if stdoutFile != nil && stderrFile != nil {
+		cmd.Stdout = stdoutFile
+		cmd.Stderr = stderrFile
+		cmd.Dir = t.ResultDir
+	}
+	return err, fileCloser
+}
+
+// Create the execution directory and the task's combined log files, and copy in any included files
+func (c *WorkerConf) prepareExecutionDirectory(t *tasks.Task, tt *tasks.TaskType) (*os.File, *os.File, func(), error) {
 	// Set up output files and configure the task to run in the correct location
 	err := os.MkdirAll(t.ResultDir, os.ModePerm)
 	if err != nil {
@@ -564,7 +1096,7 @@ func (c *WorkerConf) SetupExecutionDirectory(t *tasks.Task, tt *tasks.TaskType,
 			"err":    err.Error(),
 			"taskId": t.Id,
 		}).Error("failed to create scratch directory for task")
-		return err, func() {}
+		return nil, nil, func() {}, err
 	}
 
 	// FIXME: Can set to the same file to get golang to combine streams
@@ -577,7 +1109,7 @@ func (c *WorkerConf) SetupExecutionDirectory(t *tasks.Task, tt *tasks.TaskType,
 			"err":    err.Error(),
 			"taskId": t.Id,
 		}).Error("failed to create stdout file for task")
-		return err, func() {}
+		return nil, nil, func() {}, err
 	}
 	stderrFile, err := os.Create(stderrPath)
 	if err != nil {
@@ -585,15 +1117,11 @@ func (c *WorkerConf) SetupExecutionDirectory(t *tasks.Task, tt *tasks.TaskType,
 			"err":    err.Error(),
 			"taskId": t.Id,
 		}).Error("failed to create stderr file for task")
-		return err, func() {
+		return nil, nil, func() {
 			stdoutFile.Close()
-		}
+		}, err
 	}
 
-	cmd.Stdout = stdoutFile
-	cmd.Stderr = stderrFile
-	cmd.Dir = t.ResultDir
-
 	fileCloser := func() {
 		stdoutFile.Close()
 		stderrFile.Close()
@@ -612,7 +1140,7 @@ func (c *WorkerConf) SetupExecutionDirectory(t *tasks.Task, tt *tasks.TaskType,
 			"err":    err.Error(),
 			"taskId": t.Id,
 		}).Error("failed copy files for task")
-		return err, fileCloser
+		return stdoutFile, stderrFile, fileCloser, err
 	} else {
 		log.WithFields(log.Fields{
 			"files":  filesToInclude,
@@ -620,5 +1148,5 @@ func (c *WorkerConf) SetupExecutionDirectory(t *tasks.Task, tt *tasks.TaskType,
 		}).Error("copied files for task")
 	}
 
-	return err, fileCloser
+	return stdoutFile, stderrFile, fileCloser, err
 }
@@ -9,8 +9,14 @@
 //   - two tasks in sequence: TestProcessTwo
 //   - task timeout: TestProcessOne_Timeout — task exceeds its configured
 //     timeout, ends in TIMEDOUT
-//   - task api-stopped mid-flight: TestProcessOne_StoppedMidFlight
+//   - task api-stopped mid-flight: TestProcessOne_StoppedMidFlight, and with
+//     force: TestProcessOne_ForceStopped
+//   - cancel during a `before` hook: TestProcessOne_CancelledDuringBeforeHook
+//   - worker updates the server refuses: TestUpdateInDatabase_StaleRevision
 //   - log production: TestProcessOne_ProducesLogs
+//   - type edited between submit and run: TestProcessOne_UsesTypeSnapshot
+//   - multi-step types: TestProcessOne_Steps, TestProcessOne_StepFailureSkipsRest
+//   - hooks and follow-up tasks: TestProcessOne_Hooks, TestProcessOne_BeforeHookFailure
 //
 // Not yet covered (tracked in docs/next_up.md):
 //   - worker shutdown: SIGTERM to `Run()` stops cleanly before task 2 runs.
@@ -20,6 +26,7 @@ package worker_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -124,9 +131,9 @@ func (h *workerHarness) fetch(id objectid.ObjectId) tasks.Task {
 	return task
 }
 
-func (h *workerHarness) cancel(id objectid.ObjectId) {
+func (h *workerHarness) cancel(id objectid.ObjectId, query string) {
 	h.t.Helper()
-	req, _ := http.NewRequest("PUT", fmt.Sprintf("%s/task/%s/cancel", h.srv.URL, id.Hex()), nil)
+	req, _ := http.NewRequest("PUT", fmt.Sprintf("%s/task/%s/cancel?%s", h.srv.URL, id.Hex(), query), nil)
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		h.t.Fatalf("cancel task: %v", err)
@@ -241,10 +248,79 @@ func TestProcessOne(t *testing.T) {
 	final := h.fetch(submitted.Id)
 	assert.Equal(t, "SUCCESS", final.State)
 	assert.Equal(t, 100, final.Progress)
+	if assert.NotNil(t, final.ExitCode) {
+		assert.Equal(t, 0, *final.ExitCode)
+	}
+
+	stdout, err := os.ReadFile(filepath.Join(final.ResultDir, "blanket.stdout.log"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(stdout), "hello from blanket integration test")
+}
+
+// TestProcessOne_UsesTypeSnapshot edits the task type file after the task
+// is submitted. The worker must run the command the submitter saw.
+func TestProcessOne_UsesTypeSnapshot(t *testing.T) {
+	h := newWorkerHarness(t)
+	defer h.cleanup()
+
+	h.writeTaskType("echo_task", testTaskTypeToml)
+	submitted := h.submit("echo_task")
+
+	h.writeTaskType("echo_task", `
+tags = ["bash", "unix"]
+timeout = 10
+command = "echo 'edited after submit'"
+executor = "bash"
+`)
 
+	claimed := h.claim()
+	assert.NoError(t, h.work.ProcessOne(&claimed))
+
+	final := h.fetch(submitted.Id)
+	assert.Equal(t, "SUCCESS", final.State)
 	stdout, err := os.ReadFile(filepath.Join(final.ResultDir, "blanket.stdout.log"))
 	assert.NoError(t, err)
 	assert.Contains(t, string(stdout), "hello from blanket integration test")
+	assert.NotContains(t, string(stdout), "edited after submit")
+}
+
+// TestProcessOne_IncludedFilesChanged edits a file the task type includes
+// after the task is submitted. The worker must refuse to run it.
+func TestProcessOne_IncludedFilesChanged(t *testing.T) {
+	h := newWorkerHarness(t)
+	defer h.cleanup()
+
+	script := filepath.Join(h.typesDir, "greet.sh")
+	assert.NoError(t, os.WriteFile(script, []byte("echo 'original script'\n"), 0644))
+	h.writeTaskType("include_task", `
+tags = ["bash", "unix"]
+timeout = 10
+command = "bash greet.sh"
+executor = "bash"
+files_to_include = [["greet.sh"]]
+`)
+	submitted := h.submit("include_task")
+	assert.NotEqual(t, "", submitted.IncludedFilesDigest)
+
+	assert.NoError(t, os.WriteFile(script, []byte("echo 'edited script'\n"), 0644))
+
+	claimed := h.claim()
+	assert.Error(t, h.work.ProcessOne(&claimed))
+
+	final := h.fetch(submitted.Id)
+	assert.Equal(t, "ERROR", final.State)
+	_, err := os.Stat(filepath.Join(final.ResultDir, "greet.sh"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Unchanged files run as normal
+	resubmitted := h.submit("include_task")
+	claimed = h.claim()
+	assert.NoError(t, h.work.ProcessOne(&claimed))
+	final = h.fetch(resubmitted.Id)
+	assert.Equal(t, "SUCCESS", final.State)
+	stdout, err := os.ReadFile(filepath.Join(final.ResultDir, "blanket.stdout.log"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(stdout), "edited script")
 }
 
 // TestProcessTwo runs two tasks back-to-back on the same worker and asserts
@@ -323,12 +399,10 @@ command = "sleep 10"
 executor = "bash"
 `
 
-// TestProcessOne_StoppedMidFlight submits a long-running task, starts
-// executing it, then calls the cancel API. The worker's monitoring goroutine
-// should observe the STOPPED tombstone and kill the process.
-func TestProcessOne_StoppedMidFlight(t *testing.T) {
-	h := newWorkerHarness(t)
-	defer h.cleanup()
+// cancelMidFlight starts running a long task, cancels it through the API
+// once it is RUNNING, and returns the task after ProcessOne is done.
+func (h *workerHarness) cancelMidFlight(query string) tasks.Task {
+	h.t.Helper()
 
 	h.writeTaskType("long_task", longRunningTaskTypeToml)
 
@@ -348,22 +422,59 @@ func TestProcessOne_StoppedMidFlight(t *testing.T) {
 		}
 		time.Sleep(100 * time.Millisecond)
 	}
-	h.cancel(claimed.Id)
+	start := time.Now()
+	h.cancel(claimed.Id, query)
 
 	// ProcessOne should return within a few seconds once the monitor goroutine
-	// kills the child process.
+	// stops the child process.
 	select {
 	case <-done:
 	case <-time.After(10 * time.Second):
-		t.Fatal("ProcessOne did not return after cancel")
+		h.t.Fatal("ProcessOne did not return after cancel")
 	}
+	// The worker hears about the request without waiting for its next refresh
+	assert.True(h.t, time.Since(start) < 2*time.Second)
 
-	final := h.fetch(claimed.Id)
+	return h.fetch(claimed.Id)
+}
+
+// TestProcessOne_StoppedMidFlight submits a long-running task, starts
+// executing it, then calls the cancel API. The worker asks the command to
+// exit and reports that it did.
+func TestProcessOne_StoppedMidFlight(t *testing.T) {
+	h := newWorkerHarness(t)
+	defer h.cleanup()
+	viper.Set("tasks.cancelGracePeriodSeconds", 5)
+	defer viper.Set("tasks.cancelGracePeriodSeconds", nil)
+
+	final := h.cancelMidFlight("reason=superseded")
 	assert.Equal(t, "STOPPED", final.State)
+	if assert.NotNil(t, final.Cancellation) {
+		assert.Equal(t, tasks.CANCEL_GRACEFUL, final.Cancellation.Outcome)
+		assert.NotZero(t, final.Cancellation.AcknowledgedTs)
+	}
+	last := final.History[len(final.History)-1]
+	assert.Equal(t, tasks.WorkerActor(h.work.Id), last.Actor)
+	assert.Equal(t, "superseded", last.Reason)
+}
+
+// TestProcessOne_ForceStopped kills the command without a grace period
+func TestProcessOne_ForceStopped(t *testing.T) {
+	h := newWorkerHarness(t)
+	defer h.cleanup()
+	viper.Set("tasks.cancelGracePeriodSeconds", 5)
+	defer viper.Set("tasks.cancelGracePeriodSeconds", nil)
+
+	final := h.cancelMidFlight("force=true")
+	assert.Equal(t, "STOPPED", final.State)
+	if assert.NotNil(t, final.Cancellation) {
+		assert.True(t, final.Cancellation.Force)
+		assert.Equal(t, tasks.CANCEL_KILLED, final.Cancellation.Outcome)
+	}
 }
 
 // stopWorkerViaAPI marks the worker stopped in the DB so that the
-// ProcessTasks loop exits at its next Refetch.
+// ProcessTasks loop exits at its next Heartbeat.
 func (h *workerHarness) stopWorkerViaAPI() {
 	h.t.Helper()
 	req, _ := http.NewRequest("PUT", fmt.Sprintf("%s/worker/%s/stop", h.srv.URL, h.work.Id.Hex()), nil)
@@ -408,6 +519,37 @@ func TestProcessTasks_DoesNotHotSpinOnEmptyQueue(t *testing.T) {
 	}
 }
 
+// TestProcessTasks_ClaimsQueuedTaskRightAway checks that an idle worker
+// waiting on a claim starts a new task as soon as it is submitted, well
+// inside its CheckInterval.
+func TestProcessTasks_ClaimsQueuedTaskRightAway(t *testing.T) {
+	h := newWorkerHarness(t)
+	defer h.cleanup()
+
+	h.writeTaskType("echo_task", testTaskTypeToml)
+	h.work.CheckInterval = 10
+
+	done := make(chan error, 1)
+	go func() { done <- h.work.ProcessTasks() }()
+
+	// Let the worker settle into waiting on its claim
+	time.Sleep(300 * time.Millisecond)
+	submitted := h.submit("echo_task")
+	deadline := time.Now().Add(5 * time.Second)
+	for h.fetch(submitted.Id).State != "SUCCESS" && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Equal(t, "SUCCESS", h.fetch(submitted.Id).State)
+
+	h.stopWorkerViaAPI()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ProcessTasks did not exit after stop")
+	}
+}
+
 // TestRun_RejectsLowCheckInterval covers the defensive limit: WorkerConf.Run
 // must refuse a CheckInterval below MIN_CHECK_INTERVAL_SECONDS rather than
 // silently clamping. This is the second guard rail behind the loop fix; if
@@ -450,3 +592,285 @@ func TestProcessOne_ProducesLogs(t *testing.T) {
 		}
 	}
 }
+
+// stepsTaskTypeToml runs three steps; the middle one fails but is allowed to.
+const stepsTaskTypeToml = `
+tags = ["bash", "unix"]
+timeout = 10
+executor = "bash"
+
+    [[steps]]
+    name = "fetch"
+    command = "echo fetched > data.txt"
+
+    [[steps]]
+    name = "lint"
+    command = "echo 'lint warnings' >&2; exit 3"
+    continue_on_error = true
+
+    [[steps]]
+    name = "package"
+    command = "cat data.txt; echo packaged"
+`
+
+// TestProcessOne_Steps runs a multi-step task and checks per-step state,
+// per-step logs, and that all steps share the result directory.
+func TestProcessOne_Steps(t *testing.T) {
+	h := newWorkerHarness(t)
+	defer h.cleanup()
+
+	h.writeTaskType("steps_task", stepsTaskTypeToml)
+	submitted := h.submit("steps_task")
+	if assert.Len(t, submitted.Steps, 3) {
+		assert.Equal(t, "WAITING", submitted.Steps[0].State)
+	}
+
+	claimed := h.claim()
+	assert.NoError(t, h.work.ProcessOne(&claimed))
+
+	final := h.fetch(submitted.Id)
+	assert.Equal(t, "SUCCESS", final.State)
+	assert.Equal(t, 100, final.Progress)
+	assert.Equal(t, "", final.FailedStep)
+	if assert.Len(t, final.Steps, 3) {
+		assert.Equal(t, "SUCCESS", final.Steps[0].State)
+		assert.Equal(t, "ERROR", final.Steps[1].State)
+		assert.Equal(t, 3, final.Steps[1].ExitCode)
+		assert.Equal(t, "SUCCESS", final.Steps[2].State)
+	}
+
+	stepLog, err := os.ReadFile(tasks.StepLogPath(final.ResultDir, 2, "stdout"))
+	assert.NoError(t, err)
+	assert.Equal(t, "fetched\npackaged\n", string(stepLog))
+	stepLog, err = os.ReadFile(tasks.StepLogPath(final.ResultDir, 1, "stderr"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(stepLog), "lint warnings")
+
+	combined, err := os.ReadFile(filepath.Join(final.ResultDir, "blanket.stdout.log"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(combined), "step 3/3: package")
+	assert.Contains(t, string(combined), "packaged")
+}
+
+// TestProcessOne_StepFailureSkipsRest checks that a failing step without
+// continue_on_error fails the task and skips the steps after it.
+func TestProcessOne_StepFailureSkipsRest(t *testing.T) {
+	h := newWorkerHarness(t)
+	defer h.cleanup()
+
+	h.writeTaskType("steps_task", strings.Replace(stepsTaskTypeToml, "continue_on_error = true", "", 1))
+	submitted := h.submit("steps_task")
+	claimed := h.claim()
+	assert.Error(t, h.work.ProcessOne(&claimed))
+
+	final := h.fetch(submitted.Id)
+	assert.Equal(t, "ERROR", final.State)
+	assert.Equal(t, "lint", final.FailedStep)
+	if assert.Len(t, final.Steps, 3) {
+		assert.Equal(t, "SUCCESS", final.Steps[0].State)
+		assert.Equal(t, "ERROR", final.Steps[1].State)
+		assert.Equal(t, "SKIPPED", final.Steps[2].State)
+	}
+	_, err := os.Stat(tasks.StepLogPath(final.ResultDir, 2, "stdout"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+// hooksTaskTypeToml sets up a file in `before`, reads it in the main command,
+// submits a follow-up on success and cleans up in `after`.
+const hooksTaskTypeToml = `
+tags = ["bash", "unix"]
+timeout = 10
+command = "cat setup.txt; echo main ran > main.txt"
+before = "echo prepared > setup.txt; echo before ran"
+after = "rm setup.txt; echo after saw $BLANKET_APP_TASK_STATE"
+on_failure = "echo failed"
+
+    [on_success]
+    command = "echo succeeded"
+
+    [on_success.submit]
+    type = "follow_up"
+
+        [[on_success.submit.environment]]
+        name = "SOURCE_DIR"
+        value = "{{.BLANKET_PARENT_RESULT_DIR}}"
+`
+
+// TestProcessOne_Hooks checks that hooks run around the main command with
+// their own logs and states, and that on_success submits a follow-up task
+// carrying the parent's fields.
+func TestProcessOne_Hooks(t *testing.T) {
+	h := newWorkerHarness(t)
+	defer h.cleanup()
+
+	h.writeTaskType("hooks_task", hooksTaskTypeToml)
+	h.writeTaskType("follow_up", testTaskTypeToml)
+	submitted := h.submit("hooks_task")
+	if assert.Len(t, submitted.Hooks, 4) {
+		assert.Equal(t, "before", submitted.Hooks[0].Name)
+		assert.Equal(t, "WAITING", submitted.Hooks[0].State)
+	}
+
+	claimed := h.claim()
+	assert.NoError(t, h.work.ProcessOne(&claimed))
+
+	final := h.fetch(submitted.Id)
+	assert.Equal(t, "SUCCESS", final.State)
+	states := map[string]string{}
+	var followUpId string
+	for _, hook := range final.Hooks {
+		states[hook.Name] = hook.State
+		if hook.Name == "on_success" {
+			followUpId = hook.FollowUpTaskId
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"before":     "SUCCESS",
+		"on_success": "SUCCESS",
+		"on_failure": "SKIPPED",
+		"after":      "SUCCESS",
+	}, states)
+
+	stdout, err := os.ReadFile(filepath.Join(final.ResultDir, "blanket.stdout.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, "prepared\n", string(stdout))
+	hookLog, err := os.ReadFile(tasks.HookLogPath(final.ResultDir, "before", "stdout"))
+	assert.NoError(t, err)
+	assert.Equal(t, "before ran\n", string(hookLog))
+	hookLog, err = os.ReadFile(tasks.HookLogPath(final.ResultDir, "after", "stdout"))
+	assert.NoError(t, err)
+	assert.Equal(t, "after saw SUCCESS\n", string(hookLog))
+	_, err = os.Stat(filepath.Join(final.ResultDir, "setup.txt"))
+	assert.True(t, os.IsNotExist(err))
+
+	if assert.True(t, objectid.IsObjectIdHex(followUpId)) {
+		followUp := h.fetch(objectid.ObjectIdHex(followUpId))
+		assert.Equal(t, "follow_up", followUp.TypeId)
+		assert.Equal(t, submitted.Id.Hex(), followUp.ParentId)
+		assert.Equal(t, final.ResultDir, followUp.ExecEnv["SOURCE_DIR"])
+		assert.Equal(t, final.ResultDir, followUp.ExecEnv["BLANKET_PARENT_RESULT_DIR"])
+		assert.Equal(t, "SUCCESS", followUp.ExecEnv["BLANKET_PARENT_TASK_STATE"])
+	}
+}
+
+// TestProcessOne_BeforeHookFailure checks that a failing `before` hook skips
+// the main command and fails the task, while on_failure and after still run.
+func TestProcessOne_BeforeHookFailure(t *testing.T) {
+	h := newWorkerHarness(t)
+	defer h.cleanup()
+
+	h.writeTaskType("hooks_task", strings.Replace(hooksTaskTypeToml, "echo before ran", "exit 4", 1))
+	submitted := h.submit("hooks_task")
+	claimed := h.claim()
+	assert.Error(t, h.work.ProcessOne(&claimed))
+
+	final := h.fetch(submitted.Id)
+	assert.Equal(t, "ERROR", final.State)
+	if assert.Len(t, final.Hooks, 4) {
+		assert.Equal(t, "ERROR", final.Hooks[0].State)
+		assert.Equal(t, 4, final.Hooks[0].ExitCode)
+		assert.Equal(t, "SKIPPED", final.Hooks[1].State)
+		assert.Equal(t, "", final.Hooks[1].FollowUpTaskId)
+		assert.Equal(t, "SUCCESS", final.Hooks[2].State)
+		assert.Equal(t, "SUCCESS", final.Hooks[3].State)
+	}
+	_, err := os.Stat(filepath.Join(final.ResultDir, "main.txt"))
+	assert.True(t, os.IsNotExist(err))
+	hookLog, err := os.ReadFile(tasks.HookLogPath(final.ResultDir, "after", "stdout"))
+	assert.NoError(t, err)
+	assert.Equal(t, "after saw ERROR\n", string(hookLog))
+}
+
+// TestProcessOne_CancelledDuringBeforeHook cancels a task while its `before`
+// hook runs. The worker acknowledges the request right away, lets the hook
+// finish, then stops the task before the main command gets anywhere.
+func TestProcessOne_CancelledDuringBeforeHook(t *testing.T) {
+	h := newWorkerHarness(t)
+	defer h.cleanup()
+	viper.Set("tasks.cancelGracePeriodSeconds", 5)
+	defer viper.Set("tasks.cancelGracePeriodSeconds", nil)
+
+	h.writeTaskType("hooks_task", strings.Replace(hooksTaskTypeToml, "echo before ran", "sleep 2; echo before ran", 1))
+	submitted := h.submit("hooks_task")
+	claimed := h.claim()
+
+	done := make(chan error, 1)
+	go func() { done <- h.work.ProcessOne(&claimed) }()
+
+	// Wait for the hook to start, then cancel
+	hookLog := tasks.HookLogPath(submitted.ResultDir, "before", "stdout")
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(hookLog); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	h.cancel(claimed.Id, "")
+
+	// Acknowledged while the hook is still running
+	acked := false
+	for time.Now().Before(deadline) && !acked {
+		cur := h.fetch(claimed.Id)
+		acked = cur.Cancellation != nil && cur.Cancellation.AcknowledgedTs != 0
+		if !acked {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	assert.True(t, acked)
+	assert.Equal(t, "CLAIMED", h.fetch(claimed.Id).State)
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("ProcessOne did not return after cancel")
+	}
+
+	final := h.fetch(submitted.Id)
+	assert.Equal(t, "STOPPED", final.State)
+	if assert.NotNil(t, final.Cancellation) {
+		assert.NotEqual(t, tasks.CANCEL_UNACKNOWLEDGED, final.Cancellation.Outcome)
+	}
+	if assert.Len(t, final.Hooks, 4) {
+		assert.Equal(t, "SUCCESS", final.Hooks[0].State)
+	}
+	_, err := os.Stat(filepath.Join(final.ResultDir, "main.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+// TestUpdateInDatabase_StaleRevision checks that a write the server refuses
+// is reported as an error rather than taken as saved.
+func TestUpdateInDatabase_StaleRevision(t *testing.T) {
+	h := newWorkerHarness(t)
+	defer h.cleanup()
+
+	h.work.Revision = 99
+	err := h.work.UpdateInDatabase(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "409")
+	}
+}
+
+// TestMustRegister_KeepsDraining checks that registering again under the same
+// id clears a stop but not a drain.
+func TestMustRegister_KeepsDraining(t *testing.T) {
+	h := newWorkerHarness(t)
+	defer h.cleanup()
+
+	req, _ := http.NewRequest("PUT", fmt.Sprintf("%s/worker/%s/drain", h.srv.URL, h.work.Id.Hex()), nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("drain worker: %v", err)
+	}
+	resp.Body.Close()
+
+	restarted := worker.WorkerConf{Id: h.work.Id, Tags: h.work.Tags, Stopped: true}
+	restarted.MustRegister()
+	assert.True(t, restarted.Draining)
+	assert.False(t, restarted.Stopped)
+
+	stored := worker.WorkerConf{Id: h.work.Id}
+	assert.NoError(t, stored.Refetch(context.Background()))
+	assert.True(t, stored.Draining)
+	assert.False(t, stored.Stopped)
+}